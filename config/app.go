@@ -15,6 +15,7 @@ import (
 
 	"go_creation/database"
 	"go_creation/routes"
+	"go_creation/utils"
 )
 
 // InitApp 初始化整个应用程序
@@ -28,10 +29,29 @@ func InitApp() {
 	// 如果数据库连接失败，程序将终止
 	database.Init()
 
+	// 加载JWT签名密钥
+	// 环境变量在数据库初始化时加载，因此需要在其之后执行
+	if err := utils.InitJWTKeys(); err != nil {
+		log.Fatalf("加载JWT签名密钥失败: %v", err)
+	}
+
 	// 执行数据库迁移
 	// 确保所有必要的表和结构都存在
 	database.Migrate()
 
+	// 开发模式的请求头认证不验证任何凭证，启用时给出明显提示
+	if utils.DevHeaderAuthEnabled() {
+		log.Println("警告: 已启用X-Salesperson-ID请求头认证（AUTH_DEV_HEADER=true），仅可用于开发和测试环境")
+	}
+
+	// 配置登录限制器的存储方式和限制规则
+	if err := utils.InitLoginLimiter(database.GetDB()); err != nil {
+		log.Fatalf("初始化登录限制器失败: %v", err)
+	}
+
+	// 启动后台定时任务
+	StartBackgroundJobs()
+
 	log.Println("应用程序初始化完成")
 }
 
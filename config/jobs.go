@@ -0,0 +1,87 @@
+package config
+
+import (
+	"log"
+	"time"
+
+	"go_creation/database"
+	"go_creation/handlers"
+	"go_creation/utils"
+)
+
+// 后台定时任务的执行间隔
+const (
+	commissionRecognitionInterval = 10 * time.Minute // 冻结期佣金确认
+	invitationExpiryInterval      = time.Hour        // 代理邀请过期
+	jwtKeyReloadInterval          = 5 * time.Minute  // 重新加载JWT签名密钥
+	scheduledPriceInterval        = time.Minute      // 同步到期的计划调价
+)
+
+// StartBackgroundJobs 启动所有后台定时任务
+// 应在数据库初始化和迁移完成之后调用
+func StartBackgroundJobs() {
+	// 确认冻结期已结束的佣金
+	runPeriodically("佣金确认", commissionRecognitionInterval, func() {
+		count, err := handlers.RecognizeDueCommissions(database.GetDB())
+		if err != nil {
+			log.Printf("确认到期佣金失败: %v", err)
+			return
+		}
+		if count > 0 {
+			log.Printf("已确认 %d 条到期佣金", count)
+		}
+	})
+
+	// 标记已过期的代理邀请
+	runPeriodically("邀请过期", invitationExpiryInterval, func() {
+		count, err := handlers.ExpireAgentInvitations(database.GetDB())
+		if err != nil {
+			log.Printf("标记过期邀请失败: %v", err)
+			return
+		}
+		if count > 0 {
+			log.Printf("已将 %d 个邀请标记为过期", count)
+		}
+	})
+
+	// 将到期的计划调价同步到卡密类型
+	runPeriodically("计划调价", scheduledPriceInterval, func() {
+		count, err := handlers.ApplyScheduledKeyTypePrices(database.GetDB())
+		if err != nil {
+			log.Printf("同步计划调价失败: %v", err)
+			return
+		}
+		if count > 0 {
+			log.Printf("已更新 %d 个卡密类型的价格", count)
+		}
+	})
+
+	// 重新加载JWT签名密钥，更新密钥配置文件后无需重启即可完成轮换
+	runPeriodically("JWT密钥重载", jwtKeyReloadInterval, func() {
+		if err := utils.ReloadJWTKeys(); err != nil {
+			log.Printf("重新加载JWT签名密钥失败: %v", err)
+		}
+	})
+}
+
+// runPeriodically 在后台协程中按固定间隔执行任务
+// 任务启动时会立即执行一次，任务中的panic会被捕获并记录，不会影响后续执行
+func runPeriodically(name string, interval time.Duration, job func()) {
+	run := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("后台任务[%s]异常: %v", name, r)
+			}
+		}()
+		job()
+	}
+
+	go func() {
+		run()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			run()
+		}
+	}()
+}
@@ -153,24 +153,135 @@ func Migrate() {
 	err := db.AutoMigrate(
 		// 基础模型
 		&models.KeyType{},
+		&models.KeyTypePrice{},
 		&models.Key{},
+		&models.KeyConsumption{},
 		&models.Software{},
 		&models.SoftwareKeyType{},
+		&models.SoftwareRelease{},
+		&models.SoftwareAnnouncement{},
+		&models.SoftwareAnnouncementReceipt{},
+		&models.SoftwareConfigItem{},
+		&models.SoftwareConfigOverride{},
 		// 销售员相关模型
 		&models.Salesperson{},
 		&models.SalespersonProduct{},
+		&models.WholesalePriceTier{},
+		&models.Coupon{},
+		&models.CouponRedemption{},
 		&models.SalespersonSale{},
+		&models.SalespersonSaleItem{},
 		&models.SalespersonCustomer{},
 		&models.SalespersonCommissionSettlement{},
 		&models.SalespersonToken{},
+		&models.SalespersonRefreshToken{},
+		&models.LoginAttempt{},
+		&models.SalespersonPasswordReset{},
+		&models.SalespersonRecoveryCode{},
+		&models.SalespersonLoginChallenge{},
+		&models.SalespersonAPIKey{},
 		// 代理相关模型
 		&models.SalespersonAgentCommission{},
 		&models.SalespersonAgentInvitation{},
+		&models.SalespersonAgentPath{},
 	)
 
 	if err != nil {
 		log.Fatalf("数据库迁移失败: %v", err)
 	}
 
+	// 回填历史数据
+	backfill(db)
+
 	log.Println("数据库迁移成功")
 }
+
+// backfill 回填新增字段的历史数据
+// 每一步都是幂等的，重复执行不会改变已回填的数据
+func backfill(db *gorm.DB) {
+	// 引入佣金确认策略之前的销售记录都是在生成时确认佣金的
+	if err := db.Model(&models.SalespersonSale{}).
+		Where("commission_policy = '' OR commission_policy IS NULL").
+		Updates(map[string]interface{}{
+			"commission_policy":     models.CommissionPolicyGeneration,
+			"recognized_commission": gorm.Expr("commission"),
+		}).Error; err != nil {
+		log.Printf("回填销售记录佣金策略失败: %v", err)
+	}
+
+	if err := db.Model(&models.SalespersonSaleItem{}).
+		Where("commission_status = '' OR commission_status IS NULL").
+		Update("commission_status", "recognized").Error; err != nil {
+		log.Printf("回填销售明细佣金状态失败: %v", err)
+	}
+
+	// 引入会话ID之前的登录令牌无法刷新，直接清理，相关设备需要重新登录
+	if err := db.Where("session_id = '' OR session_id IS NULL").Delete(&models.SalespersonToken{}).Error; err != nil {
+		log.Printf("清理旧版登录令牌失败: %v", err)
+	}
+
+	// 引入价格版本之前的卡密类型以当前价格作为创建时生效的常规价格
+	if err := db.Exec(`INSERT INTO key_type_prices (key_type_id, kind, price, effective_from, note, creator_id, created_at)
+		SELECT kt.id, ?, kt.price, kt.created_at, ?, kt.creator_id, NOW() FROM key_types kt
+		WHERE NOT EXISTS (SELECT 1 FROM key_type_prices ktp WHERE ktp.key_type_id = kt.id)`,
+		models.KeyTypePriceRegular, "初始价格").Error; err != nil {
+		log.Printf("回填卡密类型价格版本失败: %v", err)
+	}
+
+	// 引入有效期单位之前的卡密类型和卡密都按小时计算有效期
+	for _, model := range []interface{}{&models.KeyType{}, &models.Key{}} {
+		if err := db.Model(model).
+			Where("duration_unit = '' OR duration_unit IS NULL").
+			Updates(map[string]interface{}{
+				"duration_unit":   models.DurationUnitHour,
+				"duration_amount": gorm.Expr("hours"),
+			}).Error; err != nil {
+			log.Printf("回填有效期单位失败: %v", err)
+		}
+	}
+
+	// 根据上级关系生成代理层级闭包表
+	var pathCount int64
+	if err := db.Model(&models.SalespersonAgentPath{}).Count(&pathCount).Error; err != nil {
+		log.Printf("查询代理层级闭包表失败: %v", err)
+		return
+	}
+	if pathCount == 0 {
+		if err := backfillAgentPaths(db); err != nil {
+			log.Printf("回填代理层级闭包表失败: %v", err)
+		}
+	}
+}
+
+// backfillAgentPaths 根据销售员的parent_id生成代理层级闭包表
+// 仅在闭包表为空时执行，沿上级链逐级向上生成每个销售员的路径，已软删除的销售员同样生成路径，保证其下级的层级关系完整
+func backfillAgentPaths(db *gorm.DB) error {
+	var salespersons []models.Salesperson
+	if err := db.Unscoped().Select("id", "parent_id").Find(&salespersons).Error; err != nil {
+		return err
+	}
+
+	parents := make(map[uint]*uint, len(salespersons))
+	for _, sp := range salespersons {
+		parents[sp.ID] = sp.ParentID
+	}
+
+	paths := make([]models.SalespersonAgentPath, 0, len(salespersons))
+	for _, sp := range salespersons {
+		paths = append(paths, models.SalespersonAgentPath{AncestorID: sp.ID, DescendantID: sp.ID, Depth: 0})
+
+		// 记录已访问的上级，防止历史数据中存在循环引用
+		visited := map[uint]bool{sp.ID: true}
+		depth := 1
+		for parentID := sp.ParentID; parentID != nil && !visited[*parentID]; parentID = parents[*parentID] {
+			visited[*parentID] = true
+			paths = append(paths, models.SalespersonAgentPath{AncestorID: *parentID, DescendantID: sp.ID, Depth: depth})
+			depth++
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil
+	}
+	return db.CreateInBatches(paths, 500).Error
+}
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"go_creation/database"
+	"go_creation/models"
+	"go_creation/utils"
+)
+
+// maxAPIKeysPerSalesperson 每个销售员最多拥有的有效API密钥数量
+const maxAPIKeysPerSalesperson = 20
+
+// CreateAPIKey 销售员创建API密钥
+// 请求体:
+//   - name: 名称，必填
+//   - scopes: 权限范围列表，必填，可选值见models.APIKeyScopes
+//   - allowed_ips: 允许调用的IP或CIDR列表，为空表示不限制
+//   - rate_limit: 每分钟最多请求次数，0表示不限制
+//   - expires_at / expires_in_days: 过期时间，二选一，都不传表示永不过期
+//
+// 完整密钥只在本接口返回一次，之后无法再次查看
+func CreateAPIKey(c *fiber.Ctx) error {
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
+		})
+	}
+
+	var request struct {
+		Name          string     `json:"name"`
+		Scopes        []string   `json:"scopes"`
+		AllowedIPs    []string   `json:"allowed_ips"`
+		RateLimit     int        `json:"rate_limit"`
+		ExpiresAt     *time.Time `json:"expires_at"`
+		ExpiresInDays int        `json:"expires_in_days"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len(request.Name) > 100 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "名称不能为空且不能超过100个字符",
+		})
+	}
+
+	// 校验权限范围并去重
+	if len(request.Scopes) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "至少需要指定一个权限范围",
+		})
+	}
+	scopes := make([]string, 0, len(request.Scopes))
+	for _, scope := range request.Scopes {
+		valid := false
+		for _, s := range models.APIKeyScopes {
+			if scope == s {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":  "无效的权限范围: " + scope,
+				"scopes": models.APIKeyScopes,
+			})
+		}
+		duplicate := false
+		for _, s := range scopes {
+			if scope == s {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	allowedIPs, err := utils.ParseIPAllowlist(strings.Join(request.AllowedIPs, ","))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if request.RateLimit < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "请求频率限制不能为负数",
+		})
+	}
+
+	now := time.Now()
+	var expiredAt *time.Time
+	switch {
+	case request.ExpiresAt != nil && request.ExpiresInDays != 0:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "expires_at和expires_in_days不能同时指定",
+		})
+	case request.ExpiresAt != nil:
+		if !request.ExpiresAt.After(now) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "过期时间必须晚于当前时间",
+			})
+		}
+		expiredAt = request.ExpiresAt
+	case request.ExpiresInDays < 0:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "有效天数不能为负数",
+		})
+	case request.ExpiresInDays > 0:
+		t := now.AddDate(0, 0, request.ExpiresInDays)
+		expiredAt = &t
+	}
+
+	db := database.GetDB()
+
+	// 限制有效密钥数量
+	var activeCount int64
+	if err := db.Model(&models.SalespersonAPIKey{}).
+		Where("salesperson_id = ? AND revoked_at IS NULL AND (expired_at IS NULL OR expired_at > ?)", auth.SalespersonID, now).
+		Count(&activeCount).Error; err != nil {
+		log.Printf("统计API密钥数量失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "创建API密钥失败",
+		})
+	}
+	if activeCount >= maxAPIKeysPerSalesperson {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "有效的API密钥数量已达上限，请先撤销不再使用的密钥",
+		})
+	}
+
+	key, prefix, secret, err := utils.GenerateAPIKey()
+	if err != nil {
+		log.Printf("生成API密钥失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "创建API密钥失败",
+		})
+	}
+
+	apiKey := models.SalespersonAPIKey{
+		SalespersonID: auth.SalespersonID,
+		Name:          request.Name,
+		Prefix:        prefix,
+		SecretHash:    utils.HashToken(secret),
+		Scopes:        strings.Join(scopes, ","),
+		AllowedIPs:    strings.Join(allowedIPs, ","),
+		RateLimit:     request.RateLimit,
+		ExpiredAt:     expiredAt,
+	}
+	if err := db.Create(&apiKey).Error; err != nil {
+		log.Printf("保存API密钥失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "创建API密钥失败",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "API密钥创建成功，请妥善保存，密钥只显示一次",
+		"key":     key,
+		"data":    formatAPIKey(apiKey, now),
+	})
+}
+
+// GetAPIKeys 销售员查看自己的API密钥列表
+// 只返回密钥前缀，不返回密文
+func GetAPIKeys(c *fiber.Ctx) error {
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
+		})
+	}
+
+	var apiKeys []models.SalespersonAPIKey
+	if err := database.GetDB().Where("salesperson_id = ?", auth.SalespersonID).
+		Order("created_at DESC").Find(&apiKeys).Error; err != nil {
+		log.Printf("查询API密钥失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询API密钥失败",
+		})
+	}
+
+	now := time.Now()
+	result := make([]fiber.Map, 0, len(apiKeys))
+	for _, apiKey := range apiKeys {
+		result = append(result, formatAPIKey(apiKey, now))
+	}
+
+	return c.JSON(fiber.Map{
+		"total": len(result),
+		"data":  result,
+	})
+}
+
+// RevokeAPIKey 销售员撤销自己的API密钥
+// 撤销后立即失效，且不能恢复
+func RevokeAPIKey(c *fiber.Ctx) error {
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
+		})
+	}
+
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的API密钥ID",
+		})
+	}
+
+	result := database.GetDB().Model(&models.SalespersonAPIKey{}).
+		Where("id = ? AND salesperson_id = ? AND revoked_at IS NULL", id, auth.SalespersonID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		log.Printf("撤销API密钥失败: %v", result.Error)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "撤销API密钥失败，请稍后重试",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "API密钥不存在或已撤销",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "API密钥已撤销",
+	})
+}
+
+// formatAPIKey 格式化API密钥信息
+func formatAPIKey(apiKey models.SalespersonAPIKey, now time.Time) fiber.Map {
+	status := "active"
+	if apiKey.RevokedAt != nil {
+		status = "revoked"
+	} else if apiKey.ExpiredAt != nil && now.After(*apiKey.ExpiredAt) {
+		status = "expired"
+	}
+
+	scopes := make([]string, 0)
+	if apiKey.Scopes != "" {
+		scopes = strings.Split(apiKey.Scopes, ",")
+	}
+	allowedIPs := make([]string, 0)
+	if apiKey.AllowedIPs != "" {
+		allowedIPs = strings.Split(apiKey.AllowedIPs, ",")
+	}
+
+	return fiber.Map{
+		"id":           apiKey.ID,
+		"name":         apiKey.Name,
+		"prefix":       "gck_" + apiKey.Prefix,
+		"scopes":       scopes,
+		"allowed_ips":  allowedIPs,
+		"rate_limit":   apiKey.RateLimit,
+		"expired_at":   apiKey.ExpiredAt,
+		"last_used_at": apiKey.LastUsedAt,
+		"last_used_ip": apiKey.LastUsedIP,
+		"revoked_at":   apiKey.RevokedAt,
+		"status":       status,
+		"created_at":   apiKey.CreatedAt,
+	}
+}
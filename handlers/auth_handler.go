@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"log"
 	"strconv"
 	"time"
@@ -13,62 +14,177 @@ import (
 	"go_creation/utils"
 )
 
-// RefreshToken 刷新认证令牌
-// 该处理函数用于延长用户会话，通过验证现有令牌并签发新令牌
-// 处理流程:
-//  1. 从请求头提取当前令牌
-//  2. 验证令牌的有效性和存在性
-//  3. 检查令牌是否过期
-//  4. 验证关联销售员的状态
-//  5. 生成新令牌并存储到数据库
-//  6. 删除旧令牌
-func RefreshToken(c *fiber.Ctx) error {
-	// 从请求头获取令牌
-	// 验证Authorization头是否存在且格式正确（Bearer格式）
-	authHeader := c.Get("Authorization")
-	if authHeader == "" || len(authHeader) < 7 || authHeader[:7] != "Bearer " {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "未提供有效的认证令牌",
-		})
+// 令牌有效期配置
+// 访问令牌有效期较短，泄露后影响有限；刷新令牌有效期较长，只保存摘要且每次使用后轮换
+const (
+	accessTokenTTL = 15 * time.Minute    // 访问令牌有效期
+	sessionTTL     = 30 * 24 * time.Hour // 会话（刷新令牌）有效期
+)
+
+// issueRefreshToken 为会话签发新的刷新令牌，返回令牌明文
+func issueRefreshToken(tx *gorm.DB, session *models.SalespersonToken) (string, error) {
+	refreshToken, err := utils.GenerateSecureToken()
+	if err != nil {
+		return "", err
 	}
 
-	tokenString := authHeader[7:]
+	record := models.SalespersonRefreshToken{
+		SessionID: session.SessionID,
+		TokenHash: utils.HashToken(refreshToken),
+		ExpiredAt: session.ExpiredAt,
+	}
+	if err := tx.Create(&record).Error; err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
 
-	// 解析令牌
-	// 使用JWT工具验证令牌签名并提取声明信息
-	claims, err := utils.ParseToken(tokenString)
+// createLoginSession 为登录成功的销售员创建会话，并签发访问令牌和刷新令牌
+func createLoginSession(c *fiber.Ctx, salesperson *models.Salesperson) (fiber.Map, error) {
+	sessionID, err := utils.GenerateSecureToken()
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "无效的认证令牌",
+		return nil, err
+	}
+
+	session := models.SalespersonToken{
+		SalespersonID: salesperson.ID,
+		SessionID:     sessionID,
+		UserAgent:     c.Get("User-Agent"),
+		IP:            c.IP(),
+		ExpiredAt:     time.Now().Add(sessionTTL),
+	}
+
+	var refreshToken string
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+		refreshToken, err = issueRefreshToken(tx, &session)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := utils.GenerateToken(salesperson.ID, salesperson.Username, sessionID, accessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return fiber.Map{
+		"token":                    accessToken,
+		"expires_at":               time.Now().Add(accessTokenTTL).Unix(), // 返回过期时间戳，方便前端处理
+		"refresh_token":            refreshToken,
+		"refresh_token_expires_at": session.ExpiredAt.Unix(),
+	}, nil
+}
+
+// revokeSessions 撤销销售员的登录会话
+// exceptSessionID不为空时保留该会话，reason记录撤销原因
+func revokeSessions(db *gorm.DB, salespersonID uint, exceptSessionID, reason string) error {
+	query := db.Model(&models.SalespersonToken{}).
+		Where("salesperson_id = ? AND revoked_at IS NULL", salespersonID)
+	if exceptSessionID != "" {
+		query = query.Where("session_id <> ?", exceptSessionID)
+	}
+	return query.Updates(map[string]interface{}{
+		"revoked_at":    time.Now(),
+		"revoke_reason": reason,
+	}).Error
+}
+
+// errRefreshTokenReused 刷新令牌在轮换时已被其他请求使用
+var errRefreshTokenReused = errors.New("刷新令牌已被使用")
+
+// revokeRefreshTokenFamily 检测到刷新令牌重用时撤销整个令牌族，即该刷新令牌所属的登录会话
+// 会话下的访问令牌和所有刷新令牌同时失效，返回要求重新登录的响应
+func revokeRefreshTokenFamily(c *fiber.Ctx, session *models.SalespersonToken) error {
+	log.Printf("检测到刷新令牌重用，撤销会话: 销售员ID=%d, 会话ID=%d, IP=%s", session.SalespersonID, session.ID, c.IP())
+	if err := database.GetDB().Model(&models.SalespersonToken{}).
+		Where("id = ? AND revoked_at IS NULL", session.ID).
+		Updates(map[string]interface{}{
+			"revoked_at":    time.Now(),
+			"revoke_reason": "refresh_reuse",
+		}).Error; err != nil {
+		log.Printf("撤销会话失败: %v", err)
+	}
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+		"error": "刷新令牌已失效，请重新登录",
+	})
+}
+
+// cleanupExpiredSessions 清理销售员已过期的会话及其刷新令牌
+func cleanupExpiredSessions(db *gorm.DB, salespersonID uint) error {
+	var sessionIDs []string
+	if err := db.Model(&models.SalespersonToken{}).
+		Where("salesperson_id = ? AND expired_at < ?", salespersonID, time.Now()).
+		Pluck("session_id", &sessionIDs).Error; err != nil {
+		return err
+	}
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+	if err := db.Where("session_id IN ?", sessionIDs).Delete(&models.SalespersonRefreshToken{}).Error; err != nil {
+		return err
+	}
+	return db.Where("session_id IN ?", sessionIDs).Delete(&models.SalespersonToken{}).Error
+}
+
+// RefreshToken 刷新认证令牌
+// 该处理函数使用刷新令牌换取新的访问令牌，同时轮换刷新令牌
+// 处理流程:
+//  1. 从请求体提取刷新令牌
+//  2. 根据摘要查找刷新令牌及其所属会话
+//  3. 已使用过的刷新令牌再次出现时，视为令牌被盗用，撤销整个会话
+//  4. 验证会话和关联销售员的状态
+//  5. 标记旧刷新令牌已使用，签发新的刷新令牌和访问令牌
+func RefreshToken(c *fiber.Ctx) error {
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.BodyParser(&request); err != nil || request.RefreshToken == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "未提供有效的刷新令牌",
 		})
 	}
 
-	// 检查令牌是否存在于数据库
-	// 确保令牌未被撤销且仍然有效
-	var token models.SalespersonToken
-	if err := database.GetDB().Where("token = ?", tokenString).First(&token).Error; err != nil {
+	// 根据摘要查找刷新令牌
+	var record models.SalespersonRefreshToken
+	if err := database.GetDB().Where("token_hash = ?", utils.HashToken(request.RefreshToken)).First(&record).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "认证令牌不存在",
+				"error": "无效的刷新令牌",
 			})
 		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "验证认证令牌失败",
+			"error": "验证刷新令牌失败",
 		})
 	}
 
-	// 检查令牌是否已过期
-	// 即使JWT本身未过期，也需检查数据库中的过期时间
-	if time.Now().After(token.ExpiredAt) {
+	// 查询所属会话
+	var session models.SalespersonToken
+	if err := database.GetDB().Where("session_id = ?", record.SessionID).First(&session).Error; err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "认证令牌已过期",
+			"error": "登录会话不存在",
+		})
+	}
+
+	// 检测令牌重用：已轮换的刷新令牌再次被使用，撤销整个令牌族
+	if record.UsedAt != nil {
+		return revokeRefreshTokenFamily(c, &session)
+	}
+
+	// 检查会话是否已撤销或过期
+	if session.RevokedAt != nil || time.Now().After(session.ExpiredAt) || time.Now().After(record.ExpiredAt) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "登录会话已失效，请重新登录",
 		})
 	}
 
 	// 查询销售员信息
 	// 验证销售员是否存在且状态为活跃
 	var salesperson models.Salesperson
-	if err := database.GetDB().Where("id = ? AND status = ?", claims.SalespersonID, "active").First(&salesperson).Error; err != nil {
+	if err := database.GetDB().Where("id = ? AND status = ?", session.SalespersonID, "active").First(&salesperson).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error": "销售员不存在或已被禁用",
@@ -79,80 +195,87 @@ func RefreshToken(c *fiber.Ctx) error {
 		})
 	}
 
-	// 懒惰删除：清理该用户的过期令牌
-	// 提高系统性能并减少数据库中的无效记录
-	if err := database.GetDB().Where("salesperson_id = ? AND expired_at < ?", salesperson.ID, time.Now()).Delete(&models.SalespersonToken{}).Error; err != nil {
-		log.Printf("删除过期令牌失败: %v", err)
-		// 不返回错误，继续处理
-	}
+	// 轮换刷新令牌
+	var newRefreshToken string
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		// 以条件更新的方式标记旧令牌已使用，并发刷新时只有一个请求能成功
+		now := time.Now()
+		result := tx.Model(&models.SalespersonRefreshToken{}).
+			Where("id = ? AND used_at IS NULL", record.ID).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRefreshTokenReused
+		}
+
+		if err := tx.Model(&models.SalespersonToken{}).Where("id = ?", session.ID).
+			Updates(map[string]interface{}{
+				"last_used_at": now,
+				"ip":           c.IP(),
+			}).Error; err != nil {
+			return err
+		}
 
-	// 生成新的JWT令牌
-	// 设置24小时的有效期
-	newToken, err := utils.GenerateToken(salesperson.ID, salesperson.Username, 24*time.Hour)
+		var err error
+		newRefreshToken, err = issueRefreshToken(tx, &session)
+		return err
+	})
 	if err != nil {
-		log.Printf("生成令牌失败: %v", err)
+		// 并发使用同一刷新令牌时，未能轮换的请求同样视为令牌重用
+		if errors.Is(err, errRefreshTokenReused) {
+			return revokeRefreshTokenFamily(c, &session)
+		}
+		log.Printf("轮换刷新令牌失败: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "刷新令牌失败，请稍后重试",
 		})
 	}
 
-	// 计算过期时间
-	expireTime := time.Now().Add(24 * time.Hour)
-
-	// 删除旧令牌
-	// 确保旧令牌不能再被使用，防止令牌重放攻击
-	if err := database.GetDB().Delete(&token).Error; err != nil {
-		log.Printf("删除旧令牌失败: %v", err)
-		// 不返回错误，继续处理
-	}
-
-	// 存储新令牌到数据库
-	// 记录令牌信息，包括关联的销售员、设备信息和过期时间
-	newSalespersonToken := models.SalespersonToken{
-		SalespersonID: salesperson.ID,
-		Token:         newToken,
-		UserAgent:     token.UserAgent, // 保持原有的用户代理信息
-		IP:            c.IP(),          // 更新IP地址
-		ExpiredAt:     expireTime,
-	}
-
-	if err := database.GetDB().Create(&newSalespersonToken).Error; err != nil {
-		log.Printf("存储新令牌失败: %v", err)
+	// 生成新的访问令牌
+	newToken, err := utils.GenerateToken(salesperson.ID, salesperson.Username, session.SessionID, accessTokenTTL)
+	if err != nil {
+		log.Printf("生成令牌失败: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "刷新令牌失败，请稍后重试",
 		})
 	}
 
 	// 返回新令牌
-	// 包括令牌字符串和过期时间戳
+	// 包括访问令牌、新的刷新令牌和各自的过期时间戳
 	return c.JSON(fiber.Map{
-		"message":    "刷新令牌成功",
-		"token":      newToken,
-		"expires_at": expireTime.Unix(),
+		"message":                  "刷新令牌成功",
+		"token":                    newToken,
+		"expires_at":               time.Now().Add(accessTokenTTL).Unix(),
+		"refresh_token":            newRefreshToken,
+		"refresh_token_expires_at": session.ExpiredAt.Unix(),
 	})
 }
 
 // SalespersonLogout 销售员登出
-// 该处理函数用于使当前会话的令牌失效
+// 该处理函数用于使当前会话失效
 // 处理流程:
-//  1. 从请求头提取当前令牌
-//  2. 从数据库中删除该令牌记录
+//  1. 从上下文获取当前会话ID
+//  2. 撤销该会话，会话下的访问令牌和刷新令牌同时失效
 func SalespersonLogout(c *fiber.Ctx) error {
-	// 从请求头获取令牌
-	// 验证Authorization头是否存在且格式正确
-	authHeader := c.Get("Authorization")
-	if authHeader == "" || len(authHeader) < 7 || authHeader[:7] != "Bearer " {
+	auth, ok := utils.GetAuthContext(c)
+	if !ok || auth.SessionID == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "未提供有效的认证令牌",
 		})
 	}
+	sessionID := auth.SessionID
 
-	tokenString := authHeader[7:]
-
-	// 将令牌从数据库中删除
+	// 撤销会话
 	// 使令牌立即失效，防止后续使用
-	if err := database.GetDB().Where("token = ?", tokenString).Delete(&models.SalespersonToken{}).Error; err != nil {
-		log.Printf("删除令牌失败: %v", err)
+	if err := database.GetDB().Model(&models.SalespersonToken{}).
+		Where("session_id = ? AND revoked_at IS NULL", sessionID).
+		Updates(map[string]interface{}{
+			"revoked_at":    time.Now(),
+			"revoke_reason": "logout",
+		}).Error; err != nil {
+		log.Printf("撤销会话失败: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "登出失败，请稍后重试",
 		})
@@ -164,25 +287,27 @@ func SalespersonLogout(c *fiber.Ctx) error {
 }
 
 // GetLoginDevices 获取登录设备列表
-// 该处理函数返回当前销售员的所有活跃登录设备
+// 该处理函数返回当前销售员的所有活跃登录会话
 // 处理流程:
 //  1. 获取当前销售员ID
-//  2. 查询该销售员的所有未过期令牌
+//  2. 查询该销售员所有未撤销且未过期的会话
 //  3. 构建并返回设备列表
 func GetLoginDevices(c *fiber.Ctx) error {
 	// 获取当前销售员ID
 	// 从请求头中提取经过身份验证的销售员ID
-	salespersonID, err := strconv.Atoi(c.Get("X-Salesperson-ID"))
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "无效的销售员ID",
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
 		})
 	}
+	salespersonID := auth.SalespersonID
 
-	// 查询该销售员的所有有效令牌
-	// 只返回未过期的令牌，代表当前活跃的登录会话
-	var tokens []models.SalespersonToken
-	if err := database.GetDB().Where("salesperson_id = ? AND expired_at > ?", salespersonID, time.Now()).Find(&tokens).Error; err != nil {
+	// 查询该销售员的所有有效会话
+	// 只返回未撤销且未过期的会话，代表当前活跃的登录设备
+	var sessions []models.SalespersonToken
+	if err := database.GetDB().Where("salesperson_id = ? AND revoked_at IS NULL AND expired_at > ?", salespersonID, time.Now()).
+		Order("created_at DESC").Find(&sessions).Error; err != nil {
 		log.Printf("查询登录设备失败: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "查询登录设备失败，请稍后重试",
@@ -191,14 +316,17 @@ func GetLoginDevices(c *fiber.Ctx) error {
 
 	// 构建设备列表
 	// 转换为前端友好的格式，包含必要的设备信息
-	devices := make([]fiber.Map, 0, len(tokens))
-	for _, token := range tokens {
+	currentSessionID := auth.SessionID
+	devices := make([]fiber.Map, 0, len(sessions))
+	for _, session := range sessions {
 		devices = append(devices, fiber.Map{
-			"id":         token.ID,
-			"user_agent": token.UserAgent,
-			"ip":         token.IP,
-			"created_at": token.CreatedAt,
-			"expired_at": token.ExpiredAt,
+			"id":           session.ID,
+			"user_agent":   session.UserAgent,
+			"ip":           session.IP,
+			"created_at":   session.CreatedAt,
+			"last_used_at": session.LastUsedAt,
+			"expired_at":   session.ExpiredAt,
+			"current":      session.SessionID == currentSessionID,
 		})
 	}
 
@@ -208,20 +336,21 @@ func GetLoginDevices(c *fiber.Ctx) error {
 }
 
 // LogoutDevice 登出特定设备
-// 该处理函数用于使特定设备的会话令牌失效
+// 该处理函数用于撤销特定设备的登录会话
 // 处理流程:
 //  1. 获取当前销售员ID
 //  2. 获取目标设备ID
-//  3. 删除对应的令牌记录
+//  3. 撤销对应的会话
 func LogoutDevice(c *fiber.Ctx) error {
 	// 获取当前销售员ID
 	// 确保只能操作自己的设备
-	salespersonID, err := strconv.Atoi(c.Get("X-Salesperson-ID"))
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "无效的销售员ID",
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
 		})
 	}
+	salespersonID := auth.SalespersonID
 
 	// 获取设备ID
 	// 从URL参数中提取目标设备ID
@@ -232,9 +361,14 @@ func LogoutDevice(c *fiber.Ctx) error {
 		})
 	}
 
-	// 删除特定设备的令牌
-	// 确保只删除属于当前销售员的设备令牌
-	result := database.GetDB().Where("id = ? AND salesperson_id = ?", deviceID, salespersonID).Delete(&models.SalespersonToken{})
+	// 撤销特定设备的会话
+	// 确保只撤销属于当前销售员的会话
+	result := database.GetDB().Model(&models.SalespersonToken{}).
+		Where("id = ? AND salesperson_id = ? AND revoked_at IS NULL", deviceID, salespersonID).
+		Updates(map[string]interface{}{
+			"revoked_at":    time.Now(),
+			"revoke_reason": "device_logout",
+		})
 	if result.Error != nil {
 		log.Printf("登出设备失败: %v", result.Error)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -242,7 +376,7 @@ func LogoutDevice(c *fiber.Ctx) error {
 		})
 	}
 
-	// 检查是否找到并删除了记录
+	// 检查是否找到并撤销了会话
 	if result.RowsAffected == 0 {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "设备不存在或不属于当前销售员",
@@ -254,11 +388,11 @@ func LogoutDevice(c *fiber.Ctx) error {
 	})
 }
 
-// ForceLogoutSalesperson 强制销售员登出（使所有令牌失效）
+// ForceLogoutSalesperson 强制销售员登出（使所有会话失效）
 // 该处理函数用于管理员强制使特定销售员的所有会话失效
 // 处理流程:
 //  1. 获取目标销售员ID
-//  2. 删除该销售员的所有令牌记录
+//  2. 撤销该销售员的所有会话
 func ForceLogoutSalesperson(c *fiber.Ctx) error {
 	// 获取销售员ID
 	// 从URL参数中提取目标销售员ID
@@ -269,10 +403,10 @@ func ForceLogoutSalesperson(c *fiber.Ctx) error {
 		})
 	}
 
-	// 删除该销售员的所有令牌
+	// 撤销该销售员的所有会话
 	// 使所有设备上的会话立即失效，强制用户重新登录
-	if err := database.GetDB().Where("salesperson_id = ?", salespersonID).Delete(&models.SalespersonToken{}).Error; err != nil {
-		log.Printf("删除销售员令牌失败: %v", err)
+	if err := revokeSessions(database.GetDB(), uint(salespersonID), "", "force_logout"); err != nil {
+		log.Printf("撤销销售员会话失败: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "强制登出失败，请稍后重试",
 		})
@@ -282,3 +416,18 @@ func ForceLogoutSalesperson(c *fiber.Ctx) error {
 		"message": "强制登出成功",
 	})
 }
+
+// GetJWKS 返回验证令牌使用的公钥集合
+// 响应可以被缓存，密钥轮换时新密钥会在生效前提前发布
+func GetJWKS(c *fiber.Ctx) error {
+	jwks, err := utils.JWKS()
+	if err != nil {
+		log.Printf("获取JWKS失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "获取公钥失败",
+		})
+	}
+
+	c.Set("Cache-Control", "public, max-age=300")
+	return c.JSON(jwks)
+}
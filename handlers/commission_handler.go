@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"go_creation/models"
+)
+
+// applyCommissionPolicy 为新建的销售记录设置佣金确认策略
+// 策略按销售员产品 > 卡密类型 > 默认的顺序解析，并快照到销售记录上，
+// 之后修改策略不会影响已经产生的销售记录。
+// 生成时确认的策略会立即把全部佣金记为已确认
+func applyCommissionPolicy(sale *models.SalespersonSale, product *models.SalespersonProduct, keyType *models.KeyType) {
+	policy, holdDays := models.ResolveCommissionPolicy(product, keyType)
+	sale.CommissionPolicy = policy
+	sale.CommissionHoldDays = holdDays
+	if policy == models.CommissionPolicyGeneration {
+		sale.RecognizedCommission = sale.Commission
+	} else {
+		sale.RecognizedCommission = 0
+	}
+}
+
+// initialItemCommissionStatus 返回新建销售明细的佣金状态
+func initialItemCommissionStatus(sale *models.SalespersonSale) string {
+	if sale.CommissionPolicy == models.CommissionPolicyGeneration {
+		return "recognized"
+	}
+	return "unrecognized"
+}
+
+// recognizeSaleItemCommission 确认一条销售明细的佣金
+// 只有待结算销售记录中未确认或冻结中的明细会被确认，并同步增加销售记录的已确认佣金、销售员和上级代理的总佣金
+// 返回本次是否实际确认了佣金
+func recognizeSaleItemCommission(tx *gorm.DB, item *models.SalespersonSaleItem, now time.Time) (bool, error) {
+	// 锁定销售记录，与取消销售记录互斥，已取消或已结算的销售记录不再确认佣金
+	var sale models.SalespersonSale
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "status").First(&sale, item.SaleID).Error; err != nil {
+		return false, fmt.Errorf("查询销售记录失败: %w", err)
+	}
+	if sale.Status != "pending" {
+		return false, nil
+	}
+
+	// 以条件更新的方式确认，防止激活和定时任务重复确认
+	result := tx.Model(&models.SalespersonSaleItem{}).
+		Where("id = ? AND commission_status IN ?", item.ID, []string{"unrecognized", "held"}).
+		Updates(map[string]interface{}{
+			"commission_status": "recognized",
+			"recognized_at":     now,
+		})
+	if result.Error != nil {
+		return false, fmt.Errorf("更新销售明细佣金状态失败: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+
+	if err := tx.Model(&models.SalespersonSale{}).Where("id = ?", item.SaleID).
+		UpdateColumn("recognized_commission", gorm.Expr("recognized_commission + ?", item.Commission)).Error; err != nil {
+		return false, fmt.Errorf("更新销售记录已确认佣金失败: %w", err)
+	}
+
+	if err := tx.Model(&models.Salesperson{}).Where("id = ?", item.SalespersonID).
+		UpdateColumn("total_commission", gorm.Expr("total_commission + ?", item.Commission)).Error; err != nil {
+		return false, fmt.Errorf("更新销售员总佣金失败: %w", err)
+	}
+
+	if err := recognizeAgentCommissions(tx, item); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// recognizeAgentCommissions 随销售明细的佣金确认，确认上级代理在该明细上的佣金
+// 每个上级确认的金额为明细单价乘以该上级的佣金比例，全部明细确认后等于代理佣金记录的佣金金额
+func recognizeAgentCommissions(tx *gorm.DB, item *models.SalespersonSaleItem) error {
+	var agentCommissions []models.SalespersonAgentCommission
+	if err := tx.Where("sale_id = ? AND status = ?", item.SaleID, "pending").Find(&agentCommissions).Error; err != nil {
+		return fmt.Errorf("查询代理佣金记录失败: %w", err)
+	}
+
+	for _, commission := range agentCommissions {
+		amount := item.UnitPrice * commission.CommissionRate
+		if amount <= 0 {
+			continue
+		}
+		if err := tx.Model(&models.SalespersonAgentCommission{}).Where("id = ?", commission.ID).
+			UpdateColumn("recognized_amount", gorm.Expr("recognized_amount + ?", amount)).Error; err != nil {
+			return fmt.Errorf("更新代理佣金已确认金额失败: %w", err)
+		}
+		if err := tx.Model(&models.Salesperson{}).Where("id = ?", commission.AgentID).
+			UpdateColumn("total_commission", gorm.Expr("total_commission + ?", amount)).Error; err != nil {
+			return fmt.Errorf("更新上级代理(ID:%d)佣金失败: %w", commission.AgentID, err)
+		}
+	}
+	return nil
+}
+
+// handleActivationCommission 卡密激活后按销售记录的策略处理佣金
+// activation策略立即确认，activation_hold策略进入冻结期，由定时任务在冻结期结束后确认
+func handleActivationCommission(tx *gorm.DB, key *models.Key) error {
+	var item models.SalespersonSaleItem
+	if err := tx.Where("key_id = ?", key.ID).First(&item).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return fmt.Errorf("查询销售明细失败: %w", err)
+	}
+
+	if item.CommissionStatus != "unrecognized" {
+		return nil
+	}
+
+	// 已取消的销售记录不再确认佣金
+	var sale models.SalespersonSale
+	if err := tx.First(&sale, item.SaleID).Error; err != nil {
+		return fmt.Errorf("查询销售记录失败: %w", err)
+	}
+	if sale.Status != "pending" {
+		return nil
+	}
+
+	switch sale.CommissionPolicy {
+	case models.CommissionPolicyActivation:
+		_, err := recognizeSaleItemCommission(tx, &item, *key.ActivatedAt)
+		return err
+	case models.CommissionPolicyActivationHold:
+		recognizableAt := key.ActivatedAt.AddDate(0, 0, sale.CommissionHoldDays)
+		return tx.Model(&models.SalespersonSaleItem{}).
+			Where("id = ? AND commission_status = ?", item.ID, "unrecognized").
+			Updates(map[string]interface{}{
+				"commission_status": "held",
+				"recognizable_at":   recognizableAt,
+			}).Error
+	}
+	return nil
+}
+
+// RecognizeDueCommissions 确认冻结期已结束的佣金
+// 由后台定时任务调用，每条明细在独立的事务中处理，单条失败不影响其他明细
+// 返回本次确认的明细数量
+func RecognizeDueCommissions(db *gorm.DB) (int, error) {
+	now := time.Now()
+
+	var items []models.SalespersonSaleItem
+	if err := db.Where("commission_status = ? AND recognizable_at <= ?", "held", now).
+		Where("sale_id IN (?)", db.Model(&models.SalespersonSale{}).Select("id").Where("status = ?", "pending")).
+		Limit(500).Find(&items).Error; err != nil {
+		return 0, fmt.Errorf("查询待确认佣金失败: %w", err)
+	}
+
+	recognized := 0
+	for i := range items {
+		var ok bool
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			ok, err = recognizeSaleItemCommission(tx, &items[i], now)
+			return err
+		})
+		if err != nil {
+			log.Printf("确认销售明细(ID:%d)佣金失败: %v", items[i].ID, err)
+			continue
+		}
+		if ok {
+			recognized++
+		}
+	}
+
+	return recognized, nil
+}
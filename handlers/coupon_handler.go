@@ -0,0 +1,503 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"go_creation/database"
+	"go_creation/models"
+)
+
+// normalizeCouponCodes 将优惠码统一为大写并去除空白和重复项
+func normalizeCouponCodes(codes ...string) []string {
+	seen := make(map[string]bool, len(codes))
+	normalized := make([]string, 0, len(codes))
+	for _, code := range codes {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if code == "" || seen[code] {
+			continue
+		}
+		seen[code] = true
+		normalized = append(normalized, code)
+	}
+	return normalized
+}
+
+// couponCustomerKey 返回用于统计每个客户使用次数的客户标识，优先使用小写邮箱，其次为电话
+func couponCustomerKey(email, phone string) string {
+	if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+		return email
+	}
+	return strings.TrimSpace(phone)
+}
+
+// resolveCoupons 查询并校验本次销售使用的优惠码
+// 校验状态、有效期、软件和卡密类型限制、最低订单金额和叠加规则，校验失败时返回可以直接展示给销售员的错误
+// 总使用次数和每个客户的使用次数在redeemCoupons中加锁校验
+func resolveCoupons(db *gorm.DB, codes []string, softwareID, keyTypeID uint, amount float64, customerKey string, now time.Time) ([]models.Coupon, error) {
+	if len(codes) == 0 {
+		return nil, nil
+	}
+
+	var coupons []models.Coupon
+	if err := db.Where("code IN ?", codes).Find(&coupons).Error; err != nil {
+		return nil, err
+	}
+	if len(coupons) != len(codes) {
+		found := make(map[string]bool, len(coupons))
+		for _, coupon := range coupons {
+			found[coupon.Code] = true
+		}
+		for _, code := range codes {
+			if !found[code] {
+				return nil, fiber.NewError(fiber.StatusBadRequest, "优惠码不存在: "+code)
+			}
+		}
+	}
+
+	softwareIDStr := strconv.FormatUint(uint64(softwareID), 10)
+	keyTypeIDStr := strconv.FormatUint(uint64(keyTypeID), 10)
+	for _, coupon := range coupons {
+		switch {
+		case coupon.Status != "active":
+			return nil, fiber.NewError(fiber.StatusBadRequest, "优惠码已停用: "+coupon.Code)
+		case coupon.StartAt != nil && now.Before(*coupon.StartAt):
+			return nil, fiber.NewError(fiber.StatusBadRequest, "优惠码尚未生效: "+coupon.Code)
+		case coupon.EndAt != nil && !now.Before(*coupon.EndAt):
+			return nil, fiber.NewError(fiber.StatusBadRequest, "优惠码已过期: "+coupon.Code)
+		case coupon.SoftwareIDs != "" && !containsCSV(coupon.SoftwareIDs, softwareIDStr),
+			coupon.KeyTypeIDs != "" && !containsCSV(coupon.KeyTypeIDs, keyTypeIDStr):
+			return nil, fiber.NewError(fiber.StatusBadRequest, "优惠码不适用于该产品: "+coupon.Code)
+		case coupon.MinAmount > 0 && amount < coupon.MinAmount:
+			return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("订单金额未达到优惠码%s的最低金额%.2f", coupon.Code, coupon.MinAmount))
+		case coupon.PerCustomerLimit > 0 && customerKey == "":
+			return nil, fiber.NewError(fiber.StatusBadRequest, "优惠码"+coupon.Code+"限制每个客户的使用次数，请填写客户邮箱或电话")
+		case !coupon.Stackable && len(coupons) > 1:
+			return nil, fiber.NewError(fiber.StatusBadRequest, "优惠码不能与其他优惠码同时使用: "+coupon.Code)
+		}
+	}
+	return coupons, nil
+}
+
+// applyCoupons 计算优惠码的减免金额
+// 先按比例折扣再减固定金额，每个优惠码依次作用于前一个优惠码减免后的金额，总减免不超过订单金额
+// 返回的coupons已按使用顺序排列，discounts与之一一对应
+func applyCoupons(coupons []models.Coupon, amount float64) ([]models.Coupon, []float64, float64) {
+	sort.SliceStable(coupons, func(i, j int) bool {
+		return coupons[i].DiscountType == models.CouponDiscountPercent && coupons[j].DiscountType != models.CouponDiscountPercent
+	})
+
+	discounts := make([]float64, len(coupons))
+	var total float64
+	for i := range coupons {
+		discounts[i] = coupons[i].Discount(amount - total)
+		total += discounts[i]
+	}
+	return coupons, discounts, total
+}
+
+// redeemCoupons 在事务中占用优惠码的使用次数并记录使用情况
+// 以条件更新的方式增加使用次数，同时锁定优惠码记录，保证并发时不会超出总次数和每个客户的次数限制
+func redeemCoupons(tx *gorm.DB, coupons []models.Coupon, discounts []float64, sale *models.SalespersonSale, customerKey string) error {
+	for i, coupon := range coupons {
+		result := tx.Model(&models.Coupon{}).
+			Where("id = ? AND (usage_limit = 0 OR used_count < usage_limit)", coupon.ID).
+			UpdateColumn("used_count", gorm.Expr("used_count + 1"))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fiber.NewError(fiber.StatusConflict, "优惠码使用次数已达上限: "+coupon.Code)
+		}
+
+		// 使用次数的更新已锁定优惠码记录，同一优惠码的兑换在此串行执行
+		// 统计必须使用加锁读取：REPEATABLE READ下的普通读取使用事务开始时的快照，看不到刚提交的使用记录
+		if coupon.PerCustomerLimit > 0 {
+			var used int64
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Model(&models.CouponRedemption{}).
+				Where("coupon_id = ? AND customer_key = ? AND status = ?", coupon.ID, customerKey, "applied").
+				Count(&used).Error; err != nil {
+				return err
+			}
+			if int(used) >= coupon.PerCustomerLimit {
+				return fiber.NewError(fiber.StatusConflict, "该客户使用优惠码的次数已达上限: "+coupon.Code)
+			}
+		}
+
+		if err := tx.Create(&models.CouponRedemption{
+			CouponID:       coupon.ID,
+			Code:           coupon.Code,
+			SaleID:         sale.ID,
+			SalespersonID:  sale.SalespersonID,
+			CustomerKey:    customerKey,
+			DiscountAmount: discounts[i],
+			Status:         "applied",
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseCouponRedemptions 取消销售时取消优惠码的使用记录并退回使用次数
+func releaseCouponRedemptions(tx *gorm.DB, saleID uint, now time.Time) error {
+	var redemptions []models.CouponRedemption
+	if err := tx.Where("sale_id = ? AND status = ?", saleID, "applied").Find(&redemptions).Error; err != nil {
+		return err
+	}
+	for _, redemption := range redemptions {
+		if err := tx.Model(&models.CouponRedemption{}).Where("id = ?", redemption.ID).
+			Updates(map[string]interface{}{
+				"status":       "cancelled",
+				"cancelled_at": now,
+			}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Coupon{}).Where("id = ? AND used_count > 0", redemption.CouponID).
+			UpdateColumn("used_count", gorm.Expr("used_count - 1")).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// couponRequest 创建和更新优惠码的请求参数，更新时未传的字段保持不变
+type couponRequest struct {
+	Code             *string    `json:"code"`
+	Name             *string    `json:"name"`
+	DiscountType     *string    `json:"discount_type"`
+	DiscountValue    *float64   `json:"discount_value"`
+	MaxDiscount      *float64   `json:"max_discount"`
+	MinAmount        *float64   `json:"min_amount"`
+	SoftwareIDs      *[]uint    `json:"software_ids"`
+	KeyTypeIDs       *[]uint    `json:"key_type_ids"`
+	UsageLimit       *int       `json:"usage_limit"`
+	PerCustomerLimit *int       `json:"per_customer_limit"`
+	Stackable        *bool      `json:"stackable"`
+	StartAt          *time.Time `json:"start_at"`
+	EndAt            *time.Time `json:"end_at"`
+	Status           *string    `json:"status"`
+}
+
+// joinIDs 校验ID都存在后拼接为逗号分隔的字符串
+func joinIDs(db *gorm.DB, model interface{}, ids []uint) (string, error) {
+	if len(ids) == 0 {
+		return "", nil
+	}
+	var count int64
+	if err := db.Model(model).Where("id IN ?", ids).Count(&count).Error; err != nil {
+		return "", err
+	}
+	values := make([]string, 0, len(ids))
+	seen := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			values = append(values, strconv.FormatUint(uint64(id), 10))
+		}
+	}
+	if int(count) != len(values) {
+		return "", errors.New("存在无效的ID")
+	}
+	return strings.Join(values, ","), nil
+}
+
+// apply 校验请求参数并写入优惠码
+func (r *couponRequest) apply(db *gorm.DB, coupon *models.Coupon) error {
+	if r.Code != nil {
+		codes := normalizeCouponCodes(*r.Code)
+		if len(codes) == 0 || len(codes[0]) > 50 {
+			return errors.New("优惠码不能为空且不能超过50个字符")
+		}
+		coupon.Code = codes[0]
+	}
+	if coupon.Code == "" {
+		return errors.New("优惠码不能为空")
+	}
+	if r.Name != nil {
+		coupon.Name = *r.Name
+	}
+	if r.DiscountType != nil {
+		coupon.DiscountType = *r.DiscountType
+	}
+	if !models.IsValidCouponDiscountType(coupon.DiscountType) {
+		return errors.New("无效的折扣类型，可选值：percent, fixed")
+	}
+	if r.DiscountValue != nil {
+		coupon.DiscountValue = *r.DiscountValue
+	}
+	if coupon.DiscountValue <= 0 || (coupon.DiscountType == models.CouponDiscountPercent && coupon.DiscountValue > 100) {
+		return errors.New("折扣值必须大于0，按比例折扣不能超过100")
+	}
+	if r.MaxDiscount != nil {
+		coupon.MaxDiscount = *r.MaxDiscount
+	}
+	if r.MinAmount != nil {
+		coupon.MinAmount = *r.MinAmount
+	}
+	if coupon.MaxDiscount < 0 || coupon.MinAmount < 0 {
+		return errors.New("最高减免金额和最低订单金额不能为负数")
+	}
+	if r.SoftwareIDs != nil {
+		ids, err := joinIDs(db, &models.Software{}, *r.SoftwareIDs)
+		if err != nil {
+			return errors.New("软件限制中" + err.Error())
+		}
+		coupon.SoftwareIDs = ids
+	}
+	if r.KeyTypeIDs != nil {
+		ids, err := joinIDs(db, &models.KeyType{}, *r.KeyTypeIDs)
+		if err != nil {
+			return errors.New("卡密类型限制中" + err.Error())
+		}
+		coupon.KeyTypeIDs = ids
+	}
+	if r.UsageLimit != nil {
+		coupon.UsageLimit = *r.UsageLimit
+	}
+	if r.PerCustomerLimit != nil {
+		coupon.PerCustomerLimit = *r.PerCustomerLimit
+	}
+	if coupon.UsageLimit < 0 || coupon.PerCustomerLimit < 0 {
+		return errors.New("使用次数限制不能为负数")
+	}
+	if r.Stackable != nil {
+		coupon.Stackable = *r.Stackable
+	}
+	if r.StartAt != nil {
+		coupon.StartAt = r.StartAt
+	}
+	if r.EndAt != nil {
+		coupon.EndAt = r.EndAt
+	}
+	if coupon.StartAt != nil && coupon.EndAt != nil && !coupon.EndAt.After(*coupon.StartAt) {
+		return errors.New("结束时间必须晚于开始时间")
+	}
+	if r.Status != nil {
+		if *r.Status != "active" && *r.Status != "inactive" {
+			return errors.New("无效的状态，可选值：active, inactive")
+		}
+		coupon.Status = *r.Status
+	}
+	return nil
+}
+
+// GetCoupons 获取优惠码列表
+// 可按status筛选，按code模糊搜索
+func GetCoupons(c *fiber.Ctx) error {
+	db := database.GetDB().Model(&models.Coupon{})
+	if status := c.Query("status"); status != "" {
+		db = db.Where("status = ?", status)
+	}
+	if code := strings.TrimSpace(c.Query("code")); code != "" {
+		db = db.Where("code LIKE ?", "%"+strings.ToUpper(code)+"%")
+	}
+
+	var coupons []models.Coupon
+	if err := db.Order("id DESC").Find(&coupons).Error; err != nil {
+		log.Printf("查询优惠码失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询优惠码失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": coupons,
+	})
+}
+
+// GetCoupon 获取优惠码详情和使用记录
+func GetCoupon(c *fiber.Ctx) error {
+	coupon, err := findCoupon(c)
+	if coupon == nil {
+		return err
+	}
+
+	var redemptions []models.CouponRedemption
+	if err := database.GetDB().Where("coupon_id = ?", coupon.ID).Order("id DESC").Find(&redemptions).Error; err != nil {
+		log.Printf("查询优惠码使用记录失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询优惠码使用记录失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": fiber.Map{
+			"coupon":      coupon,
+			"redemptions": redemptions,
+		},
+	})
+}
+
+// CreateCoupon 创建优惠码
+func CreateCoupon(c *fiber.Ctx) error {
+	var req couponRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	db := database.GetDB()
+	coupon := models.Coupon{Status: "active"}
+	if err := req.apply(db, &coupon); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var count int64
+	if err := db.Model(&models.Coupon{}).Where("code = ?", coupon.Code).Count(&count).Error; err != nil {
+		log.Printf("查询优惠码失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询优惠码失败",
+		})
+	}
+	if count > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "优惠码已存在",
+		})
+	}
+
+	if err := db.Create(&coupon).Error; err != nil {
+		log.Printf("创建优惠码失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "创建优惠码失败",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "优惠码创建成功",
+		"data":    coupon,
+	})
+}
+
+// UpdateCoupon 更新优惠码
+// 已使用过的优惠码不能修改优惠码本身，已有销售记录保留使用时的减免金额
+func UpdateCoupon(c *fiber.Ctx) error {
+	coupon, err := findCoupon(c)
+	if coupon == nil {
+		return err
+	}
+
+	var req couponRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	db := database.GetDB()
+	originalCode := coupon.Code
+	if err := req.apply(db, coupon); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if coupon.Code != originalCode {
+		var count int64
+		if err := db.Model(&models.CouponRedemption{}).Where("coupon_id = ?", coupon.ID).Count(&count).Error; err != nil {
+			log.Printf("查询优惠码使用记录失败: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "查询优惠码使用记录失败",
+			})
+		}
+		if count > 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "优惠码已被使用，不能修改优惠码",
+			})
+		}
+		if err := db.Model(&models.Coupon{}).Where("code = ? AND id <> ?", coupon.Code, coupon.ID).Count(&count).Error; err != nil {
+			log.Printf("查询优惠码失败: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "查询优惠码失败",
+			})
+		}
+		if count > 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "优惠码已存在",
+			})
+		}
+	}
+
+	// 使用Select保存所有字段，避免布尔值和空值被忽略；使用次数由销售流程维护，不在这里修改
+	if err := db.Select("*").Omit("created_at", "used_count").Updates(coupon).Error; err != nil {
+		log.Printf("更新优惠码失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "更新优惠码失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "优惠码更新成功",
+		"data":    coupon,
+	})
+}
+
+// DeleteCoupon 删除优惠码
+// 已被使用过的优惠码需要保留使用记录，只能停用
+func DeleteCoupon(c *fiber.Ctx) error {
+	coupon, err := findCoupon(c)
+	if coupon == nil {
+		return err
+	}
+
+	db := database.GetDB()
+	var count int64
+	if err := db.Model(&models.CouponRedemption{}).Where("coupon_id = ?", coupon.ID).Count(&count).Error; err != nil {
+		log.Printf("查询优惠码使用记录失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询优惠码使用记录失败",
+		})
+	}
+	if count > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "优惠码已被使用，只能停用不能删除",
+		})
+	}
+
+	if err := db.Delete(coupon).Error; err != nil {
+		log.Printf("删除优惠码失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "删除优惠码失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "优惠码删除成功",
+	})
+}
+
+// findCoupon 根据路径参数id查询优惠码，查询失败时写入错误响应并返回nil
+func findCoupon(c *fiber.Ctx) (*models.Coupon, error) {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的优惠码ID",
+		})
+	}
+
+	var coupon models.Coupon
+	if err := database.GetDB().First(&coupon, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "优惠码不存在",
+			})
+		}
+		log.Printf("查询优惠码失败: %v", err)
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询优惠码失败",
+		})
+	}
+	return &coupon, nil
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"go_creation/database"
+	"go_creation/models"
+)
+
+// maxConsumeAmount 单次扣减的最大次数
+const maxConsumeAmount = 10000
+
+// consumptionResponse 返回扣减结果，replayed表示该请求ID已经扣减过，本次没有重复扣减
+func consumptionResponse(c *fiber.Ctx, key *models.Key, consumption *models.KeyConsumption, replayed bool) error {
+	message := "扣减成功"
+	if replayed {
+		message = "该请求已处理"
+	}
+	return c.JSON(fiber.Map{
+		"code":    0,
+		"message": message,
+		"data": fiber.Map{
+			"key_id":          key.ID,
+			"request_id":      consumption.RequestID,
+			"amount":          consumption.Amount,
+			"quota_total":     key.QuotaTotal,
+			"quota_remaining": consumption.RemainingAfter,
+			"consumed_at":     consumption.CreatedAt,
+			"replayed":        replayed,
+		},
+	})
+}
+
+// ConsumeKey 扣减按次计费卡密的剩余次数
+// 客户端每次使用计次功能时调用，request_id由客户端生成并在重试时保持不变，
+// 同一卡密的同一request_id只扣减一次，重复请求返回首次扣减的结果
+// 剩余次数不足时拒绝扣减，次数用完后卡密过期
+func ConsumeKey(c *fiber.Ctx) error {
+	var req struct {
+		Code       string `json:"code"`        // 卡密码
+		KeyCode    string `json:"key_code"`    // 激活码
+		SoftwareID uint   `json:"software_id"` // 软件ID
+		Amount     int    `json:"amount"`      // 扣减次数，默认为1
+		RequestID  string `json:"request_id"`  // 请求ID，用于防止重复扣减
+		DeviceInfo string `json:"device_info"` // 设备信息
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败",
+		})
+	}
+
+	req.RequestID = strings.TrimSpace(req.RequestID)
+	if req.Code == "" || req.KeyCode == "" || req.SoftwareID == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "卡密码、激活码和软件ID不能为空",
+		})
+	}
+	if req.RequestID == "" || len(req.RequestID) > 100 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "请求ID不能为空且不能超过100个字符",
+		})
+	}
+	if req.Amount == 0 {
+		req.Amount = 1
+	}
+	if req.Amount < 0 || req.Amount > maxConsumeAmount {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "扣减次数必须在1到10000之间",
+		})
+	}
+
+	db := database.GetDB()
+	var key models.Key
+	if err := db.Where("code = ? AND key_code = ? AND software_id = ?", req.Code, req.KeyCode, req.SoftwareID).
+		First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "卡密不存在或激活码错误",
+			})
+		}
+		log.Printf("查询卡密失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询卡密失败",
+		})
+	}
+
+	if !key.IsQuota() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "该卡密不是按次计费的卡密",
+		})
+	}
+
+	// 重复的请求直接返回首次扣减的结果
+	var existing models.KeyConsumption
+	err := db.Where("key_id = ? AND request_id = ?", key.ID, req.RequestID).First(&existing).Error
+	if err == nil {
+		return consumptionResponse(c, &key, &existing, true)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("查询扣减记录失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询扣减记录失败",
+		})
+	}
+
+	// 验证卡密状态
+	now := time.Now()
+	if key.Status != "used" || key.IsBlacklisted {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "卡密未激活或已失效",
+		})
+	}
+	if key.ExpiredAt != nil && !key.ExpiredAt.After(now) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error":           "卡密已过期",
+			"quota_remaining": key.QuotaRemaining,
+		})
+	}
+
+	consumption := models.KeyConsumption{
+		KeyID:      key.ID,
+		RequestID:  req.RequestID,
+		Amount:     req.Amount,
+		DeviceInfo: req.DeviceInfo,
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// 以条件更新的方式扣减，剩余次数不足时不会扣减
+		result := tx.Model(&models.Key{}).
+			Where("id = ? AND status = ? AND quota_remaining >= ?", key.ID, "used", req.Amount).
+			UpdateColumn("quota_remaining", gorm.Expr("quota_remaining - ?", req.Amount))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fiber.NewError(fiber.StatusConflict, "剩余次数不足")
+		}
+
+		if err := tx.Select("quota_remaining").First(&key, key.ID).Error; err != nil {
+			return err
+		}
+		consumption.RemainingAfter = key.QuotaRemaining
+
+		// 次数用完时卡密过期
+		if key.QuotaRemaining == 0 {
+			if err := tx.Model(&models.Key{}).Where("id = ?", key.ID).UpdateColumn("expired_at", now).Error; err != nil {
+				return err
+			}
+			key.ExpiredAt = &now
+		}
+
+		return tx.Create(&consumption).Error
+	})
+	if err != nil {
+		if e, ok := err.(*fiber.Error); ok {
+			return c.Status(e.Code).JSON(fiber.Map{
+				"error":           e.Message,
+				"quota_remaining": key.QuotaRemaining,
+			})
+		}
+
+		// 并发的相同请求只有一个能写入扣减记录，其余的回滚后返回已写入的结果
+		if db.Where("key_id = ? AND request_id = ?", key.ID, req.RequestID).First(&existing).Error == nil {
+			return consumptionResponse(c, &key, &existing, true)
+		}
+		log.Printf("扣减卡密次数失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "扣减卡密次数失败",
+		})
+	}
+
+	return consumptionResponse(c, &key, &consumption, false)
+}
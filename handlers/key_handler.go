@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"go_creation/database"
 	"go_creation/models"
+	"go_creation/utils"
 	"math"
 	"math/rand"
 	"strconv"
@@ -135,22 +136,39 @@ func BatchCreateKeys(c *fiber.Ctx) error {
 		}
 	}
 
+	// 该软件下的实际价格，绑定上的价格优先于卡密类型当前有效的价格版本
+	price, priceVersionID, err := resolveProductPrice(database.GetDB(), &binding, &keyType)
+	if err != nil {
+		fmt.Printf("查询卡密类型价格失败: %v\n", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询卡密类型价格失败",
+		})
+	}
+
+	// 该软件下的实际有效期，绑定上的有效期优先
+	duration := binding.ResolveDuration(&keyType)
+
 	// 生成卡密
 	keys := make([]models.Key, req.Count)
 	for i := 0; i < req.Count; i++ {
 		keys[i] = models.Key{
-			TypeID:        req.TypeID,
-			TypeName:      keyType.Name,
-			SoftwareID:    req.SoftwareID,
-			SoftwareName:  software.Name,
-			Code:          generateUniqueCode(),    // 生成唯一的卡密码
-			KeyCode:       generateUniqueKeyCode(), // 生成唯一的激活码
-			Hours:         keyType.Hours,           // 使用卡密类型的有效期
-			Price:         keyType.Price,           // 使用卡密类型的价格
-			Status:        "unused",                // 初始状态为未使用
-			CreatorID:     req.CreatorID,           // 设置创建者ID
-			CreatorType:   req.CreatorType,         // 设置创建者类型
-			SalespersonID: req.SalespersonID,       // 设置销售员ID
+			TypeID:         req.TypeID,
+			TypeName:       keyType.Name,
+			SoftwareID:     req.SoftwareID,
+			SoftwareName:   software.Name,
+			Code:           generateUniqueCode(),    // 生成唯一的卡密码
+			KeyCode:        generateUniqueKeyCode(), // 生成唯一的激活码
+			Hours:          duration.Hours(),        // 有效期小时数
+			DurationUnit:   duration.Unit,           // 有效期单位
+			DurationAmount: duration.Amount,         // 有效期数量
+			Price:          price,                   // 生成时的实际价格
+			PriceVersionID: priceVersionID,          // 使用的价格版本
+			QuotaTotal:     keyType.KeyQuota(),      // 按次计费的总次数
+			QuotaRemaining: keyType.KeyQuota(),      // 按次计费的剩余次数
+			Status:         "unused",                // 初始状态为未使用
+			CreatorID:      req.CreatorID,           // 设置创建者ID
+			CreatorType:    req.CreatorType,         // 设置创建者类型
+			SalespersonID:  req.SalespersonID,       // 设置销售员ID
 		}
 	}
 
@@ -190,21 +208,42 @@ func BatchCreateKeys(c *fiber.Ctx) error {
 				})
 			}
 
+			// 按销售员的代理层级和生成数量查询适用的批发价格阶梯
+			var salesperson models.Salesperson
+			if err := tx.Select("id", "level").First(&salesperson, req.SalespersonID).Error; err != nil {
+				tx.Rollback()
+				fmt.Printf("查询销售员失败: %v\n", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "查询销售员失败",
+				})
+			}
+			tier, err := findWholesaleTier(tx, req.SoftwareID, req.TypeID, salesperson.Level, req.Count)
+			if err != nil {
+				tx.Rollback()
+				fmt.Printf("查询批发价格阶梯失败: %v\n", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "查询批发价格阶梯失败",
+				})
+			}
+
 			// 创建销售记录
-			totalAmount := float64(req.Count) * keyType.Price
+			totalAmount := float64(req.Count) * price
 			commission := totalAmount * salespersonProduct.CommissionRate
 
 			sale := models.SalespersonSale{
 				SalespersonID:  req.SalespersonID,
-				KeyID:          0, // 批量生成时不关联具体卡密
+				KeyID:          0, // 批量生成的卡密通过销售明细SalespersonSaleItem逐张关联
 				SoftwareID:     req.SoftwareID,
 				KeyTypeID:      req.TypeID,
 				SaleAmount:     totalAmount,
+				PriceVersionID: priceVersionID,
 				CommissionRate: salespersonProduct.CommissionRate,
 				Commission:     commission,
 				Status:         "pending",
 				Notes:          "通过API批量生成",
 			}
+			applyWholesaleTier(&sale, tier, req.Count)
+			applyCommissionPolicy(&sale, &salespersonProduct, &keyType)
 
 			// 打印SQL查询语句
 			stmt = tx.Session(&gorm.Session{DryRun: true}).Create(&sale).Statement
@@ -219,10 +258,19 @@ func BatchCreateKeys(c *fiber.Ctx) error {
 				})
 			}
 
-			// 更新销售员的总销售额和总佣金
+			// 将本次生成的卡密关联到销售记录，便于后续取消/退款
+			if err := linkKeysToSale(tx, keys, &sale); err != nil {
+				tx.Rollback()
+				fmt.Printf("关联卡密与销售记录失败: %v", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "关联卡密与销售记录失败",
+				})
+			}
+
+			// 更新销售员的总销售额和已确认的佣金
 			if err := tx.Model(&models.Salesperson{}).Where("id = ?", req.SalespersonID).Updates(map[string]interface{}{
 				"total_sales":      gorm.Expr("total_sales + ?", totalAmount),
-				"total_commission": gorm.Expr("total_commission + ?", commission),
+				"total_commission": gorm.Expr("total_commission + ?", sale.RecognizedCommission),
 			}).Error; err != nil {
 				tx.Rollback()
 				fmt.Printf("更新销售员销售统计失败: %v", err)
@@ -230,6 +278,15 @@ func BatchCreateKeys(c *fiber.Ctx) error {
 					"error": "更新销售员销售统计失败",
 				})
 			}
+
+			// 为上级代理生成代理佣金
+			if err := ProcessAgentCommission(sale, tx); err != nil {
+				tx.Rollback()
+				fmt.Printf("处理代理佣金失败: %v", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "处理代理佣金失败",
+				})
+			}
 		}
 	}
 
@@ -260,6 +317,8 @@ func ActivateKey(c *fiber.Ctx) error {
 		SoftwareID  uint   `json:"software_id"`  // 软件ID
 		DeviceInfo  string `json:"device_info"`  // 设备信息
 		ActivatorID uint   `json:"activator_id"` // 激活者ID
+		Version     string `json:"version"`      // 客户端版本，可选，传入时检查是否低于最低支持版本
+		Channel     string `json:"channel"`      // 客户端发布渠道，stable或beta，默认stable
 	}
 
 	var req ActivateRequest
@@ -323,6 +382,36 @@ func ActivateKey(c *fiber.Ctx) error {
 		})
 	}
 
+	// 检查客户端版本，低于最低支持版本时必须先更新
+	var versionCheck *VersionCheckResult
+	if req.Version != "" {
+		if _, err := utils.ParseSemver(req.Version); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		channel, ok := parseClientChannel(req.Channel)
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "无效的发布渠道，可选值：stable, beta",
+			})
+		}
+		result, err := checkClientVersion(database.GetDB(), software.ID, req.Version, channel)
+		if err != nil {
+			fmt.Printf("检查软件版本失败: %v\n", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "检查软件版本失败",
+			})
+		}
+		if result.UpdateRequired {
+			return c.Status(fiber.StatusUpgradeRequired).JSON(fiber.Map{
+				"error":   "当前版本过低，请更新到" + result.MinimumVersion + "或更高版本后再激活",
+				"version": result,
+			})
+		}
+		versionCheck = result
+	}
+
 	// 开始事务
 	tx := database.GetDB().Begin()
 	if err := tx.Error; err != nil {
@@ -333,12 +422,17 @@ func ActivateKey(c *fiber.Ctx) error {
 
 	// 更新卡密状态
 	now := time.Now()
-	expiredAt := now.Add(time.Duration(key.Hours) * time.Hour)
 
 	key.Status = "used"
 	key.UsedAt = &now
 	key.ActivatedAt = &now
-	key.ExpiredAt = &expiredAt
+	// 按卡密的有效期计算到期时间，天、自然月和自然年按配置的时区计算
+	// 永久有效以及按次计费且不限时间的卡密没有过期时间，按次计费的卡密次数用完时过期
+	duration := key.Duration()
+	key.ExpiredAt = nil
+	if !key.IsQuota() || duration.Amount > 0 {
+		key.ExpiredAt = duration.ExpiresAt(now.In(utils.LicenseLocation()))
+	}
 	key.DeviceInfo = req.DeviceInfo
 	key.UserID = &req.ActivatorID
 
@@ -354,6 +448,14 @@ func ActivateKey(c *fiber.Ctx) error {
 		})
 	}
 
+	// 将激活归属到对应的销售明细
+	if err := markSaleItemActivated(tx, &key); err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "更新销售明细失败",
+		})
+	}
+
 	// 提交事务
 	if err := tx.Commit().Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -362,15 +464,33 @@ func ActivateKey(c *fiber.Ctx) error {
 	}
 
 	// 返回激活结果
+	data := fiber.Map{
+		"key_id":     key.ID,
+		"expired_at": key.ExpiredAt,
+		"hours":      key.Hours,
+		"duration":   key.Duration(),
+		"permanent":  key.ExpiredAt == nil && !key.IsQuota(),
+		"software":   software.Name,
+		"version":    versionCheck,
+	}
+	if key.IsQuota() {
+		data["quota_total"] = key.QuotaTotal
+		data["quota_remaining"] = key.QuotaRemaining
+	}
+
+	// 附带按卡密类型和卡密解析后的远程配置，配置失败不影响激活结果
+	if config, err := clientConfigResponse(database.GetDB(), &key); err != nil {
+		fmt.Printf("生成远程配置失败: %v\n", err)
+	} else {
+		for k, v := range config {
+			data[k] = v
+		}
+	}
+
 	return c.JSON(fiber.Map{
 		"code":    0,
 		"message": "卡密激活成功",
-		"data": fiber.Map{
-			"key_id":     key.ID,
-			"expired_at": key.ExpiredAt,
-			"hours":      key.Hours,
-			"software":   software.Name,
-		},
+		"data":    data,
 	})
 }
 
@@ -451,47 +571,16 @@ func ExportKeys(c *fiber.Ctx) error {
 	fmt.Println("====================== 开始导出卡密 ======================")
 	// 获取当前登录的销售员信息
 	fmt.Printf("请求头: %+v\n", c.GetReqHeaders())
-	fmt.Printf("认证信息: %+v\n", c.Locals("salesperson_id"))
 
-	salespersonID, ok := c.Locals("salesperson_id").(uint)
+	auth, ok := utils.GetAuthContext(c)
 	if !ok {
-		// 尝试转换其他类型
-		fmt.Printf("salesperson_id类型转换失败，尝试其他类型转换\n")
-		switch id := c.Locals("salesperson_id").(type) {
-		case int:
-			fmt.Printf("salesperson_id是int类型: %d\n", id)
-			salespersonID = uint(id)
-		case float64:
-			fmt.Printf("salesperson_id是float64类型: %f\n", id)
-			salespersonID = uint(id)
-		case int64:
-			fmt.Printf("salesperson_id是int64类型: %d\n", id)
-			salespersonID = uint(id)
-		default:
-			fmt.Printf("无法识别的销售员ID类型: %T, 值: %v\n", c.Locals("salesperson_id"), c.Locals("salesperson_id"))
-			// 尝试从请求头获取
-			salespersonIDStr := c.Get("X-Salesperson-ID")
-			if salespersonIDStr != "" {
-				fmt.Printf("从请求头获取到销售员ID: %s\n", salespersonIDStr)
-				id, err := strconv.Atoi(salespersonIDStr)
-				if err == nil {
-					salespersonID = uint(id)
-				} else {
-					fmt.Printf("销售员ID转换失败: %v\n", err)
-					return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-						"code":  -1,
-						"error": "未授权访问，请先登录",
-					})
-				}
-			} else {
-				fmt.Printf("未从请求头获取到销售员ID\n")
-				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-					"code":  -1,
-					"error": "未授权访问，请先登录",
-				})
-			}
-		}
+		fmt.Printf("未找到销售员身份信息\n")
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"code":  -1,
+			"error": "未授权访问，请先登录",
+		})
 	}
+	salespersonID := auth.SalespersonID
 
 	fmt.Printf("导出卡密 - 当前销售员ID: %d\n", salespersonID)
 
@@ -617,24 +706,29 @@ func ExportKeys(c *fiber.Ctx) error {
 		// 构建CSV内容
 		var csvContent strings.Builder
 		// 添加CSV头
-		csvContent.WriteString("ID,卡密码,激活码,类型ID,类型名称,有效期(小时),价格,软件ID,软件名称,状态,创建者ID,创建者类型,销售员ID,使用者ID,使用设备信息,使用时间,过期时间,激活时间,是否黑名单,创建时间,更新时间\n")
+		csvContent.WriteString("ID,卡密码,激活码,类型ID,类型名称,有效期,价格,软件ID,软件名称,状态,创建者ID,创建者类型,销售员ID,使用者ID,使用设备信息,使用时间,过期时间,激活时间,是否黑名单,创建时间,更新时间\n")
+
+		// 时间按卡密到期时间使用的时区显示
+		loc := utils.LicenseLocation()
 
 		// 添加数据行
 		for _, key := range keys {
 			// 处理可能为空的时间字段
 			usedAt := ""
 			if key.UsedAt != nil {
-				usedAt = key.UsedAt.Format("2006-01-02 15:04:05")
+				usedAt = key.UsedAt.In(loc).Format("2006-01-02 15:04:05")
 			}
 
 			expiredAt := ""
 			if key.ExpiredAt != nil {
-				expiredAt = key.ExpiredAt.Format("2006-01-02 15:04:05")
+				expiredAt = key.ExpiredAt.In(loc).Format("2006-01-02 15:04:05")
+			} else if key.Status == "used" && key.Duration().IsPermanent() {
+				expiredAt = "永久"
 			}
 
 			activatedAt := ""
 			if key.ActivatedAt != nil {
-				activatedAt = key.ActivatedAt.Format("2006-01-02 15:04:05")
+				activatedAt = key.ActivatedAt.In(loc).Format("2006-01-02 15:04:05")
 			}
 
 			// 处理可能为空的用户ID
@@ -644,13 +738,13 @@ func ExportKeys(c *fiber.Ctx) error {
 			}
 
 			// 构建CSV行
-			row := fmt.Sprintf("%d,%s,%s,%d,%s,%d,%.2f,%d,%s,%s,%d,%s,%d,%s,%s,%s,%s,%s,%t,%s,%s\n",
+			row := fmt.Sprintf("%d,%s,%s,%d,%s,%s,%.2f,%d,%s,%s,%d,%s,%d,%s,%s,%s,%s,%s,%t,%s,%s\n",
 				key.ID,
 				escapeCSVField(key.Code),
 				escapeCSVField(key.KeyCode),
 				key.TypeID,
 				escapeCSVField(key.TypeName),
-				key.Hours,
+				escapeCSVField(key.Duration().String()),
 				key.Price,
 				key.SoftwareID,
 				escapeCSVField(key.SoftwareName),
@@ -664,8 +758,8 @@ func ExportKeys(c *fiber.Ctx) error {
 				expiredAt,
 				activatedAt,
 				key.IsBlacklisted,
-				key.CreatedAt.Format("2006-01-02 15:04:05"),
-				key.UpdatedAt.Format("2006-01-02 15:04:05"))
+				key.CreatedAt.In(loc).Format("2006-01-02 15:04:05"),
+				key.UpdatedAt.In(loc).Format("2006-01-02 15:04:05"))
 			csvContent.WriteString(row)
 		}
 
@@ -752,12 +846,32 @@ func GetKeyStatus(c *fiber.Ctx) error {
 
 	fmt.Printf("查询成功，找到 %d 条记录\n", len(keys))
 
-	// 返回查询结果
-	return c.JSON(fiber.Map{
+	response := fiber.Map{
 		"code":    0,
 		"message": "查询成功",
 		"data":    keys,
-	})
+	}
+
+	// 精确查到一张按次计费的卡密时附带剩余次数
+	if key := &keys[0]; len(keys) == 1 && key.IsQuota() {
+		response["quota_total"] = key.QuotaTotal
+		response["quota_remaining"] = key.QuotaRemaining
+	}
+
+	// 精确查到一张已激活且未过期的卡密时附带远程配置
+	if key := &keys[0]; len(keys) == 1 && key.Status == "used" && !key.IsBlacklisted &&
+		(key.ExpiredAt == nil || key.ExpiredAt.After(time.Now())) {
+		if config, err := clientConfigResponse(database.GetDB(), key); err != nil {
+			fmt.Printf("生成远程配置失败: %v\n", err)
+		} else {
+			for k, v := range config {
+				response[k] = v
+			}
+		}
+	}
+
+	// 返回查询结果
+	return c.JSON(response)
 }
 
 // GetAllKeys 获取所有卡密
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"go_creation/database"
+	"go_creation/models"
+	"go_creation/utils"
+)
+
+// RenewKey 使用未使用的卡密为已激活的卡密续期
+// 续期从原到期时间开始计算，已过期的卡密从当前时间开始计算，按续期卡密的有效期单位在配置的时区中计算到期时间，
+// 续期卡密为永久有效时原卡密变为永久有效；续期卡密会被标记为已使用
+func RenewKey(c *fiber.Ctx) error {
+	var req struct {
+		Code         string `json:"code"`           // 需要续期的卡密码
+		KeyCode      string `json:"key_code"`       // 需要续期的激活码
+		SoftwareID   uint   `json:"software_id"`    // 软件ID
+		RenewCode    string `json:"renew_code"`     // 用于续期的卡密码
+		RenewKeyCode string `json:"renew_key_code"` // 用于续期的激活码
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败",
+		})
+	}
+	if req.Code == "" || req.KeyCode == "" || req.RenewCode == "" || req.RenewKeyCode == "" || req.SoftwareID == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "卡密码、激活码、续期卡密和软件ID不能为空",
+		})
+	}
+
+	db := database.GetDB()
+	var key, renewal models.Key
+	if err := db.Where("code = ? AND key_code = ? AND software_id = ?", req.Code, req.KeyCode, req.SoftwareID).
+		First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "卡密不存在或激活码错误",
+			})
+		}
+		log.Printf("查询卡密失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询卡密失败",
+		})
+	}
+	if err := db.Where("code = ? AND key_code = ? AND software_id = ?", req.RenewCode, req.RenewKeyCode, req.SoftwareID).
+		First(&renewal).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "续期卡密不存在或激活码错误",
+			})
+		}
+		log.Printf("查询续期卡密失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询续期卡密失败",
+		})
+	}
+
+	// 验证卡密状态
+	switch {
+	case key.Status != "used" || key.IsBlacklisted:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "只能为已激活的卡密续期",
+		})
+	case renewal.Status != "unused" || renewal.IsBlacklisted:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("续期卡密状态无效: %s", renewal.Status),
+		})
+	case key.IsQuota() || renewal.IsQuota():
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "按次计费的卡密不支持续期",
+		})
+	}
+
+	now := time.Now()
+	previousExpired := key.ExpiredAt
+	var expiredAt *time.Time
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// 锁定需要续期的卡密，并发续期时依次在最新的到期时间上累加
+		var locked models.Key
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&locked, key.ID).Error; err != nil {
+			return err
+		}
+		if locked.Status != "used" || locked.IsBlacklisted {
+			return fiber.NewError(fiber.StatusBadRequest, "只能为已激活的卡密续期")
+		}
+		if locked.ExpiredAt == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "永久有效的卡密无需续期")
+		}
+		previousExpired = locked.ExpiredAt
+
+		// 计算新的到期时间
+		start := now
+		if locked.ExpiredAt.After(now) {
+			start = *locked.ExpiredAt
+		}
+		expiredAt = renewal.Duration().ExpiresAt(start.In(utils.LicenseLocation()))
+
+		// 以条件更新的方式占用续期卡密，防止同一张卡密被重复使用
+		result := tx.Model(&models.Key{}).Where("id = ? AND status = ?", renewal.ID, "unused").
+			Updates(map[string]interface{}{
+				"status":       "used",
+				"used_at":      now,
+				"activated_at": now,
+				"expired_at":   expiredAt,
+				"user_id":      key.UserID,
+				"device_info":  fmt.Sprintf("续期卡密#%d", key.ID),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fiber.NewError(fiber.StatusConflict, "续期卡密已被使用")
+		}
+
+		// 将续期卡密的激活归属到对应的销售明细
+		renewal.ActivatedAt = &now
+		if err := markSaleItemActivated(tx, &renewal); err != nil {
+			return err
+		}
+
+		return tx.Model(&models.Key{}).Where("id = ?", key.ID).Update("expired_at", expiredAt).Error
+	})
+	if err != nil {
+		if e, ok := err.(*fiber.Error); ok {
+			return c.Status(e.Code).JSON(fiber.Map{
+				"error": e.Message,
+			})
+		}
+		log.Printf("续期卡密失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "续期卡密失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"code":    0,
+		"message": "卡密续期成功",
+		"data": fiber.Map{
+			"key_id":           key.ID,
+			"renewal_key_id":   renewal.ID,
+			"previous_expired": previousExpired,
+			"expired_at":       expiredAt,
+			"duration":         renewal.Duration(),
+			"permanent":        expiredAt == nil,
+		},
+	})
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"log"
 	"strconv"
 
@@ -29,6 +30,39 @@ func CreateKeyType(c *fiber.Ctx) error {
 		})
 	}
 
+	// 验证佣金确认策略
+	if !models.IsValidCommissionPolicy(keyType.CommissionPolicy) || keyType.CommissionHoldDays < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的佣金确认策略，可选值：generation, activation, activation_hold",
+		})
+	}
+
+	// 验证计费方式，按次计费的卡密类型必须设置可用次数
+	if err := validateBillingMode(keyType.BillingMode, keyType.Quota); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if !keyType.IsQuota() {
+		keyType.BillingMode = models.BillingModeTime
+		keyType.Quota = 0
+	}
+
+	// 验证有效期，未设置有效期单位时按hours计算
+	if keyType.DurationUnit == "" {
+		keyType.DurationUnit = models.DurationUnitHour
+		keyType.DurationAmount = keyType.Hours
+	}
+	duration, err := normalizeKeyTypeDuration(keyType.Duration(), keyType.IsQuota())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	keyType.DurationUnit = duration.Unit
+	keyType.DurationAmount = duration.Amount
+	keyType.Hours = duration.Hours()
+
 	// 验证卡密类型名称是否已存在
 	var existingKeyType models.KeyType
 	result := database.GetDB().Where("name = ?", keyType.Name).First(&existingKeyType)
@@ -50,8 +84,13 @@ func CreateKeyType(c *fiber.Ctx) error {
 	}
 	keyType.IsActive = true // 默认启用
 
-	// 保存卡密类型到数据库
-	if err := database.GetDB().Create(&keyType).Error; err != nil {
+	// 保存卡密类型到数据库，同时记录初始价格版本
+	if err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&keyType).Error; err != nil {
+			return err
+		}
+		return recordKeyTypePrice(tx, &keyType, "初始价格")
+	}); err != nil {
 		log.Printf("创建卡密类型失败: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "创建卡密类型失败: " + err.Error(),
@@ -189,6 +228,35 @@ func UpdateKeyType(c *fiber.Ctx) error {
 		})
 	}
 
+	// 验证佣金确认策略
+	if policy, ok := updates["commission_policy"]; ok {
+		if policyStr, isStr := policy.(string); !isStr || !models.IsValidCommissionPolicy(policyStr) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "无效的佣金确认策略，可选值：generation, activation, activation_hold",
+			})
+		}
+	}
+	if holdDays, ok := updates["commission_hold_days"]; ok {
+		if value, isNumber := holdDays.(float64); !isNumber || value < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "佣金冻结天数不能为负数",
+			})
+		}
+	}
+
+	// 验证价格，直接修改价格会记录一个立即生效的常规价格版本
+	price, priceChanged := updates["price"]
+	if priceChanged {
+		if value, isNumber := price.(float64); !isNumber || value < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "价格必须为不小于0的数字",
+			})
+		}
+	}
+
 	// 检查卡密类型是否存在
 	var keyType models.KeyType
 	if err := database.GetDB().First(&keyType, id).Error; err != nil {
@@ -198,8 +266,70 @@ func UpdateKeyType(c *fiber.Ctx) error {
 		})
 	}
 
+	// 验证计费方式，只影响之后生成的卡密，已生成的卡密保留生成时的次数
+	_, modeChanged := updates["billing_mode"]
+	_, quotaChanged := updates["quota"]
+	if modeChanged || quotaChanged {
+		mode, quota := keyType.BillingMode, keyType.Quota
+		if modeChanged {
+			mode, _ = updates["billing_mode"].(string)
+		}
+		if quotaChanged {
+			value, _ := updates["quota"].(float64)
+			quota = int(value)
+		}
+		if err := validateBillingMode(mode, quota); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+	}
+
+	// 验证有效期，只修改hours时按小时计算，hours始终与有效期保持一致
+	_, unitChanged := updates["duration_unit"]
+	_, amountChanged := updates["duration_amount"]
+	_, hoursChanged := updates["hours"]
+	if unitChanged || amountChanged || hoursChanged {
+		duration := keyType.Duration()
+		if unitChanged {
+			duration.Unit, _ = updates["duration_unit"].(string)
+		}
+		if amountChanged {
+			value, _ := updates["duration_amount"].(float64)
+			duration.Amount = int(value)
+		}
+		if hoursChanged && !unitChanged && !amountChanged {
+			value, _ := updates["hours"].(float64)
+			duration = models.KeyDuration{Unit: models.DurationUnitHour, Amount: int(value)}
+		}
+		isQuota := keyType.IsQuota()
+		if mode, ok := updates["billing_mode"]; ok {
+			isQuota = mode == models.BillingModeQuota
+		}
+		duration, err := normalizeKeyTypeDuration(duration, isQuota)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		updates["duration_unit"] = duration.Unit
+		updates["duration_amount"] = duration.Amount
+		updates["hours"] = duration.Hours()
+	}
+
 	// 更新卡密类型
-	if err := database.GetDB().Model(&keyType).Updates(updates).Error; err != nil {
+	if err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&keyType).Updates(updates).Error; err != nil {
+			return err
+		}
+		if !priceChanged {
+			return nil
+		}
+		keyType.Price = price.(float64)
+		return recordKeyTypePrice(tx, &keyType, "修改卡密类型价格")
+	}); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"success": false,
 			"error":   "更新卡密类型失败: " + err.Error(),
@@ -221,7 +351,9 @@ func UpdateKeyType(c *fiber.Ctx) error {
 	})
 }
 
-// DeleteKeyType 删除卡密类型
+// DeleteKeyType 删除卡密类型（软删除）
+// 存在未使用的卡密、有效的软件绑定或销售员产品分配时拒绝删除，
+// 查询参数cascade=true时作废未使用的卡密并停用绑定和产品分配后删除
 func DeleteKeyType(c *fiber.Ctx) error {
 	// 获取路径参数
 	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
@@ -241,33 +373,109 @@ func DeleteKeyType(c *fiber.Ctx) error {
 		})
 	}
 
-	// 检查是否有关联的卡密
-	var count int64
-	if err := database.GetDB().Model(&models.Key{}).Where("type_id = ?", id).Count(&count).Error; err != nil {
+	// 检查关联数据：未售出的卡密、含有未使用卡密的销售记录、有效的软件绑定和销售员产品分配
+	// 已使用和已作废的卡密作为历史记录保留，不影响删除
+	db := database.GetDB()
+	dependencies, err := countDependencies(productDependencyChecks(db, "key_type_id", keyType.ID)...)
+	if err != nil {
+		log.Printf("检查卡密类型关联数据失败: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"success": false,
-			"error":   "检查关联卡密失败: " + err.Error(),
+			"error":   "检查关联数据失败: " + err.Error(),
+		})
+	}
+	cascade := c.QueryBool("cascade")
+	if len(dependencies) > 0 && !cascade {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success":      false,
+			"error":        "卡密类型存在关联数据，请先处理或使用cascade=true级联删除",
+			"dependencies": dependencies,
 		})
 	}
 
-	if count > 0 {
+	// 软删除卡密类型，级联时作废未售出的未使用卡密并停用绑定和产品分配
+	var result cascadeResult
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if cascade {
+			var err error
+			if result, err = cascadeProductDependencies(tx, "key_type_id", keyType.ID); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&keyType).Error
+	})
+	if err != nil {
+		log.Printf("删除卡密类型失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "删除卡密类型失败: " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "卡密类型删除成功",
+		"cascade": result,
+	})
+}
+
+// RestoreKeyType 恢复已删除的卡密类型
+// 级联删除时作废的卡密和停用的绑定、产品分配不会自动恢复
+func RestoreKeyType(c *fiber.Ctx) error {
+	// 获取路径参数
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"success": false,
-			"error":   "该卡密类型下存在卡密，无法删除",
+			"error":   "无效的ID: " + err.Error(),
 		})
 	}
 
-	// 删除卡密类型
-	if err := database.GetDB().Delete(&keyType).Error; err != nil {
+	// 查询已删除的卡密类型
+	var keyType models.KeyType
+	if err := database.GetDB().Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id).First(&keyType).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "卡密类型不存在或未被删除",
+			})
+		}
+		log.Printf("查询卡密类型失败: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"success": false,
-			"error":   "删除卡密类型失败: " + err.Error(),
+			"error":   "查询卡密类型失败",
+		})
+	}
+
+	// 删除后可能已经创建了同名卡密类型
+	var count int64
+	if err := database.GetDB().Model(&models.KeyType{}).Where("name = ?", keyType.Name).Count(&count).Error; err != nil {
+		log.Printf("查询卡密类型失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "查询卡密类型失败",
+		})
+	}
+	if count > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "已存在同名卡密类型，无法恢复",
 		})
 	}
 
+	if err := database.GetDB().Unscoped().Model(&keyType).Update("deleted_at", nil).Error; err != nil {
+		log.Printf("恢复卡密类型失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "恢复卡密类型失败",
+		})
+	}
+	keyType.DeletedAt = gorm.DeletedAt{}
+
 	return c.JSON(fiber.Map{
 		"success": true,
-		"message": "卡密类型删除成功",
+		"message": "卡密类型恢复成功",
+		"data":    keyType,
 	})
 }
 
@@ -364,3 +572,26 @@ func DeactivateKeyType(c *fiber.Ctx) error {
 		"data":    keyType,
 	})
 }
+
+// validateBillingMode 验证计费方式和按次计费的可用次数
+func validateBillingMode(mode string, quota int) error {
+	if !models.IsValidBillingMode(mode) {
+		return errors.New("无效的计费方式，可选值：time, quota")
+	}
+	if mode == models.BillingModeQuota && quota <= 0 {
+		return errors.New("按次计费的卡密类型必须设置大于0的可用次数")
+	}
+	return nil
+}
+
+// normalizeKeyTypeDuration 规范化并验证卡密类型的有效期
+// 永久有效的数量统一为0；按次计费且有效期为0小时表示不限时间，转换为永久有效
+func normalizeKeyTypeDuration(duration models.KeyDuration, isQuota bool) (models.KeyDuration, error) {
+	if isQuota && duration.Unit == models.DurationUnitHour && duration.Amount == 0 {
+		duration.Unit = models.DurationUnitPermanent
+	}
+	if duration.IsPermanent() {
+		duration.Amount = 0
+	}
+	return duration, duration.Validate()
+}
@@ -0,0 +1,373 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"go_creation/database"
+	"go_creation/models"
+)
+
+// resolveKeyTypePrice 返回卡密类型在指定时间的价格和对应的价格版本
+// 有效的促销价格优先于常规价格，多个同时有效时使用生效时间最晚的一个
+// 没有任何价格版本时返回卡密类型上的价格，价格版本为nil
+func resolveKeyTypePrice(db *gorm.DB, keyType *models.KeyType, at time.Time) (float64, *models.KeyTypePrice, error) {
+	var promotion models.KeyTypePrice
+	err := db.Where("key_type_id = ? AND kind = ? AND effective_from <= ? AND effective_until > ?",
+		keyType.ID, models.KeyTypePricePromotion, at, at).
+		Order("effective_from DESC, id DESC").First(&promotion).Error
+	if err == nil {
+		return promotion.Price, &promotion, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return 0, nil, err
+	}
+
+	var regular models.KeyTypePrice
+	err = db.Where("key_type_id = ? AND kind = ? AND effective_from <= ?", keyType.ID, models.KeyTypePriceRegular, at).
+		Order("effective_from DESC, id DESC").First(&regular).Error
+	if err == nil {
+		return regular.Price, &regular, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return 0, nil, err
+	}
+	return keyType.Price, nil, nil
+}
+
+// effectiveKeyTypePriceSQL 在SQL中按resolveKeyTypePrice的规则计算卡密类型kt在指定时间的价格
+// 依次使用有效的促销价格、已生效的常规价格和卡密类型上的价格，时间通过命名参数@at传入
+const effectiveKeyTypePriceSQL = `COALESCE(
+	(SELECT ktp.price FROM key_type_prices ktp WHERE ktp.key_type_id = kt.id AND ktp.kind = 'promotion'
+		AND ktp.effective_from <= @at AND ktp.effective_until > @at ORDER BY ktp.effective_from DESC, ktp.id DESC LIMIT 1),
+	(SELECT ktp.price FROM key_type_prices ktp WHERE ktp.key_type_id = kt.id AND ktp.kind = 'regular'
+		AND ktp.effective_from <= @at ORDER BY ktp.effective_from DESC, ktp.id DESC LIMIT 1),
+	kt.price)`
+
+// resolveProductPrice 返回软件下卡密类型当前的实际价格和使用的价格版本ID
+// 软件绑定上的价格覆盖优先于卡密类型的价格版本，此时价格版本ID为nil
+func resolveProductPrice(db *gorm.DB, binding *models.SoftwareKeyType, keyType *models.KeyType) (float64, *uint, error) {
+	if binding != nil && binding.Price != nil {
+		return *binding.Price, nil, nil
+	}
+	price, version, err := resolveKeyTypePrice(db, keyType, time.Now())
+	if err != nil || version == nil {
+		return price, nil, err
+	}
+	return price, &version.ID, nil
+}
+
+// recordKeyTypePrice 记录立即生效的常规价格，创建卡密类型和直接修改价格时调用
+func recordKeyTypePrice(tx *gorm.DB, keyType *models.KeyType, note string) error {
+	return tx.Create(&models.KeyTypePrice{
+		KeyTypeID:     keyType.ID,
+		Kind:          models.KeyTypePriceRegular,
+		Price:         keyType.Price,
+		EffectiveFrom: time.Now(),
+		Note:          note,
+		CreatorID:     keyType.CreatorID,
+	}).Error
+}
+
+// ApplyScheduledKeyTypePrices 将已到生效时间的计划调价同步到卡密类型的价格上
+// 卡密类型的price字段始终为当前的常规价格，促销价格不会写入该字段
+// 返回价格发生变化的卡密类型数量
+func ApplyScheduledKeyTypePrices(db *gorm.DB) (int64, error) {
+	// 只查询每个卡密类型最新生效的常规价格，查询量不随价格历史增长
+	now := time.Now()
+	latest := db.Model(&models.KeyTypePrice{}).
+		Select("key_type_id, MAX(effective_from) AS effective_from").
+		Where("kind = ? AND effective_from <= ?", models.KeyTypePriceRegular, now).
+		Group("key_type_id")
+
+	var versions []models.KeyTypePrice
+	if err := db.Model(&models.KeyTypePrice{}).Select("key_type_prices.*").
+		Joins("JOIN (?) latest ON latest.key_type_id = key_type_prices.key_type_id AND latest.effective_from = key_type_prices.effective_from", latest).
+		Where("key_type_prices.kind = ?", models.KeyTypePriceRegular).
+		Order("key_type_prices.key_type_id, key_type_prices.id DESC").Find(&versions).Error; err != nil {
+		return 0, err
+	}
+
+	var updated int64
+	current := make(map[uint]bool)
+	for _, version := range versions {
+		// 生效时间相同的多个版本以最后创建的为准，每个卡密类型的第一条即为当前价格
+		if current[version.KeyTypeID] {
+			continue
+		}
+		current[version.KeyTypeID] = true
+
+		result := db.Model(&models.KeyType{}).Where("id = ? AND price <> ?", version.KeyTypeID, version.Price).
+			Update("price", version.Price)
+		if result.Error != nil {
+			return updated, result.Error
+		}
+		updated += result.RowsAffected
+	}
+	return updated, nil
+}
+
+// keyTypePriceRequest 新增价格版本的请求参数
+type keyTypePriceRequest struct {
+	Kind           string     `json:"kind"`            // 价格类型，默认为regular
+	Price          *float64   `json:"price"`           // 价格，必填
+	EffectiveFrom  *time.Time `json:"effective_from"`  // 生效时间，为空表示立即生效
+	EffectiveUntil *time.Time `json:"effective_until"` // 结束时间，促销价格必填
+	Note           string     `json:"note"`            // 调价说明
+	CreatorID      uint       `json:"creator_id"`      // 创建者ID
+}
+
+// toPrice 校验请求参数并生成价格版本
+// 生效时间不能早于当前时间，已经过去的价格不允许补录或修改
+func (r *keyTypePriceRequest) toPrice(keyTypeID uint, now time.Time) (*models.KeyTypePrice, error) {
+	if r.Kind == "" {
+		r.Kind = models.KeyTypePriceRegular
+	}
+	if !models.IsValidKeyTypePriceKind(r.Kind) {
+		return nil, errors.New("无效的价格类型，可选值：regular, promotion")
+	}
+	if r.Price == nil || *r.Price < 0 {
+		return nil, errors.New("价格不能为空且不能为负数")
+	}
+
+	effectiveFrom := now
+	if r.EffectiveFrom != nil {
+		if r.EffectiveFrom.Before(now.Add(-time.Minute)) {
+			return nil, errors.New("生效时间不能早于当前时间")
+		}
+		if r.EffectiveFrom.After(now) {
+			effectiveFrom = *r.EffectiveFrom
+		}
+	}
+
+	switch r.Kind {
+	case models.KeyTypePricePromotion:
+		if r.EffectiveUntil == nil || !r.EffectiveUntil.After(effectiveFrom) {
+			return nil, errors.New("促销价格的结束时间必须晚于生效时间")
+		}
+	case models.KeyTypePriceRegular:
+		if r.EffectiveUntil != nil {
+			return nil, errors.New("常规价格没有结束时间，限时价格请使用promotion类型")
+		}
+	}
+
+	return &models.KeyTypePrice{
+		KeyTypeID:      keyTypeID,
+		Kind:           r.Kind,
+		Price:          *r.Price,
+		EffectiveFrom:  effectiveFrom,
+		EffectiveUntil: r.EffectiveUntil,
+		Note:           r.Note,
+		CreatorID:      r.CreatorID,
+	}, nil
+}
+
+// parsePriceTime 解析查询参数中的时间，支持RFC3339和日期格式，日期格式表示当天结束时的价格
+func parsePriceTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.Add(24*time.Hour - time.Second), nil
+}
+
+// findKeyType 根据路径参数id查询卡密类型，查询失败时写入错误响应并返回nil
+func findKeyType(c *fiber.Ctx) (*models.KeyType, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "无效的卡密类型ID",
+		})
+	}
+
+	var keyType models.KeyType
+	if err := database.GetDB().First(&keyType, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "卡密类型不存在",
+			})
+		}
+		log.Printf("查询卡密类型失败: %v", err)
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "查询卡密类型失败",
+		})
+	}
+	return &keyType, nil
+}
+
+// GetKeyTypePrices 获取卡密类型的价格历史
+// 查询参数at指定时间（RFC3339或2006-01-02），返回该时间的有效价格，默认为当前时间
+func GetKeyTypePrices(c *fiber.Ctx) error {
+	keyType, err := findKeyType(c)
+	if keyType == nil {
+		return err
+	}
+
+	at := time.Now()
+	if value := c.Query("at"); value != "" {
+		if at, err = parsePriceTime(value); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"success": false,
+				"error":   "无效的时间格式，请使用RFC3339或2006-01-02格式",
+			})
+		}
+	}
+
+	db := database.GetDB()
+	var history []models.KeyTypePrice
+	if err := db.Where("key_type_id = ?", keyType.ID).Order("effective_from DESC, id DESC").Find(&history).Error; err != nil {
+		log.Printf("查询价格历史失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "查询价格历史失败",
+		})
+	}
+
+	price, version, err := resolveKeyTypePrice(db, keyType, at)
+	if err != nil {
+		log.Printf("查询有效价格失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "查询有效价格失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data": fiber.Map{
+			"key_type_id":   keyType.ID,
+			"at":            at,
+			"price":         price,
+			"price_version": version,
+			"history":       history,
+		},
+	})
+}
+
+// CreateKeyTypePrice 新增卡密类型的价格版本
+// 生效时间在未来的常规价格为计划调价，到期后由后台任务同步到卡密类型；促销价格只在指定时间段内有效
+func CreateKeyTypePrice(c *fiber.Ctx) error {
+	keyType, err := findKeyType(c)
+	if keyType == nil {
+		return err
+	}
+
+	var req keyTypePriceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "参数解析失败: " + err.Error(),
+		})
+	}
+
+	now := time.Now()
+	price, err := req.toPrice(keyType.ID, now)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   err.Error(),
+		})
+	}
+
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(price).Error; err != nil {
+			return err
+		}
+		// 立即生效的常规价格同步到卡密类型
+		if price.Kind == models.KeyTypePriceRegular && !price.EffectiveFrom.After(now) {
+			return tx.Model(keyType).Update("price", price.Price).Error
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("创建价格版本失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "创建价格版本失败",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"success": true,
+		"message": "价格版本创建成功",
+		"data":    price,
+	})
+}
+
+// DeleteKeyTypePrice 取消价格版本
+// 尚未生效的价格版本直接删除；进行中的促销提前结束；已生效的常规价格属于价格历史，不允许删除
+func DeleteKeyTypePrice(c *fiber.Ctx) error {
+	keyType, err := findKeyType(c)
+	if keyType == nil {
+		return err
+	}
+
+	priceID, err := strconv.ParseUint(c.Params("price_id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "无效的价格版本ID",
+		})
+	}
+
+	db := database.GetDB()
+	var price models.KeyTypePrice
+	if err := db.Where("id = ? AND key_type_id = ?", priceID, keyType.ID).First(&price).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "价格版本不存在",
+			})
+		}
+		log.Printf("查询价格版本失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "查询价格版本失败",
+		})
+	}
+
+	now := time.Now()
+	switch {
+	case price.EffectiveFrom.After(now):
+		if err := db.Delete(&price).Error; err != nil {
+			log.Printf("删除价格版本失败: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"success": false,
+				"error":   "删除价格版本失败",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "计划调价已取消",
+		})
+	case price.Kind == models.KeyTypePricePromotion && price.ActiveAt(now):
+		if err := db.Model(&price).Update("effective_until", now).Error; err != nil {
+			log.Printf("结束促销价格失败: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"success": false,
+				"error":   "结束促销价格失败",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "促销已提前结束",
+			"data":    price,
+		})
+	default:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "已生效的价格属于价格历史，不能删除",
+		})
+	}
+}
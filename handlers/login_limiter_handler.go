@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"go_creation/utils"
+)
+
+// GetLoginLockouts 管理员查看登录失败记录
+// 查询参数:
+//   - locked: 为true时只返回处于锁定状态的记录
+//   - scope: 按限制维度过滤（username, ip, username_ip）
+//   - username / ip: 按用户名或IP过滤
+func GetLoginLockouts(c *fiber.Ctx) error {
+	attempts, err := utils.DefaultLoginLimiter.ListAttempts(c.QueryBool("locked"))
+	if err != nil {
+		log.Printf("查询登录失败记录失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询登录失败记录失败",
+		})
+	}
+
+	now := time.Now()
+	scopeFilter, usernameFilter, ipFilter := c.Query("scope"), c.Query("username"), c.Query("ip")
+	result := make([]fiber.Map, 0, len(attempts))
+	for _, attempt := range attempts {
+		scope, username, ip := utils.ParseLoginLimitKey(attempt.Key)
+		if (scopeFilter != "" && scope != scopeFilter) ||
+			(usernameFilter != "" && username != usernameFilter) ||
+			(ipFilter != "" && ip != ipFilter) {
+			continue
+		}
+
+		item := fiber.Map{
+			"key":      attempt.Key,
+			"scope":    scope,
+			"username": username,
+			"ip":       ip,
+			"count":    attempt.Count,
+			"last_try": attempt.LastTry,
+			"locked":   false,
+		}
+		if !attempt.LockUntil.IsZero() {
+			item["lock_until"] = attempt.LockUntil
+			item["locked"] = attempt.Locked(now)
+		}
+		result = append(result, item)
+	}
+
+	return c.JSON(fiber.Map{
+		"total": len(result),
+		"data":  result,
+	})
+}
+
+// ClearLoginLockouts 管理员清除登录失败记录和锁定
+// 请求体可以指定key清除单条记录，或指定username、ip清除相关的所有记录
+func ClearLoginLockouts(c *fiber.Ctx) error {
+	var request struct {
+		Key      string `json:"key"`
+		Username string `json:"username"`
+		IP       string `json:"ip"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+	if request.Key == "" && request.Username == "" && request.IP == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "必须指定key、username或ip",
+		})
+	}
+
+	cleared, err := utils.DefaultLoginLimiter.ClearAttempts(request.Key, request.Username, request.IP)
+	if err != nil {
+		log.Printf("清除登录失败记录失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "清除登录失败记录失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "已清除登录锁定",
+		"cleared": cleared,
+	})
+}
@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"go_creation/database"
+	"go_creation/models"
+	"go_creation/utils"
+)
+
+// 密码重置相关配置
+const (
+	passwordResetTTL      = 30 * time.Minute // 重置令牌有效期
+	passwordResetInterval = time.Minute      // 同一账号两次申请重置的最小间隔
+	minPasswordLength     = 6                // 密码最小长度
+)
+
+// validatePassword 验证新密码是否符合要求
+func validatePassword(password string) error {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return fmt.Errorf("密码长度不能少于%d位", minPasswordLength)
+	}
+	return nil
+}
+
+// setSalespersonPassword 修改销售员密码并清除强制修改密码标记
+// exceptSessionID不为空时保留该会话，其余登录会话和所有API密钥全部撤销
+func setSalespersonPassword(tx *gorm.DB, salesperson *models.Salesperson, newPassword, exceptSessionID string) error {
+	if err := salesperson.SetPassword(newPassword); err != nil {
+		return fmt.Errorf("密码加密失败: %w", err)
+	}
+
+	now := time.Now()
+	if err := tx.Model(&models.Salesperson{}).Where("id = ?", salesperson.ID).
+		Updates(map[string]interface{}{
+			"password":             salesperson.Password,
+			"must_change_password": false,
+			"password_changed_at":  now,
+		}).Error; err != nil {
+		return fmt.Errorf("更新密码失败: %w", err)
+	}
+	salesperson.MustChangePassword = false
+	salesperson.PasswordChangedAt = &now
+
+	// 撤销登录会话，已登录的设备需要使用新密码重新登录
+	if err := revokeSessions(tx, salesperson.ID, exceptSessionID, "password_changed"); err != nil {
+		return fmt.Errorf("撤销登录会话失败: %w", err)
+	}
+
+	// 撤销API密钥，账号泄露时已签发的密钥同样不能继续使用，需要重新创建
+	if err := tx.Model(&models.SalespersonAPIKey{}).
+		Where("salesperson_id = ? AND revoked_at IS NULL", salesperson.ID).
+		Update("revoked_at", now).Error; err != nil {
+		return fmt.Errorf("撤销API密钥失败: %w", err)
+	}
+
+	return nil
+}
+
+// ForgotPassword 申请重置密码
+// 根据用户名查找销售员，通过邮件（优先）或短信发送一次性重置令牌
+// 无论账号是否存在都返回相同的结果，避免泄露账号信息
+func ForgotPassword(c *fiber.Ctx) error {
+	var request struct {
+		Username string `json:"username"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+	if request.Username == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "用户名不能为空",
+		})
+	}
+
+	response := fiber.Map{
+		"message": "如果账号存在且绑定了邮箱或手机，重置令牌已发送",
+	}
+
+	var salesperson models.Salesperson
+	if err := database.GetDB().Where("username = ? AND status = ?", request.Username, "active").First(&salesperson).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			log.Printf("查询销售员失败: %v", err)
+		}
+		return c.JSON(response)
+	}
+
+	// 优先通过邮件发送，没有邮箱时通过短信发送
+	channel, to := utils.ChannelEmail, salesperson.Email
+	if to == "" {
+		channel, to = utils.ChannelSMS, salesperson.Phone
+	}
+	if to == "" {
+		log.Printf("销售员(ID:%d)未绑定邮箱或手机，无法发送重置令牌", salesperson.ID)
+		return c.JSON(response)
+	}
+
+	// 限制申请频率
+	var recent int64
+	if err := database.GetDB().Model(&models.SalespersonPasswordReset{}).
+		Where("salesperson_id = ? AND created_at > ?", salesperson.ID, time.Now().Add(-passwordResetInterval)).
+		Count(&recent).Error; err != nil {
+		log.Printf("查询重置记录失败: %v", err)
+		return c.JSON(response)
+	}
+	if recent > 0 {
+		return c.JSON(response)
+	}
+
+	token, err := utils.GenerateSecureToken()
+	if err != nil {
+		log.Printf("生成重置令牌失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "申请重置密码失败，请稍后重试",
+		})
+	}
+
+	now := time.Now()
+	reset := models.SalespersonPasswordReset{
+		SalespersonID: salesperson.ID,
+		TokenHash:     utils.HashToken(token),
+		Channel:       channel,
+		IP:            c.IP(),
+		ExpiredAt:     now.Add(passwordResetTTL),
+	}
+
+	// 新令牌生效时，之前未使用的令牌全部作废
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.SalespersonPasswordReset{}).
+			Where("salesperson_id = ? AND used_at IS NULL AND expired_at > ?", salesperson.ID, now).
+			Update("expired_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Create(&reset).Error
+	})
+	if err != nil {
+		log.Printf("保存重置令牌失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "申请重置密码失败，请稍后重试",
+		})
+	}
+
+	data := fiber.Map{
+		"Name":           salesperson.Name,
+		"Token":          token,
+		"ResetURL":       "",
+		"ExpiresMinutes": int(passwordResetTTL.Minutes()),
+	}
+	// 配置了重置密码页面地址时附带链接
+	if resetURL := os.Getenv("PASSWORD_RESET_URL"); resetURL != "" {
+		data["ResetURL"] = resetURL + "?token=" + url.QueryEscape(token)
+	}
+
+	msg, err := utils.RenderNotification("password_reset", channel, to, data)
+	if err == nil {
+		err = utils.GetNotifier(channel).Send(msg)
+	}
+	if err != nil {
+		log.Printf("发送重置令牌给销售员(ID:%d)失败: %v", salesperson.ID, err)
+	}
+
+	return c.JSON(response)
+}
+
+// ResetPassword 使用重置令牌设置新密码
+// 令牌只能使用一次，重置成功后该账号所有设备的登录会话和所有API密钥都会被撤销
+func ResetPassword(c *fiber.Ctx) error {
+	var request struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+	if request.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "重置令牌不能为空",
+		})
+	}
+	if err := validatePassword(request.NewPassword); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var reset models.SalespersonPasswordReset
+	if err := database.GetDB().Where("token_hash = ? AND used_at IS NULL AND expired_at > ?", utils.HashToken(request.Token), time.Now()).
+		First(&reset).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "重置令牌无效或已过期",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询重置令牌失败: " + err.Error(),
+		})
+	}
+
+	var salesperson models.Salesperson
+	if err := database.GetDB().Where("id = ? AND status = ?", reset.SalespersonID, "active").First(&salesperson).Error; err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "重置令牌无效或已过期",
+		})
+	}
+
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		// 以条件更新的方式使用令牌，防止同一令牌被并发使用
+		result := tx.Model(&models.SalespersonPasswordReset{}).
+			Where("id = ? AND used_at IS NULL", reset.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "重置令牌无效或已过期")
+		}
+
+		return setSalespersonPassword(tx, &salesperson, request.NewPassword, "")
+	})
+	if err != nil {
+		if e, ok := err.(*fiber.Error); ok {
+			return c.Status(e.Code).JSON(fiber.Map{
+				"error": e.Message,
+			})
+		}
+		log.Printf("重置密码失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "重置密码失败，请稍后重试",
+		})
+	}
+
+	// 重置成功后解除登录锁定
+	if _, err := utils.DefaultLoginLimiter.ClearAttempts("", salesperson.Username, ""); err != nil {
+		log.Printf("解除登录锁定失败: %v", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "密码重置成功，请使用新密码登录",
+	})
+}
+
+// ChangePassword 已登录的销售员修改自己的密码
+// 需要提供原密码，修改成功后当前设备保持登录，其他设备的登录会话和所有API密钥被撤销
+func ChangePassword(c *fiber.Ctx) error {
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
+		})
+	}
+	salespersonID := auth.SalespersonID
+
+	var request struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+	if request.OldPassword == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "原密码不能为空",
+		})
+	}
+	if err := validatePassword(request.NewPassword); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if request.NewPassword == request.OldPassword {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "新密码不能与原密码相同",
+		})
+	}
+
+	var salesperson models.Salesperson
+	if err := database.GetDB().First(&salesperson, salespersonID).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询销售员失败: " + err.Error(),
+		})
+	}
+
+	// 原密码错误与登录失败一样计入失败次数，防止持有访问令牌的人暴力猜测密码
+	if isLocked, minutes := utils.DefaultLoginLimiter.IsLocked(salesperson.Username, c.IP()); isLocked {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error":   "尝试次数过多，账号已被临时锁定",
+			"minutes": minutes,
+		})
+	}
+	if !salesperson.CheckPassword(request.OldPassword) {
+		isLocked, minutes := utils.DefaultLoginLimiter.RecordFailedLogin(salesperson.Username, c.IP())
+		log.Printf("修改密码失败，原因: 原密码错误, 用户名: %s", salesperson.Username)
+		if isLocked {
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error":   "尝试次数过多，账号已被临时锁定",
+				"minutes": minutes,
+			})
+		}
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":              "原密码错误",
+			"remaining_attempts": utils.DefaultLoginLimiter.GetRemainingAttempts(salesperson.Username, c.IP()),
+		})
+	}
+	utils.DefaultLoginLimiter.ResetAttempts(salesperson.Username, c.IP())
+
+	// 保留当前设备的登录会话
+	currentSessionID := auth.SessionID
+
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		return setSalespersonPassword(tx, &salesperson, request.NewPassword, currentSessionID)
+	})
+	if err != nil {
+		log.Printf("修改密码失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "修改密码失败，请稍后重试",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "密码修改成功",
+	})
+}
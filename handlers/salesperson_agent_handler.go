@@ -19,6 +19,9 @@ import (
 // 最大允许的代理层级
 const MaxAgentLevel = 5
 
+// 每个销售员同时存在的待接受邀请数量上限
+const MaxPendingInvitations = 20
+
 // GenerateAgentCode 为销售员生成代理码
 func GenerateAgentCode(c *fiber.Ctx) error {
 	// 获取当前销售员ID
@@ -69,12 +72,13 @@ func GenerateAgentCode(c *fiber.Ctx) error {
 // CreateAgentInvitation 创建代理邀请
 func CreateAgentInvitation(c *fiber.Ctx) error {
 	// 获取当前销售员ID
-	salespersonID, err := strconv.Atoi(c.Get("X-Salesperson-ID"))
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "无效的销售员ID",
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
 		})
 	}
+	salespersonID := auth.SalespersonID
 
 	// 解析请求体
 	var request struct {
@@ -127,6 +131,21 @@ func CreateAgentInvitation(c *fiber.Ctx) error {
 		})
 	}
 
+	// 检查待接受邀请数量是否超过上限
+	var pendingCount int64
+	if err := database.GetDB().Model(&models.SalespersonAgentInvitation{}).
+		Where("inviter_id = ? AND status = ? AND expired_at > ?", salespersonID, "pending", time.Now()).
+		Count(&pendingCount).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询邀请记录失败: " + err.Error(),
+		})
+	}
+	if pendingCount >= MaxPendingInvitations {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": fmt.Sprintf("待接受的邀请最多%d个，请先撤回或等待已有邀请处理", MaxPendingInvitations),
+		})
+	}
+
 	// 检查是否已存在相同邮箱或电话的待处理邀请
 	var existingInvitation models.SalespersonAgentInvitation
 	query := database.GetDB().Where("status = ?", "pending")
@@ -152,7 +171,7 @@ func CreateAgentInvitation(c *fiber.Ctx) error {
 
 	// 创建邀请记录
 	invitation := models.SalespersonAgentInvitation{
-		InviterID:  uint(salespersonID),
+		InviterID:  salespersonID,
 		InviteCode: inviteCode,
 		Email:      request.Email,
 		Phone:      request.Phone,
@@ -166,12 +185,17 @@ func CreateAgentInvitation(c *fiber.Ctx) error {
 		})
 	}
 
-	// TODO: 发送邀请邮件或短信
+	// 发送邀请邮件或短信，发送失败不影响邀请的创建，可以稍后重发
+	if err := deliverInvitation(database.GetDB(), &invitation, &salesperson); err != nil {
+		log.Printf("更新邀请(ID:%d)发送状态失败: %v", invitation.ID, err)
+	}
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
-		"invitation_id": invitation.ID,
-		"invite_code":   inviteCode,
-		"message":       "邀请创建成功",
+		"invitation_id":   invitation.ID,
+		"invite_code":     inviteCode,
+		"delivery_status": invitation.DeliveryStatus,
+		"delivery_error":  invitation.DeliveryError,
+		"message":         "邀请创建成功",
 	})
 }
 
@@ -217,12 +241,13 @@ func AcceptAgentInvitation(c *fiber.Ctx) error {
 	}
 
 	// 获取当前销售员ID
-	salespersonID, err := strconv.Atoi(c.Get("X-Salesperson-ID"))
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "无效的销售员ID",
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
 		})
 	}
+	salespersonID := auth.SalespersonID
 
 	// 查询销售员信息
 	var salesperson models.Salesperson
@@ -250,13 +275,6 @@ func AcceptAgentInvitation(c *fiber.Ctx) error {
 		})
 	}
 
-	// 检查代理层级是否超过限制
-	if inviter.Level >= MaxAgentLevel {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "代理层级已达到最大限制，无法添加更多下级",
-		})
-	}
-
 	// 检查是否已经有上级
 	if salesperson.ParentID != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -264,18 +282,10 @@ func AcceptAgentInvitation(c *fiber.Ctx) error {
 		})
 	}
 
-	// 检查是否形成循环引用（防止A是B的上级，B又成为A的上级）
-	if isCircularReference(invitation.InviterID, uint(salespersonID)) {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "不能接受下级或间接下级的邀请，这会形成循环引用",
-		})
-	}
-
-	// 检查新的层级是否会超过限制
-	newLevel := inviter.Level + 1
-	if newLevel > MaxAgentLevel {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": fmt.Sprintf("接受此邀请会使您的代理层级达到%d，超过最大限制%d", newLevel, MaxAgentLevel),
+	// 检查代理层级和循环引用
+	if ferr := checkAgentAttach(database.GetDB(), &inviter, salesperson.ID); ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
 		})
 	}
 
@@ -301,6 +311,18 @@ func AcceptAgentInvitation(c *fiber.Ctx) error {
 		})
 	}
 
+	// 更新代理层级闭包表，并同步下级的代理层级
+	if err := attachAgentSubtree(tx, inviter.ID, salesperson.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := syncSubtreeLevels(tx, salesperson.ID, salesperson.Level); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
 	// 更新邀请人的下级数量
 	if err := tx.Model(&models.Salesperson{}).Where("id = ?", inviter.ID).
 		UpdateColumn("children_count", gorm.Expr("children_count + 1")).Error; err != nil {
@@ -310,13 +332,23 @@ func AcceptAgentInvitation(c *fiber.Ctx) error {
 	}
 
 	// 更新邀请记录
+	// 以条件更新的方式接受，防止邀请在此期间被撤回
 	now := time.Now()
-	invitation.Status = "accepted"
-	invitation.InviteeID = &salesperson.ID
-	invitation.AcceptedAt = &now
-	if err := tx.Save(&invitation).Error; err != nil {
+	result := tx.Model(&models.SalespersonAgentInvitation{}).
+		Where("id = ? AND status = ?", invitation.ID, "pending").
+		Updates(map[string]interface{}{
+			"status":      "accepted",
+			"invitee_id":  salesperson.ID,
+			"accepted_at": now,
+		})
+	if result.Error != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "更新邀请记录失败: " + err.Error(),
+			"error": "更新邀请记录失败: " + result.Error.Error(),
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "邀请已失效",
 		})
 	}
 
@@ -339,50 +371,63 @@ func AcceptAgentInvitation(c *fiber.Ctx) error {
 	})
 }
 
+// checkAgentAttach 检查能否把销售员（及其下级树）挂到parent之下
+// 检查上级的层级限制、循环引用以及挂上后整个下级树的层级限制
+func checkAgentAttach(db *gorm.DB, parent *models.Salesperson, childID uint) *fiber.Error {
+	// 检查代理层级是否超过限制
+	if parent.Level >= MaxAgentLevel {
+		return fiber.NewError(fiber.StatusBadRequest, "代理层级已达到最大限制，无法添加更多下级")
+	}
+
+	// 检查是否形成循环引用（防止A是B的上级，B又成为A的上级）
+	if isCircularReference(db, parent.ID, childID) {
+		return fiber.NewError(fiber.StatusBadRequest, "不能成为下级或间接下级的下级，这会形成循环引用")
+	}
+
+	// 下级会随自己一起移动，整个下级树都不能超过层级限制
+	newLevel := parent.Level + 1
+	subtreeHeight, err := agentSubtreeHeight(db, childID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	if newLevel+subtreeHeight > MaxAgentLevel {
+		return fiber.NewError(fiber.StatusBadRequest,
+			fmt.Sprintf("代理层级将达到%d，超过最大限制%d", newLevel+subtreeHeight, MaxAgentLevel))
+	}
+
+	return nil
+}
+
 // isCircularReference 检查是否形成循环引用
 // 检查potentialParentID是否是childID的下级或间接下级
-func isCircularReference(potentialParentID, childID uint) bool {
+// 通过代理层级闭包表一次查询完成，db可以是事务
+func isCircularReference(db *gorm.DB, potentialParentID, childID uint) bool {
 	// 如果潜在的上级就是自己，直接返回true
 	if potentialParentID == childID {
 		return true
 	}
 
-	// 查询childID的所有直接下级
-	var children []models.Salesperson
-	if err := database.GetDB().Where("parent_id = ?", childID).Find(&children).Error; err != nil {
+	var count int64
+	if err := db.Model(&models.SalespersonAgentPath{}).
+		Where("ancestor_id = ? AND descendant_id = ?", childID, potentialParentID).
+		Count(&count).Error; err != nil {
 		log.Printf("查询下级失败: %v", err)
 		return false // 查询失败时，为安全起见，不阻止操作
 	}
 
-	// 如果没有下级，则不会形成循环
-	if len(children) == 0 {
-		return false
-	}
-
-	// 检查直接下级
-	for _, child := range children {
-		if child.ID == potentialParentID {
-			return true // 发现循环引用
-		}
-
-		// 递归检查间接下级
-		if isCircularReference(potentialParentID, child.ID) {
-			return true
-		}
-	}
-
-	return false
+	return count > 0
 }
 
 // GetAgentHierarchy 获取代理层级结构
 func GetAgentHierarchy(c *fiber.Ctx) error {
 	// 获取当前销售员ID
-	salespersonID, err := strconv.Atoi(c.Get("X-Salesperson-ID"))
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "无效的销售员ID",
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
 		})
 	}
+	salespersonID := auth.SalespersonID
 
 	// 查询销售员信息
 	var salesperson models.Salesperson
@@ -448,12 +493,13 @@ func GetAgentHierarchy(c *fiber.Ctx) error {
 // GetAgentCommissions 获取代理佣金记录
 func GetAgentCommissions(c *fiber.Ctx) error {
 	// 获取当前销售员ID
-	salespersonID, err := strconv.Atoi(c.Get("X-Salesperson-ID"))
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "无效的销售员ID",
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
 		})
 	}
+	salespersonID := auth.SalespersonID
 
 	// 查询销售员信息
 	var salesperson models.Salesperson
@@ -476,85 +522,55 @@ func GetAgentCommissions(c *fiber.Ctx) error {
 		})
 	}
 
-	// 统计总佣金
-	var totalCommission float64
+	// 统计总佣金和已确认的佣金
+	var totalCommission, recognizedCommission float64
 	for _, commission := range agentCommissions {
 		totalCommission += commission.CommissionAmount
+		recognizedCommission += commission.RecognizedAmount
 	}
 
 	return c.JSON(fiber.Map{
-		"total_commission": totalCommission,
-		"commissions":      agentCommissions,
+		"total_commission":      totalCommission,
+		"recognized_commission": recognizedCommission,
+		"commissions":           agentCommissions,
 	})
 }
 
 // ProcessAgentCommission 在销售记录创建后，处理代理佣金
 // 支持多级代理分佣，每个上级都能获得相应的佣金
-// 使用事务确保数据一致性
-func ProcessAgentCommission(sale models.SalespersonSale, db *gorm.DB) error {
-	// 查询销售员信息
-	var salesperson models.Salesperson
-	if err := db.First(&salesperson, sale.SalespersonID).Error; err != nil {
-		return fmt.Errorf("查询销售员失败: %w", err)
+// 需要在创建销售记录的事务中调用；代理佣金与销售员自己的佣金同步确认：
+// 生成时确认的策略立即计入上级的总佣金，其他策略在销售明细的佣金确认时由recognizeAgentCommissions按明细确认
+func ProcessAgentCommission(sale models.SalespersonSale, tx *gorm.DB) error {
+	// 通过代理层级闭包表一次查出所有上级，按距离从近到远排序
+	var uplines []agentRow
+	if err := tx.Table("salespersons").
+		Select("salespersons.*, p.depth").
+		Joins("JOIN salesperson_agent_paths p ON p.ancestor_id = salespersons.id").
+		Where("p.descendant_id = ? AND p.depth > 0 AND p.depth <= ?", sale.SalespersonID, MaxAgentLevel).
+		Where("salespersons.deleted_at IS NULL").
+		Order("p.depth ASC").
+		Scan(&uplines).Error; err != nil {
+		return fmt.Errorf("查询上级销售员失败: %w", err)
 	}
 
 	// 如果没有上级，则不需要处理代理佣金
-	if salesperson.ParentID == nil {
+	if len(uplines) == 0 {
 		return nil
 	}
 
-	// 开始事务
-	tx := db.Begin()
-	if tx.Error != nil {
-		return fmt.Errorf("开始事务失败: %w", tx.Error)
-	}
-
-	// 使用defer确保事务在函数返回时被正确处理
-	var txCommitted bool
-	defer func() {
-		// 如果事务还没有被提交，则回滚
-		if !txCommitted && tx != nil {
-			tx.Rollback()
-			log.Println("事务已回滚")
-		}
-	}()
+	recognized := sale.CommissionPolicy == models.CommissionPolicyGeneration
 
 	// 处理多级代理佣金
 	// 从直接上级开始，逐级向上处理
 	currentSalespersonID := sale.SalespersonID
-	currentParentID := salesperson.ParentID
-	currentLevel := salesperson.Level
-
-	// 设置最大处理层级，防止无限循环
-	maxLevels := MaxAgentLevel
-	processedLevels := 0
-
-	// 逐级向上处理佣金
-	for currentParentID != nil && processedLevels < maxLevels {
-		// 查询上级销售员
-		var parent models.Salesperson
-		if err := tx.First(&parent, *currentParentID).Error; err != nil {
-			return fmt.Errorf("查询上级销售员(ID:%d)失败: %w", *currentParentID, err)
-		}
-
+	for _, parent := range uplines {
 		// 计算当前层级的佣金
-		// 佣金比例随层级增加而递减
-		var commissionRate float64
-		var commissionAmount float64
-
-		// 直接上级使用设置的佣金比例
-		if currentLevel-1 == parent.Level {
-			commissionRate = parent.ParentCommissionRate
-		} else {
-			// 间接上级佣金比例递减
-			// 每上升一级，佣金比例减半
-			levelDiff := currentLevel - parent.Level - 1
-			divisor := math.Pow(2, float64(levelDiff))
-			commissionRate = parent.ParentCommissionRate / divisor
-		}
+		// 直接上级使用设置的佣金比例，间接上级每上升一级，佣金比例减半
+		divisor := math.Pow(2, float64(parent.Depth-1))
+		commissionRate := parent.ParentCommissionRate / divisor
 
 		// 计算佣金金额
-		commissionAmount = sale.SaleAmount * commissionRate
+		commissionAmount := sale.SaleAmount * commissionRate
 
 		// 如果佣金金额太小，则不再处理
 		if commissionAmount < 0.01 {
@@ -572,31 +588,25 @@ func ProcessAgentCommission(sale models.SalespersonSale, db *gorm.DB) error {
 			CommissionAmount: commissionAmount,
 			Status:           "pending",
 		}
+		if recognized {
+			agentCommission.RecognizedAmount = commissionAmount
+		}
 
 		if err := tx.Create(&agentCommission).Error; err != nil {
 			return fmt.Errorf("创建代理佣金记录失败: %w", err)
 		}
 
-		// 更新上级销售员的总佣金
-		if err := tx.Model(&models.Salesperson{}).Where("id = ?", parent.ID).
-			UpdateColumn("total_commission", gorm.Expr("total_commission + ?", commissionAmount)).Error; err != nil {
-			return fmt.Errorf("更新上级销售员佣金失败: %w", err)
+		// 已确认的佣金计入上级销售员的总佣金
+		if recognized {
+			if err := tx.Model(&models.Salesperson{}).Where("id = ?", parent.ID).
+				UpdateColumn("total_commission", gorm.Expr("total_commission + ?", commissionAmount)).Error; err != nil {
+				return fmt.Errorf("更新上级销售员佣金失败: %w", err)
+			}
 		}
 
 		// 准备处理下一级
 		currentSalespersonID = parent.ID
-		currentParentID = parent.ParentID
-		currentLevel = parent.Level
-		processedLevels++
 	}
 
-	// 提交事务
-	if err := tx.Commit().Error; err != nil {
-		return fmt.Errorf("提交事务失败: %w", err)
-	}
-
-	// 标记事务已提交
-	txCommitted = true
-
 	return nil
 }
@@ -0,0 +1,538 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"go_creation/database"
+	"go_creation/models"
+	"go_creation/utils"
+)
+
+// ensureAgentSelfPath 确保销售员在代理层级闭包表中有指向自己的记录
+func ensureAgentSelfPath(tx *gorm.DB, salespersonID uint) error {
+	path := models.SalespersonAgentPath{AncestorID: salespersonID, DescendantID: salespersonID, Depth: 0}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&path).Error; err != nil {
+		return fmt.Errorf("创建代理层级记录失败: %w", err)
+	}
+	return nil
+}
+
+// attachAgentSubtree 把childID及其整个下级树挂到parentID之下
+// 为parentID的每个上级（包括自己）与childID的每个下级（包括自己）生成一条路径
+func attachAgentSubtree(tx *gorm.DB, parentID, childID uint) error {
+	if err := ensureAgentSelfPath(tx, parentID); err != nil {
+		return err
+	}
+	if err := ensureAgentSelfPath(tx, childID); err != nil {
+		return err
+	}
+
+	if err := tx.Exec(`INSERT INTO salesperson_agent_paths (ancestor_id, descendant_id, depth, created_at)
+		SELECT p.ancestor_id, c.descendant_id, p.depth + c.depth + 1, NOW()
+		FROM salesperson_agent_paths p, salesperson_agent_paths c
+		WHERE p.descendant_id = ? AND c.ancestor_id = ?`, parentID, childID).Error; err != nil {
+		return fmt.Errorf("更新代理层级关系失败: %w", err)
+	}
+	return nil
+}
+
+// agentSubtreeHeight 返回销售员下级树的高度，没有下级时为0
+func agentSubtreeHeight(db *gorm.DB, salespersonID uint) (int, error) {
+	var height int
+	if err := db.Model(&models.SalespersonAgentPath{}).
+		Where("ancestor_id = ?", salespersonID).
+		Select("COALESCE(MAX(depth), 0)").
+		Scan(&height).Error; err != nil {
+		return 0, fmt.Errorf("查询下级层级失败: %w", err)
+	}
+	return height, nil
+}
+
+// syncSubtreeLevels 根据闭包表更新销售员下级树中所有下级的代理层级
+func syncSubtreeLevels(tx *gorm.DB, salespersonID uint, level int) error {
+	if err := tx.Exec(`UPDATE salespersons s
+		JOIN salesperson_agent_paths p ON p.descendant_id = s.id
+		SET s.level = ? + p.depth
+		WHERE p.ancestor_id = ? AND p.depth > 0`, level, salespersonID).Error; err != nil {
+		return fmt.Errorf("更新下级代理层级失败: %w", err)
+	}
+	return nil
+}
+
+// agentTreeNode 代理树节点
+type agentTreeNode struct {
+	ID            uint             `json:"id"`
+	Name          string           `json:"name"`
+	Username      string           `json:"username"`
+	Status        string           `json:"status"`
+	Level         int              `json:"level"`
+	Depth         int              `json:"depth"`
+	ChildrenCount int              `json:"children_count"`
+	Children      []*agentTreeNode `json:"children,omitempty"`
+}
+
+// agentRow 闭包表与销售员表联查的结果
+type agentRow struct {
+	models.Salesperson
+	Depth int
+}
+
+// parseAgentMaxDepth 解析查询的最大层级，默认和上限均为MaxAgentLevel
+func parseAgentMaxDepth(c *fiber.Ctx) (int, error) {
+	maxDepth := c.QueryInt("max_depth", MaxAgentLevel)
+	if maxDepth < 1 {
+		return 0, fmt.Errorf("max_depth必须大于0")
+	}
+	if maxDepth > MaxAgentLevel {
+		maxDepth = MaxAgentLevel
+	}
+	return maxDepth, nil
+}
+
+// buildAgentTree 查询销售员maxDepth层以内的整个下级树
+func buildAgentTree(db *gorm.DB, root models.Salesperson, maxDepth int) (*agentTreeNode, int, error) {
+	var rows []agentRow
+	if err := db.Table("salespersons").
+		Select("salespersons.*, p.depth").
+		Joins("JOIN salesperson_agent_paths p ON p.descendant_id = salespersons.id").
+		Where("p.ancestor_id = ? AND p.depth > 0 AND p.depth <= ?", root.ID, maxDepth).
+		Order("p.depth ASC, salespersons.id ASC").
+		Scan(&rows).Error; err != nil {
+		return nil, 0, fmt.Errorf("查询下级树失败: %w", err)
+	}
+
+	rootNode := &agentTreeNode{
+		ID:            root.ID,
+		Name:          root.Name,
+		Username:      root.Username,
+		Status:        root.Status,
+		Level:         root.Level,
+		ChildrenCount: root.ChildrenCount,
+	}
+
+	// 按层级从浅到深处理，上级节点总是先于下级节点加入
+	nodes := map[uint]*agentTreeNode{root.ID: rootNode}
+	for _, row := range rows {
+		if row.ParentID == nil {
+			continue
+		}
+		parent, ok := nodes[*row.ParentID]
+		if !ok {
+			continue
+		}
+		node := &agentTreeNode{
+			ID:            row.ID,
+			Name:          row.Name,
+			Username:      row.Username,
+			Status:        row.Status,
+			Level:         row.Level,
+			Depth:         row.Depth,
+			ChildrenCount: row.ChildrenCount,
+		}
+		parent.Children = append(parent.Children, node)
+		nodes[row.ID] = node
+	}
+
+	return rootNode, len(nodes) - 1, nil
+}
+
+// getAgentTree 返回销售员的整个下级树
+func getAgentTree(c *fiber.Ctx, salespersonID uint) error {
+	maxDepth, err := parseAgentMaxDepth(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var salesperson models.Salesperson
+	if err := database.GetDB().First(&salesperson, salespersonID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "销售员不存在",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询销售员失败: " + err.Error(),
+		})
+	}
+
+	tree, total, err := buildAgentTree(database.GetDB(), salesperson, maxDepth)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"max_depth":      maxDepth,
+		"total_downline": total,
+		"tree":           tree,
+	})
+}
+
+// GetAgentTree 获取当前销售员的整个下级树
+// 支持max_depth参数限制返回的层级
+func GetAgentTree(c *fiber.Ctx) error {
+	// 获取当前销售员ID
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
+		})
+	}
+
+	return getAgentTree(c, auth.SalespersonID)
+}
+
+// GetSalespersonAgentTree 管理员获取指定销售员的整个下级树
+func GetSalespersonAgentTree(c *fiber.Ctx) error {
+	salespersonID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的销售员ID",
+		})
+	}
+
+	return getAgentTree(c, uint(salespersonID))
+}
+
+// GetAgentUpline 获取当前销售员的上级链，从直接上级到顶级代理
+func GetAgentUpline(c *fiber.Ctx) error {
+	// 获取当前销售员ID
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
+		})
+	}
+	salespersonID := auth.SalespersonID
+
+	var rows []agentRow
+	if err := database.GetDB().Table("salespersons").
+		Select("salespersons.*, p.depth").
+		Joins("JOIN salesperson_agent_paths p ON p.ancestor_id = salespersons.id").
+		Where("p.descendant_id = ? AND p.depth > 0", salespersonID).
+		Order("p.depth ASC").
+		Scan(&rows).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询上级链失败: " + err.Error(),
+		})
+	}
+
+	upline := make([]fiber.Map, 0, len(rows))
+	for _, row := range rows {
+		upline = append(upline, fiber.Map{
+			"id":    row.ID,
+			"name":  row.Name,
+			"level": row.Level,
+			"depth": row.Depth,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"upline": upline,
+	})
+}
+
+// GetAgentDownlineSales 获取当前销售员下级树的销售汇总
+// 每个下级的汇总包含其自身及其所有下级的销售，已取消的销售不计入
+// 支持max_depth、start_date和end_date参数
+func GetAgentDownlineSales(c *fiber.Ctx) error {
+	// 获取当前销售员ID
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
+		})
+	}
+	salespersonID := auth.SalespersonID
+
+	maxDepth, err := parseAgentMaxDepth(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// 汇总范围内每个节点（包括自己）的子树销售
+	type subtreeSales struct {
+		SalespersonID   uint    `json:"salesperson_id"`
+		Name            string  `json:"name"`
+		Depth           int     `json:"depth"`
+		SalesCount      int64   `json:"sales_count"`
+		TotalSales      float64 `json:"total_sales"`
+		TotalCommission float64 `json:"total_commission"`
+	}
+
+	db := database.GetDB()
+	salesJoin := "LEFT JOIN salesperson_sales s ON s.salesperson_id = sub.descendant_id AND s.status <> 'cancelled'"
+	var salesArgs []interface{}
+	if startDate := c.Query("start_date"); startDate != "" {
+		salesJoin += " AND s.created_at >= ?"
+		salesArgs = append(salesArgs, startDate)
+	}
+	if endDate := c.Query("end_date"); endDate != "" {
+		salesJoin += " AND s.created_at <= ?"
+		salesArgs = append(salesArgs, endDate)
+	}
+
+	var results []subtreeSales
+	if err := db.Table("salesperson_agent_paths root").
+		Select("root.descendant_id AS salesperson_id, sp.name, root.depth, "+
+			"COUNT(s.id) AS sales_count, COALESCE(SUM(s.sale_amount), 0) AS total_sales, COALESCE(SUM(s.commission), 0) AS total_commission").
+		Joins("JOIN salespersons sp ON sp.id = root.descendant_id AND sp.deleted_at IS NULL").
+		Joins("JOIN salesperson_agent_paths sub ON sub.ancestor_id = root.descendant_id").
+		Joins(salesJoin, salesArgs...).
+		Where("root.ancestor_id = ? AND root.depth <= ?", salespersonID, maxDepth).
+		Group("root.descendant_id, sp.name, root.depth").
+		Order("root.depth ASC, root.descendant_id ASC").
+		Scan(&results).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询下级销售汇总失败: " + err.Error(),
+		})
+	}
+
+	// 第一行是自己，子树汇总即整个团队的销售
+	response := fiber.Map{
+		"max_depth": maxDepth,
+		"subtrees":  []subtreeSales{},
+	}
+	if len(results) > 0 && results[0].SalespersonID == salespersonID {
+		response["team"] = results[0]
+		response["subtrees"] = results[1:]
+	}
+
+	return c.JSON(response)
+}
+
+// detachAgentSubtree 把salespersonID及其整个下级树从原上级链中分离
+// 删除子树外的上级与子树内节点之间的路径，子树内部的路径保持不变
+func detachAgentSubtree(tx *gorm.DB, salespersonID uint) error {
+	var subtreeIDs []uint
+	if err := tx.Model(&models.SalespersonAgentPath{}).
+		Where("ancestor_id = ?", salespersonID).
+		Pluck("descendant_id", &subtreeIDs).Error; err != nil {
+		return fmt.Errorf("查询下级树失败: %w", err)
+	}
+	if len(subtreeIDs) == 0 {
+		subtreeIDs = []uint{salespersonID}
+	}
+
+	if err := tx.Where("descendant_id IN ? AND ancestor_id NOT IN ?", subtreeIDs, subtreeIDs).
+		Delete(&models.SalespersonAgentPath{}).Error; err != nil {
+		return fmt.Errorf("删除代理层级关系失败: %w", err)
+	}
+	return nil
+}
+
+// moveAgentSubtree 把salespersonID及其整个下级树移动到newParent之下
+// newParent为nil时成为顶级代理，同步更新上级关系、闭包表和所有下级的代理层级
+func moveAgentSubtree(tx *gorm.DB, salespersonID uint, newParent *models.Salesperson) error {
+	if err := detachAgentSubtree(tx, salespersonID); err != nil {
+		return err
+	}
+
+	updates := map[string]interface{}{"parent_id": nil, "level": 0}
+	if newParent != nil {
+		if err := attachAgentSubtree(tx, newParent.ID, salespersonID); err != nil {
+			return err
+		}
+		updates["parent_id"] = newParent.ID
+		updates["level"] = newParent.Level + 1
+	}
+
+	if err := tx.Model(&models.Salesperson{}).Where("id = ?", salespersonID).Updates(updates).Error; err != nil {
+		return fmt.Errorf("更新销售员上级关系失败: %w", err)
+	}
+
+	return syncSubtreeLevels(tx, salespersonID, updates["level"].(int))
+}
+
+// ReparentSalesperson 管理员调整销售员的上级
+// 请求体：
+//   - new_parent_id: 新上级ID，为空时成为顶级代理
+//   - with_subtree: 是否连同下级一起移动，默认true；为false时原下级改挂到原上级之下
+//
+// 调整前产生的代理佣金记录保持原有归属，之后的销售按新的上级链分佣
+func ReparentSalesperson(c *fiber.Ctx) error {
+	salespersonID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的销售员ID",
+		})
+	}
+
+	var request struct {
+		NewParentID *uint `json:"new_parent_id"`
+		WithSubtree *bool `json:"with_subtree"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+	withSubtree := request.WithSubtree == nil || *request.WithSubtree
+
+	// 查询销售员信息
+	var salesperson models.Salesperson
+	if err := database.GetDB().First(&salesperson, salespersonID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "销售员不存在",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询销售员失败: " + err.Error(),
+		})
+	}
+
+	// 检查上级是否发生变化
+	if (request.NewParentID == nil && salesperson.ParentID == nil) ||
+		(request.NewParentID != nil && salesperson.ParentID != nil && *request.NewParentID == *salesperson.ParentID) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "新上级与当前上级相同",
+		})
+	}
+
+	// 查询新上级信息
+	var newParent *models.Salesperson
+	newLevel := 0
+	if request.NewParentID != nil {
+		var parent models.Salesperson
+		if err := database.GetDB().First(&parent, *request.NewParentID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "新上级不存在",
+				})
+			}
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "查询新上级失败: " + err.Error(),
+			})
+		}
+		newParent = &parent
+		newLevel = parent.Level + 1
+	}
+
+	// 开始事务
+	tx := database.GetDB().Begin()
+
+	// 使用defer确保事务在函数返回时被正确处理
+	var txCommitted bool
+	defer func() {
+		// 如果事务还没有被提交，则回滚
+		if !txCommitted && tx != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// 不连同下级移动时，先把直接下级连同其下级树改挂到原上级之下
+	var oldParent *models.Salesperson
+	if salesperson.ParentID != nil {
+		var parent models.Salesperson
+		if err := tx.First(&parent, *salesperson.ParentID).Error; err == nil {
+			oldParent = &parent
+		}
+	}
+
+	var movedChildren int64
+	if !withSubtree {
+		var children []models.Salesperson
+		if err := tx.Where("parent_id = ?", salesperson.ID).Find(&children).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "查询下级失败: " + err.Error(),
+			})
+		}
+		for _, child := range children {
+			if err := moveAgentSubtree(tx, child.ID, oldParent); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+		}
+		movedChildren = int64(len(children))
+	}
+
+	// 检查是否形成循环引用
+	if newParent != nil && isCircularReference(tx, newParent.ID, salesperson.ID) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "不能把销售员移动到自己的下级之下，这会形成循环引用",
+		})
+	}
+
+	// 检查移动后的代理层级是否超过限制
+	subtreeHeight, err := agentSubtreeHeight(tx, salesperson.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if newLevel+subtreeHeight > MaxAgentLevel {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("移动后代理层级将达到%d，超过最大限制%d", newLevel+subtreeHeight, MaxAgentLevel),
+		})
+	}
+
+	// 移动销售员（及其下级树）
+	if err := moveAgentSubtree(tx, salesperson.ID, newParent); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// 更新原上级、新上级和自己的下级数量
+	if oldParent != nil {
+		// 原上级失去自己，但接收了自己的直接下级
+		if err := tx.Model(&models.Salesperson{}).Where("id = ?", oldParent.ID).
+			UpdateColumn("children_count", gorm.Expr("GREATEST(children_count + ? - 1, 0)", movedChildren)).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "更新原上级信息失败: " + err.Error(),
+			})
+		}
+	}
+	if newParent != nil {
+		if err := tx.Model(&models.Salesperson{}).Where("id = ?", newParent.ID).
+			UpdateColumn("children_count", gorm.Expr("children_count + 1")).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "更新新上级信息失败: " + err.Error(),
+			})
+		}
+	}
+	if !withSubtree {
+		if err := tx.Model(&models.Salesperson{}).Where("id = ?", salesperson.ID).
+			UpdateColumn("children_count", 0).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "更新销售员信息失败: " + err.Error(),
+			})
+		}
+	}
+
+	// 提交事务
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "提交事务失败: " + err.Error(),
+		})
+	}
+
+	// 标记事务已提交
+	txCommitted = true
+
+	// 返回调整后的销售员信息
+	if err := database.GetDB().First(&salesperson, salesperson.ID).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询销售员失败: " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "上级调整成功",
+		"with_subtree":   withSubtree,
+		"moved_children": movedChildren,
+		"data":           salesperson,
+	})
+}
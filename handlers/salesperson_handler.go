@@ -5,6 +5,7 @@ import (
 	"log"
 	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -47,9 +48,9 @@ func CreateSalesperson(c *fiber.Ctx) error {
 		})
 	}
 
-	// 验证用户名是否已存在
+	// 验证用户名是否已存在，已删除的销售员仍然占用用户名，以便恢复
 	var existingSalesperson models.Salesperson
-	result := database.GetDB().Where("username = ?", salesperson.Username).First(&existingSalesperson)
+	result := database.GetDB().Unscoped().Where("username = ?", salesperson.Username).First(&existingSalesperson)
 	if result.Error == nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "用户名已存在",
@@ -90,6 +91,11 @@ func CreateSalesperson(c *fiber.Ctx) error {
 		})
 	}
 
+	// 在代理层级闭包表中记录自己
+	if err := ensureAgentSelfPath(database.GetDB(), salesperson.ID); err != nil {
+		log.Printf("初始化代理层级失败: %v", err)
+	}
+
 	// 返回创建成功的销售员信息
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"message": "销售员创建成功",
@@ -224,6 +230,8 @@ func UpdateSalesperson(c *fiber.Ctx) error {
 		Avatar         string  `json:"avatar"`
 		CommissionRate float64 `json:"commission_rate"`
 		Password       string  `json:"password"`
+		// 要求销售员下次登录时修改密码
+		MustChangePassword *bool `json:"must_change_password"`
 	}
 
 	if err := c.BodyParser(&updateData); err != nil {
@@ -253,6 +261,9 @@ func UpdateSalesperson(c *fiber.Ctx) error {
 	if updateData.CommissionRate > 0 {
 		updates["commission_rate"] = updateData.CommissionRate
 	}
+	if updateData.MustChangePassword != nil {
+		updates["must_change_password"] = *updateData.MustChangePassword
+	}
 
 	// 处理密码更新
 	if updateData.Password != "" {
@@ -288,7 +299,8 @@ func UpdateSalesperson(c *fiber.Ctx) error {
 	})
 }
 
-// DeleteSalesperson 删除销售员
+// DeleteSalesperson 删除销售员（软删除）
+// 有下级的销售员不能删除；存在有效的产品分配时拒绝删除，查询参数cascade=true时停用产品分配后删除
 func DeleteSalesperson(c *fiber.Ctx) error {
 	// 获取销售员ID
 	id, err := strconv.Atoi(c.Params("id"))
@@ -312,8 +324,62 @@ func DeleteSalesperson(c *fiber.Ctx) error {
 		})
 	}
 
-	// 执行删除
-	if err := database.GetDB().Delete(&salesperson).Error; err != nil {
+	// 有下级的销售员不能删除，需要先把下级转移到其他上级
+	db := database.GetDB()
+	dependencies, err := countDependencies(
+		dependencyCheck{"children", db.Model(&models.Salesperson{}).Where("parent_id = ?", salesperson.ID)},
+		dependencyCheck{"active_products", db.Model(&models.SalespersonProduct{}).Where("salesperson_id = ? AND is_active = ?", salesperson.ID, true)},
+	)
+	if err != nil {
+		log.Printf("检查销售员关联数据失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "检查销售员关联数据失败",
+		})
+	}
+	if dependencies["children"] > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":        "该销售员还有下级，请先将下级转移到其他上级",
+			"dependencies": dependencies,
+		})
+	}
+	cascade := c.QueryBool("cascade")
+	if len(dependencies) > 0 && !cascade {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":        "销售员存在关联数据，请先处理或使用cascade=true级联删除",
+			"dependencies": dependencies,
+		})
+	}
+
+	// 软删除销售员，同时撤销登录会话和API密钥、减少上级的下级数量
+	// 代理层级记录保留，恢复后重新挂回原上级
+	var deactivatedProducts int64
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if cascade {
+			result := tx.Model(&models.SalespersonProduct{}).
+				Where("salesperson_id = ? AND is_active = ?", salesperson.ID, true).
+				Update("is_active", false)
+			if result.Error != nil {
+				return result.Error
+			}
+			deactivatedProducts = result.RowsAffected
+		}
+		if err := revokeSessions(tx, salesperson.ID, "", "salesperson_deleted"); err != nil {
+			return err
+		}
+		if err := tx.Model(&models.SalespersonAPIKey{}).
+			Where("salesperson_id = ? AND revoked_at IS NULL", salesperson.ID).
+			Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+		if salesperson.ParentID != nil {
+			if err := tx.Model(&models.Salesperson{}).Where("id = ?", *salesperson.ParentID).
+				UpdateColumn("children_count", gorm.Expr("GREATEST(children_count - 1, 0)")).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&salesperson).Error
+	})
+	if err != nil {
 		log.Printf("删除销售员失败: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "删除销售员失败: " + err.Error(),
@@ -322,14 +388,74 @@ func DeleteSalesperson(c *fiber.Ctx) error {
 
 	// 返回成功消息
 	return c.JSON(fiber.Map{
-		"message": "销售员删除成功",
+		"message":              "销售员删除成功",
+		"deactivated_products": deactivatedProducts,
+	})
+}
+
+// RestoreSalesperson 恢复已删除的销售员
+// 恢复后重新挂回原上级；登录会话、API密钥和级联停用的产品分配不会自动恢复
+func RestoreSalesperson(c *fiber.Ctx) error {
+	// 获取销售员ID
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的销售员ID",
+		})
+	}
+
+	// 查询已删除的销售员
+	db := database.GetDB()
+	var salesperson models.Salesperson
+	if err := db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id).First(&salesperson).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "销售员不存在或未被删除",
+			})
+		}
+		log.Printf("查询销售员失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询销售员失败",
+		})
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// 上级也已被删除时需要先恢复上级
+		if salesperson.ParentID != nil {
+			result := tx.Model(&models.Salesperson{}).Where("id = ?", *salesperson.ParentID).
+				UpdateColumn("children_count", gorm.Expr("children_count + 1"))
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return fiber.NewError(fiber.StatusConflict, "上级销售员已被删除，请先恢复上级")
+			}
+		}
+		return tx.Unscoped().Model(&salesperson).Update("deleted_at", nil).Error
+	})
+	if err != nil {
+		if e, ok := err.(*fiber.Error); ok {
+			return c.Status(e.Code).JSON(fiber.Map{
+				"error": e.Message,
+			})
+		}
+		log.Printf("恢复销售员失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "恢复销售员失败",
+		})
+	}
+	salesperson.DeletedAt = gorm.DeletedAt{}
+
+	return c.JSON(fiber.Map{
+		"message": "销售员恢复成功",
+		"data":    salesperson,
 	})
 }
 
 // 处理登录失败响应
 func handleLoginFailure(c *fiber.Ctx, username string, message string) error {
 	// 记录失败的登录尝试
-	isLocked, minutes := utils.DefaultLoginLimiter.RecordFailedLogin(username)
+	isLocked, minutes := utils.DefaultLoginLimiter.RecordFailedLogin(username, c.IP())
 
 	log.Printf("登录失败，原因: %s, 用户名: %s", message, username)
 
@@ -340,7 +466,7 @@ func handleLoginFailure(c *fiber.Ctx, username string, message string) error {
 			"minutes": minutes,
 		}
 	} else {
-		remainingAttempts := utils.DefaultLoginLimiter.GetRemainingAttempts(username)
+		remainingAttempts := utils.DefaultLoginLimiter.GetRemainingAttempts(username, c.IP())
 		response = fiber.Map{
 			"error":              "用户名或密码错误",
 			"remaining_attempts": remainingAttempts,
@@ -351,11 +477,13 @@ func handleLoginFailure(c *fiber.Ctx, username string, message string) error {
 }
 
 // SalespersonLogin 销售员登录
+// 启用两步验证的账号在密码验证通过后返回挑战令牌，需要调用VerifyLoginTwoFactor完成登录
 func SalespersonLogin(c *fiber.Ctx) error {
 	// 解析请求数据
 	var loginData struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+		Username    string `json:"username"`
+		Password    string `json:"password"`
+		NewPassword string `json:"new_password"` // 账号被要求修改密码时，登录同时设置的新密码；启用两步验证时在第二步提供
 	}
 
 	if err := c.BodyParser(&loginData); err != nil {
@@ -373,7 +501,7 @@ func SalespersonLogin(c *fiber.Ctx) error {
 	}
 
 	// 检查登录尝试次数限制
-	isLocked, remainingMinutes := utils.DefaultLoginLimiter.IsLocked(loginData.Username)
+	isLocked, remainingMinutes := utils.DefaultLoginLimiter.IsLocked(loginData.Username, c.IP())
 	if isLocked {
 		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
 			"error":   "登录尝试次数过多，账号已被临时锁定",
@@ -394,6 +522,11 @@ func SalespersonLogin(c *fiber.Ctx) error {
 	}
 
 	// 检查销售员状态
+	if salesperson.Status == "pending" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "账号正在等待审核",
+		})
+	}
 	if salesperson.Status != "active" {
 		log.Printf("登录失败，账号状态非活跃: %s, 状态 %s", loginData.Username, salesperson.Status)
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
@@ -401,42 +534,69 @@ func SalespersonLogin(c *fiber.Ctx) error {
 		})
 	}
 
-	// 重置登录尝试次数
-	utils.DefaultLoginLimiter.ResetAttempts(loginData.Username)
-
-	// 懒惰删除：清理该用户的过期令牌
-	if err := database.GetDB().Where("salesperson_id = ? AND expired_at < ?", salesperson.ID, time.Now()).Delete(&models.SalespersonToken{}).Error; err != nil {
-		log.Printf("删除过期令牌失败: %v", err)
-		// 不返回错误，继续处理
+	// 启用两步验证时只签发登录挑战，客户端凭挑战令牌和验证码或恢复码在第二步完成登录
+	// 密码正确但第二步尚未完成，登录失败次数在第二步成功后才重置
+	if salesperson.TwoFactorEnabled {
+		return issueLoginChallenge(c, &salesperson)
 	}
 
-	// 生成JWT令牌，有效期24小时
-	token, err := utils.GenerateToken(salesperson.ID, salesperson.Username, 24*time.Hour)
-	if err != nil {
-		log.Printf("生成令牌失败: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "登录失败，请稍后重试",
+	// 账号被要求修改密码时，必须在登录时同时设置新密码
+	if e := checkRequiredPasswordChange(&salesperson, loginData.NewPassword); e != nil {
+		return c.Status(e.Code).JSON(fiber.Map{
+			"error":                e.Message,
+			"must_change_password": true,
 		})
 	}
 
-	// 获取客户端信息
-	userAgent := c.Get("User-Agent")
-	ip := c.IP()
+	// 重置登录尝试次数
+	utils.DefaultLoginLimiter.ResetAttempts(loginData.Username, c.IP())
+
+	return completeLogin(c, &salesperson, loginData.NewPassword)
+}
+
+// checkRequiredPasswordChange 检查被要求修改密码的账号是否提供了有效的新密码
+// 账号未被要求修改密码时返回nil
+func checkRequiredPasswordChange(salesperson *models.Salesperson, newPassword string) *fiber.Error {
+	if !salesperson.MustChangePassword {
+		return nil
+	}
+	if newPassword == "" {
+		return fiber.NewError(fiber.StatusForbidden, "登录前必须修改密码，请提供new_password")
+	}
+	if err := validatePassword(newPassword); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if salesperson.CheckPassword(newPassword) {
+		return fiber.NewError(fiber.StatusBadRequest, "新密码不能与原密码相同")
+	}
+	return nil
+}
 
-	// 定义过期时间
-	expireTime := time.Now().Add(24 * time.Hour)
+// completeLogin 完成登录，签发访问令牌和刷新令牌
+// 调用前必须已经完成密码和两步验证，并通过checkRequiredPasswordChange检查新密码
+func completeLogin(c *fiber.Ctx, salesperson *models.Salesperson, newPassword string) error {
+	// 账号被要求修改密码时，登录同时设置新密码
+	if salesperson.MustChangePassword {
+		if err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+			return setSalespersonPassword(tx, salesperson, newPassword, "")
+		}); err != nil {
+			log.Printf("登录时修改密码失败: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "登录失败，请稍后重试",
+			})
+		}
+	}
 
-	// 存储令牌到数据库
-	salespersonToken := models.SalespersonToken{
-		SalespersonID: salesperson.ID,
-		Token:         token,
-		UserAgent:     userAgent,
-		IP:            ip,
-		ExpiredAt:     expireTime,
+	// 懒惰删除：清理该用户的过期会话
+	if err := cleanupExpiredSessions(database.GetDB(), salesperson.ID); err != nil {
+		log.Printf("删除过期会话失败: %v", err)
+		// 不返回错误，继续处理
 	}
 
-	if err := database.GetDB().Create(&salespersonToken).Error; err != nil {
-		log.Printf("存储令牌失败: %v", err)
+	// 创建登录会话，签发访问令牌和刷新令牌
+	tokens, err := createLoginSession(c, salesperson)
+	if err != nil {
+		log.Printf("创建登录会话失败: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "登录失败，请稍后重试",
 		})
@@ -445,17 +605,15 @@ func SalespersonLogin(c *fiber.Ctx) error {
 	// 更新最后登录时间
 	now := time.Now()
 	salesperson.LastLoginAt = &now
-	if err := database.GetDB().Model(&salesperson).Update("last_login_at", now).Error; err != nil {
+	if err := database.GetDB().Model(salesperson).Update("last_login_at", now).Error; err != nil {
 		log.Printf("更新最后登录时间失败: %v", err)
 	}
 
 	log.Printf("用户登录成功: %s, ID: %d", salesperson.Username, salesperson.ID)
 
 	// 返回登录成功信息和令牌
-	return c.JSON(fiber.Map{
-		"message":    "登录成功",
-		"token":      token,
-		"expires_at": expireTime.Unix(), // 返回过期时间戳，方便前端处理
+	response := fiber.Map{
+		"message": "登录成功",
 		"data": fiber.Map{
 			"id":       salesperson.ID,
 			"username": salesperson.Username,
@@ -463,7 +621,13 @@ func SalespersonLogin(c *fiber.Ctx) error {
 			"status":   salesperson.Status,
 			"avatar":   salesperson.Avatar,
 		},
-	})
+		// 管理员要求启用两步验证但尚未启用时，登录后只能访问两步验证相关接口
+		"two_factor_setup_required": salesperson.TwoFactorRequired && !salesperson.TwoFactorEnabled,
+	}
+	for k, v := range tokens {
+		response[k] = v
+	}
+	return c.JSON(response)
 }
 
 // AssignProductToSalesperson 为销售员分配产品
@@ -475,6 +639,9 @@ func AssignProductToSalesperson(c *fiber.Ctx) error {
 		KeyTypeID      uint    `json:"key_type_id"`
 		CommissionRate float64 `json:"commission_rate"`
 		KeyGenLimit    int     `json:"key_gen_limit"`
+		// 佣金确认策略，为空时使用卡密类型的策略
+		CommissionPolicy   string `json:"commission_policy"`
+		CommissionHoldDays int    `json:"commission_hold_days"`
 	}
 
 	if err := c.BodyParser(&assignData); err != nil {
@@ -490,6 +657,18 @@ func AssignProductToSalesperson(c *fiber.Ctx) error {
 		})
 	}
 
+	// 验证佣金确认策略
+	if !models.IsValidCommissionPolicy(assignData.CommissionPolicy) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的佣金确认策略，可选值：generation, activation, activation_hold",
+		})
+	}
+	if assignData.CommissionHoldDays < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "佣金冻结天数不能为负数",
+		})
+	}
+
 	// 验证销售员是否存在
 	var salesperson models.Salesperson
 	if err := database.GetDB().First(&salesperson, assignData.SalespersonID).Error; err != nil {
@@ -565,6 +744,11 @@ func AssignProductToSalesperson(c *fiber.Ctx) error {
 			updates["key_gen_limit"] = assignData.KeyGenLimit
 		}
 
+		if assignData.CommissionPolicy != "" {
+			updates["commission_policy"] = assignData.CommissionPolicy
+			updates["commission_hold_days"] = assignData.CommissionHoldDays
+		}
+
 		if err := database.GetDB().Model(&existingAssignment).Updates(updates).Error; err != nil {
 			log.Printf("更新产品分配失败: %v", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -591,6 +775,9 @@ func AssignProductToSalesperson(c *fiber.Ctx) error {
 		CommissionRate: assignData.CommissionRate,
 		KeyGenLimit:    assignData.KeyGenLimit,
 		IsActive:       true,
+
+		CommissionPolicy:   assignData.CommissionPolicy,
+		CommissionHoldDays: assignData.CommissionHoldDays,
 	}
 
 	if err := database.GetDB().Create(&salespersonProduct).Error; err != nil {
@@ -633,21 +820,28 @@ func GetSalespersonProducts(c *fiber.Ctx) error {
 	// 查询销售员可销售的产品
 	var products []struct {
 		models.SalespersonProduct
-		SoftwareName string  `json:"software_name"`
-		KeyTypeName  string  `json:"key_type_name"`
-		Hours        int     `json:"hours"`
-		Price        float64 `json:"price"`
+		SoftwareName   string  `json:"software_name"`
+		KeyTypeName    string  `json:"key_type_name"`
+		Hours          int     `json:"hours"`
+		DurationUnit   string  `json:"duration_unit"`
+		DurationAmount int     `json:"duration_amount"`
+		Price          float64 `json:"price"`
 	}
 
 	query := `
-		SELECT sp.*, s.name as software_name, kt.name as key_type_name, kt.hours, kt.price
+		SELECT sp.*, s.name as software_name, kt.name as key_type_name,
+			COALESCE(skt.hours, kt.hours) AS hours, COALESCE(skt.price, ` + effectiveKeyTypePriceSQL + `) AS price,
+			COALESCE(skt.duration_unit, IF(skt.hours IS NULL, kt.duration_unit, 'hour')) AS duration_unit,
+			IF(skt.duration_unit IS NULL, COALESCE(skt.hours, kt.duration_amount), skt.duration_amount) AS duration_amount
 		FROM salesperson_products sp
-		JOIN softwares s ON sp.software_id = s.id
-		JOIN key_types kt ON sp.key_type_id = kt.id
-		WHERE sp.salesperson_id = ? AND sp.is_active = true
+		JOIN softwares s ON sp.software_id = s.id AND s.deleted_at IS NULL
+		JOIN key_types kt ON sp.key_type_id = kt.id AND kt.deleted_at IS NULL
+		LEFT JOIN software_key_types skt ON skt.software_id = sp.software_id AND skt.key_type_id = sp.key_type_id
+		WHERE sp.salesperson_id = @salesperson_id AND sp.is_active = true
 	`
 
-	if err := database.GetDB().Raw(query, id).Scan(&products).Error; err != nil {
+	args := map[string]interface{}{"salesperson_id": id, "at": time.Now()}
+	if err := database.GetDB().Raw(query, args).Scan(&products).Error; err != nil {
 		log.Printf("查询销售员产品失败: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "查询销售员产品失败",
@@ -662,22 +856,25 @@ func GetSalespersonProducts(c *fiber.Ctx) error {
 // GenerateKeysForSalesperson 销售员生成卡密
 func GenerateKeysForSalesperson(c *fiber.Ctx) error {
 	// 从上下文中获取销售员ID
-	salespersonID, ok := c.Locals("salesperson_id").(uint)
+	auth, ok := utils.GetAuthContext(c)
 	if !ok {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "未找到销售员身份信息",
 		})
 	}
+	salespersonID := auth.SalespersonID
 
 	// 解析请求数据
 	var genData struct {
-		SoftwareID    uint   `json:"software_id"`
-		KeyTypeID     uint   `json:"key_type_id"`
-		Count         int    `json:"count"`
-		CustomerName  string `json:"customer_name"`
-		CustomerPhone string `json:"customer_phone"`
-		CustomerEmail string `json:"customer_email"`
-		Notes         string `json:"notes"`
+		SoftwareID    uint     `json:"software_id"`
+		KeyTypeID     uint     `json:"key_type_id"`
+		Count         int      `json:"count"`
+		CustomerName  string   `json:"customer_name"`
+		CustomerPhone string   `json:"customer_phone"`
+		CustomerEmail string   `json:"customer_email"`
+		Notes         string   `json:"notes"`
+		CouponCode    string   `json:"coupon_code"`
+		CouponCodes   []string `json:"coupon_codes"`
 	}
 
 	if err := c.BodyParser(&genData); err != nil {
@@ -774,6 +971,44 @@ func GenerateKeysForSalesperson(c *fiber.Ctx) error {
 		}
 	}
 
+	// 该软件下的实际价格和有效期，绑定上的覆盖优先于卡密类型当前有效的价格版本
+	price, priceVersionID, err := resolveProductPrice(database.GetDB(), &softwareKeyType, &keyType)
+	if err != nil {
+		log.Printf("查询卡密类型价格失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询卡密类型价格失败",
+		})
+	}
+	duration := softwareKeyType.ResolveDuration(&keyType)
+
+	// 按代理层级和生成数量查询适用的批发价格阶梯
+	tier, err := findWholesaleTier(database.GetDB(), genData.SoftwareID, genData.KeyTypeID, salesperson.Level, genData.Count)
+	if err != nil {
+		log.Printf("查询批发价格阶梯失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询批发价格阶梯失败",
+		})
+	}
+
+	// 校验优惠码并计算减免金额
+	originalAmount := float64(genData.Count) * price
+	customerKey := couponCustomerKey(genData.CustomerEmail, genData.CustomerPhone)
+	couponCodes := normalizeCouponCodes(append(genData.CouponCodes, genData.CouponCode)...)
+	coupons, err := resolveCoupons(database.GetDB(), couponCodes, genData.SoftwareID, genData.KeyTypeID,
+		originalAmount, customerKey, time.Now())
+	if err != nil {
+		if e, ok := err.(*fiber.Error); ok {
+			return c.Status(e.Code).JSON(fiber.Map{
+				"error": e.Message,
+			})
+		}
+		log.Printf("查询优惠码失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询优惠码失败",
+		})
+	}
+	coupons, discounts, discountAmount := applyCoupons(coupons, originalAmount)
+
 	// 开始事务
 	tx := database.GetDB().Begin()
 	if tx.Error != nil {
@@ -792,16 +1027,21 @@ func GenerateKeysForSalesperson(c *fiber.Ctx) error {
 
 		// 创建卡密
 		key := models.Key{
-			Code:         code,
-			KeyCode:      keyCode,
-			TypeID:       genData.KeyTypeID,
-			TypeName:     keyType.Name,
-			Hours:        keyType.Hours,
-			Price:        keyType.Price,
-			Status:       "unused",
-			CreatorID:    salespersonID,
-			SoftwareID:   genData.SoftwareID,
-			SoftwareName: software.Name,
+			Code:           code,
+			KeyCode:        keyCode,
+			TypeID:         genData.KeyTypeID,
+			TypeName:       keyType.Name,
+			Hours:          duration.Hours(),
+			DurationUnit:   duration.Unit,
+			DurationAmount: duration.Amount,
+			Price:          price,
+			PriceVersionID: priceVersionID,
+			QuotaTotal:     keyType.KeyQuota(),
+			QuotaRemaining: keyType.KeyQuota(),
+			Status:         "unused",
+			CreatorID:      salespersonID,
+			SoftwareID:     genData.SoftwareID,
+			SoftwareName:   software.Name,
 		}
 
 		if err := tx.Create(&key).Error; err != nil {
@@ -825,24 +1065,34 @@ func GenerateKeysForSalesperson(c *fiber.Ctx) error {
 		})
 	}
 
-	// 创建销售记录
-	totalAmount := float64(genData.Count) * keyType.Price
+	// 创建销售记录，销售金额为减去优惠码减免后的金额
+	totalAmount := originalAmount - discountAmount
 	commission := totalAmount * salespersonProduct.CommissionRate
+	usedCodes := make([]string, 0, len(coupons))
+	for _, coupon := range coupons {
+		usedCodes = append(usedCodes, coupon.Code)
+	}
 
 	sale := models.SalespersonSale{
 		SalespersonID:  salespersonID,
-		KeyID:          0, // 批量生成时不关联具体卡密
+		KeyID:          0, // 批量生成的卡密通过销售明细SalespersonSaleItem逐张关联
 		SoftwareID:     genData.SoftwareID,
 		KeyTypeID:      genData.KeyTypeID,
 		CustomerName:   genData.CustomerName,
 		CustomerPhone:  genData.CustomerPhone,
 		CustomerEmail:  genData.CustomerEmail,
 		SaleAmount:     totalAmount,
+		DiscountAmount: discountAmount,
+		CouponCodes:    strings.Join(usedCodes, ","),
+		PriceVersionID: priceVersionID,
 		CommissionRate: salespersonProduct.CommissionRate,
 		Commission:     commission,
 		Status:         "pending",
 		Notes:          genData.Notes,
 	}
+	applyWholesaleTier(&sale, tier, genData.Count)
+	applyCommissionPolicy(&sale, &salespersonProduct, &keyType)
+	commission = sale.Commission
 
 	if err := tx.Create(&sale).Error; err != nil {
 		tx.Rollback()
@@ -852,11 +1102,34 @@ func GenerateKeysForSalesperson(c *fiber.Ctx) error {
 		})
 	}
 
-	// 更新销售员的总销售额和总佣金
+	// 将本次生成的卡密关联到销售记录，便于后续取消/退款
+	if err := linkKeysToSale(tx, keys, &sale); err != nil {
+		tx.Rollback()
+		log.Printf("关联卡密与销售记录失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "关联卡密与销售记录失败",
+		})
+	}
+
+	// 占用优惠码的使用次数并记录使用情况
+	if err := redeemCoupons(tx, coupons, discounts, &sale, customerKey); err != nil {
+		tx.Rollback()
+		if e, ok := err.(*fiber.Error); ok {
+			return c.Status(e.Code).JSON(fiber.Map{
+				"error": e.Message,
+			})
+		}
+		log.Printf("记录优惠码使用失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "记录优惠码使用失败",
+		})
+	}
+
+	// 更新销售员的总销售额和已确认的佣金
 	if err := tx.Model(&models.Salesperson{}).Where("id = ?", salespersonID).
 		UpdateColumns(map[string]interface{}{
 			"total_sales":      gorm.Expr("total_sales + ?", totalAmount),
-			"total_commission": gorm.Expr("total_commission + ?", commission),
+			"total_commission": gorm.Expr("total_commission + ?", sale.RecognizedCommission),
 		}).Error; err != nil {
 		tx.Rollback()
 		log.Printf("更新销售员销售统计失败: %v", err)
@@ -865,6 +1138,15 @@ func GenerateKeysForSalesperson(c *fiber.Ctx) error {
 		})
 	}
 
+	// 为上级代理生成代理佣金
+	if err := ProcessAgentCommission(sale, tx); err != nil {
+		tx.Rollback()
+		log.Printf("处理代理佣金失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "处理代理佣金失败",
+		})
+	}
+
 	// 提交事务
 	if err := tx.Commit().Error; err != nil {
 		log.Printf("提交事务失败: %v", err)
@@ -882,6 +1164,16 @@ func GenerateKeysForSalesperson(c *fiber.Ctx) error {
 			"total":      genData.Count,
 			"amount":     totalAmount,
 			"commission": commission,
+			// 使用了优惠码时，amount为减免后的金额
+			"original_amount": originalAmount,
+			"discount_amount": discountAmount,
+			"coupons":         usedCodes,
+			// 使用了批发价格阶梯时，佣金为零售价与批发价的差额
+			"price_tier":           tier,
+			"wholesale_unit_price": sale.WholesaleUnitPrice,
+			// 按佣金确认策略，非生成时确认的佣金需等卡密激活后才计入可结算佣金
+			"commission_policy":     sale.CommissionPolicy,
+			"recognized_commission": sale.RecognizedCommission,
 		},
 	})
 }
@@ -997,27 +1289,33 @@ func GetSalespersonCommission(c *fiber.Ctx) error {
 		db = db.Where("created_at <= ?", query.EndDate)
 	}
 
+	// 开启新会话，使下面每个统计查询的条件互不影响
+	db = db.Session(&gorm.Session{})
+
 	// 计算总销售额和总佣金
+	// 待结算金额只统计已确认的佣金，未确认的佣金单独列出
 	type CommissionStats struct {
-		TotalSales      float64 `json:"total_sales"`
-		TotalCommission float64 `json:"total_commission"`
-		PendingAmount   float64 `json:"pending_amount"`
-		SettledAmount   float64 `json:"settled_amount"`
-		CancelledAmount float64 `json:"cancelled_amount"`
+		TotalSales             float64 `json:"total_sales"`
+		TotalCommission        float64 `json:"total_commission"`
+		RecognizedCommission   float64 `json:"recognized_commission"`
+		UnrecognizedCommission float64 `json:"unrecognized_commission"`
+		PendingAmount          float64 `json:"pending_amount"`
+		SettledAmount          float64 `json:"settled_amount"`
+		CancelledAmount        float64 `json:"cancelled_amount"`
 	}
 
 	var stats CommissionStats
 
 	// 计算总销售额和总佣金
-	if err := db.Select("SUM(sale_amount) as total_sales, SUM(commission) as total_commission").Scan(&stats).Error; err != nil {
+	if err := db.Select("SUM(sale_amount) as total_sales, SUM(commission) as total_commission, SUM(recognized_commission) as recognized_commission").Scan(&stats).Error; err != nil {
 		log.Printf("计算佣金统计失败: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "计算佣金统计失败",
 		})
 	}
 
-	// 计算待结算金额
-	if err := db.Where("status = ?", "pending").Select("SUM(commission) as pending_amount").Scan(&stats).Error; err != nil {
+	// 计算待结算金额（已确认）和未确认佣金
+	if err := db.Where("status = ?", "pending").Select("SUM(recognized_commission) as pending_amount, SUM(commission - recognized_commission) as unrecognized_commission").Scan(&stats).Error; err != nil {
 		log.Printf("计算待结算金额失败: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "计算待结算金额失败",
@@ -1066,13 +1364,14 @@ func GetSalespersonCommission(c *fiber.Ctx) error {
 // GetSalespersonOwnProducts 获取销售员自己可销售的产品
 func GetSalespersonOwnProducts(c *fiber.Ctx) error {
 	// 从上下文中获取销售员ID
-	salespersonID, ok := c.Locals("salesperson_id").(uint)
+	auth, ok := utils.GetAuthContext(c)
 	if !ok {
-		log.Printf("未找到销售员身份信息: %v", c.Locals("salesperson_id"))
+		log.Printf("未找到销售员身份信息")
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "未找到销售员身份信息",
 		})
 	}
+	salespersonID := auth.SalespersonID
 
 	// 设置X-Salesperson-Id头，用于调试
 	c.Set("X-Salesperson-Id", fmt.Sprintf("%d", salespersonID))
@@ -1086,6 +1385,8 @@ func GetSalespersonOwnProducts(c *fiber.Ctx) error {
 		KeyTypeID      uint    `json:"key_type_id"`
 		KeyTypeName    string  `json:"key_type_name"`
 		Hours          int     `json:"hours"`
+		DurationUnit   string  `json:"duration_unit"`
+		DurationAmount int     `json:"duration_amount"`
 		Price          float64 `json:"price"`
 		CommissionRate float64 `json:"commission_rate"`
 		KeyGenLimit    int     `json:"key_gen_limit"`
@@ -1102,8 +1403,10 @@ func GetSalespersonOwnProducts(c *fiber.Ctx) error {
 			s.name AS software_name, 
 			sp.key_type_id, 
 			kt.name AS key_type_name, 
-			kt.hours, 
-			kt.price, 
+			COALESCE(skt.hours, kt.hours) AS hours, 
+			COALESCE(skt.duration_unit, IF(skt.hours IS NULL, kt.duration_unit, 'hour')) AS duration_unit, 
+			IF(skt.duration_unit IS NULL, COALESCE(skt.hours, kt.duration_amount), skt.duration_amount) AS duration_amount, 
+			COALESCE(skt.price, ` + effectiveKeyTypePriceSQL + `) AS price, 
 			sp.commission_rate, 
 			sp.key_gen_limit, 
 			sp.keys_generated, 
@@ -1111,16 +1414,19 @@ func GetSalespersonOwnProducts(c *fiber.Ctx) error {
 		FROM 
 			salesperson_products sp
 		JOIN 
-			softwares s ON sp.software_id = s.id
+			softwares s ON sp.software_id = s.id AND s.deleted_at IS NULL
 		JOIN 
-			key_types kt ON sp.key_type_id = kt.id
+			key_types kt ON sp.key_type_id = kt.id AND kt.deleted_at IS NULL
+		LEFT JOIN 
+			software_key_types skt ON skt.software_id = sp.software_id AND skt.key_type_id = sp.key_type_id
 		WHERE 
-			sp.salesperson_id = ? AND sp.is_active = true AND s.is_active = true AND kt.is_active = true
+			sp.salesperson_id = @salesperson_id AND sp.is_active = true AND s.is_active = true AND kt.is_active = true
 		ORDER BY 
 			s.name, kt.name
 	`
 
-	if err := database.GetDB().Raw(query, salespersonID).Scan(&products).Error; err != nil {
+	args := map[string]interface{}{"salesperson_id": salespersonID, "at": time.Now()}
+	if err := database.GetDB().Raw(query, args).Scan(&products).Error; err != nil {
 		log.Printf("查询销售员产品失败: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "查询产品失败",
@@ -1143,12 +1449,13 @@ func GetSalespersonOwnProducts(c *fiber.Ctx) error {
 // GetSalespersonOwnSales 获取销售员自己的销售记录
 func GetSalespersonOwnSales(c *fiber.Ctx) error {
 	// 从上下文中获取销售员ID
-	salespersonID, ok := c.Locals("salesperson_id").(uint)
+	auth, ok := utils.GetAuthContext(c)
 	if !ok {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "未找到销售员身份信息",
 		})
 	}
+	salespersonID := auth.SalespersonID
 
 	// 解析查询参数
 	var query struct {
@@ -1223,12 +1530,13 @@ func GetSalespersonOwnSales(c *fiber.Ctx) error {
 // GetSalespersonOwnCommission 获取销售员自己的佣金统计
 func GetSalespersonOwnCommission(c *fiber.Ctx) error {
 	// 从上下文中获取销售员ID
-	salespersonID, ok := c.Locals("salesperson_id").(uint)
+	auth, ok := utils.GetAuthContext(c)
 	if !ok {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "未找到销售员身份信息",
 		})
 	}
+	salespersonID := auth.SalespersonID
 
 	// 查询销售员信息
 	var salesperson models.Salesperson
@@ -1241,11 +1549,12 @@ func GetSalespersonOwnCommission(c *fiber.Ctx) error {
 
 	// 查询佣金统计
 	type CommissionStats struct {
-		TotalSales      float64 `json:"total_sales"`
-		TotalCommission float64 `json:"total_commission"`
-		PendingAmount   float64 `json:"pending_amount"`
-		SettledAmount   float64 `json:"settled_amount"`
-		CancelledAmount float64 `json:"cancelled_amount"`
+		TotalSales             float64 `json:"total_sales"`
+		TotalCommission        float64 `json:"total_commission"`
+		PendingAmount          float64 `json:"pending_amount"`
+		UnrecognizedCommission float64 `json:"unrecognized_commission"`
+		SettledAmount          float64 `json:"settled_amount"`
+		CancelledAmount        float64 `json:"cancelled_amount"`
 	}
 
 	var stats CommissionStats
@@ -1254,14 +1563,22 @@ func GetSalespersonOwnCommission(c *fiber.Ctx) error {
 	stats.TotalSales = salesperson.TotalSales
 	stats.TotalCommission = salesperson.TotalCommission
 
-	// 查询待结算佣金
+	// 查询待结算佣金，只有已确认的佣金可以结算
 	if err := database.GetDB().Model(&models.SalespersonSale{}).
 		Where("salesperson_id = ? AND status = ?", salespersonID, "pending").
-		Select("COALESCE(SUM(commission), 0) as pending_amount").
+		Select("COALESCE(SUM(recognized_commission), 0) as pending_amount").
 		Scan(&stats.PendingAmount).Error; err != nil {
 		log.Printf("查询待结算佣金失败: %v", err)
 	}
 
+	// 查询尚未确认的佣金（等待卡密激活或处于冻结期）
+	if err := database.GetDB().Model(&models.SalespersonSale{}).
+		Where("salesperson_id = ? AND status = ?", salespersonID, "pending").
+		Select("COALESCE(SUM(commission - recognized_commission), 0) as unrecognized_commission").
+		Scan(&stats.UnrecognizedCommission).Error; err != nil {
+		log.Printf("查询未确认佣金失败: %v", err)
+	}
+
 	// 查询已结算佣金
 	if err := database.GetDB().Model(&models.SalespersonSale{}).
 		Where("salesperson_id = ? AND status = ?", salespersonID, "settled").
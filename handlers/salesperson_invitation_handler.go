@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"go_creation/database"
+	"go_creation/models"
+	"go_creation/utils"
+)
+
+// 两次发送邀请之间的最小间隔，防止频繁重发骚扰被邀请人
+const invitationResendInterval = time.Minute
+
+// invitationMessageData 邀请通知模板使用的数据
+type invitationMessageData struct {
+	InviterName string
+	InviteCode  string
+	AcceptURL   string
+	ExpiredAt   string
+}
+
+// deliverInvitation 通过邮件和短信发送邀请，并记录发送结果
+// 邀请同时填写了邮箱和电话时两个渠道都会发送，只有部分成功时记为partial
+func deliverInvitation(db *gorm.DB, invitation *models.SalespersonAgentInvitation, inviter *models.Salesperson) error {
+	data := invitationMessageData{
+		InviterName: inviter.Name,
+		InviteCode:  invitation.InviteCode,
+		ExpiredAt:   invitation.ExpiredAt.Format("2006-01-02 15:04"),
+	}
+	// 配置了接受邀请页面地址时附带链接
+	if acceptURL := os.Getenv("INVITATION_ACCEPT_URL"); acceptURL != "" {
+		data.AcceptURL = acceptURL + "?code=" + invitation.InviteCode
+	}
+
+	targets := map[string]string{}
+	if invitation.Email != "" {
+		targets[utils.ChannelEmail] = invitation.Email
+	}
+	if invitation.Phone != "" {
+		targets[utils.ChannelSMS] = invitation.Phone
+	}
+
+	var errs []string
+	for channel, to := range targets {
+		msg, err := utils.RenderNotification("agent_invitation", channel, to, data)
+		if err == nil {
+			err = utils.GetNotifier(channel).Send(msg)
+		}
+		if err != nil {
+			errs = append(errs, channel+": "+err.Error())
+		}
+	}
+
+	now := time.Now()
+	status := "sent"
+	switch {
+	case len(errs) == len(targets):
+		status = "failed"
+	case len(errs) > 0:
+		status = "partial"
+	}
+
+	invitation.DeliveryStatus = status
+	invitation.DeliveryError = strings.Join(errs, "; ")
+	invitation.DeliveryAttempts++
+	invitation.LastSentAt = &now
+
+	return db.Model(&models.SalespersonAgentInvitation{}).Where("id = ?", invitation.ID).
+		Updates(map[string]interface{}{
+			"delivery_status":   invitation.DeliveryStatus,
+			"delivery_error":    invitation.DeliveryError,
+			"delivery_attempts": gorm.Expr("delivery_attempts + 1"),
+			"last_sent_at":      now,
+		}).Error
+}
+
+// findOwnInvitation 查询当前销售员发出的邀请
+func findOwnInvitation(c *fiber.Ctx) (*models.SalespersonAgentInvitation, *fiber.Error) {
+	// 获取当前销售员ID
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return nil, fiber.NewError(fiber.StatusUnauthorized, "未登录")
+	}
+	salespersonID := auth.SalespersonID
+
+	invitationID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "无效的邀请ID")
+	}
+
+	var invitation models.SalespersonAgentInvitation
+	if err := database.GetDB().Where("id = ? AND inviter_id = ?", invitationID, salespersonID).
+		First(&invitation).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, fiber.NewError(fiber.StatusNotFound, "邀请不存在")
+		}
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "查询邀请失败: "+err.Error())
+	}
+
+	return &invitation, nil
+}
+
+// ResendAgentInvitation 重新发送代理邀请
+// 只能重发自己发出的、仍处于待接受状态且未过期的邀请
+func ResendAgentInvitation(c *fiber.Ctx) error {
+	invitation, ferr := findOwnInvitation(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	if invitation.Status != "pending" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "只能重发待接受的邀请",
+		})
+	}
+
+	if time.Now().After(invitation.ExpiredAt) {
+		database.GetDB().Model(invitation).Update("status", "expired")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "邀请已过期",
+		})
+	}
+
+	if invitation.LastSentAt != nil && time.Since(*invitation.LastSentAt) < invitationResendInterval {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "发送过于频繁，请稍后再试",
+		})
+	}
+
+	var inviter models.Salesperson
+	if err := database.GetDB().First(&inviter, invitation.InviterID).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询邀请人失败: " + err.Error(),
+		})
+	}
+
+	if err := deliverInvitation(database.GetDB(), invitation, &inviter); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "更新发送状态失败: " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":         "邀请已重新发送",
+		"delivery_status": invitation.DeliveryStatus,
+		"delivery_error":  invitation.DeliveryError,
+	})
+}
+
+// RevokeAgentInvitation 撤回代理邀请
+// 撤回后邀请码立即失效
+func RevokeAgentInvitation(c *fiber.Ctx) error {
+	invitation, ferr := findOwnInvitation(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	// 以条件更新的方式撤回，防止与接受邀请并发
+	now := time.Now()
+	result := database.GetDB().Model(&models.SalespersonAgentInvitation{}).
+		Where("id = ? AND status = ?", invitation.ID, "pending").
+		Updates(map[string]interface{}{
+			"status":     "revoked",
+			"revoked_at": now,
+		})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "撤回邀请失败: " + result.Error.Error(),
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "只能撤回待接受的邀请",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "邀请已撤回",
+	})
+}
+
+// GetAgentInvitations 获取当前销售员发出的邀请列表
+// 支持status参数按状态筛选，支持page和page_size分页
+func GetAgentInvitations(c *fiber.Ctx) error {
+	// 获取当前销售员ID
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
+		})
+	}
+	salespersonID := auth.SalespersonID
+
+	page := c.QueryInt("page", 1)
+	if page < 1 {
+		page = 1
+	}
+	pageSize := c.QueryInt("page_size", 20)
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	query := database.GetDB().Model(&models.SalespersonAgentInvitation{}).Where("inviter_id = ?", salespersonID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询邀请记录失败: " + err.Error(),
+		})
+	}
+
+	var invitations []models.SalespersonAgentInvitation
+	if err := query.Order("created_at DESC").Offset((page - 1) * pageSize).Limit(pageSize).
+		Find(&invitations).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询邀请记录失败: " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+		"data":      invitations,
+	})
+}
+
+// RejectAgentInvitation 被邀请人拒绝代理邀请
+func RejectAgentInvitation(c *fiber.Ctx) error {
+	// 获取当前销售员ID
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
+		})
+	}
+	salespersonID := auth.SalespersonID
+
+	// 解析请求体
+	var request struct {
+		InviteCode string `json:"invite_code"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+	if request.InviteCode == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "邀请码不能为空",
+		})
+	}
+
+	// 以条件更新的方式拒绝，已过期、已撤回或已处理的邀请不能再拒绝
+	now := time.Now()
+	result := database.GetDB().Model(&models.SalespersonAgentInvitation{}).
+		Where("invite_code = ? AND status = ? AND expired_at > ? AND inviter_id <> ?", request.InviteCode, "pending", now, salespersonID).
+		Updates(map[string]interface{}{
+			"status":      "rejected",
+			"invitee_id":  salespersonID,
+			"rejected_at": now,
+		})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "拒绝邀请失败: " + result.Error.Error(),
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "邀请不存在或已失效",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "已拒绝邀请",
+	})
+}
+
+// ExpireAgentInvitations 把已超过过期时间的待接受邀请标记为过期
+// 由后台定时任务调用，返回本次标记的邀请数量
+func ExpireAgentInvitations(db *gorm.DB) (int64, error) {
+	result := db.Model(&models.SalespersonAgentInvitation{}).
+		Where("status = ? AND expired_at <= ?", "pending", time.Now()).
+		Update("status", "expired")
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return result.RowsAffected, nil
+}
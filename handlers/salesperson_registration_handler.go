@@ -0,0 +1,369 @@
+package handlers
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"go_creation/database"
+	"go_creation/models"
+	"go_creation/utils"
+)
+
+// RegisterSalesperson 通过上级的代理码自助注册销售员
+// 注册后的销售员处于pending待审核状态，直接挂在代理码所有者之下，
+// 由上级或管理员审核通过后才能登录
+func RegisterSalesperson(c *fiber.Ctx) error {
+	// 解析请求体
+	var request struct {
+		AgentCode string `json:"agent_code"`
+		Username  string `json:"username"`
+		Password  string `json:"password"`
+		Name      string `json:"name"`
+		Phone     string `json:"phone"`
+		Email     string `json:"email"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	// 验证必填字段
+	if request.AgentCode == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "代理码不能为空",
+		})
+	}
+	if request.Username == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "用户名不能为空",
+		})
+	}
+	if request.Name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "姓名不能为空",
+		})
+	}
+	if request.Password == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "密码不能为空",
+		})
+	}
+
+	// 查询代理码所有者，只有在职的销售员可以发展下线
+	var upline models.Salesperson
+	if err := database.GetDB().Where("agent_code = ? AND status = ?", request.AgentCode, "active").First(&upline).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "代理码无效",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询代理码失败: " + err.Error(),
+		})
+	}
+
+	// 验证用户名是否已存在，已删除的销售员仍然占用用户名
+	var count int64
+	if err := database.GetDB().Unscoped().Model(&models.Salesperson{}).Where("username = ?", request.Username).Count(&count).Error; err != nil {
+		log.Printf("查询销售员失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询销售员失败",
+		})
+	}
+	if count > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "用户名已存在",
+		})
+	}
+
+	salesperson := models.Salesperson{
+		Username:  request.Username,
+		Name:      request.Name,
+		Phone:     request.Phone,
+		Email:     request.Email,
+		Status:    "pending",
+		CreatorID: upline.ID,
+		ParentID:  &upline.ID,
+		Level:     upline.Level + 1,
+	}
+	if err := salesperson.SetPassword(request.Password); err != nil {
+		log.Printf("密码加密失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "密码加密失败",
+		})
+	}
+
+	// 开始事务
+	tx := database.GetDB().Begin()
+
+	// 使用defer确保事务在函数返回时被正确处理
+	var txCommitted bool
+	defer func() {
+		// 如果事务还没有被提交，则回滚
+		if !txCommitted && tx != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err := tx.Create(&salesperson).Error; err != nil {
+		log.Printf("创建销售员失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "注册失败: " + err.Error(),
+		})
+	}
+
+	// 检查代理层级和循环引用
+	if ferr := checkAgentAttach(tx, &upline, salesperson.ID); ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	// 更新代理层级闭包表
+	if err := attachAgentSubtree(tx, upline.ID, salesperson.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// 更新上级的下级数量
+	if err := tx.Model(&models.Salesperson{}).Where("id = ?", upline.ID).
+		UpdateColumn("children_count", gorm.Expr("children_count + 1")).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "更新上级信息失败: " + err.Error(),
+		})
+	}
+
+	// 提交事务
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "提交事务失败: " + err.Error(),
+		})
+	}
+
+	// 标记事务已提交
+	txCommitted = true
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "注册成功，请等待上级或管理员审核",
+		"data": fiber.Map{
+			"id":       salesperson.ID,
+			"username": salesperson.Username,
+			"name":     salesperson.Name,
+			"status":   salesperson.Status,
+			"upline": fiber.Map{
+				"id":   upline.ID,
+				"name": upline.Name,
+			},
+		},
+	})
+}
+
+// listPendingRegistrations 查询待审核的自助注册，uplineID不为空时只查询其直接下级
+func listPendingRegistrations(c *fiber.Ctx, uplineID *uint) error {
+	query := database.GetDB().Where("status = ?", "pending")
+	if uplineID != nil {
+		query = query.Where("parent_id = ?", *uplineID)
+	}
+
+	var registrations []models.Salesperson
+	if err := query.Order("created_at ASC").Find(&registrations).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询待审核注册失败: " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"total": len(registrations),
+		"data":  registrations,
+	})
+}
+
+// reviewRegistration 审核自助注册
+// uplineID不为空时只允许审核其直接下级；审核通过后账号变为active，
+// 拒绝后账号变为rejected并从上级的代理树中移除
+func reviewRegistration(c *fiber.Ctx, uplineID *uint, approve bool) error {
+	registrationID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的销售员ID",
+		})
+	}
+
+	var request struct {
+		Note string `json:"note"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "参数解析失败: " + err.Error(),
+			})
+		}
+	}
+
+	// 查询待审核的销售员
+	query := database.GetDB().Where("id = ? AND status = ?", registrationID, "pending")
+	if uplineID != nil {
+		query = query.Where("parent_id = ?", *uplineID)
+	}
+	var salesperson models.Salesperson
+	if err := query.First(&salesperson).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "待审核的注册不存在",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询销售员失败: " + err.Error(),
+		})
+	}
+
+	// 开始事务
+	tx := database.GetDB().Begin()
+
+	// 使用defer确保事务在函数返回时被正确处理
+	var txCommitted bool
+	defer func() {
+		// 如果事务还没有被提交，则回滚
+		if !txCommitted && tx != nil {
+			tx.Rollback()
+		}
+	}()
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"reviewed_at": now,
+		"review_note": request.Note,
+	}
+
+	if approve {
+		// 上级可能在审核前被调整过，重新检查代理层级和循环引用
+		if salesperson.ParentID != nil {
+			var upline models.Salesperson
+			if err := tx.First(&upline, *salesperson.ParentID).Error; err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "查询上级失败: " + err.Error(),
+				})
+			}
+			if ferr := checkAgentAttach(tx, &upline, salesperson.ID); ferr != nil {
+				return c.Status(ferr.Code).JSON(fiber.Map{
+					"error": ferr.Message,
+				})
+			}
+		}
+		updates["status"] = "active"
+	} else {
+		// 从代理树中移除，并减少上级的下级数量
+		if err := detachAgentSubtree(tx, salesperson.ID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if salesperson.ParentID != nil {
+			if err := tx.Model(&models.Salesperson{}).Where("id = ?", *salesperson.ParentID).
+				UpdateColumn("children_count", gorm.Expr("GREATEST(children_count - 1, 0)")).Error; err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "更新上级信息失败: " + err.Error(),
+				})
+			}
+		}
+		updates["status"] = "rejected"
+		updates["parent_id"] = nil
+		updates["level"] = 0
+	}
+
+	// 以条件更新的方式审核，防止重复审核
+	result := tx.Model(&models.Salesperson{}).Where("id = ? AND status = ?", salesperson.ID, "pending").Updates(updates)
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "更新销售员状态失败: " + result.Error.Error(),
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "该注册已被审核",
+		})
+	}
+
+	// 提交事务
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "提交事务失败: " + err.Error(),
+		})
+	}
+
+	// 标记事务已提交
+	txCommitted = true
+
+	message := "已拒绝注册"
+	if approve {
+		message = "已通过注册审核"
+	}
+	return c.JSON(fiber.Map{
+		"message": message,
+		"id":      salesperson.ID,
+		"status":  updates["status"],
+	})
+}
+
+// currentUplineID 获取当前销售员ID
+func currentUplineID(c *fiber.Ctx) (*uint, bool) {
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return nil, false
+	}
+	return &auth.SalespersonID, true
+}
+
+// GetPendingRegistrations 上级查询通过自己代理码注册、待审核的下级
+func GetPendingRegistrations(c *fiber.Ctx) error {
+	uplineID, ok := currentUplineID(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
+		})
+	}
+	return listPendingRegistrations(c, uplineID)
+}
+
+// ApproveRegistration 上级审核通过下级的注册
+func ApproveRegistration(c *fiber.Ctx) error {
+	uplineID, ok := currentUplineID(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
+		})
+	}
+	return reviewRegistration(c, uplineID, true)
+}
+
+// RejectRegistration 上级拒绝下级的注册
+func RejectRegistration(c *fiber.Ctx) error {
+	uplineID, ok := currentUplineID(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未登录",
+		})
+	}
+	return reviewRegistration(c, uplineID, false)
+}
+
+// AdminGetPendingRegistrations 管理员查询所有待审核的注册
+func AdminGetPendingRegistrations(c *fiber.Ctx) error {
+	return listPendingRegistrations(c, nil)
+}
+
+// AdminApproveRegistration 管理员审核通过注册
+func AdminApproveRegistration(c *fiber.Ctx) error {
+	return reviewRegistration(c, nil, true)
+}
+
+// AdminRejectRegistration 管理员拒绝注册
+func AdminRejectRegistration(c *fiber.Ctx) error {
+	return reviewRegistration(c, nil, false)
+}
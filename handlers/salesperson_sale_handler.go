@@ -0,0 +1,460 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"go_creation/database"
+	"go_creation/models"
+	"go_creation/utils"
+)
+
+var (
+	// errSaleNotCancellable 销售记录当前状态不允许取消
+	errSaleNotCancellable = errors.New("销售记录当前状态不允许取消")
+	// errSaleHasActivatedKeys 销售记录下存在已激活的卡密
+	errSaleHasActivatedKeys = errors.New("销售记录下存在已激活的卡密")
+)
+
+// linkKeysToSale 将生成的卡密关联到销售记录
+// 为每张卡密创建销售明细，记录单价和对应的佣金，使用了优惠码时单价按减免比例折算，
+// 同时回写卡密的销售记录ID，保证返回给前端的数据与数据库一致
+func linkKeysToSale(tx *gorm.DB, keys []models.Key, sale *models.SalespersonSale) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// 优惠码减免后的金额占原金额的比例
+	priceRatio := 1.0
+	if sale.DiscountAmount > 0 && sale.SaleAmount+sale.DiscountAmount > 0 {
+		priceRatio = sale.SaleAmount / (sale.SaleAmount + sale.DiscountAmount)
+	}
+
+	now := time.Now()
+	keyIDs := make([]uint, 0, len(keys))
+	items := make([]models.SalespersonSaleItem, 0, len(keys))
+	for _, key := range keys {
+		keyIDs = append(keyIDs, key.ID)
+		unitPrice := key.Price * priceRatio
+		item := models.SalespersonSaleItem{
+			SaleID:        sale.ID,
+			KeyID:         key.ID,
+			SalespersonID: sale.SalespersonID,
+			UnitPrice:     unitPrice,
+			Commission:    unitPrice * sale.CommissionRate,
+			Status:        "sold",
+		}
+		item.CommissionStatus = initialItemCommissionStatus(sale)
+		if item.CommissionStatus == "recognized" {
+			item.RecognizedAt = &now
+		}
+		items = append(items, item)
+	}
+
+	if err := tx.Model(&models.Key{}).Where("id IN ?", keyIDs).Update("sale_id", sale.ID).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Create(&items).Error; err != nil {
+		return err
+	}
+
+	for i := range keys {
+		keys[i].SaleID = sale.ID
+	}
+	return nil
+}
+
+// markSaleItemActivated 将卡密的激活归属到其销售明细，并按销售记录的策略处理佣金
+// 卡密未关联销售记录时不做任何处理
+func markSaleItemActivated(tx *gorm.DB, key *models.Key) error {
+	if key.SaleID == 0 || key.ActivatedAt == nil {
+		return nil
+	}
+	if err := tx.Model(&models.SalespersonSaleItem{}).
+		Where("key_id = ? AND activated_at IS NULL", key.ID).
+		Update("activated_at", *key.ActivatedAt).Error; err != nil {
+		return err
+	}
+	return handleActivationCommission(tx, key)
+}
+
+// saleItemDetail 销售明细及其卡密的激活状态
+type saleItemDetail struct {
+	models.SalespersonSaleItem
+	Code        string     `json:"code"`         // 卡密码
+	KeyCode     string     `json:"key_code"`     // 激活码
+	KeyStatus   string     `json:"key_status"`   // 卡密状态：unused,used,void
+	ExpiredAt   *time.Time `json:"expired_at"`   // 卡密过期时间
+	DeviceInfo  string     `json:"device_info"`  // 激活设备信息
+	IsActivated bool       `json:"is_activated"` // 是否已激活
+}
+
+// loadSaleDetail 查询销售记录及其明细
+// 参数:
+//   - saleID: 销售记录ID
+//   - salespersonID: 大于0时仅允许查询该销售员自己的销售记录
+func loadSaleDetail(saleID uint, salespersonID uint) (*models.SalespersonSale, []saleItemDetail, error) {
+	db := database.GetDB()
+
+	var sale models.SalespersonSale
+	query := db.Where("id = ?", saleID)
+	if salespersonID > 0 {
+		query = query.Where("salesperson_id = ?", salespersonID)
+	}
+	if err := query.First(&sale).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var items []models.SalespersonSaleItem
+	if err := db.Where("sale_id = ?", sale.ID).Order("id ASC").Find(&items).Error; err != nil {
+		return &sale, nil, fmt.Errorf("查询销售明细失败: %w", err)
+	}
+
+	keyIDs := make([]uint, 0, len(items))
+	for _, item := range items {
+		keyIDs = append(keyIDs, item.KeyID)
+	}
+
+	keysByID := make(map[uint]models.Key, len(keyIDs))
+	if len(keyIDs) > 0 {
+		var keys []models.Key
+		if err := db.Where("id IN ?", keyIDs).Find(&keys).Error; err != nil {
+			return &sale, nil, fmt.Errorf("查询卡密失败: %w", err)
+		}
+		for _, key := range keys {
+			keysByID[key.ID] = key
+		}
+	}
+
+	details := make([]saleItemDetail, 0, len(items))
+	for _, item := range items {
+		key := keysByID[item.KeyID]
+		details = append(details, saleItemDetail{
+			SalespersonSaleItem: item,
+			Code:                key.Code,
+			KeyCode:             key.KeyCode,
+			KeyStatus:           key.Status,
+			ExpiredAt:           key.ExpiredAt,
+			DeviceInfo:          key.DeviceInfo,
+			IsActivated:         key.ActivatedAt != nil,
+		})
+	}
+
+	return &sale, details, nil
+}
+
+// saleDetailResponse 构建销售记录详情响应
+func saleDetailResponse(c *fiber.Ctx, sale *models.SalespersonSale, items []saleItemDetail) error {
+	var activated, unused, void int
+	for _, item := range items {
+		switch item.KeyStatus {
+		case "used":
+			activated++
+		case "unused":
+			unused++
+		case "void":
+			void++
+		}
+	}
+	summary := fiber.Map{
+		"total":     len(items),
+		"activated": activated,
+		"unused":    unused,
+		"void":      void,
+	}
+
+	return c.JSON(fiber.Map{
+		"data": fiber.Map{
+			"sale":    sale,
+			"items":   items,
+			"summary": summary,
+		},
+	})
+}
+
+// GetSaleDetail 获取销售记录详情（管理员）
+// 返回销售记录及其包含的每张卡密的激活状态
+func GetSaleDetail(c *fiber.Ctx) error {
+	// 获取销售记录ID
+	saleID, err := strconv.Atoi(c.Params("id"))
+	if err != nil || saleID <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的销售记录ID",
+		})
+	}
+
+	sale, items, err := loadSaleDetail(uint(saleID), 0)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "销售记录不存在",
+			})
+		}
+		log.Printf("查询销售记录详情失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询销售记录详情失败",
+		})
+	}
+
+	return saleDetailResponse(c, sale, items)
+}
+
+// GetSalespersonOwnSaleDetail 获取销售员自己的销售记录详情
+func GetSalespersonOwnSaleDetail(c *fiber.Ctx) error {
+	// 从上下文中获取销售员ID
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "未找到销售员身份信息",
+		})
+	}
+	salespersonID := auth.SalespersonID
+
+	// 获取销售记录ID
+	saleID, err := strconv.Atoi(c.Params("id"))
+	if err != nil || saleID <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的销售记录ID",
+		})
+	}
+
+	sale, items, err := loadSaleDetail(uint(saleID), salespersonID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "销售记录不存在",
+			})
+		}
+		log.Printf("查询销售记录详情失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询销售记录详情失败",
+		})
+	}
+
+	return saleDetailResponse(c, sale, items)
+}
+
+// saleCancelResult 取消销售记录的处理结果
+type saleCancelResult struct {
+	VoidedKeys          int64   `json:"voided_keys"`           // 作废的卡密数量
+	ActivatedKeys       int64   `json:"activated_keys"`        // 已激活的卡密数量
+	RevokedKeys         int64   `json:"revoked_keys"`          // 加入黑名单的已激活卡密数量
+	ReversedSales       float64 `json:"reversed_sales"`        // 冲减的销售额
+	ReversedCommission  float64 `json:"reversed_commission"`   // 冲减的销售员已确认佣金
+	ReversedAgentAmount float64 `json:"reversed_agent_amount"` // 冲减的上级代理已确认佣金合计
+}
+
+// cancelSaleInTx 在事务中取消销售记录
+// 作废该销售记录下所有未使用的卡密，冲减销售员与上级代理的佣金及统计数据，并记录取消原因
+// 取消即全额退款，所有销售明细标记为已退款，销售明细的佣金全部取消，与冲减的统计数据保持一致
+// 参数:
+//   - tx: 数据库事务
+//   - saleID: 销售记录ID
+//   - reason: 取消原因
+//   - allowActivated: 存在已激活卡密时是否仍然取消（已激活的卡密加入黑名单）
+func cancelSaleInTx(tx *gorm.DB, saleID uint, reason string, allowActivated bool) (*models.SalespersonSale, *saleCancelResult, error) {
+	// 锁定销售记录，与佣金确认互斥，保证冲减的是最新的已确认佣金
+	var sale models.SalespersonSale
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&sale, saleID).Error; err != nil {
+		return nil, nil, err
+	}
+
+	// 只有待结算的销售记录可以取消，已结算的佣金已经支付，不能直接冲减
+	if sale.Status != "pending" {
+		return &sale, nil, errSaleNotCancellable
+	}
+
+	result := &saleCancelResult{}
+
+	// 统计已激活的卡密
+	keysQuery := tx.Model(&models.Key{}).Where("sale_id = ?", sale.ID)
+	if sale.KeyID != 0 {
+		keysQuery = tx.Model(&models.Key{}).Where("sale_id = ? OR id = ?", sale.ID, sale.KeyID)
+	}
+	if err := keysQuery.Session(&gorm.Session{}).Where("status = ?", "used").Count(&result.ActivatedKeys).Error; err != nil {
+		return &sale, nil, fmt.Errorf("统计已激活卡密失败: %w", err)
+	}
+	if result.ActivatedKeys > 0 && !allowActivated {
+		return &sale, result, errSaleHasActivatedKeys
+	}
+
+	// 先以条件更新的方式占用销售记录，防止并发重复取消
+	now := time.Now()
+	update := tx.Model(&models.SalespersonSale{}).Where("id = ? AND status = ?", sale.ID, "pending").
+		Updates(map[string]interface{}{
+			"status":        "cancelled",
+			"cancelled_at":  now,
+			"cancel_reason": reason,
+		})
+	if update.Error != nil {
+		return &sale, nil, fmt.Errorf("更新销售记录状态失败: %w", update.Error)
+	}
+	if update.RowsAffected == 0 {
+		return &sale, nil, errSaleNotCancellable
+	}
+
+	// 作废未使用的卡密
+	voided := keysQuery.Session(&gorm.Session{}).Where("status = ?", "unused").Update("status", "void")
+	if voided.Error != nil {
+		return &sale, nil, fmt.Errorf("作废卡密失败: %w", voided.Error)
+	}
+	result.VoidedKeys = voided.RowsAffected
+
+	// 已激活的卡密随退款一起失效
+	if result.ActivatedKeys > 0 {
+		revoked := keysQuery.Session(&gorm.Session{}).Where("status = ?", "used").Update("is_blacklisted", true)
+		if revoked.Error != nil {
+			return &sale, nil, fmt.Errorf("已激活卡密加入黑名单失败: %w", revoked.Error)
+		}
+		result.RevokedKeys = revoked.RowsAffected
+	}
+
+	// 所有销售明细标记为已退款，佣金随销售额一起全部冲减
+	if err := tx.Model(&models.SalespersonSaleItem{}).Where("sale_id = ?", sale.ID).
+		Updates(map[string]interface{}{
+			"status":            "refunded",
+			"refunded_at":       now,
+			"commission_status": "cancelled",
+		}).Error; err != nil {
+		return &sale, nil, fmt.Errorf("更新销售明细状态失败: %w", err)
+	}
+
+	// 退回优惠码的使用次数
+	if err := releaseCouponRedemptions(tx, sale.ID, now); err != nil {
+		return &sale, nil, fmt.Errorf("退回优惠码使用次数失败: %w", err)
+	}
+
+	// 冲减销售员的总销售额和已确认的佣金
+	if err := tx.Model(&models.Salesperson{}).Where("id = ?", sale.SalespersonID).
+		UpdateColumns(map[string]interface{}{
+			"total_sales":      gorm.Expr("total_sales - ?", sale.SaleAmount),
+			"total_commission": gorm.Expr("total_commission - ?", sale.RecognizedCommission),
+		}).Error; err != nil {
+		return &sale, nil, fmt.Errorf("冲减销售员销售统计失败: %w", err)
+	}
+	result.ReversedSales = sale.SaleAmount
+	result.ReversedCommission = sale.RecognizedCommission
+
+	// 冲减上级代理已确认的佣金
+	var agentCommissions []models.SalespersonAgentCommission
+	if err := tx.Where("sale_id = ? AND status = ?", sale.ID, "pending").Find(&agentCommissions).Error; err != nil {
+		return &sale, nil, fmt.Errorf("查询代理佣金记录失败: %w", err)
+	}
+	for _, commission := range agentCommissions {
+		if err := tx.Model(&models.SalespersonAgentCommission{}).Where("id = ?", commission.ID).
+			Update("status", "cancelled").Error; err != nil {
+			return &sale, nil, fmt.Errorf("取消代理佣金记录失败: %w", err)
+		}
+		if err := tx.Model(&models.Salesperson{}).Where("id = ?", commission.AgentID).
+			UpdateColumn("total_commission", gorm.Expr("total_commission - ?", commission.RecognizedAmount)).Error; err != nil {
+			return &sale, nil, fmt.Errorf("冲减上级代理(ID:%d)佣金失败: %w", commission.AgentID, err)
+		}
+		result.ReversedAgentAmount += commission.RecognizedAmount
+	}
+
+	sale.Status = "cancelled"
+	sale.CancelledAt = &now
+	sale.CancelReason = reason
+	return &sale, result, nil
+}
+
+// CancelSale 取消销售记录（退款）
+// 作废该销售记录下未使用的卡密，冲减销售员和上级代理的佣金，所有操作在同一事务中完成
+// 请求体:
+//   - reason: 取消原因，必填
+//   - allow_activated: 存在已激活的卡密时是否仍然取消，默认拒绝；设置后已激活的卡密加入黑名单
+func CancelSale(c *fiber.Ctx) error {
+	// 获取销售记录ID
+	saleID, err := strconv.Atoi(c.Params("id"))
+	if err != nil || saleID <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的销售记录ID",
+		})
+	}
+
+	// 解析请求体
+	var request struct {
+		Reason         string `json:"reason"`
+		AllowActivated bool   `json:"allow_activated"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	if request.Reason == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "取消原因不能为空",
+		})
+	}
+
+	// 开始事务
+	tx := database.GetDB().Begin()
+	if tx.Error != nil {
+		log.Printf("开始事务失败: %v", tx.Error)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "开始事务失败",
+		})
+	}
+
+	// 使用defer确保事务在函数返回时被正确处理
+	var txCommitted bool
+	defer func() {
+		// 如果事务还没有被提交，则回滚
+		if !txCommitted {
+			tx.Rollback()
+		}
+	}()
+
+	sale, result, err := cancelSaleInTx(tx, uint(saleID), request.Reason, request.AllowActivated)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "销售记录不存在",
+			})
+		case errors.Is(err, errSaleNotCancellable):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error":  "只有待结算的销售记录可以取消",
+				"status": sale.Status,
+			})
+		case errors.Is(err, errSaleHasActivatedKeys):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error":          "该销售记录下已有卡密被激活，如需继续取消请设置allow_activated，已激活的卡密将加入黑名单",
+				"activated_keys": result.ActivatedKeys,
+			})
+		}
+		log.Printf("取消销售记录失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "取消销售记录失败: " + err.Error(),
+		})
+	}
+
+	// 提交事务
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("提交事务失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "提交事务失败",
+		})
+	}
+	txCommitted = true
+
+	log.Printf("销售记录已取消: ID=%d, 原因=%s, 作废卡密=%d", sale.ID, request.Reason, result.VoidedKeys)
+
+	return c.JSON(fiber.Map{
+		"message": "销售记录已取消",
+		"data": fiber.Map{
+			"sale":   sale,
+			"result": result,
+		},
+	})
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"gorm.io/gorm"
+
+	"go_creation/models"
+)
+
+// dependencyCheck 删除前需要检查的一类关联数据
+type dependencyCheck struct {
+	name  string   // 关联数据名称，出现在响应的dependencies中
+	query *gorm.DB // 统计关联数据数量的查询
+}
+
+// countDependencies 统计关联数据数量，只返回数量大于0的项
+func countDependencies(checks ...dependencyCheck) (map[string]int64, error) {
+	dependencies := make(map[string]int64)
+	for _, check := range checks {
+		var count int64
+		if err := check.query.Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			dependencies[check.name] = count
+		}
+	}
+	return dependencies, nil
+}
+
+// cascadeResult 级联删除时处理的关联数据数量
+type cascadeResult struct {
+	VoidedKeys          int64 `json:"voided_keys"`          // 作废的未售出卡密
+	RetainedSoldKeys    int64 `json:"retained_sold_keys"`   // 已售出未使用而保留的卡密，仍可继续激活
+	DeactivatedBindings int64 `json:"deactivated_bindings"` // 停用的软件与卡密类型绑定
+	DeactivatedProducts int64 `json:"deactivated_products"` // 停用的销售员产品分配
+}
+
+// cascadeProductDependencies 作废未售出的未使用卡密，并停用软件与卡密类型的绑定和销售员产品分配
+// column为关联字段，software_id或key_type_id（卡密表中卡密类型的字段为type_id）
+// 已通过销售记录售出的卡密买家已经付款，不作废，只统计保留的数量
+func cascadeProductDependencies(tx *gorm.DB, column string, id uint) (cascadeResult, error) {
+	var result cascadeResult
+
+	keyColumn := productKeyColumn(column)
+	keys := tx.Model(&models.Key{}).Where(keyColumn+" = ? AND status = ? AND sale_id = ?", id, "unused", 0).Update("status", "void")
+	if keys.Error != nil {
+		return result, keys.Error
+	}
+	result.VoidedKeys = keys.RowsAffected
+
+	if err := tx.Model(&models.Key{}).Where(keyColumn+" = ? AND status = ? AND sale_id <> ?", id, "unused", 0).
+		Count(&result.RetainedSoldKeys).Error; err != nil {
+		return result, err
+	}
+
+	bindings := tx.Model(&models.SoftwareKeyType{}).Where(column+" = ? AND is_active = ?", id, true).Update("is_active", false)
+	if bindings.Error != nil {
+		return result, bindings.Error
+	}
+	result.DeactivatedBindings = bindings.RowsAffected
+
+	products := tx.Model(&models.SalespersonProduct{}).Where(column+" = ? AND is_active = ?", id, true).Update("is_active", false)
+	if products.Error != nil {
+		return result, products.Error
+	}
+	result.DeactivatedProducts = products.RowsAffected
+
+	return result, nil
+}
+
+// productKeyColumn 返回卡密表中对应的关联字段，卡密类型的字段为type_id
+func productKeyColumn(column string) string {
+	if column == "key_type_id" {
+		return "type_id"
+	}
+	return column
+}
+
+// productDependencyChecks 软件或卡密类型删除前需要检查的关联数据
+// 含有已售出未使用卡密的销售记录单独列出，级联删除时这些卡密不会被作废
+func productDependencyChecks(db *gorm.DB, column string, id uint) []dependencyCheck {
+	keyColumn := productKeyColumn(column)
+	return []dependencyCheck{
+		{"unused_keys", db.Model(&models.Key{}).Where(keyColumn+" = ? AND status = ? AND sale_id = ?", id, "unused", 0)},
+		{"sales_with_unused_keys", db.Model(&models.SalespersonSale{}).Where("id IN (?)",
+			db.Model(&models.Key{}).Select("sale_id").Where(keyColumn+" = ? AND status = ? AND sale_id <> ?", id, "unused", 0))},
+		{"active_bindings", db.Model(&models.SoftwareKeyType{}).Where(column+" = ? AND is_active = ?", id, true)},
+		{"active_products", db.Model(&models.SalespersonProduct{}).Where(column+" = ? AND is_active = ?", id, true)},
+	}
+}
@@ -0,0 +1,528 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"go_creation/database"
+	"go_creation/models"
+	"go_creation/utils"
+)
+
+// announcementRequest 创建和更新公告的请求参数，更新时未传的字段保持不变
+type announcementRequest struct {
+	Title      *string    `json:"title"`
+	Content    *string    `json:"content"`
+	Severity   *string    `json:"severity"`
+	Priority   *int       `json:"priority"`
+	RequireAck *bool      `json:"require_ack"`
+	Status     *string    `json:"status"`
+	StartAt    *time.Time `json:"start_at"`
+	EndAt      *time.Time `json:"end_at"`
+	KeyTypeIDs *[]uint    `json:"key_type_ids"`
+	MinVersion *string    `json:"min_version"`
+	MaxVersion *string    `json:"max_version"`
+	Channels   *[]string  `json:"channels"`
+}
+
+// apply 校验请求参数并写入公告
+func (r *announcementRequest) apply(db *gorm.DB, announcement *models.SoftwareAnnouncement) error {
+	if r.Title != nil {
+		announcement.Title = strings.TrimSpace(*r.Title)
+	}
+	if announcement.Title == "" || len(announcement.Title) > 200 {
+		return errors.New("标题不能为空且不能超过200个字符")
+	}
+	if r.Content != nil {
+		announcement.Content = *r.Content
+	}
+	if r.Severity != nil {
+		if !models.IsValidAnnouncementSeverity(*r.Severity) {
+			return errors.New("无效的严重程度，可选值：info, warning, critical")
+		}
+		announcement.Severity = *r.Severity
+	}
+	if r.Priority != nil {
+		announcement.Priority = *r.Priority
+	}
+	if r.RequireAck != nil {
+		announcement.RequireAck = *r.RequireAck
+	}
+	if r.Status != nil {
+		if *r.Status != "active" && *r.Status != "inactive" {
+			return errors.New("无效的状态，可选值：active, inactive")
+		}
+		announcement.Status = *r.Status
+	}
+	if r.StartAt != nil {
+		announcement.StartAt = r.StartAt
+	}
+	if r.EndAt != nil {
+		announcement.EndAt = r.EndAt
+	}
+	if announcement.StartAt != nil && announcement.EndAt != nil && !announcement.EndAt.After(*announcement.StartAt) {
+		return errors.New("结束时间必须晚于开始时间")
+	}
+
+	if r.KeyTypeIDs != nil {
+		ids := make([]string, 0, len(*r.KeyTypeIDs))
+		if len(*r.KeyTypeIDs) > 0 {
+			var count int64
+			if err := db.Model(&models.KeyType{}).Where("id IN ?", *r.KeyTypeIDs).Count(&count).Error; err != nil {
+				return err
+			}
+			if int(count) != len(*r.KeyTypeIDs) {
+				return errors.New("卡密类型不存在或有重复")
+			}
+			for _, id := range *r.KeyTypeIDs {
+				ids = append(ids, strconv.FormatUint(uint64(id), 10))
+			}
+		}
+		announcement.KeyTypeIDs = strings.Join(ids, ",")
+	}
+
+	if r.MinVersion != nil {
+		announcement.MinVersion = ""
+		if *r.MinVersion != "" {
+			v, err := utils.ParseSemver(*r.MinVersion)
+			if err != nil {
+				return err
+			}
+			announcement.MinVersion = v.String()
+		}
+	}
+	if r.MaxVersion != nil {
+		announcement.MaxVersion = ""
+		if *r.MaxVersion != "" {
+			v, err := utils.ParseSemver(*r.MaxVersion)
+			if err != nil {
+				return err
+			}
+			announcement.MaxVersion = v.String()
+		}
+	}
+	if announcement.MinVersion != "" && announcement.MaxVersion != "" {
+		if c, _ := utils.CompareVersions(announcement.MinVersion, announcement.MaxVersion); c > 0 {
+			return errors.New("最低版本不能高于最高版本")
+		}
+	}
+
+	if r.Channels != nil {
+		for _, channel := range *r.Channels {
+			if !models.IsValidReleaseChannel(channel) {
+				return errors.New("无效的发布渠道，可选值：stable, beta")
+			}
+		}
+		announcement.Channels = strings.Join(*r.Channels, ",")
+	}
+	return nil
+}
+
+// announcementMatches 判断公告是否面向指定的客户端
+// keyTypeID为0表示客户端未提供卡密类型，clientVersion为空表示未提供版本
+func announcementMatches(announcement *models.SoftwareAnnouncement, keyTypeID uint, clientVersion *utils.Semver, channel string) bool {
+	if announcement.KeyTypeIDs != "" {
+		if keyTypeID == 0 || !containsCSV(announcement.KeyTypeIDs, strconv.FormatUint(uint64(keyTypeID), 10)) {
+			return false
+		}
+	}
+	if announcement.Channels != "" && !containsCSV(announcement.Channels, channel) {
+		return false
+	}
+	if announcement.MinVersion != "" || announcement.MaxVersion != "" {
+		if clientVersion == nil {
+			return false
+		}
+		if min, err := utils.ParseSemver(announcement.MinVersion); err == nil && clientVersion.Compare(min) < 0 {
+			return false
+		}
+		if max, err := utils.ParseSemver(announcement.MaxVersion); err == nil && clientVersion.Compare(max) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// containsCSV 判断逗号分隔的列表中是否包含指定值
+func containsCSV(list, value string) bool {
+	for _, item := range strings.Split(list, ",") {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// findAnnouncement 查询属于指定软件的公告，失败时已写入错误响应
+func findAnnouncement(c *fiber.Ctx, softwareID uint) (*models.SoftwareAnnouncement, error) {
+	id, err := strconv.Atoi(c.Params("announcement_id"))
+	if err != nil || id <= 0 {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的公告ID",
+		})
+	}
+
+	var announcement models.SoftwareAnnouncement
+	if err := database.GetDB().Where("id = ? AND software_id = ?", id, softwareID).First(&announcement).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "公告不存在",
+			})
+		}
+		log.Printf("查询公告失败: %v", err)
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询公告失败",
+		})
+	}
+	return &announcement, nil
+}
+
+// CreateSoftwareAnnouncement 管理员为软件创建公告
+// 请求体见announcementRequest，title必填；key_type_ids、min_version、max_version、channels为定向条件
+func CreateSoftwareAnnouncement(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+
+	var request announcementRequest
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	announcement := models.SoftwareAnnouncement{
+		SoftwareID: software.ID,
+		Severity:   models.AnnouncementSeverityInfo,
+		Status:     "active",
+	}
+	if err := request.apply(database.GetDB(), &announcement); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if err := database.GetDB().Create(&announcement).Error; err != nil {
+		log.Printf("创建公告失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "创建公告失败",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "公告创建成功",
+		"data":    announcement,
+	})
+}
+
+// GetSoftwareAnnouncements 管理员查看软件的所有公告及阅读、确认人数
+func GetSoftwareAnnouncements(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+
+	db := database.GetDB()
+	var announcements []models.SoftwareAnnouncement
+	if err := db.Where("software_id = ?", software.ID).
+		Order("priority DESC, id DESC").Find(&announcements).Error; err != nil {
+		log.Printf("查询公告失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询公告失败",
+		})
+	}
+
+	// 统计阅读和确认人数
+	ids := make([]uint, 0, len(announcements))
+	for _, announcement := range announcements {
+		ids = append(ids, announcement.ID)
+	}
+	type receiptStat struct {
+		AnnouncementID uint
+		ReadCount      int64
+		AckCount       int64
+	}
+	var stats []receiptStat
+	if len(ids) > 0 {
+		if err := db.Model(&models.SoftwareAnnouncementReceipt{}).
+			Select("announcement_id, COUNT(*) AS read_count, COUNT(acked_at) AS ack_count").
+			Where("announcement_id IN ?", ids).
+			Group("announcement_id").
+			Scan(&stats).Error; err != nil {
+			log.Printf("统计公告阅读人数失败: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "查询公告失败",
+			})
+		}
+	}
+	statMap := make(map[uint]receiptStat, len(stats))
+	for _, stat := range stats {
+		statMap[stat.AnnouncementID] = stat
+	}
+
+	now := time.Now()
+	result := make([]fiber.Map, 0, len(announcements))
+	for _, announcement := range announcements {
+		live := announcement.Status == "active" &&
+			(announcement.StartAt == nil || !announcement.StartAt.After(now)) &&
+			(announcement.EndAt == nil || announcement.EndAt.After(now))
+		result = append(result, fiber.Map{
+			"announcement": announcement,
+			"live":         live,
+			"read_count":   statMap[announcement.ID].ReadCount,
+			"ack_count":    statMap[announcement.ID].AckCount,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"total": len(result),
+		"data":  result,
+	})
+}
+
+// UpdateSoftwareAnnouncement 管理员更新公告，未传的字段保持不变
+func UpdateSoftwareAnnouncement(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+	announcement, err := findAnnouncement(c, software.ID)
+	if announcement == nil {
+		return err
+	}
+
+	var request announcementRequest
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+	if err := request.apply(database.GetDB(), announcement); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if err := database.GetDB().Save(announcement).Error; err != nil {
+		log.Printf("更新公告失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "更新公告失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "公告更新成功",
+		"data":    announcement,
+	})
+}
+
+// DeleteSoftwareAnnouncement 管理员删除公告及其阅读回执
+func DeleteSoftwareAnnouncement(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+	announcement, err := findAnnouncement(c, software.ID)
+	if announcement == nil {
+		return err
+	}
+
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("announcement_id = ?", announcement.ID).Delete(&models.SoftwareAnnouncementReceipt{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(announcement).Error
+	})
+	if err != nil {
+		log.Printf("删除公告失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "删除公告失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "公告删除成功",
+	})
+}
+
+// GetActiveAnnouncements 客户端获取当前生效的公告
+// 查询参数:
+//   - version: 客户端版本，不传时不会收到限定了版本范围的公告
+//   - channel: 发布渠道，stable或beta，默认stable
+//   - key_type_id / code: 客户端使用的卡密类型，或卡密码（由服务端查出卡密类型）
+//
+// 响应带有ETag，客户端在If-None-Match中带上次的ETag，公告没有变化时返回304
+func GetActiveAnnouncements(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+
+	var clientVersion *utils.Semver
+	if version := c.Query("version"); version != "" {
+		v, err := utils.ParseSemver(version)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		clientVersion = &v
+	}
+	channel, ok := parseClientChannel(c.Query("channel"))
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的发布渠道，可选值：stable, beta",
+		})
+	}
+
+	db := database.GetDB()
+	keyTypeID := uint(c.QueryInt("key_type_id"))
+	if code := c.Query("code"); code != "" && keyTypeID == 0 {
+		var key models.Key
+		if err := db.Select("type_id").Where("code = ? AND software_id = ?", code, software.ID).First(&key).Error; err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				log.Printf("查询卡密失败: %v", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "查询公告失败",
+				})
+			}
+		} else {
+			keyTypeID = key.TypeID
+		}
+	}
+
+	now := time.Now()
+	var announcements []models.SoftwareAnnouncement
+	if err := db.Where("software_id = ? AND status = ?", software.ID, "active").
+		Where("start_at IS NULL OR start_at <= ?", now).
+		Where("end_at IS NULL OR end_at > ?", now).
+		Order("priority DESC, id DESC").
+		Find(&announcements).Error; err != nil {
+		log.Printf("查询公告失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询公告失败",
+		})
+	}
+
+	result := make([]fiber.Map, 0, len(announcements))
+	for i := range announcements {
+		announcement := &announcements[i]
+		if !announcementMatches(announcement, keyTypeID, clientVersion, channel) {
+			continue
+		}
+		result = append(result, fiber.Map{
+			"id":          announcement.ID,
+			"title":       announcement.Title,
+			"content":     announcement.Content,
+			"severity":    announcement.Severity,
+			"priority":    announcement.Priority,
+			"require_ack": announcement.RequireAck,
+			"start_at":    announcement.StartAt,
+			"end_at":      announcement.EndAt,
+			"updated_at":  announcement.UpdatedAt,
+		})
+	}
+
+	body, err := json.Marshal(fiber.Map{
+		"total": len(result),
+		"data":  result,
+	})
+	if err != nil {
+		log.Printf("序列化公告失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询公告失败",
+		})
+	}
+
+	// 内容相同则ETag相同，客户端可以用If-None-Match避免重复下载
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	for _, candidate := range strings.Split(c.Get(fiber.HeaderIfNoneMatch), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(body)
+}
+
+// recordAnnouncementReceipt 记录客户端阅读或确认公告
+func recordAnnouncementReceipt(c *fiber.Ctx, ack bool) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+	announcement, err := findAnnouncement(c, software.ID)
+	if announcement == nil {
+		return err
+	}
+
+	var request struct {
+		ClientID string `json:"client_id"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+	request.ClientID = strings.TrimSpace(request.ClientID)
+	if request.ClientID == "" || len(request.ClientID) > 100 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "客户端标识不能为空且不能超过100个字符",
+		})
+	}
+
+	now := time.Now()
+	receipt := models.SoftwareAnnouncementReceipt{
+		AnnouncementID: announcement.ID,
+		ClientID:       request.ClientID,
+		ReadAt:         now,
+	}
+	onConflict := clause.OnConflict{DoNothing: true}
+	if ack {
+		// 确认同时视为已读，重复确认保留首次确认时间
+		receipt.AckedAt = &now
+		onConflict = clause.OnConflict{
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"acked_at": gorm.Expr("COALESCE(acked_at, ?)", now),
+			}),
+		}
+	}
+	if err := database.GetDB().Clauses(onConflict).Create(&receipt).Error; err != nil {
+		log.Printf("记录公告回执失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "记录公告回执失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "记录成功",
+	})
+}
+
+// MarkAnnouncementRead 客户端标记公告已读
+// 请求体: client_id 客户端标识，如设备ID
+func MarkAnnouncementRead(c *fiber.Ctx) error {
+	return recordAnnouncementReceipt(c, false)
+}
+
+// AckAnnouncement 客户端确认公告
+// 请求体: client_id 客户端标识，如设备ID
+func AckAnnouncement(c *fiber.Ctx) error {
+	return recordAnnouncementReceipt(c, true)
+}
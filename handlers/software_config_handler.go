@@ -0,0 +1,551 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"go_creation/database"
+	"go_creation/models"
+	"go_creation/utils"
+)
+
+// configKeyPattern 配置项名称格式，字母开头，可包含字母、数字、下划线、点和短横线
+var configKeyPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.\-]{0,99}$`)
+
+// normalizeConfigValue 按值类型校验配置值，返回规范化的JSON编码
+func normalizeConfigValue(valueType string, raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return "", errors.New("配置值不能为空")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", errors.New("配置值不是有效的JSON")
+	}
+
+	switch valueType {
+	case models.ConfigValueString:
+		if _, ok := value.(string); !ok {
+			return "", errors.New("配置值必须是字符串")
+		}
+	case models.ConfigValueInt:
+		n, ok := value.(json.Number)
+		if !ok {
+			return "", errors.New("配置值必须是整数")
+		}
+		if _, err := n.Int64(); err != nil {
+			return "", errors.New("配置值必须是整数")
+		}
+	case models.ConfigValueFloat:
+		n, ok := value.(json.Number)
+		if !ok {
+			return "", errors.New("配置值必须是数字")
+		}
+		if _, err := n.Float64(); err != nil {
+			return "", errors.New("配置值必须是数字")
+		}
+	case models.ConfigValueBool:
+		if _, ok := value.(bool); !ok {
+			return "", errors.New("配置值必须是布尔值")
+		}
+	case models.ConfigValueJSON:
+	default:
+		return "", errors.New("无效的值类型，可选值：string, int, float, bool, json")
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return "", errors.New("配置值不是有效的JSON")
+	}
+	return buf.String(), nil
+}
+
+// resolveClientConfig 解析软件对指定卡密生效的配置
+// 优先级：卡密覆盖 > 卡密类型覆盖 > 默认值
+func resolveClientConfig(db *gorm.DB, softwareID, keyTypeID, keyID uint) (map[string]interface{}, error) {
+	config := make(map[string]interface{})
+
+	var items []models.SoftwareConfigItem
+	if err := db.Where("software_id = ?", softwareID).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return config, nil
+	}
+
+	ids := make([]uint, 0, len(items))
+	values := make(map[uint]string, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ID)
+		values[item.ID] = item.DefaultValue
+	}
+
+	var overrides []models.SoftwareConfigOverride
+	if err := db.Where("config_item_id IN ?", ids).
+		Where("(scope = ? AND target_id = ?) OR (scope = ? AND target_id = ?)",
+			models.ConfigScopeKeyType, keyTypeID, models.ConfigScopeKey, keyID).
+		Find(&overrides).Error; err != nil {
+		return nil, err
+	}
+	// 先应用卡密类型的覆盖，再应用卡密的覆盖
+	for _, scope := range []string{models.ConfigScopeKeyType, models.ConfigScopeKey} {
+		for _, override := range overrides {
+			if override.Scope == scope {
+				values[override.ConfigItemID] = override.Value
+			}
+		}
+	}
+
+	for _, item := range items {
+		var value interface{}
+		if err := json.Unmarshal([]byte(values[item.ID]), &value); err != nil {
+			log.Printf("配置项%s的值无效: %v", item.Key, err)
+			continue
+		}
+		config[item.Key] = value
+	}
+	return config, nil
+}
+
+// clientConfigResponse 生成卡密的配置和签名后的配置令牌
+func clientConfigResponse(db *gorm.DB, key *models.Key) (fiber.Map, error) {
+	config, err := resolveClientConfig(db, key.SoftwareID, key.TypeID, key.ID)
+	if err != nil {
+		return nil, err
+	}
+	token, err := utils.SignClientConfig(utils.ClientConfigClaims{
+		SoftwareID: key.SoftwareID,
+		KeyID:      key.ID,
+		Code:       key.Code,
+		KeyTypeID:  key.TypeID,
+		Config:     config,
+	}, key.ExpiredAt)
+	if err != nil {
+		return nil, err
+	}
+	return fiber.Map{
+		"config":       config,
+		"config_token": token,
+	}, nil
+}
+
+// findConfigItem 查询属于指定软件的配置项，失败时已写入错误响应
+func findConfigItem(c *fiber.Ctx, softwareID uint) (*models.SoftwareConfigItem, error) {
+	id, err := strconv.Atoi(c.Params("item_id"))
+	if err != nil || id <= 0 {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的配置项ID",
+		})
+	}
+
+	var item models.SoftwareConfigItem
+	if err := database.GetDB().Where("id = ? AND software_id = ?", id, softwareID).First(&item).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "配置项不存在",
+			})
+		}
+		log.Printf("查询配置项失败: %v", err)
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询配置项失败",
+		})
+	}
+	return &item, nil
+}
+
+// GetSoftwareConfig 管理员查看软件的配置项及其覆盖值
+func GetSoftwareConfig(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+
+	db := database.GetDB()
+	var items []models.SoftwareConfigItem
+	if err := db.Where("software_id = ?", software.ID).Order("config_key").Find(&items).Error; err != nil {
+		log.Printf("查询配置项失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询配置项失败",
+		})
+	}
+
+	ids := make([]uint, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	overridesByItem := make(map[uint][]models.SoftwareConfigOverride)
+	if len(ids) > 0 {
+		var overrides []models.SoftwareConfigOverride
+		if err := db.Where("config_item_id IN ?", ids).Order("scope, target_id").Find(&overrides).Error; err != nil {
+			log.Printf("查询配置覆盖值失败: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "查询配置项失败",
+			})
+		}
+		for _, override := range overrides {
+			overridesByItem[override.ConfigItemID] = append(overridesByItem[override.ConfigItemID], override)
+		}
+	}
+
+	result := make([]fiber.Map, 0, len(items))
+	for _, item := range items {
+		overrides := overridesByItem[item.ID]
+		if overrides == nil {
+			overrides = []models.SoftwareConfigOverride{}
+		}
+		result = append(result, fiber.Map{
+			"item":      item,
+			"overrides": overrides,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"total": len(result),
+		"data":  result,
+	})
+}
+
+// CreateSoftwareConfigItem 管理员为软件创建配置项
+// 请求体:
+//   - key: 配置项名称，必填
+//   - value_type: 值类型，string, int, float, bool, json
+//   - default_value: 默认值，必须符合值类型
+//   - description: 说明
+func CreateSoftwareConfigItem(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+
+	var request struct {
+		Key          string          `json:"key"`
+		ValueType    string          `json:"value_type"`
+		DefaultValue json.RawMessage `json:"default_value"`
+		Description  string          `json:"description"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	if !configKeyPattern.MatchString(request.Key) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "配置项名称必须以字母开头，只能包含字母、数字、下划线、点和短横线，且不超过100个字符",
+		})
+	}
+	if !models.IsValidConfigValueType(request.ValueType) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的值类型，可选值：string, int, float, bool, json",
+		})
+	}
+	value, err := normalizeConfigValue(request.ValueType, request.DefaultValue)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	item := models.SoftwareConfigItem{
+		SoftwareID:   software.ID,
+		Key:          request.Key,
+		ValueType:    request.ValueType,
+		DefaultValue: value,
+		Description:  request.Description,
+	}
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.SoftwareConfigItem{}).
+			Where("software_id = ? AND config_key = ?", software.ID, item.Key).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "配置项名称已存在")
+		}
+		return tx.Create(&item).Error
+	})
+	if err != nil {
+		if e, ok := err.(*fiber.Error); ok {
+			return c.Status(e.Code).JSON(fiber.Map{
+				"error": e.Message,
+			})
+		}
+		log.Printf("创建配置项失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "创建配置项失败",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "配置项创建成功",
+		"data":    item,
+	})
+}
+
+// UpdateSoftwareConfigItem 管理员更新配置项的默认值和说明
+// 值类型创建后不能修改，需要修改时应删除后重新创建
+func UpdateSoftwareConfigItem(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+	item, err := findConfigItem(c, software.ID)
+	if item == nil {
+		return err
+	}
+
+	var request struct {
+		DefaultValue json.RawMessage `json:"default_value"`
+		Description  *string         `json:"description"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	updates := map[string]interface{}{}
+	if len(request.DefaultValue) > 0 {
+		value, err := normalizeConfigValue(item.ValueType, request.DefaultValue)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		updates["default_value"] = value
+	}
+	if request.Description != nil {
+		updates["description"] = *request.Description
+	}
+	if len(updates) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "没有需要更新的字段",
+		})
+	}
+
+	if err := database.GetDB().Model(item).Updates(updates).Error; err != nil {
+		log.Printf("更新配置项失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "更新配置项失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "配置项更新成功",
+		"data":    item,
+	})
+}
+
+// DeleteSoftwareConfigItem 管理员删除配置项及其所有覆盖值
+func DeleteSoftwareConfigItem(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+	item, err := findConfigItem(c, software.ID)
+	if item == nil {
+		return err
+	}
+
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("config_item_id = ?", item.ID).Delete(&models.SoftwareConfigOverride{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(item).Error
+	})
+	if err != nil {
+		log.Printf("删除配置项失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "删除配置项失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "配置项删除成功",
+	})
+}
+
+// validateConfigOverrideTarget 校验覆盖范围和目标
+// 卡密类型必须已绑定到该软件，卡密必须属于该软件
+func validateConfigOverrideTarget(db *gorm.DB, softwareID uint, scope string, targetID uint) error {
+	if targetID == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "目标ID不能为空")
+	}
+	var count int64
+	switch scope {
+	case models.ConfigScopeKeyType:
+		if err := db.Model(&models.SoftwareKeyType{}).
+			Where("software_id = ? AND key_type_id = ?", softwareID, targetID).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "卡密类型不存在或未绑定到该软件")
+		}
+	case models.ConfigScopeKey:
+		if err := db.Model(&models.Key{}).
+			Where("id = ? AND software_id = ?", targetID, softwareID).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "卡密不存在或不属于该软件")
+		}
+	default:
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("无效的覆盖范围，可选值：%s, %s", models.ConfigScopeKeyType, models.ConfigScopeKey))
+	}
+	return nil
+}
+
+// SetSoftwareConfigOverride 管理员设置配置项的覆盖值
+// 请求体:
+//   - scope: 覆盖范围，key_type或key
+//   - target_id: 卡密类型ID或卡密ID
+//   - value: 覆盖值，必须符合配置项的值类型
+func SetSoftwareConfigOverride(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+	item, err := findConfigItem(c, software.ID)
+	if item == nil {
+		return err
+	}
+
+	var request struct {
+		Scope    string          `json:"scope"`
+		TargetID uint            `json:"target_id"`
+		Value    json.RawMessage `json:"value"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	value, err := normalizeConfigValue(item.ValueType, request.Value)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	db := database.GetDB()
+	if err := validateConfigOverrideTarget(db, software.ID, request.Scope, request.TargetID); err != nil {
+		if e, ok := err.(*fiber.Error); ok {
+			return c.Status(e.Code).JSON(fiber.Map{
+				"error": e.Message,
+			})
+		}
+		log.Printf("校验配置覆盖目标失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "设置覆盖值失败",
+		})
+	}
+
+	override := models.SoftwareConfigOverride{
+		ConfigItemID: item.ID,
+		Scope:        request.Scope,
+		TargetID:     request.TargetID,
+		Value:        value,
+	}
+	if err := db.Clauses(clause.OnConflict{
+		DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at"}),
+	}).Create(&override).Error; err != nil {
+		log.Printf("设置配置覆盖值失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "设置覆盖值失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "覆盖值设置成功",
+		"data":    override,
+	})
+}
+
+// DeleteSoftwareConfigOverride 管理员删除配置项的覆盖值
+// 查询参数: scope 覆盖范围，target_id 卡密类型ID或卡密ID
+func DeleteSoftwareConfigOverride(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+	item, err := findConfigItem(c, software.ID)
+	if item == nil {
+		return err
+	}
+
+	result := database.GetDB().
+		Where("config_item_id = ? AND scope = ? AND target_id = ?", item.ID, c.Query("scope"), c.QueryInt("target_id")).
+		Delete(&models.SoftwareConfigOverride{})
+	if result.Error != nil {
+		log.Printf("删除配置覆盖值失败: %v", result.Error)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "删除覆盖值失败",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "覆盖值不存在",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "覆盖值删除成功",
+	})
+}
+
+// PreviewSoftwareConfig 管理员预览指定卡密类型或卡密生效的配置
+// 查询参数: key_type_id 卡密类型ID，key_id 卡密ID（指定卡密时使用卡密的类型）
+func PreviewSoftwareConfig(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+
+	db := database.GetDB()
+	keyTypeID, keyID := uint(c.QueryInt("key_type_id")), uint(c.QueryInt("key_id"))
+	if keyID > 0 {
+		var key models.Key
+		if err := db.Where("id = ? AND software_id = ?", keyID, software.ID).First(&key).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "卡密不存在或不属于该软件",
+				})
+			}
+			log.Printf("查询卡密失败: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "查询卡密失败",
+			})
+		}
+		keyTypeID = key.TypeID
+	}
+
+	config, err := resolveClientConfig(db, software.ID, keyTypeID, keyID)
+	if err != nil {
+		log.Printf("解析配置失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "解析配置失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"key_type_id": keyTypeID,
+		"key_id":      keyID,
+		"config":      config,
+	})
+}
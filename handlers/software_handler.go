@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"log"
 	"strconv"
 	"time"
@@ -240,7 +241,9 @@ func UpdateSoftware(c *fiber.Ctx) error {
 	})
 }
 
-// DeleteSoftware 删除软件
+// DeleteSoftware 删除软件（软删除）
+// 存在未使用的卡密、有效的卡密类型绑定或销售员产品分配时拒绝删除，
+// 查询参数cascade=true时作废未使用的卡密并停用绑定和产品分配后删除
 func DeleteSoftware(c *fiber.Ctx) error {
 	// 获取软件ID
 	id, err := strconv.Atoi(c.Params("id"))
@@ -260,8 +263,39 @@ func DeleteSoftware(c *fiber.Ctx) error {
 		})
 	}
 
-	// 删除软件
-	if err := database.GetDB().Delete(&software).Error; err != nil {
+	// 检查关联数据：未售出的卡密、含有未使用卡密的销售记录、有效的卡密类型绑定和销售员产品分配
+	db := database.GetDB()
+	dependencies, err := countDependencies(productDependencyChecks(db, "software_id", software.ID)...)
+	if err != nil {
+		log.Printf("检查软件关联数据失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "检查软件关联数据失败",
+		})
+	}
+	cascade := c.QueryBool("cascade")
+	if len(dependencies) > 0 && !cascade {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success":      false,
+			"error":        "软件存在关联数据，请先处理或使用cascade=true级联删除",
+			"dependencies": dependencies,
+		})
+	}
+
+	// 软删除软件，级联时作废未售出的未使用卡密并停用绑定和产品分配
+	// 发布版本、公告和远程配置保留，恢复软件后继续生效
+	var result cascadeResult
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if cascade {
+			var err error
+			if result, err = cascadeProductDependencies(tx, "software_id", software.ID); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&software).Error
+	})
+	if err != nil {
+		log.Printf("删除软件失败: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"success": false,
 			"error":   "删除软件失败: " + err.Error(),
@@ -271,6 +305,67 @@ func DeleteSoftware(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{
 		"success": true,
 		"message": "软件删除成功",
+		"cascade": result,
+	})
+}
+
+// RestoreSoftware 恢复已删除的软件
+// 级联删除时作废的卡密和停用的绑定、产品分配不会自动恢复
+func RestoreSoftware(c *fiber.Ctx) error {
+	// 获取软件ID
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "无效的软件ID",
+		})
+	}
+
+	// 查询已删除的软件
+	var software models.Software
+	if err := database.GetDB().Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id).First(&software).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "软件不存在或未被删除",
+			})
+		}
+		log.Printf("查询软件失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "查询软件失败",
+		})
+	}
+
+	// 删除后可能已经创建了同名软件
+	var count int64
+	if err := database.GetDB().Model(&models.Software{}).Where("name = ?", software.Name).Count(&count).Error; err != nil {
+		log.Printf("查询软件失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "查询软件失败",
+		})
+	}
+	if count > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"success": false,
+			"error":   "已存在同名软件，无法恢复",
+		})
+	}
+
+	if err := database.GetDB().Unscoped().Model(&software).Update("deleted_at", nil).Error; err != nil {
+		log.Printf("恢复软件失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "恢复软件失败",
+		})
+	}
+	software.DeletedAt = gorm.DeletedAt{}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "软件恢复成功",
+		"data":    software,
 	})
 }
 
@@ -374,9 +469,13 @@ func DeactivateSoftware(c *fiber.Ctx) error {
 func BindKeyType(c *fiber.Ctx) error {
 	// 解析请求参数
 	type BindRequest struct {
-		SoftwareID uint `json:"software_id"`
-		KeyTypeID  uint `json:"key_type_id"`
-		CreatorID  uint `json:"creator_id"`
+		SoftwareID     uint     `json:"software_id"`
+		KeyTypeID      uint     `json:"key_type_id"`
+		CreatorID      uint     `json:"creator_id"`
+		Price          *float64 `json:"price"`           // 该软件的价格，为空时使用卡密类型的价格
+		Hours          *int     `json:"hours"`           // 该软件的有效期（小时），为空时使用卡密类型的有效期
+		DurationUnit   *string  `json:"duration_unit"`   // 该软件的有效期单位，设置后优先于hours
+		DurationAmount *int     `json:"duration_amount"` // 该软件的有效期数量，永久时可不传
 	}
 
 	var req BindRequest
@@ -386,6 +485,14 @@ func BindKeyType(c *fiber.Ctx) error {
 		})
 	}
 
+	// 验证价格和有效期覆盖
+	duration, err := validateBindingOverrides(req.Price, req.Hours, req.DurationUnit, req.DurationAmount)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
 	// 验证软件是否存在
 	var software models.Software
 	if err := database.GetDB().First(&software, req.SoftwareID).Error; err != nil {
@@ -417,7 +524,9 @@ func BindKeyType(c *fiber.Ctx) error {
 		KeyTypeID:  req.KeyTypeID,
 		IsActive:   true,
 		CreatorID:  req.CreatorID,
+		Price:      req.Price,
 	}
+	binding.SetDurationOverride(duration)
 
 	if err := database.GetDB().Create(&binding).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -523,26 +632,40 @@ func GetSoftwareKeyTypes(c *fiber.Ctx) error {
 	}
 
 	// 构建结果
+	// price、hours和duration_unit、duration_amount为该软件下的实际价格和有效期，base_开头的字段为卡密类型本身的价格和有效期
 	type KeyTypeWithBinding struct {
 		models.KeyType
-		IsDefault bool `json:"is_default"`
+		IsDefault    bool               `json:"is_default"`
+		BasePrice    float64            `json:"base_price"`
+		BaseHours    int                `json:"base_hours"`
+		BaseDuration models.KeyDuration `json:"base_duration"`
 	}
 
 	var result []KeyTypeWithBinding
 	for _, keyType := range keyTypes {
 		// 查找对应的绑定关系
 		var isDefault bool
-		for _, binding := range bindings {
+		var keyTypeBinding *models.SoftwareKeyType
+		for i, binding := range bindings {
 			if binding.KeyTypeID == keyType.ID {
 				isDefault = binding.IsActive
+				keyTypeBinding = &bindings[i]
 				break
 			}
 		}
 
-		result = append(result, KeyTypeWithBinding{
-			KeyType:   keyType,
-			IsDefault: isDefault,
-		})
+		item := KeyTypeWithBinding{
+			KeyType:      keyType,
+			IsDefault:    isDefault,
+			BasePrice:    keyType.Price,
+			BaseHours:    keyType.Hours,
+			BaseDuration: keyType.Duration(),
+		}
+		duration := keyTypeBinding.ResolveDuration(&keyType)
+		item.Price = keyTypeBinding.ResolvePrice(&keyType)
+		item.Hours = keyTypeBinding.ResolveHours(&keyType)
+		item.DurationUnit, item.DurationAmount = duration.Unit, duration.Amount
+		result = append(result, item)
 	}
 
 	return c.JSON(fiber.Map{
@@ -550,3 +673,108 @@ func GetSoftwareKeyTypes(c *fiber.Ctx) error {
 		"data":    result,
 	})
 }
+
+// validateBindingOverrides 验证绑定上的价格和有效期覆盖，返回需要覆盖的有效期，不覆盖时返回nil
+// 设置了有效期单位时按单位和数量计算，否则hours按小时计算
+func validateBindingOverrides(price *float64, hours *int, unit *string, amount *int) (*models.KeyDuration, error) {
+	if price != nil && *price < 0 {
+		return nil, errors.New("价格不能为负数")
+	}
+	if unit != nil && *unit != "" {
+		duration := models.KeyDuration{Unit: *unit}
+		if amount != nil && !duration.IsPermanent() {
+			duration.Amount = *amount
+		}
+		if err := duration.Validate(); err != nil {
+			return nil, err
+		}
+		return &duration, nil
+	}
+	if hours != nil {
+		if *hours <= 0 {
+			return nil, errors.New("有效期必须大于0小时")
+		}
+		return &models.KeyDuration{Unit: models.DurationUnitHour, Amount: *hours}, nil
+	}
+	return nil, nil
+}
+
+// UpdateKeyTypeBindingPricing 设置软件下卡密类型的价格和有效期覆盖
+// 请求体中的price为空（null或不传）时清除价格覆盖，hours和duration_unit都为空时清除有效期覆盖，恢复使用卡密类型的价格和有效期
+// duration_unit和duration_amount按自然月、自然年或永久等单位覆盖有效期，设置后优先于hours
+// 只影响之后生成的卡密，已生成的卡密保留生成时的价格和有效期
+func UpdateKeyTypeBindingPricing(c *fiber.Ctx) error {
+	// 获取软件ID和卡密类型ID
+	softwareID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "无效的软件ID",
+		})
+	}
+	keyTypeID, err := strconv.Atoi(c.Params("key_type_id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "无效的卡密类型ID",
+		})
+	}
+
+	// 解析请求参数
+	var req struct {
+		Price          *float64 `json:"price"`
+		Hours          *int     `json:"hours"`
+		DurationUnit   *string  `json:"duration_unit"`
+		DurationAmount *int     `json:"duration_amount"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "参数解析失败: " + err.Error(),
+		})
+	}
+	duration, err := validateBindingOverrides(req.Price, req.Hours, req.DurationUnit, req.DurationAmount)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   err.Error(),
+		})
+	}
+
+	// 查询绑定关系
+	var binding models.SoftwareKeyType
+	if err := database.GetDB().Where("software_id = ? AND key_type_id = ?", softwareID, keyTypeID).First(&binding).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"success": false,
+				"error":   "该卡密类型未绑定到此软件",
+			})
+		}
+		log.Printf("查询绑定关系失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "查询绑定关系失败",
+		})
+	}
+
+	// 更新覆盖值，使用map以便写入NULL
+	binding.Price = req.Price
+	binding.SetDurationOverride(duration)
+	if err := database.GetDB().Model(&binding).Updates(map[string]interface{}{
+		"price":           binding.Price,
+		"hours":           binding.Hours,
+		"duration_unit":   binding.DurationUnit,
+		"duration_amount": binding.DurationAmount,
+	}).Error; err != nil {
+		log.Printf("更新绑定价格失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"success": false,
+			"error":   "更新绑定价格失败",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "绑定价格更新成功",
+		"data":    binding,
+	})
+}
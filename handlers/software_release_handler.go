@@ -0,0 +1,474 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"go_creation/database"
+	"go_creation/models"
+	"go_creation/utils"
+)
+
+// checksumPattern 安装包校验值格式，可带算法前缀，如"sha256:3a7bd3e2..."
+var checksumPattern = regexp.MustCompile(`^(?:(md5|sha1|sha256|sha512):)?[0-9a-f]{32,128}$`)
+
+// VersionCheckResult 客户端版本检查结果
+type VersionCheckResult struct {
+	CurrentVersion  string                  `json:"current_version"`  // 客户端当前版本
+	Channel         string                  `json:"channel"`          // 客户端所在的发布渠道
+	LatestVersion   string                  `json:"latest_version"`   // 该渠道的最新版本，没有发布任何版本时为空
+	MinimumVersion  string                  `json:"minimum_version"`  // 最低支持版本，没有设置时为空
+	UpdateAvailable bool                    `json:"update_available"` // 是否有可用更新
+	UpdateRequired  bool                    `json:"update_required"`  // 是否必须更新，当前版本低于最低支持版本时为true
+	Latest          *models.SoftwareRelease `json:"latest,omitempty"` // 最新版本的发布信息，只有可以更新时才返回
+}
+
+// publishedReleases 查询软件在指定渠道可见的已发布版本，按版本号从新到旧排序
+// 正式版渠道只能看到正式版，测试版渠道同时能看到正式版和测试版
+func publishedReleases(db *gorm.DB, softwareID uint, channel string) ([]models.SoftwareRelease, error) {
+	query := db.Where("software_id = ? AND published_at IS NOT NULL AND published_at <= ?", softwareID, time.Now())
+	if channel != models.ReleaseChannelBeta {
+		query = query.Where("channel = ?", models.ReleaseChannelStable)
+	}
+
+	var releases []models.SoftwareRelease
+	if err := query.Find(&releases).Error; err != nil {
+		return nil, err
+	}
+	sortReleases(releases)
+	return releases, nil
+}
+
+// sortReleases 按版本号从新到旧排序，版本号无效的记录排在最后
+func sortReleases(releases []models.SoftwareRelease) {
+	sort.SliceStable(releases, func(i, j int) bool {
+		vi, errI := utils.ParseSemver(releases[i].Version)
+		vj, errJ := utils.ParseSemver(releases[j].Version)
+		if errI != nil || errJ != nil {
+			return errI == nil
+		}
+		return vi.Compare(vj) > 0
+	})
+}
+
+// checkClientVersion 根据已发布的版本检查客户端版本
+// clientVersion必须是已经校验过的有效版本号
+func checkClientVersion(db *gorm.DB, softwareID uint, clientVersion, channel string) (*VersionCheckResult, error) {
+	current, err := utils.ParseSemver(clientVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	releases, err := publishedReleases(db, softwareID, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &VersionCheckResult{
+		CurrentVersion: current.String(),
+		Channel:        channel,
+	}
+	for i := range releases {
+		release := &releases[i]
+		v, err := utils.ParseSemver(release.Version)
+		if err != nil {
+			continue
+		}
+		if result.LatestVersion == "" {
+			result.LatestVersion = release.Version
+			if v.Compare(current) > 0 {
+				result.UpdateAvailable = true
+				result.Latest = release
+			}
+		}
+		// 取最高的最低支持版本
+		if release.IsMinimumSupported && result.MinimumVersion == "" {
+			result.MinimumVersion = release.Version
+			result.UpdateRequired = current.Compare(v) < 0
+		}
+	}
+	return result, nil
+}
+
+// parseClientChannel 解析客户端传入的发布渠道，为空时默认为正式版
+func parseClientChannel(channel string) (string, bool) {
+	if channel == "" {
+		return models.ReleaseChannelStable, true
+	}
+	return channel, models.IsValidReleaseChannel(channel)
+}
+
+// syncSoftwareVersion 将软件的当前版本号同步为最新发布的正式版
+// 没有任何已发布的正式版时保留原来的版本号
+func syncSoftwareVersion(db *gorm.DB, softwareID uint) error {
+	releases, err := publishedReleases(db, softwareID, models.ReleaseChannelStable)
+	if err != nil || len(releases) == 0 {
+		return err
+	}
+	return db.Model(&models.Software{}).Where("id = ?", softwareID).
+		Update("version", releases[0].Version).Error
+}
+
+// validateReleaseFields 校验发布版本的下载地址和校验值，返回规范化后的校验值
+func validateReleaseFields(downloadURL, checksum string) (string, error) {
+	if downloadURL != "" {
+		u, err := url.Parse(downloadURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", errors.New("下载地址必须是有效的http或https地址")
+		}
+	}
+	checksum = strings.ToLower(strings.TrimSpace(checksum))
+	if checksum != "" && !checksumPattern.MatchString(checksum) {
+		return "", errors.New("无效的校验值，格式应为十六进制摘要，可带算法前缀，如sha256:...")
+	}
+	return checksum, nil
+}
+
+// findSoftware 根据路径参数查询软件，失败时已写入错误响应
+func findSoftware(c *fiber.Ctx) (*models.Software, error) {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil || id <= 0 {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的软件ID",
+		})
+	}
+
+	var software models.Software
+	if err := database.GetDB().First(&software, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "软件不存在",
+			})
+		}
+		log.Printf("查询软件失败: %v", err)
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询软件失败",
+		})
+	}
+	return &software, nil
+}
+
+// CreateSoftwareRelease 管理员为软件创建发布版本
+// 请求体:
+//   - version: 版本号，必填，语义化版本格式
+//   - changelog / download_url / checksum: 更新说明、下载地址和安装包校验值
+//   - channel: 发布渠道，stable或beta，默认stable
+//   - is_minimum_supported: 是否为最低支持版本
+//   - publish: 是否立即发布，默认true；为false时保存为草稿
+func CreateSoftwareRelease(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+
+	var request struct {
+		Version            string `json:"version"`
+		Changelog          string `json:"changelog"`
+		DownloadURL        string `json:"download_url"`
+		Checksum           string `json:"checksum"`
+		Channel            string `json:"channel"`
+		IsMinimumSupported bool   `json:"is_minimum_supported"`
+		Publish            *bool  `json:"publish"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	version, err := utils.ParseSemver(request.Version)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	channel, ok := parseClientChannel(request.Channel)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的发布渠道，可选值：stable, beta",
+		})
+	}
+
+	checksum, err := validateReleaseFields(request.DownloadURL, request.Checksum)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	release := models.SoftwareRelease{
+		SoftwareID:         software.ID,
+		Version:            version.String(),
+		Changelog:          request.Changelog,
+		DownloadURL:        request.DownloadURL,
+		Checksum:           checksum,
+		Channel:            channel,
+		IsMinimumSupported: request.IsMinimumSupported,
+	}
+	if request.Publish == nil || *request.Publish {
+		now := time.Now()
+		release.PublishedAt = &now
+	}
+
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.SoftwareRelease{}).
+			Where("software_id = ? AND version = ?", software.ID, release.Version).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "该版本号已存在")
+		}
+		if err := tx.Create(&release).Error; err != nil {
+			return err
+		}
+		return syncSoftwareVersion(tx, software.ID)
+	})
+	if err != nil {
+		if e, ok := err.(*fiber.Error); ok {
+			return c.Status(e.Code).JSON(fiber.Map{
+				"error": e.Message,
+			})
+		}
+		log.Printf("创建发布版本失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "创建发布版本失败",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "发布版本创建成功",
+		"data":    release,
+	})
+}
+
+// GetSoftwareReleases 管理员查看软件的发布版本
+// 查询参数:
+//   - channel: 按发布渠道过滤
+//   - include_drafts: 为true时包含未发布的草稿
+func GetSoftwareReleases(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+
+	query := database.GetDB().Where("software_id = ?", software.ID)
+	if channel := c.Query("channel"); channel != "" {
+		query = query.Where("channel = ?", channel)
+	}
+	if !c.QueryBool("include_drafts") {
+		query = query.Where("published_at IS NOT NULL")
+	}
+
+	var releases []models.SoftwareRelease
+	if err := query.Find(&releases).Error; err != nil {
+		log.Printf("查询发布版本失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询发布版本失败",
+		})
+	}
+	sortReleases(releases)
+
+	return c.JSON(fiber.Map{
+		"total": len(releases),
+		"data":  releases,
+	})
+}
+
+// UpdateSoftwareRelease 管理员更新发布版本
+// 版本号创建后不能修改；publish为true时发布草稿，为false时撤回为草稿
+func UpdateSoftwareRelease(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+
+	releaseID, err := strconv.Atoi(c.Params("release_id"))
+	if err != nil || releaseID <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的发布版本ID",
+		})
+	}
+
+	var request struct {
+		Changelog          *string `json:"changelog"`
+		DownloadURL        *string `json:"download_url"`
+		Checksum           *string `json:"checksum"`
+		Channel            *string `json:"channel"`
+		IsMinimumSupported *bool   `json:"is_minimum_supported"`
+		Publish            *bool   `json:"publish"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	var release models.SoftwareRelease
+	if err := database.GetDB().Where("id = ? AND software_id = ?", releaseID, software.ID).First(&release).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "发布版本不存在",
+			})
+		}
+		log.Printf("查询发布版本失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询发布版本失败",
+		})
+	}
+
+	updates := map[string]interface{}{}
+	if request.Changelog != nil {
+		updates["changelog"] = *request.Changelog
+	}
+	downloadURL, checksum := release.DownloadURL, release.Checksum
+	if request.DownloadURL != nil {
+		downloadURL = *request.DownloadURL
+		updates["download_url"] = downloadURL
+	}
+	if request.Checksum != nil {
+		checksum = *request.Checksum
+	}
+	checksum, err = validateReleaseFields(downloadURL, checksum)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if request.Checksum != nil {
+		updates["checksum"] = checksum
+	}
+	if request.Channel != nil {
+		if !models.IsValidReleaseChannel(*request.Channel) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "无效的发布渠道，可选值：stable, beta",
+			})
+		}
+		updates["channel"] = *request.Channel
+	}
+	if request.IsMinimumSupported != nil {
+		updates["is_minimum_supported"] = *request.IsMinimumSupported
+	}
+	if request.Publish != nil {
+		if *request.Publish && release.PublishedAt == nil {
+			updates["published_at"] = time.Now()
+		} else if !*request.Publish {
+			updates["published_at"] = nil
+		}
+	}
+	if len(updates) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "没有需要更新的字段",
+		})
+	}
+
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&release).Updates(updates).Error; err != nil {
+			return err
+		}
+		if err := syncSoftwareVersion(tx, software.ID); err != nil {
+			return err
+		}
+		return tx.First(&release, release.ID).Error
+	})
+	if err != nil {
+		log.Printf("更新发布版本失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "更新发布版本失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "发布版本更新成功",
+		"data":    release,
+	})
+}
+
+// DeleteSoftwareRelease 管理员删除发布版本
+func DeleteSoftwareRelease(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+
+	releaseID, err := strconv.Atoi(c.Params("release_id"))
+	if err != nil || releaseID <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的发布版本ID",
+		})
+	}
+
+	var deleted int64
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ? AND software_id = ?", releaseID, software.ID).Delete(&models.SoftwareRelease{})
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted = result.RowsAffected
+		return syncSoftwareVersion(tx, software.ID)
+	})
+	if err != nil {
+		log.Printf("删除发布版本失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "删除发布版本失败",
+		})
+	}
+	if deleted == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "发布版本不存在",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "发布版本删除成功",
+	})
+}
+
+// CheckSoftwareVersion 客户端检查更新
+// 查询参数:
+//   - version: 客户端当前版本，必填
+//   - channel: 发布渠道，stable或beta，默认stable
+//
+// 当前版本低于最低支持版本时update_required为true，客户端应强制更新
+func CheckSoftwareVersion(c *fiber.Ctx) error {
+	software, err := findSoftware(c)
+	if software == nil {
+		return err
+	}
+
+	if _, err := utils.ParseSemver(c.Query("version")); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	channel, ok := parseClientChannel(c.Query("channel"))
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的发布渠道，可选值：stable, beta",
+		})
+	}
+
+	result, err := checkClientVersion(database.GetDB(), software.ID, c.Query("version"), channel)
+	if err != nil {
+		log.Printf("检查软件版本失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "检查软件版本失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"software": software.Name,
+		"data":     result,
+	})
+}
@@ -0,0 +1,617 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"go_creation/database"
+	"go_creation/models"
+	"go_creation/utils"
+)
+
+// 每次生成的恢复码数量
+const recoveryCodeCount = 10
+
+// loginChallengeTTL 两步验证登录挑战的有效期
+const loginChallengeTTL = 5 * time.Minute
+
+// totpIssuer 返回身份验证器应用中显示的发行方名称
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "Go Creation"
+}
+
+// verifySecondFactor 验证两步验证码或恢复码
+// TOTP验证码的周期必须晚于上次使用的周期，恢复码使用后立即作废
+func verifySecondFactor(db *gorm.DB, salesperson *models.Salesperson, totpCode, recoveryCode string) (bool, error) {
+	if totpCode != "" {
+		step, ok := utils.ValidateTOTP(salesperson.TwoFactorSecret, totpCode, time.Now())
+		if !ok || step <= salesperson.TwoFactorLastStep {
+			return false, nil
+		}
+		// 以条件更新的方式记录周期，防止同一验证码被并发使用
+		result := db.Model(&models.Salesperson{}).
+			Where("id = ? AND two_factor_last_step < ?", salesperson.ID, step).
+			Update("two_factor_last_step", step)
+		if result.Error != nil {
+			return false, fmt.Errorf("更新两步验证状态失败: %w", result.Error)
+		}
+		salesperson.TwoFactorLastStep = step
+		return result.RowsAffected > 0, nil
+	}
+
+	if recoveryCode != "" {
+		result := db.Model(&models.SalespersonRecoveryCode{}).
+			Where("salesperson_id = ? AND code_hash = ? AND used_at IS NULL",
+				salesperson.ID, utils.HashToken(utils.NormalizeRecoveryCode(recoveryCode))).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return false, fmt.Errorf("使用恢复码失败: %w", result.Error)
+		}
+		return result.RowsAffected > 0, nil
+	}
+
+	return false, nil
+}
+
+// replaceRecoveryCodes 作废旧的恢复码并生成一组新的恢复码
+// 返回明文恢复码，只在生成时展示一次
+func replaceRecoveryCodes(tx *gorm.DB, salespersonID uint) ([]string, error) {
+	codes, err := utils.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, fmt.Errorf("生成恢复码失败: %w", err)
+	}
+
+	if err := tx.Where("salesperson_id = ?", salespersonID).Delete(&models.SalespersonRecoveryCode{}).Error; err != nil {
+		return nil, fmt.Errorf("删除旧恢复码失败: %w", err)
+	}
+
+	records := make([]models.SalespersonRecoveryCode, 0, len(codes))
+	for _, code := range codes {
+		records = append(records, models.SalespersonRecoveryCode{
+			SalespersonID: salespersonID,
+			CodeHash:      utils.HashToken(utils.NormalizeRecoveryCode(code)),
+		})
+	}
+	if err := tx.Create(&records).Error; err != nil {
+		return nil, fmt.Errorf("保存恢复码失败: %w", err)
+	}
+
+	return codes, nil
+}
+
+// issueLoginChallenge 密码验证通过后签发两步验证登录挑战
+// 挑战令牌只能使用一次，有效期为loginChallengeTTL，同时清理该账号已过期的挑战
+func issueLoginChallenge(c *fiber.Ctx, salesperson *models.Salesperson) error {
+	token, err := utils.GenerateSecureToken()
+	if err != nil {
+		log.Printf("生成登录挑战令牌失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "登录失败，请稍后重试",
+		})
+	}
+
+	now := time.Now()
+	challenge := models.SalespersonLoginChallenge{
+		SalespersonID: salesperson.ID,
+		TokenHash:     utils.HashToken(token),
+		IP:            c.IP(),
+		ExpiredAt:     now.Add(loginChallengeTTL),
+	}
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("salesperson_id = ? AND expired_at <= ?", salesperson.ID, now).
+			Delete(&models.SalespersonLoginChallenge{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&challenge).Error
+	})
+	if err != nil {
+		log.Printf("保存登录挑战失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "登录失败，请稍后重试",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":             "请输入两步验证码完成登录",
+		"two_factor_required": true,
+		"challenge_token":     token,
+		"expires_in":          int(loginChallengeTTL.Seconds()),
+		// 账号被要求修改密码时，需要在第二步同时提供new_password
+		"must_change_password": salesperson.MustChangePassword,
+	})
+}
+
+// VerifyLoginTwoFactor 两步验证登录的第二步
+// 使用登录时返回的挑战令牌和验证码或恢复码完成登录，成功后签发访问令牌和刷新令牌
+// 验证失败与密码错误一样计入登录失败次数；挑战令牌在登录成功后作废，不需要重新提交密码
+func VerifyLoginTwoFactor(c *fiber.Ctx) error {
+	var request struct {
+		ChallengeToken string `json:"challenge_token"` // 登录时返回的挑战令牌
+		TOTPCode       string `json:"totp_code"`       // 身份验证器中的验证码
+		RecoveryCode   string `json:"recovery_code"`   // 无法使用验证码时的恢复码
+		NewPassword    string `json:"new_password"`    // 账号被要求修改密码时设置的新密码
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败，请检查输入格式",
+		})
+	}
+	if request.ChallengeToken == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "挑战令牌不能为空",
+		})
+	}
+	if request.TOTPCode == "" && request.RecoveryCode == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":               "请输入两步验证码",
+			"two_factor_required": true,
+		})
+	}
+
+	db := database.GetDB()
+	var challenge models.SalespersonLoginChallenge
+	if err := db.Where("token_hash = ? AND used_at IS NULL AND expired_at > ?", utils.HashToken(request.ChallengeToken), time.Now()).
+		First(&challenge).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "登录验证已失效，请重新登录",
+			})
+		}
+		log.Printf("查询登录挑战失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "登录失败，请稍后重试",
+		})
+	}
+
+	var salesperson models.Salesperson
+	if err := db.Where("id = ? AND status = ?", challenge.SalespersonID, "active").First(&salesperson).Error; err != nil ||
+		!salesperson.TwoFactorEnabled {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "登录验证已失效，请重新登录",
+		})
+	}
+
+	// 检查登录尝试次数限制
+	if isLocked, minutes := utils.DefaultLoginLimiter.IsLocked(salesperson.Username, c.IP()); isLocked {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error":   "登录尝试次数过多，账号已被临时锁定",
+			"minutes": minutes,
+		})
+	}
+
+	// 在消耗验证码之前检查新密码，避免验证码被使用后才发现新密码不符合要求
+	if e := checkRequiredPasswordChange(&salesperson, request.NewPassword); e != nil {
+		return c.Status(e.Code).JSON(fiber.Map{
+			"error":                e.Message,
+			"must_change_password": true,
+		})
+	}
+
+	ok, err := verifySecondFactor(db, &salesperson, request.TOTPCode, request.RecoveryCode)
+	if err != nil {
+		log.Printf("验证两步验证码失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "登录失败，请稍后重试",
+		})
+	}
+	if !ok {
+		return handleTwoFactorFailure(c, salesperson.Username)
+	}
+
+	// 以条件更新的方式使用挑战令牌，防止同一令牌被并发使用
+	result := db.Model(&models.SalespersonLoginChallenge{}).
+		Where("id = ? AND used_at IS NULL", challenge.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		log.Printf("使用登录挑战失败: %v", result.Error)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "登录失败，请稍后重试",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "登录验证已失效，请重新登录",
+		})
+	}
+
+	// 重置登录尝试次数
+	utils.DefaultLoginLimiter.ResetAttempts(salesperson.Username, c.IP())
+
+	return completeLogin(c, &salesperson, request.NewPassword)
+}
+
+// handleTwoFactorFailure 处理两步验证失败
+// 与密码错误一样计入登录失败次数，达到上限后锁定账号
+func handleTwoFactorFailure(c *fiber.Ctx, username string) error {
+	isLocked, minutes := utils.DefaultLoginLimiter.RecordFailedLogin(username, c.IP())
+
+	log.Printf("登录失败，原因: 两步验证码错误, 用户名: %s", username)
+
+	if isLocked {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error":   "登录尝试次数过多，账号已被临时锁定",
+			"minutes": minutes,
+		})
+	}
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+		"error":               "两步验证码错误",
+		"two_factor_required": true,
+		"remaining_attempts":  utils.DefaultLoginLimiter.GetRemainingAttempts(username, c.IP()),
+	})
+}
+
+// currentSalesperson 查询当前登录的销售员
+func currentSalesperson(c *fiber.Ctx) (*models.Salesperson, *fiber.Error) {
+	auth, ok := utils.GetAuthContext(c)
+	if !ok {
+		return nil, fiber.NewError(fiber.StatusUnauthorized, "未登录")
+	}
+	salespersonID := auth.SalespersonID
+
+	var salesperson models.Salesperson
+	if err := database.GetDB().First(&salesperson, salespersonID).Error; err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "查询销售员失败: "+err.Error())
+	}
+	return &salesperson, nil
+}
+
+// GetTwoFactorStatus 获取当前销售员的两步验证状态
+func GetTwoFactorStatus(c *fiber.Ctx) error {
+	salesperson, ferr := currentSalesperson(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	var remaining int64
+	if err := database.GetDB().Model(&models.SalespersonRecoveryCode{}).
+		Where("salesperson_id = ? AND used_at IS NULL", salesperson.ID).
+		Count(&remaining).Error; err != nil {
+		log.Printf("查询恢复码失败: %v", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"enabled":                  salesperson.TwoFactorEnabled,
+		"required":                 salesperson.TwoFactorRequired,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// SetupTwoFactor 开始启用两步验证
+// 需要提供当前密码，生成新的TOTP密钥并返回配置地址，确认验证码后才会启用
+func SetupTwoFactor(c *fiber.Ctx) error {
+	salesperson, ferr := currentSalesperson(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	var request struct {
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	if salesperson.TwoFactorEnabled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "两步验证已启用",
+		})
+	}
+	if !salesperson.CheckPassword(request.Password) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "密码错误",
+		})
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		log.Printf("生成TOTP密钥失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "生成两步验证密钥失败",
+		})
+	}
+
+	if err := database.GetDB().Model(&models.Salesperson{}).Where("id = ?", salesperson.ID).
+		Updates(map[string]interface{}{
+			"two_factor_secret":    secret,
+			"two_factor_last_step": 0,
+		}).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "保存两步验证密钥失败: " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":          "请使用身份验证器扫描二维码，并提交验证码完成启用",
+		"secret":           secret,
+		"provisioning_uri": utils.TOTPProvisioningURI(totpIssuer(), salesperson.Username, secret),
+	})
+}
+
+// ConfirmTwoFactor 提交验证码确认启用两步验证
+// 启用成功后返回一组恢复码，恢复码只展示这一次
+func ConfirmTwoFactor(c *fiber.Ctx) error {
+	salesperson, ferr := currentSalesperson(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	var request struct {
+		Code string `json:"code"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	if salesperson.TwoFactorEnabled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "两步验证已启用",
+		})
+	}
+	if salesperson.TwoFactorSecret == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "请先获取两步验证密钥",
+		})
+	}
+
+	var codes []string
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		ok, err := verifySecondFactor(tx, salesperson, request.Code, "")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "验证码错误")
+		}
+
+		if err := tx.Model(&models.Salesperson{}).Where("id = ?", salesperson.ID).
+			Update("two_factor_enabled", true).Error; err != nil {
+			return fmt.Errorf("启用两步验证失败: %w", err)
+		}
+
+		codes, err = replaceRecoveryCodes(tx, salesperson.ID)
+		return err
+	})
+	if err != nil {
+		if e, ok := err.(*fiber.Error); ok {
+			return c.Status(e.Code).JSON(fiber.Map{
+				"error": e.Message,
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "两步验证已启用，请妥善保存恢复码",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTwoFactor 关闭两步验证
+// 需要提供密码和验证码（或恢复码），管理员要求启用两步验证的账号不能关闭
+func DisableTwoFactor(c *fiber.Ctx) error {
+	salesperson, ferr := currentSalesperson(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	var request struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	if !salesperson.TwoFactorEnabled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "两步验证未启用",
+		})
+	}
+	if salesperson.TwoFactorRequired {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "管理员要求该账号启用两步验证，不能关闭",
+		})
+	}
+	if !salesperson.CheckPassword(request.Password) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "密码错误",
+		})
+	}
+
+	ok, err := verifySecondFactor(database.GetDB(), salesperson, request.Code, request.RecoveryCode)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "验证码错误",
+		})
+	}
+
+	if err := disableTwoFactor(database.GetDB(), salesperson.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "两步验证已关闭",
+	})
+}
+
+// RegenerateRecoveryCodes 重新生成恢复码，旧的恢复码全部作废
+func RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	salesperson, ferr := currentSalesperson(c)
+	if ferr != nil {
+		return c.Status(ferr.Code).JSON(fiber.Map{
+			"error": ferr.Message,
+		})
+	}
+
+	var request struct {
+		Code string `json:"code"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	if !salesperson.TwoFactorEnabled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "两步验证未启用",
+		})
+	}
+
+	var codes []string
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		ok, err := verifySecondFactor(tx, salesperson, request.Code, "")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "验证码错误")
+		}
+		codes, err = replaceRecoveryCodes(tx, salesperson.ID)
+		return err
+	})
+	if err != nil {
+		if e, ok := err.(*fiber.Error); ok {
+			return c.Status(e.Code).JSON(fiber.Map{
+				"error": e.Message,
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "恢复码已重新生成，请妥善保存",
+		"recovery_codes": codes,
+	})
+}
+
+// disableTwoFactor 关闭两步验证并删除密钥和恢复码
+func disableTwoFactor(db *gorm.DB, salespersonID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Salesperson{}).Where("id = ?", salespersonID).
+			Updates(map[string]interface{}{
+				"two_factor_enabled":   false,
+				"two_factor_secret":    "",
+				"two_factor_last_step": 0,
+			}).Error; err != nil {
+			return fmt.Errorf("关闭两步验证失败: %w", err)
+		}
+		if err := tx.Where("salesperson_id = ?", salespersonID).Delete(&models.SalespersonRecoveryCode{}).Error; err != nil {
+			return fmt.Errorf("删除恢复码失败: %w", err)
+		}
+		return nil
+	})
+}
+
+// SetTwoFactorRequirement 管理员设置是否要求销售员启用两步验证
+// 请求体：
+//   - required: 是否要求启用
+//   - ids: 销售员ID列表
+//   - max_level: 代理层级不超过该值的销售员（0为顶级代理）
+//
+// ids和max_level至少提供一项，被要求的销售员登录后只能先完成两步验证的启用
+func SetTwoFactorRequirement(c *fiber.Ctx) error {
+	var request struct {
+		Required bool   `json:"required"`
+		IDs      []uint `json:"ids"`
+		MaxLevel *int   `json:"max_level"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+	if len(request.IDs) == 0 && request.MaxLevel == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "销售员ID列表和代理层级至少提供一项",
+		})
+	}
+
+	query := database.GetDB().Model(&models.Salesperson{})
+	if len(request.IDs) > 0 {
+		query = query.Where("id IN ?", request.IDs)
+	}
+	if request.MaxLevel != nil {
+		query = query.Where("level <= ?", *request.MaxLevel)
+	}
+
+	result := query.Update("two_factor_required", request.Required)
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "更新两步验证要求失败: " + result.Error.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":  "两步验证要求已更新",
+		"affected": result.RowsAffected,
+	})
+}
+
+// ResetSalespersonTwoFactor 管理员重置销售员的两步验证
+// 用于销售员丢失身份验证器且没有可用恢复码的情况，重置后需要重新启用
+func ResetSalespersonTwoFactor(c *fiber.Ctx) error {
+	salespersonID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的销售员ID",
+		})
+	}
+
+	var salesperson models.Salesperson
+	if err := database.GetDB().First(&salesperson, salespersonID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "销售员不存在",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询销售员失败: " + err.Error(),
+		})
+	}
+
+	if err := disableTwoFactor(database.GetDB(), salesperson.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "两步验证已重置",
+	})
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"go_creation/database"
+	"go_creation/models"
+)
+
+// findWholesaleTier 查询销售员按代理层级和生成数量适用的批发价格阶梯，没有适用的阶梯时返回nil
+func findWholesaleTier(db *gorm.DB, softwareID, keyTypeID uint, level, quantity int) (*models.WholesalePriceTier, error) {
+	var tiers []models.WholesalePriceTier
+	if err := db.Where("software_id = ? AND key_type_id = ? AND is_active = ?", softwareID, keyTypeID, true).
+		Find(&tiers).Error; err != nil {
+		return nil, err
+	}
+	return models.SelectWholesaleTier(tiers, level, quantity), nil
+}
+
+// applyWholesaleTier 按批发价格阶梯计算销售记录的佣金
+// 佣金为零售总额与批发总额的差额，佣金比例改为实际的差额比例，使销售明细的佣金按单价分摊
+// 批发价高于零售价时佣金为0；tier为nil时保持按佣金比例计算的佣金不变
+// 需要在applyCommissionPolicy之前调用
+func applyWholesaleTier(sale *models.SalespersonSale, tier *models.WholesalePriceTier, quantity int) {
+	if tier == nil {
+		return
+	}
+
+	commission := sale.SaleAmount - tier.UnitPrice*float64(quantity)
+	if commission < 0 {
+		commission = 0
+	}
+	sale.Commission = commission
+	sale.CommissionRate = 0
+	if sale.SaleAmount > 0 {
+		sale.CommissionRate = commission / sale.SaleAmount
+	}
+
+	unitPrice := tier.UnitPrice
+	sale.PriceTierID = &tier.ID
+	sale.WholesaleUnitPrice = &unitPrice
+}
+
+// wholesaleTierRequest 创建和更新批发价格阶梯的请求参数，更新时未传的字段保持不变
+type wholesaleTierRequest struct {
+	SoftwareID  *uint    `json:"software_id"`
+	KeyTypeID   *uint    `json:"key_type_id"`
+	Name        *string  `json:"name"`
+	AgentLevel  *int     `json:"agent_level"`
+	AnyLevel    bool     `json:"any_level"` // 更新时设置为true表示清除代理层级，适用于所有层级
+	MinQuantity *int     `json:"min_quantity"`
+	UnitPrice   *float64 `json:"unit_price"`
+	IsActive    *bool    `json:"is_active"`
+}
+
+// apply 校验请求参数并写入批发价格阶梯
+func (r *wholesaleTierRequest) apply(db *gorm.DB, tier *models.WholesalePriceTier) error {
+	if r.SoftwareID != nil {
+		tier.SoftwareID = *r.SoftwareID
+	}
+	if r.KeyTypeID != nil {
+		tier.KeyTypeID = *r.KeyTypeID
+	}
+	if r.Name != nil {
+		tier.Name = *r.Name
+	}
+	if r.AnyLevel {
+		tier.AgentLevel = nil
+	} else if r.AgentLevel != nil {
+		if *r.AgentLevel < 0 || *r.AgentLevel > MaxAgentLevel {
+			return errors.New("代理层级必须在0到" + strconv.Itoa(MaxAgentLevel) + "之间")
+		}
+		tier.AgentLevel = r.AgentLevel
+	}
+	if r.MinQuantity != nil {
+		tier.MinQuantity = *r.MinQuantity
+	}
+	if tier.MinQuantity < 1 {
+		return errors.New("最少数量必须大于0")
+	}
+	if r.UnitPrice != nil {
+		tier.UnitPrice = *r.UnitPrice
+	}
+	if tier.UnitPrice < 0 {
+		return errors.New("批发单价不能为负数")
+	}
+	if r.IsActive != nil {
+		tier.IsActive = *r.IsActive
+	}
+
+	// 批发价格阶梯只能设置在已绑定的软件和卡密类型上
+	var count int64
+	if err := db.Model(&models.SoftwareKeyType{}).
+		Where("software_id = ? AND key_type_id = ?", tier.SoftwareID, tier.KeyTypeID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New("软件和卡密类型未绑定，请先绑定")
+	}
+	return nil
+}
+
+// GetWholesaleTiers 获取批发价格阶梯
+// 可按software_id和key_type_id筛选
+func GetWholesaleTiers(c *fiber.Ctx) error {
+	db := database.GetDB().Model(&models.WholesalePriceTier{})
+	if softwareID := c.QueryInt("software_id"); softwareID > 0 {
+		db = db.Where("software_id = ?", softwareID)
+	}
+	if keyTypeID := c.QueryInt("key_type_id"); keyTypeID > 0 {
+		db = db.Where("key_type_id = ?", keyTypeID)
+	}
+
+	var tiers []models.WholesalePriceTier
+	if err := db.Order("software_id, key_type_id, agent_level, min_quantity").Find(&tiers).Error; err != nil {
+		log.Printf("查询批发价格阶梯失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询批发价格阶梯失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": tiers,
+	})
+}
+
+// CreateWholesaleTier 创建批发价格阶梯
+func CreateWholesaleTier(c *fiber.Ctx) error {
+	var req wholesaleTierRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+	if req.SoftwareID == nil || req.KeyTypeID == nil || req.UnitPrice == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "软件ID、卡密类型ID和批发单价不能为空",
+		})
+	}
+
+	db := database.GetDB()
+	tier := models.WholesalePriceTier{MinQuantity: 1, IsActive: true}
+	if err := req.apply(db, &tier); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if err := db.Create(&tier).Error; err != nil {
+		log.Printf("创建批发价格阶梯失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "创建批发价格阶梯失败",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "批发价格阶梯创建成功",
+		"data":    tier,
+	})
+}
+
+// UpdateWholesaleTier 更新批发价格阶梯
+// 只影响之后的销售，已有销售记录保留销售时的批发单价
+func UpdateWholesaleTier(c *fiber.Ctx) error {
+	tier, err := findWholesalePriceTier(c)
+	if tier == nil {
+		return err
+	}
+
+	var req wholesaleTierRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "参数解析失败: " + err.Error(),
+		})
+	}
+
+	db := database.GetDB()
+	if err := req.apply(db, tier); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// 使用Select保存所有字段，避免is_active为false和agent_level为空时被忽略
+	if err := db.Select("*").Omit("created_at").Updates(tier).Error; err != nil {
+		log.Printf("更新批发价格阶梯失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "更新批发价格阶梯失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "批发价格阶梯更新成功",
+		"data":    tier,
+	})
+}
+
+// DeleteWholesaleTier 删除批发价格阶梯
+// 已有销售记录保留销售时的阶梯ID和批发单价
+func DeleteWholesaleTier(c *fiber.Ctx) error {
+	tier, err := findWholesalePriceTier(c)
+	if tier == nil {
+		return err
+	}
+
+	if err := database.GetDB().Delete(tier).Error; err != nil {
+		log.Printf("删除批发价格阶梯失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "删除批发价格阶梯失败",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "批发价格阶梯删除成功",
+	})
+}
+
+// findWholesalePriceTier 根据路径参数id查询批发价格阶梯，查询失败时写入错误响应并返回nil
+func findWholesalePriceTier(c *fiber.Ctx) (*models.WholesalePriceTier, error) {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "无效的批发价格阶梯ID",
+		})
+	}
+
+	var tier models.WholesalePriceTier
+	if err := database.GetDB().First(&tier, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "批发价格阶梯不存在",
+			})
+		}
+		log.Printf("查询批发价格阶梯失败: %v", err)
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "查询批发价格阶梯失败",
+		})
+	}
+	return &tier, nil
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"go_creation/database"
+	"go_creation/models"
+	"go_creation/utils"
+)
+
+// apiKeyUsageInterval 记录API密钥最近使用时间的最小间隔，避免每个请求都写数据库
+const apiKeyUsageInterval = time.Minute
+
+// authenticateAPIKey 使用X-API-Key头中的API密钥认证
+// scopes为接口要求的权限范围，未声明权限范围的接口不接受API密钥
+func authenticateAPIKey(c *fiber.Ctx, rawKey string, scopes []string) error {
+	if len(scopes) == 0 {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "该接口不支持API密钥访问",
+		})
+	}
+
+	prefix, secret, ok := utils.ParseAPIKey(rawKey)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "无效的API密钥",
+		})
+	}
+
+	var apiKey models.SalespersonAPIKey
+	if err := database.GetDB().Where("prefix = ?", prefix).First(&apiKey).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "无效的API密钥",
+			})
+		}
+		log.Printf("查询API密钥失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "验证API密钥失败",
+		})
+	}
+
+	// 使用常量时间比较，避免通过响应时间推测密文
+	if subtle.ConstantTimeCompare([]byte(utils.HashToken(secret)), []byte(apiKey.SecretHash)) != 1 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "无效的API密钥",
+		})
+	}
+
+	now := time.Now()
+	if apiKey.RevokedAt != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "API密钥已撤销",
+		})
+	}
+	if apiKey.ExpiredAt != nil && now.After(*apiKey.ExpiredAt) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "API密钥已过期",
+		})
+	}
+
+	// 检查IP白名单
+	if !utils.IPAllowed(apiKey.AllowedIPs, c.IP()) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "当前IP不允许使用该API密钥",
+		})
+	}
+
+	// 检查权限范围
+	granted := strings.Split(apiKey.Scopes, ",")
+	auth := &utils.AuthContext{Method: utils.AuthMethodAPIKey, APIKeyID: apiKey.ID, Scopes: granted}
+	for _, scope := range scopes {
+		if !auth.HasScope(scope) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "API密钥缺少权限: " + scope,
+			})
+		}
+	}
+
+	// 以密钥所属销售员的身份访问，销售员必须处于活跃状态
+	var salesperson models.Salesperson
+	if err := database.GetDB().Where("id = ? AND status = ?", apiKey.SalespersonID, "active").First(&salesperson).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "销售员不存在或已被禁用",
+			})
+		}
+		log.Printf("查询API密钥所属销售员失败: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "验证API密钥失败",
+		})
+	}
+
+	// 检查请求频率
+	if allowed, retryAfter := utils.DefaultAPIKeyRateLimiter.Allow(apiKey.ID, apiKey.RateLimit, now); !allowed {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(retryAfter.Seconds())+1))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "请求过于频繁，请稍后重试",
+		})
+	}
+
+	// 记录最近使用时间和IP
+	if err := database.GetDB().Model(&models.SalespersonAPIKey{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", apiKey.ID, now.Add(-apiKeyUsageInterval)).
+		Updates(map[string]interface{}{
+			"last_used_at": now,
+			"last_used_ip": c.IP(),
+		}).Error; err != nil {
+		log.Printf("记录API密钥使用时间失败: %v", err)
+	}
+
+	auth.SalespersonID = salesperson.ID
+	auth.Username = salesperson.Username
+	auth.Name = salesperson.Name
+	utils.SetAuthContext(c, auth)
+
+	return c.Next()
+}
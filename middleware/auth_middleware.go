@@ -1,10 +1,10 @@
 package middleware
 
 import (
-	"fmt"
 	"go_creation/database"
 	"go_creation/models"
 	"go_creation/utils"
+	"log"
 	"strconv"
 	"strings"
 	"time"
@@ -17,25 +17,34 @@ import (
 // 该中间件负责处理所有需要销售员身份验证的路由请求
 // 支持两种认证方式:
 //  1. JWT令牌认证 - 通过Authorization头的Bearer令牌
-//  2. 兼容模式 - 通过X-Salesperson-ID头直接指定销售员ID（主要用于测试和旧版本兼容）
+//  2. 开发模式 - 通过X-Salesperson-ID头直接指定销售员ID，只有设置AUTH_DEV_HEADER=true且不是生产环境时才启用
+//  3. API密钥认证 - 通过X-API-Key头，只有声明了权限范围scopes的接口才接受，且密钥必须拥有全部所需的权限范围
 //
-// 认证成功后，会将销售员信息存储在请求上下文中，供后续处理函数使用
+// 认证成功后，会将身份信息以utils.AuthContext的形式存储在请求上下文中，处理函数通过utils.GetAuthContext获取
 // 认证失败则会返回相应的错误信息和状态码
-func SalespersonAuthMiddleware() fiber.Handler {
+func SalespersonAuthMiddleware(scopes ...string) fiber.Handler {
+	// 是否允许开发模式的请求头认证，创建中间件时确定
+	devHeaderAuth := utils.DevHeaderAuthEnabled()
+
 	return func(c *fiber.Ctx) error {
+		// 服务端集成使用API密钥认证
+		if apiKey := c.Get("X-API-Key"); apiKey != "" {
+			return authenticateAPIKey(c, apiKey, scopes)
+		}
+
 		// 从请求头获取Authorization
 		// 检查是否提供了Bearer令牌
 		authHeader := c.Get("Authorization")
-		fmt.Println("认证中间件 - Authorization头:", authHeader)
 
-		// 如果没有Authorization头，尝试从X-Salesperson-ID获取（用于兼容旧版本和测试）
-		// 这是一种备选的认证方式，主要用于API测试和开发环境
+		// 如果没有Authorization头，开发模式下尝试从X-Salesperson-ID获取
+		// 这种方式不验证任何凭证，只能用于本地开发和API测试
 		if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-			salespersonIDStr := c.Get("X-Salesperson-ID")
-			fmt.Println("认证中间件 - X-Salesperson-ID头:", salespersonIDStr)
-			
+			salespersonIDStr := ""
+			if devHeaderAuth {
+				salespersonIDStr = c.Get("X-Salesperson-ID")
+			}
+
 			if salespersonIDStr == "" {
-				fmt.Println("认证中间件 - 未提供有效的认证令牌")
 				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 					"error": "未提供有效的认证令牌",
 				})
@@ -45,7 +54,6 @@ func SalespersonAuthMiddleware() fiber.Handler {
 			// 验证ID格式是否正确
 			salespersonID, err := strconv.Atoi(salespersonIDStr)
 			if err != nil {
-				fmt.Println("认证中间件 - 无效的销售员ID:", err)
 				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 					"error": "无效的销售员ID",
 				})
@@ -56,26 +64,32 @@ func SalespersonAuthMiddleware() fiber.Handler {
 			var salesperson models.Salesperson
 			if err := database.GetDB().Where("id = ? AND status = ?", salespersonID, "active").First(&salesperson).Error; err != nil {
 				if err == gorm.ErrRecordNotFound {
-					fmt.Println("认证中间件 - 销售员不存在或已被禁用")
 					return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 						"error": "销售员不存在或已被禁用",
 					})
 				}
-				fmt.Println("认证中间件 - 验证销售员身份失败:", err)
+				log.Printf("认证中间件验证销售员身份失败: %v", err)
 				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 					"error": "验证销售员身份失败",
 				})
 			}
 
-			// 将销售员信息存储在上下文中，供后续处理函数使用
-			// 这些信息可以通过c.Locals()在后续处理函数中获取
-			c.Locals("salesperson_id", salesperson.ID)
-			c.Locals("salesperson_name", salesperson.Name)
-			fmt.Printf("认证中间件 - 通过X-Salesperson-ID认证成功，ID=%d, 名称=%s\n", salesperson.ID, salesperson.Name)
+			// 将身份信息存储在上下文中，供后续处理函数使用
+			// 处理函数通过utils.GetAuthContext获取
+			utils.SetAuthContext(c, &utils.AuthContext{
+				SalespersonID: salesperson.ID,
+				Username:      salesperson.Username,
+				Name:          salesperson.Name,
+				Method:        utils.AuthMethodDevHeader,
+			})
 
-			// 设置请求头，方便后续处理函数使用
-			// 确保X-Salesperson-ID头的值与已验证的销售员ID一致
-			c.Set("X-Salesperson-ID", strconv.FormatUint(uint64(salesperson.ID), 10))
+			// 管理员要求启用两步验证但尚未启用时，只允许访问两步验证相关接口
+			if needsTwoFactorSetup(c, &salesperson) {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+					"error":                     "请先启用两步验证",
+					"two_factor_setup_required": true,
+				})
+			}
 
 			// 继续处理请求
 			// 认证成功，允许请求继续传递到下一个处理函数
@@ -85,39 +99,39 @@ func SalespersonAuthMiddleware() fiber.Handler {
 		// 从Authorization头中提取令牌
 		// 去掉"Bearer "前缀，获取实际的JWT令牌字符串
 		tokenString := authHeader[7:] // 去掉"Bearer "前缀
-		fmt.Println("认证中间件 - JWT令牌:", tokenString)
 
 		// 解析令牌
 		// 验证JWT令牌的签名并提取声明信息
 		claims, err := utils.ParseToken(tokenString)
 		if err != nil {
-			fmt.Println("认证中间件 - 解析JWT令牌失败:", err)
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error": "无效的认证令牌",
 			})
 		}
-		fmt.Printf("认证中间件 - JWT令牌解析成功，销售员ID=%d\n", claims.SalespersonID)
 
-		// 检查令牌是否存在于数据库
-		// 确保令牌未被撤销且仍然有效
-		var token models.SalespersonToken
-		if err := database.GetDB().Where("token = ?", tokenString).First(&token).Error; err != nil {
+		// 检查令牌所属的登录会话
+		// 会话被撤销（登出、修改密码、刷新令牌重用等）或过期后，其访问令牌立即失效
+		var session models.SalespersonToken
+		if err := database.GetDB().Where("session_id = ? AND salesperson_id = ?", claims.SessionID, claims.SalespersonID).First(&session).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
-				fmt.Println("认证中间件 - 令牌不存在于数据库")
 				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 					"error": "认证令牌不存在",
 				})
 			}
-			fmt.Println("认证中间件 - 验证令牌失败:", err)
+			log.Printf("认证中间件验证会话失败: %v", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "验证认证令牌失败",
 			})
 		}
 
-		// 检查令牌是否已过期
-		// 即使JWT本身未过期，也需检查数据库中的过期时间
-		if time.Now().After(token.ExpiredAt) {
-			fmt.Println("认证中间件 - 令牌已过期")
+		if session.RevokedAt != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "登录会话已失效，请重新登录",
+			})
+		}
+
+		// 检查会话是否已过期
+		if time.Now().After(session.ExpiredAt) {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error": "认证令牌已过期",
 			})
@@ -128,29 +142,47 @@ func SalespersonAuthMiddleware() fiber.Handler {
 		var salesperson models.Salesperson
 		if err := database.GetDB().Where("id = ? AND status = ?", claims.SalespersonID, "active").First(&salesperson).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
-				fmt.Println("认证中间件 - 销售员不存在或已被禁用")
 				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 					"error": "销售员不存在或已被禁用",
 				})
 			}
-			fmt.Println("认证中间件 - 验证销售员身份失败:", err)
+			log.Printf("认证中间件验证销售员身份失败: %v", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "验证销售员身份失败",
 			})
 		}
 
-		// 将销售员信息存储在上下文中，供后续处理函数使用
-		// 这些信息可以通过c.Locals()在后续处理函数中获取
-		c.Locals("salesperson_id", salesperson.ID)
-		c.Locals("salesperson_name", salesperson.Name)
-		fmt.Printf("认证中间件 - 通过JWT认证成功，ID=%d, 名称=%s\n", salesperson.ID, salesperson.Name)
-
-		// 设置请求头，方便后续处理函数使用
-		// 确保X-Salesperson-ID头的值与已验证的销售员ID一致
-		c.Set("X-Salesperson-ID", strconv.FormatUint(uint64(salesperson.ID), 10))
+		// 将身份信息存储在上下文中，供后续处理函数使用
+		// 处理函数通过utils.GetAuthContext获取
+		utils.SetAuthContext(c, &utils.AuthContext{
+			SalespersonID: salesperson.ID,
+			Username:      salesperson.Username,
+			Name:          salesperson.Name,
+			SessionID:     session.SessionID,
+			Method:        utils.AuthMethodJWT,
+		})
+
+		// 管理员要求启用两步验证但尚未启用时，只允许访问两步验证相关接口
+		if needsTwoFactorSetup(c, &salesperson) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error":                     "请先启用两步验证",
+				"two_factor_setup_required": true,
+			})
+		}
 
 		// 继续处理请求
 		// 认证成功，允许请求继续传递到下一个处理函数
 		return c.Next()
 	}
 }
+
+// needsTwoFactorSetup 检查销售员是否需要先启用两步验证
+// 被要求启用两步验证但尚未启用的销售员，只能访问两步验证相关接口和登出接口
+func needsTwoFactorSetup(c *fiber.Ctx, salesperson *models.Salesperson) bool {
+	if !salesperson.TwoFactorRequired || salesperson.TwoFactorEnabled {
+		return false
+	}
+
+	path := c.Path()
+	return !strings.HasPrefix(path, "/api/auth/2fa/") && path != "/api/auth/logout"
+}
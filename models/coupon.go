@@ -0,0 +1,83 @@
+package models
+
+import (
+	"time"
+)
+
+// 优惠码折扣类型
+const (
+	CouponDiscountPercent = "percent" // 按比例折扣，DiscountValue为百分比，如15表示减免15%
+	CouponDiscountFixed   = "fixed"   // 固定金额折扣，DiscountValue为整笔订单减免的金额
+)
+
+// Coupon 优惠码
+// 销售员生成卡密时可以使用优惠码减免销售金额，软件和卡密类型限制为空表示不限制
+// 不可叠加的优惠码只能单独使用，可叠加的优惠码之间可以同时使用
+type Coupon struct {
+	ID               uint       `json:"id" gorm:"primaryKey"`                     // 主键ID
+	Code             string     `json:"code" gorm:"size:50;uniqueIndex;not null"` // 优惠码，统一保存为大写
+	Name             string     `json:"name" gorm:"size:100"`                     // 名称
+	DiscountType     string     `json:"discount_type" gorm:"size:20;not null"`    // 折扣类型：percent, fixed
+	DiscountValue    float64    `json:"discount_value"`                           // 折扣值，百分比或金额
+	MaxDiscount      float64    `json:"max_discount" gorm:"default:0"`            // 按比例折扣的最高减免金额，0表示不限制
+	MinAmount        float64    `json:"min_amount" gorm:"default:0"`              // 使用优惠码的最低订单金额，0表示不限制
+	SoftwareIDs      string     `json:"software_ids" gorm:"size:500"`             // 限制的软件ID，逗号分隔
+	KeyTypeIDs       string     `json:"key_type_ids" gorm:"size:500"`             // 限制的卡密类型ID，逗号分隔
+	UsageLimit       int        `json:"usage_limit" gorm:"default:0"`             // 总使用次数限制，0表示不限制
+	PerCustomerLimit int        `json:"per_customer_limit" gorm:"default:0"`      // 每个客户的使用次数限制，0表示不限制
+	UsedCount        int        `json:"used_count" gorm:"default:0"`              // 已使用次数，取消销售后会退回
+	Stackable        bool       `json:"stackable" gorm:"default:false"`           // 是否可以与其他可叠加的优惠码同时使用
+	StartAt          *time.Time `json:"start_at"`                                 // 开始时间，为空表示立即生效
+	EndAt            *time.Time `json:"end_at"`                                   // 结束时间，为空表示长期有效
+	Status           string     `json:"status" gorm:"size:20;default:active"`     // 状态：active启用, inactive停用
+	CreatedAt        time.Time  `json:"created_at" gorm:"autoCreateTime"`         // 创建时间
+	UpdatedAt        time.Time  `json:"updated_at" gorm:"autoUpdateTime"`         // 更新时间
+}
+
+// TableName 返回表名
+func (Coupon) TableName() string {
+	return "coupons"
+}
+
+// IsValidCouponDiscountType 检查优惠码折扣类型是否有效
+func IsValidCouponDiscountType(discountType string) bool {
+	return discountType == CouponDiscountPercent || discountType == CouponDiscountFixed
+}
+
+// Discount 计算优惠码对指定金额的减免金额，减免金额不超过该金额
+func (c *Coupon) Discount(amount float64) float64 {
+	discount := c.DiscountValue
+	if c.DiscountType == CouponDiscountPercent {
+		discount = amount * c.DiscountValue / 100
+		if c.MaxDiscount > 0 && discount > c.MaxDiscount {
+			discount = c.MaxDiscount
+		}
+	}
+	if discount > amount {
+		discount = amount
+	}
+	if discount < 0 {
+		discount = 0
+	}
+	return discount
+}
+
+// CouponRedemption 优惠码使用记录
+// 每笔销售使用的每个优惠码一条记录，取消销售时标记为已取消并退回使用次数
+type CouponRedemption struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`                                   // 主键ID
+	CouponID       uint       `json:"coupon_id" gorm:"not null;index:idx_coupon_customer"`    // 优惠码ID
+	Code           string     `json:"code" gorm:"size:50"`                                    // 使用时的优惠码
+	SaleID         uint       `json:"sale_id" gorm:"index"`                                   // 销售记录ID
+	SalespersonID  uint       `json:"salesperson_id" gorm:"index"`                            // 销售员ID
+	CustomerKey    string     `json:"customer_key" gorm:"size:100;index:idx_coupon_customer"` // 客户标识，优先使用小写邮箱，其次为电话
+	DiscountAmount float64    `json:"discount_amount"`                                        // 减免金额
+	Status         string     `json:"status" gorm:"size:20;default:applied"`                  // 状态：applied已使用, cancelled已取消
+	CancelledAt    *time.Time `json:"cancelled_at"`                                           // 取消时间
+	CreatedAt      time.Time  `json:"created_at" gorm:"autoCreateTime"`                       // 创建时间
+}
+
+// TableName 返回表名
+func (CouponRedemption) TableName() string {
+	return "coupon_redemptions"
+}
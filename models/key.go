@@ -9,27 +9,33 @@ import (
 // Key 表示软件授权密钥
 // 该结构体对应数据库中的keys表
 type Key struct {
-	ID            uint       `json:"id" gorm:"primaryKey"`                          // 主键ID
-	Code          string     `json:"code" gorm:"uniqueIndex;size:64"`               // 密钥代码，唯一索引
-	KeyCode       string     `json:"key_code" gorm:"uniqueIndex;size:32"`           // 激活码，唯一索引
-	TypeID        uint       `json:"type_id"`                                       // 卡密类型ID
-	TypeName      string     `json:"type_name" gorm:"size:100"`                     // 卡密类型名称
-	Hours         int        `json:"hours"`                                         // 有效期小时数
-	Price         float64    `json:"price"`                                         // 价格
-	SoftwareID    uint       `json:"software_id"`                                   // 软件ID
-	SoftwareName  string     `json:"software_name" gorm:"size:100"`                 // 软件名称
-	Status        string     `json:"status" gorm:"type:varchar(20);default:unused"` // 状态：unused,used,void
-	CreatorID     uint       `json:"creator_id"`                                    // 创建者ID
-	CreatorType   string     `json:"creator_type" gorm:"size:20"`                   // 创建者类型
-	SalespersonID uint       `json:"salesperson_id"`                                // 销售员ID
-	UserID        *uint      `json:"user_id"`                                       // 使用者ID
-	DeviceInfo    string     `json:"device_info" gorm:"type:text"`                  // 设备信息
-	UsedAt        *time.Time `json:"used_at"`                                       // 使用时间
-	ExpiredAt     *time.Time `json:"expired_at"`                                    // 过期时间
-	ActivatedAt   *time.Time `json:"activated_at"`                                  // 激活时间
-	IsBlacklisted bool       `json:"is_blacklisted" gorm:"default:false"`           // 是否黑名单
-	CreatedAt     time.Time  `json:"created_at"`                                    // 创建时间
-	UpdatedAt     time.Time  `json:"updated_at"`                                    // 更新时间
+	ID             uint       `json:"id" gorm:"primaryKey"`                          // 主键ID
+	Code           string     `json:"code" gorm:"uniqueIndex;size:64"`               // 密钥代码，唯一索引
+	KeyCode        string     `json:"key_code" gorm:"uniqueIndex;size:32"`           // 激活码，唯一索引
+	TypeID         uint       `json:"type_id"`                                       // 卡密类型ID
+	TypeName       string     `json:"type_name" gorm:"size:100"`                     // 卡密类型名称
+	Hours          int        `json:"hours"`                                         // 有效期小时数，自然月、自然年和永久为0
+	DurationUnit   string     `json:"duration_unit" gorm:"size:20"`                  // 有效期单位：hour, day, month, year, permanent
+	DurationAmount int        `json:"duration_amount" gorm:"default:0"`              // 有效期数量，永久时为0
+	QuotaTotal     int        `json:"quota_total" gorm:"default:0"`                  // 按次计费卡密的总次数，0表示按时间计费
+	QuotaRemaining int        `json:"quota_remaining" gorm:"default:0"`              // 按次计费卡密的剩余次数
+	Price          float64    `json:"price"`                                         // 价格
+	PriceVersionID *uint      `json:"price_version_id" gorm:"index"`                 // 生成时使用的价格版本ID，为空表示使用了软件绑定上的价格或没有价格版本
+	SoftwareID     uint       `json:"software_id"`                                   // 软件ID
+	SoftwareName   string     `json:"software_name" gorm:"size:100"`                 // 软件名称
+	Status         string     `json:"status" gorm:"type:varchar(20);default:unused"` // 状态：unused,used,void
+	CreatorID      uint       `json:"creator_id"`                                    // 创建者ID
+	CreatorType    string     `json:"creator_type" gorm:"size:20"`                   // 创建者类型
+	SalespersonID  uint       `json:"salesperson_id"`                                // 销售员ID
+	SaleID         uint       `json:"sale_id" gorm:"index"`                          // 所属销售记录ID，0表示未关联销售记录
+	UserID         *uint      `json:"user_id"`                                       // 使用者ID
+	DeviceInfo     string     `json:"device_info" gorm:"type:text"`                  // 设备信息
+	UsedAt         *time.Time `json:"used_at"`                                       // 使用时间
+	ExpiredAt      *time.Time `json:"expired_at"`                                    // 过期时间
+	ActivatedAt    *time.Time `json:"activated_at"`                                  // 激活时间
+	IsBlacklisted  bool       `json:"is_blacklisted" gorm:"default:false"`           // 是否黑名单
+	CreatedAt      time.Time  `json:"created_at"`                                    // 创建时间
+	UpdatedAt      time.Time  `json:"updated_at"`                                    // 更新时间
 }
 
 // TableName 指定模型对应的数据库表名
@@ -92,9 +98,27 @@ func (k *Key) IsValid() bool {
 		return false
 	}
 
+	// 检查按次计费的卡密是否还有剩余次数
+	if k.IsQuota() && k.QuotaRemaining <= 0 {
+		return false
+	}
+
 	return true
 }
 
+// Duration 返回卡密生成时的有效期，未设置有效期单位的历史数据按小时计算
+func (k *Key) Duration() KeyDuration {
+	if k.DurationUnit == "" {
+		return KeyDuration{Unit: DurationUnitHour, Amount: k.Hours}
+	}
+	return KeyDuration{Unit: k.DurationUnit, Amount: k.DurationAmount}
+}
+
+// IsQuota 检查卡密是否按次数计费
+func (k *Key) IsQuota() bool {
+	return k.QuotaTotal > 0
+}
+
 // KeyQuery 卡密查询参数
 type KeyQuery struct {
 	Page          int    `query:"page"`           // 页码
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+// KeyConsumption 按次计费卡密的使用记录
+// 客户端每次扣减次数都需要提供请求ID，同一卡密的同一请求ID只扣减一次，重试时返回首次扣减的结果
+type KeyConsumption struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`                                                        // 主键ID
+	KeyID          uint      `json:"key_id" gorm:"not null;uniqueIndex:idx_key_consumption_request"`              // 卡密ID
+	RequestID      string    `json:"request_id" gorm:"size:100;not null;uniqueIndex:idx_key_consumption_request"` // 客户端生成的请求ID
+	Amount         int       `json:"amount"`                                                                      // 扣减次数
+	RemainingAfter int       `json:"remaining_after"`                                                             // 扣减后的剩余次数
+	DeviceInfo     string    `json:"device_info" gorm:"size:255"`                                                 // 设备信息
+	CreatedAt      time.Time `json:"created_at" gorm:"autoCreateTime"`                                            // 扣减时间
+}
+
+// TableName 返回表名
+func (KeyConsumption) TableName() string {
+	return "key_consumptions"
+}
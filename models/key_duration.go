@@ -0,0 +1,105 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 卡密有效期单位
+const (
+	DurationUnitHour      = "hour"      // 小时
+	DurationUnitDay       = "day"       // 天
+	DurationUnitMonth     = "month"     // 自然月
+	DurationUnitYear      = "year"      // 自然年
+	DurationUnitPermanent = "permanent" // 永久
+)
+
+// IsValidDurationUnit 检查有效期单位是否有效
+func IsValidDurationUnit(unit string) bool {
+	switch unit {
+	case DurationUnitHour, DurationUnitDay, DurationUnitMonth, DurationUnitYear, DurationUnitPermanent:
+		return true
+	}
+	return false
+}
+
+// KeyDuration 卡密有效期，由单位和数量组成，如1个自然月、30天或永久
+type KeyDuration struct {
+	Unit   string `json:"unit"`   // 单位：hour, day, month, year, permanent
+	Amount int    `json:"amount"` // 数量，永久时为0
+}
+
+// Validate 验证有效期，除永久外数量必须大于0
+func (d KeyDuration) Validate() error {
+	if !IsValidDurationUnit(d.Unit) {
+		return errors.New("无效的有效期单位，可选值：hour, day, month, year, permanent")
+	}
+	if d.Unit != DurationUnitPermanent && d.Amount <= 0 {
+		return errors.New("有效期数量必须大于0")
+	}
+	return nil
+}
+
+// IsPermanent 检查是否为永久有效
+func (d KeyDuration) IsPermanent() bool {
+	return d.Unit == DurationUnitPermanent
+}
+
+// Hours 返回按小时计算的有效期，只有小时和天可以精确换算，其他单位返回0
+func (d KeyDuration) Hours() int {
+	switch d.Unit {
+	case DurationUnitHour:
+		return d.Amount
+	case DurationUnitDay:
+		return d.Amount * 24
+	}
+	return 0
+}
+
+// ExpiresAt 计算从start开始的到期时间，永久有效返回nil
+// 天、月和年按start所在时区的日历计算，跨越夏令时不会产生偏差；
+// 目标月份没有对应的日期时取该月最后一天，如1月31日加1个月为2月28日或29日
+func (d KeyDuration) ExpiresAt(start time.Time) *time.Time {
+	var expiredAt time.Time
+	switch d.Unit {
+	case DurationUnitPermanent:
+		return nil
+	case DurationUnitDay:
+		expiredAt = start.AddDate(0, 0, d.Amount)
+	case DurationUnitMonth:
+		expiredAt = addCalendarMonths(start, d.Amount)
+	case DurationUnitYear:
+		expiredAt = addCalendarMonths(start, d.Amount*12)
+	default:
+		expiredAt = start.Add(time.Duration(d.Amount) * time.Hour)
+	}
+	return &expiredAt
+}
+
+// String 返回用于展示的有效期，如"30天"、"1个月"、"永久"
+func (d KeyDuration) String() string {
+	switch d.Unit {
+	case DurationUnitPermanent:
+		return "永久"
+	case DurationUnitDay:
+		return fmt.Sprintf("%d天", d.Amount)
+	case DurationUnitMonth:
+		return fmt.Sprintf("%d个月", d.Amount)
+	case DurationUnitYear:
+		return fmt.Sprintf("%d年", d.Amount)
+	}
+	return fmt.Sprintf("%d小时", d.Amount)
+}
+
+// addCalendarMonths 按自然月增加月份，日期超出目标月份的天数时取目标月份的最后一天
+func addCalendarMonths(t time.Time, months int) time.Time {
+	year, month, day := t.Date()
+	firstOfTarget := time.Date(year, month+time.Month(months), 1, 0, 0, 0, 0, t.Location())
+	lastDay := firstOfTarget.AddDate(0, 1, -1).Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	hour, minute, second := t.Clock()
+	return time.Date(firstOfTarget.Year(), firstOfTarget.Month(), day, hour, minute, second, t.Nanosecond(), t.Location())
+}
@@ -3,24 +3,65 @@ package models
 
 import (
 	"time"
+
+	"gorm.io/gorm"
 )
 
 // KeyType 卡密类型模型
 // 用于定义不同类型的卡密，包括名称、描述、有效期、价格等属性
 type KeyType struct {
-	ID          uint       `gorm:"primaryKey" json:"id"`                                  // 主键ID
-	Name        string     `gorm:"column:name;not null" json:"name"`                      // 类型名称，如"月卡"、"年卡"等
-	Description string     `gorm:"column:description;type:text" json:"description"`       // 类型描述，详细说明卡密类型的用途和特点
-	Hours       int        `gorm:"column:hours" json:"hours"`                             // 有效期（小时），表示该类型卡密的有效时长
-	Price       float64    `gorm:"column:price" json:"price"`                             // 价格，表示该类型卡密的售价
-	Status      string     `gorm:"column:status;default:active" json:"status"`            // 状态：active活跃, inactive非活跃
-	IsActive    bool       `gorm:"column:is_active;default:true" json:"is_active"`        // 是否启用，控制该类型卡密是否可用
-	IsUniversal bool       `gorm:"column:is_universal;default:false" json:"is_universal"` // 是否为通用卡密，通用卡密可用于多个软件
-	CreatorID   uint       `gorm:"column:creator_id" json:"creator_id"`                   // 创建者ID（默认为admin），记录谁创建了这个卡密类型
-	SellerID    uint       `gorm:"column:seller_id" json:"seller_id"`                     // 销售员ID，记录哪个销售员负责销售这类卡密
-	Software    []Software `gorm:"many2many:software_key_types" json:"software"`          // 关联的软件，多对多关系
-	CreatedAt   time.Time  `json:"created_at"`                                            // 创建时间，记录卡密类型的创建时间
-	UpdatedAt   time.Time  `json:"updated_at"`                                            // 更新时间，记录卡密类型的最后更新时间
+	ID                 uint           `gorm:"primaryKey" json:"id"`                                              // 主键ID
+	Name               string         `gorm:"column:name;not null" json:"name"`                                  // 类型名称，如"月卡"、"年卡"等
+	Description        string         `gorm:"column:description;type:text" json:"description"`                   // 类型描述，详细说明卡密类型的用途和特点
+	Hours              int            `gorm:"column:hours" json:"hours"`                                         // 有效期（小时），按小时或天设置有效期时与其一致，自然月、自然年和永久为0
+	DurationUnit       string         `gorm:"column:duration_unit;size:20" json:"duration_unit"`                 // 有效期单位：hour, day, month, year, permanent，为空时按hours计算
+	DurationAmount     int            `gorm:"column:duration_amount;default:0" json:"duration_amount"`           // 有效期数量，永久时为0
+	BillingMode        string         `gorm:"column:billing_mode;size:20;default:time" json:"billing_mode"`      // 计费方式：time按时间, quota按次数
+	Quota              int            `gorm:"column:quota;default:0" json:"quota"`                               // 按次计费的可用次数，如100次导出或500次API调用
+	Price              float64        `gorm:"column:price" json:"price"`                                         // 价格，表示该类型卡密的售价
+	Status             string         `gorm:"column:status;default:active" json:"status"`                        // 状态：active活跃, inactive非活跃
+	IsActive           bool           `gorm:"column:is_active;default:true" json:"is_active"`                    // 是否启用，控制该类型卡密是否可用
+	IsUniversal        bool           `gorm:"column:is_universal;default:false" json:"is_universal"`             // 是否为通用卡密，通用卡密可用于多个软件
+	CreatorID          uint           `gorm:"column:creator_id" json:"creator_id"`                               // 创建者ID（默认为admin），记录谁创建了这个卡密类型
+	SellerID           uint           `gorm:"column:seller_id" json:"seller_id"`                                 // 销售员ID，记录哪个销售员负责销售这类卡密
+	CommissionPolicy   string         `gorm:"column:commission_policy;size:20" json:"commission_policy"`         // 佣金确认策略：generation, activation, activation_hold，为空表示生成时确认
+	CommissionHoldDays int            `gorm:"column:commission_hold_days;default:0" json:"commission_hold_days"` // 激活后的佣金冻结天数，仅activation_hold策略使用
+	Software           []Software     `gorm:"many2many:software_key_types" json:"software"`                      // 关联的软件，多对多关系
+	CreatedAt          time.Time      `json:"created_at"`                                                        // 创建时间，记录卡密类型的创建时间
+	UpdatedAt          time.Time      `json:"updated_at"`                                                        // 更新时间，记录卡密类型的最后更新时间
+	DeletedAt          gorm.DeletedAt `gorm:"index" json:"deleted_at"`                                           // 删除时间，软删除后可以恢复
+}
+
+// 卡密类型计费方式
+const (
+	BillingModeTime  = "time"  // 按时间计费，激活后在有效期内可用
+	BillingModeQuota = "quota" // 按次数计费，激活后每次使用扣减剩余次数，用完即过期
+)
+
+// IsValidBillingMode 检查计费方式是否有效，空字符串表示按时间计费
+func IsValidBillingMode(mode string) bool {
+	return mode == "" || mode == BillingModeTime || mode == BillingModeQuota
+}
+
+// IsQuota 检查卡密类型是否按次数计费
+func (kt *KeyType) IsQuota() bool {
+	return kt.BillingMode == BillingModeQuota
+}
+
+// Duration 返回卡密类型的有效期，未设置有效期单位的历史数据按小时计算
+func (kt *KeyType) Duration() KeyDuration {
+	if kt.DurationUnit == "" {
+		return KeyDuration{Unit: DurationUnitHour, Amount: kt.Hours}
+	}
+	return KeyDuration{Unit: kt.DurationUnit, Amount: kt.DurationAmount}
+}
+
+// KeyQuota 返回该类型生成的卡密的可用次数，按时间计费时为0
+func (kt *KeyType) KeyQuota() int {
+	if !kt.IsQuota() {
+		return 0
+	}
+	return kt.Quota
 }
 
 // TableName 返回表名
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"time"
+)
+
+// 价格版本类型
+const (
+	KeyTypePriceRegular   = "regular"   // 常规价格，从生效时间起一直有效，直到下一个常规价格生效
+	KeyTypePricePromotion = "promotion" // 促销价格，只在生效时间和结束时间之间有效，优先于常规价格
+)
+
+// KeyTypePrice 卡密类型的价格版本
+// 每次调价都新增一条记录而不修改历史记录，可以还原任意时间点的目录价格
+// 生效时间在未来的记录即为计划调价，卡密和销售记录通过PriceVersionID引用生成时使用的价格版本
+type KeyTypePrice struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`                                    // 主键ID
+	KeyTypeID      uint       `json:"key_type_id" gorm:"not null;index:idx_key_type_price"`    // 卡密类型ID
+	Kind           string     `json:"kind" gorm:"size:20;not null;default:regular"`            // 价格类型：regular常规价格, promotion促销价格
+	Price          float64    `json:"price"`                                                   // 价格
+	EffectiveFrom  time.Time  `json:"effective_from" gorm:"not null;index:idx_key_type_price"` // 生效时间
+	EffectiveUntil *time.Time `json:"effective_until"`                                         // 结束时间，仅促销价格使用
+	Note           string     `json:"note" gorm:"size:255"`                                    // 调价说明
+	CreatorID      uint       `json:"creator_id"`                                              // 创建者ID
+	CreatedAt      time.Time  `json:"created_at" gorm:"autoCreateTime"`                        // 创建时间
+}
+
+// TableName 返回表名
+func (KeyTypePrice) TableName() string {
+	return "key_type_prices"
+}
+
+// IsValidKeyTypePriceKind 检查价格类型是否有效
+func IsValidKeyTypePriceKind(kind string) bool {
+	return kind == KeyTypePriceRegular || kind == KeyTypePricePromotion
+}
+
+// ActiveAt 检查价格版本在指定时间是否有效
+// 常规价格只检查生效时间，是否被更新的常规价格取代由调用方按生效时间排序判断
+func (p *KeyTypePrice) ActiveAt(at time.Time) bool {
+	if p.EffectiveFrom.After(at) {
+		return false
+	}
+	return p.EffectiveUntil == nil || p.EffectiveUntil.After(at)
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+)
+
+// LoginAttempt 登录失败记录
+// 数据库存储方式的登录限制器使用该表，多个服务实例共享同一份失败计数和锁定状态
+// Key由限制维度和值组成，如 username:alice、ip:1.2.3.4、username_ip:alice|1.2.3.4
+type LoginAttempt struct {
+	Key       string     `json:"key" gorm:"primaryKey;size:255"` // 限制键
+	Count     int        `json:"count"`                          // 失败次数
+	LastTry   time.Time  `json:"last_try"`                       // 最后一次失败时间
+	LockUntil *time.Time `json:"lock_until"`                     // 锁定截止时间，为空表示未锁定
+	ExpiresAt time.Time  `json:"expires_at" gorm:"index"`        // 记录过期时间，过期后失败次数重新计算
+}
+
+// TableName 返回表名
+func (LoginAttempt) TableName() string {
+	return "login_attempts"
+}
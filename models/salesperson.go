@@ -4,31 +4,41 @@ import (
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 // Salesperson 销售员模型
 // 用于存储销售员的基本信息，包括姓名、联系方式、账号等
 type Salesperson struct {
-	ID                   uint       `json:"id" gorm:"primaryKey"`                      // 主键ID
-	Username             string     `json:"username" gorm:"size:50;uniqueIndex"`       // 用户名，登录用，唯一
-	Password             string     `json:"-" gorm:"size:100"`                         // 密码，不返回给前端
-	Name                 string     `json:"name" gorm:"size:50"`                       // 姓名
-	Phone                string     `json:"phone" gorm:"size:20"`                      // 电话
-	Email                string     `json:"email" gorm:"size:100"`                     // 邮箱
-	Status               string     `json:"status" gorm:"size:20;default:active"`      // 状态：active在职, inactive离职, suspended暂停
-	Avatar               string     `json:"avatar" gorm:"size:255"`                    // 头像URL
-	CommissionRate       float64    `json:"commission_rate" gorm:"default:0"`          // 默认佣金比例，例如0.1表示10%
-	TotalSales           float64    `json:"total_sales" gorm:"default:0"`              // 总销售额
-	TotalCommission      float64    `json:"total_commission" gorm:"default:0"`         // 总佣金
-	CreatorID            uint       `json:"creator_id" gorm:"not null"`                // 创建者ID，记录谁创建了这个销售员
-	ParentID             *uint      `json:"parent_id" gorm:"index"`                    // 上级销售员ID，允许为空
-	Level                int        `json:"level" gorm:"default:0"`                    // 代理层级，0表示顶级代理
-	ChildrenCount        int        `json:"children_count" gorm:"default:0"`           // 下级销售员数量
-	AgentCode            string     `json:"agent_code" gorm:"size:50;uniqueIndex"`     // 代理邀请码，用于发展下线
-	ParentCommissionRate float64    `json:"parent_commission_rate" gorm:"default:0.1"` // 上级提成比例，默认10%
-	LastLoginAt          *time.Time `json:"last_login_at"`                             // 最后登录时间
-	CreatedAt            time.Time  `json:"created_at" gorm:"autoCreateTime"`          // 创建时间
-	UpdatedAt            time.Time  `json:"updated_at" gorm:"autoUpdateTime"`          // 更新时间
+	ID                   uint           `json:"id" gorm:"primaryKey"`                      // 主键ID
+	Username             string         `json:"username" gorm:"size:50;uniqueIndex"`       // 用户名，登录用，唯一
+	Password             string         `json:"-" gorm:"size:100"`                         // 密码，不返回给前端
+	Name                 string         `json:"name" gorm:"size:50"`                       // 姓名
+	Phone                string         `json:"phone" gorm:"size:20"`                      // 电话
+	Email                string         `json:"email" gorm:"size:100"`                     // 邮箱
+	Status               string         `json:"status" gorm:"size:20;default:active"`      // 状态：active在职, inactive离职, suspended暂停, pending待审核, rejected审核未通过
+	Avatar               string         `json:"avatar" gorm:"size:255"`                    // 头像URL
+	CommissionRate       float64        `json:"commission_rate" gorm:"default:0"`          // 默认佣金比例，例如0.1表示10%
+	TotalSales           float64        `json:"total_sales" gorm:"default:0"`              // 总销售额
+	TotalCommission      float64        `json:"total_commission" gorm:"default:0"`         // 总佣金（仅包含已确认的佣金）
+	CreatorID            uint           `json:"creator_id" gorm:"not null"`                // 创建者ID，记录谁创建了这个销售员
+	ParentID             *uint          `json:"parent_id" gorm:"index"`                    // 上级销售员ID，允许为空
+	Level                int            `json:"level" gorm:"default:0"`                    // 代理层级，0表示顶级代理
+	ChildrenCount        int            `json:"children_count" gorm:"default:0"`           // 下级销售员数量
+	AgentCode            string         `json:"agent_code" gorm:"size:50;uniqueIndex"`     // 代理邀请码，用于发展下线
+	ParentCommissionRate float64        `json:"parent_commission_rate" gorm:"default:0.1"` // 上级提成比例，默认10%
+	LastLoginAt          *time.Time     `json:"last_login_at"`                             // 最后登录时间
+	MustChangePassword   bool           `json:"must_change_password" gorm:"default:false"` // 下次登录时必须修改密码
+	PasswordChangedAt    *time.Time     `json:"password_changed_at"`                       // 最近一次修改密码的时间
+	TwoFactorEnabled     bool           `json:"two_factor_enabled" gorm:"default:false"`   // 是否已启用两步验证
+	TwoFactorRequired    bool           `json:"two_factor_required" gorm:"default:false"`  // 管理员是否要求启用两步验证
+	TwoFactorSecret      string         `json:"-" gorm:"size:64"`                          // TOTP密钥，不返回给前端
+	TwoFactorLastStep    int64          `json:"-" gorm:"default:0"`                        // 最近一次使用的TOTP周期，防止验证码被重放
+	ReviewedAt           *time.Time     `json:"reviewed_at"`                               // 自助注册的审核时间
+	ReviewNote           string         `json:"review_note" gorm:"type:text"`              // 自助注册的审核备注
+	CreatedAt            time.Time      `json:"created_at" gorm:"autoCreateTime"`          // 创建时间
+	UpdatedAt            time.Time      `json:"updated_at" gorm:"autoUpdateTime"`          // 更新时间
+	DeletedAt            gorm.DeletedAt `json:"deleted_at" gorm:"index"`                   // 删除时间，软删除后可以恢复
 }
 
 // TableName 返回表名
@@ -65,16 +75,18 @@ type SalespersonQuery struct {
 // SalespersonProduct 销售员可销售产品关联
 // 记录销售员可以销售哪些软件的哪些卡密类型
 type SalespersonProduct struct {
-	ID             uint      `json:"id" gorm:"primaryKey"`                                // 主键ID
-	SalespersonID  uint      `json:"salesperson_id" gorm:"index:idx_salesperson_product"` // 销售员ID
-	SoftwareID     uint      `json:"software_id" gorm:"index:idx_salesperson_product"`    // 软件ID
-	KeyTypeID      uint      `json:"key_type_id" gorm:"index:idx_salesperson_product"`    // 卡密类型ID
-	CommissionRate float64   `json:"commission_rate"`                                     // 特定产品的佣金比例，覆盖销售员默认佣金比例
-	KeyGenLimit    int       `json:"key_gen_limit" gorm:"default:0"`                      // 卡密生成数量限制，0表示无限制
-	KeysGenerated  int       `json:"keys_generated" gorm:"default:0"`                     // 已生成卡密数量
-	IsActive       bool      `json:"is_active" gorm:"default:true"`                       // 是否启用
-	CreatedAt      time.Time `json:"created_at" gorm:"autoCreateTime"`                    // 创建时间
-	UpdatedAt      time.Time `json:"updated_at" gorm:"autoUpdateTime"`                    // 更新时间
+	ID                 uint      `json:"id" gorm:"primaryKey"`                                // 主键ID
+	SalespersonID      uint      `json:"salesperson_id" gorm:"index:idx_salesperson_product"` // 销售员ID
+	SoftwareID         uint      `json:"software_id" gorm:"index:idx_salesperson_product"`    // 软件ID
+	KeyTypeID          uint      `json:"key_type_id" gorm:"index:idx_salesperson_product"`    // 卡密类型ID
+	CommissionRate     float64   `json:"commission_rate"`                                     // 特定产品的佣金比例，覆盖销售员默认佣金比例
+	KeyGenLimit        int       `json:"key_gen_limit" gorm:"default:0"`                      // 卡密生成数量限制，0表示无限制
+	CommissionPolicy   string    `json:"commission_policy" gorm:"size:20"`                    // 佣金确认策略，为空时使用卡密类型的策略
+	CommissionHoldDays int       `json:"commission_hold_days" gorm:"default:0"`               // 激活后的佣金冻结天数，仅activation_hold策略使用
+	KeysGenerated      int       `json:"keys_generated" gorm:"default:0"`                     // 已生成卡密数量
+	IsActive           bool      `json:"is_active" gorm:"default:true"`                       // 是否启用
+	CreatedAt          time.Time `json:"created_at" gorm:"autoCreateTime"`                    // 创建时间
+	UpdatedAt          time.Time `json:"updated_at" gorm:"autoUpdateTime"`                    // 更新时间
 }
 
 // TableName 返回表名
@@ -82,25 +94,65 @@ func (SalespersonProduct) TableName() string {
 	return "salesperson_products"
 }
 
+// 佣金确认策略
+// 决定销售佣金在什么时候计入可结算佣金
+const (
+	CommissionPolicyGeneration     = "generation"      // 生成卡密时立即确认
+	CommissionPolicyActivation     = "activation"      // 卡密首次激活时确认
+	CommissionPolicyActivationHold = "activation_hold" // 卡密激活并经过冻结期后确认
+)
+
+// IsValidCommissionPolicy 检查佣金确认策略是否有效，空字符串表示未设置
+func IsValidCommissionPolicy(policy string) bool {
+	switch policy {
+	case "", CommissionPolicyGeneration, CommissionPolicyActivation, CommissionPolicyActivationHold:
+		return true
+	}
+	return false
+}
+
+// ResolveCommissionPolicy 解析销售产品最终使用的佣金确认策略
+// 优先级：销售员产品 > 卡密类型 > 默认（生成时确认）
+// 返回策略名称和冻结天数
+func ResolveCommissionPolicy(product *SalespersonProduct, keyType *KeyType) (string, int) {
+	if product != nil && product.CommissionPolicy != "" {
+		return product.CommissionPolicy, product.CommissionHoldDays
+	}
+	if keyType != nil && keyType.CommissionPolicy != "" {
+		return keyType.CommissionPolicy, keyType.CommissionHoldDays
+	}
+	return CommissionPolicyGeneration, 0
+}
+
 // SalespersonSale 销售员销售记录
 // 记录销售员的每一笔销售记录
 type SalespersonSale struct {
-	ID             uint       `json:"id" gorm:"primaryKey"`                             // 主键ID
-	SalespersonID  uint       `json:"salesperson_id" gorm:"index:idx_salesperson_sale"` // 销售员ID
-	KeyID          uint       `json:"key_id" gorm:"index:idx_salesperson_sale"`         // 卡密ID
-	SoftwareID     uint       `json:"software_id"`                                      // 软件ID
-	KeyTypeID      uint       `json:"key_type_id"`                                      // 卡密类型ID
-	CustomerName   string     `json:"customer_name" gorm:"size:100"`                    // 客户姓名
-	CustomerPhone  string     `json:"customer_phone" gorm:"size:20"`                    // 客户电话
-	CustomerEmail  string     `json:"customer_email" gorm:"size:100"`                   // 客户邮箱
-	SaleAmount     float64    `json:"sale_amount"`                                      // 销售金额
-	CommissionRate float64    `json:"commission_rate"`                                  // 实际佣金比例
-	Commission     float64    `json:"commission"`                                       // 实际佣金金额
-	Status         string     `json:"status" gorm:"default:pending"`                    // 状态：pending待结算, settled已结算, cancelled已取消
-	SettledAt      *time.Time `json:"settled_at"`                                       // 结算时间
-	Notes          string     `json:"notes" gorm:"type:text"`                           // 备注
-	CreatedAt      time.Time  `json:"created_at" gorm:"autoCreateTime"`                 // 创建时间
-	UpdatedAt      time.Time  `json:"updated_at" gorm:"autoUpdateTime"`                 // 更新时间
+	ID                   uint       `json:"id" gorm:"primaryKey"`                             // 主键ID
+	SalespersonID        uint       `json:"salesperson_id" gorm:"index:idx_salesperson_sale"` // 销售员ID
+	KeyID                uint       `json:"key_id" gorm:"index:idx_salesperson_sale"`         // 卡密ID
+	SoftwareID           uint       `json:"software_id"`                                      // 软件ID
+	KeyTypeID            uint       `json:"key_type_id"`                                      // 卡密类型ID
+	CustomerName         string     `json:"customer_name" gorm:"size:100"`                    // 客户姓名
+	CustomerPhone        string     `json:"customer_phone" gorm:"size:20"`                    // 客户电话
+	CustomerEmail        string     `json:"customer_email" gorm:"size:100"`                   // 客户邮箱
+	SaleAmount           float64    `json:"sale_amount"`                                      // 销售金额，已减去优惠码的减免金额
+	DiscountAmount       float64    `json:"discount_amount" gorm:"default:0"`                 // 优惠码减免的金额
+	CouponCodes          string     `json:"coupon_codes" gorm:"size:255"`                     // 使用的优惠码，逗号分隔
+	PriceVersionID       *uint      `json:"price_version_id"`                                 // 销售时使用的价格版本ID，为空表示使用了软件绑定上的价格或没有价格版本
+	PriceTierID          *uint      `json:"price_tier_id"`                                    // 使用的批发价格阶梯ID，为空表示按佣金比例计算佣金
+	WholesaleUnitPrice   *float64   `json:"wholesale_unit_price"`                             // 使用的批发单价，佣金为零售价与批发价的差额
+	CommissionRate       float64    `json:"commission_rate"`                                  // 实际佣金比例
+	Commission           float64    `json:"commission"`                                       // 实际佣金金额
+	CommissionPolicy     string     `json:"commission_policy" gorm:"size:20"`                 // 销售时使用的佣金确认策略
+	CommissionHoldDays   int        `json:"commission_hold_days" gorm:"default:0"`            // 销售时使用的佣金冻结天数
+	RecognizedCommission float64    `json:"recognized_commission" gorm:"default:0"`           // 已确认的佣金金额，只有已确认的佣金计入可结算佣金
+	Status               string     `json:"status" gorm:"default:pending"`                    // 状态：pending待结算, settled已结算, cancelled已取消
+	SettledAt            *time.Time `json:"settled_at"`                                       // 结算时间
+	CancelledAt          *time.Time `json:"cancelled_at"`                                     // 取消时间
+	CancelReason         string     `json:"cancel_reason" gorm:"type:text"`                   // 取消/退款原因
+	Notes                string     `json:"notes" gorm:"type:text"`                           // 备注
+	CreatedAt            time.Time  `json:"created_at" gorm:"autoCreateTime"`                 // 创建时间
+	UpdatedAt            time.Time  `json:"updated_at" gorm:"autoUpdateTime"`                 // 更新时间
 }
 
 // TableName 返回表名
@@ -108,6 +160,30 @@ func (SalespersonSale) TableName() string {
 	return "salesperson_sales"
 }
 
+// SalespersonSaleItem 销售记录明细
+// 记录一笔销售记录对应的每一张卡密，以及该卡密的单价、佣金和激活情况
+type SalespersonSaleItem struct {
+	ID               uint       `json:"id" gorm:"primaryKey"`                   // 主键ID
+	SaleID           uint       `json:"sale_id" gorm:"index"`                   // 销售记录ID
+	KeyID            uint       `json:"key_id" gorm:"uniqueIndex"`              // 卡密ID，一张卡密只属于一笔销售
+	SalespersonID    uint       `json:"salesperson_id" gorm:"index"`            // 销售员ID
+	UnitPrice        float64    `json:"unit_price"`                             // 单价
+	Commission       float64    `json:"commission"`                             // 该卡密对应的佣金
+	Status           string     `json:"status" gorm:"size:20;default:sold"`     // 状态：sold已售出, refunded已退款
+	ActivatedAt      *time.Time `json:"activated_at"`                           // 卡密激活时间，用于将激活归属到销售记录
+	CommissionStatus string     `json:"commission_status" gorm:"size:20;index"` // 佣金状态：unrecognized未确认, held冻结中, recognized已确认, cancelled已取消
+	RecognizableAt   *time.Time `json:"recognizable_at" gorm:"index"`           // 冻结期结束、可确认佣金的时间
+	RecognizedAt     *time.Time `json:"recognized_at"`                          // 佣金确认时间
+	RefundedAt       *time.Time `json:"refunded_at"`                            // 退款时间
+	CreatedAt        time.Time  `json:"created_at" gorm:"autoCreateTime"`       // 创建时间
+	UpdatedAt        time.Time  `json:"updated_at" gorm:"autoUpdateTime"`       // 更新时间
+}
+
+// TableName 返回表名
+func (SalespersonSaleItem) TableName() string {
+	return "salesperson_sale_items"
+}
+
 // SalespersonCustomer 销售员客户关系
 // 记录销售员与客户的绑定关系
 type SalespersonCustomer struct {
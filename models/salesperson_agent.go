@@ -7,18 +7,19 @@ import (
 // SalespersonAgentCommission 销售员代理佣金记录
 // 记录上下级销售员之间的佣金分成记录
 type SalespersonAgentCommission struct {
-	ID               uint      `json:"id" gorm:"primaryKey"`             // 主键ID
-	SaleID           uint      `json:"sale_id" gorm:"index"`             // 销售记录ID
-	SalespersonID    uint      `json:"salesperson_id" gorm:"index"`      // 销售员ID（下级）
-	AgentID          uint      `json:"agent_id" gorm:"index"`            // 代理ID（上级）
-	AgentLevel       int       `json:"agent_level"`                      // 代理层级
-	OriginalAmount   float64   `json:"original_amount"`                  // 原始销售金额
-	CommissionRate   float64   `json:"commission_rate"`                  // 佣金比例
-	CommissionAmount float64   `json:"commission_amount"`                // 佣金金额
-	Status           string    `json:"status" gorm:"default:pending"`    // 状态：pending待结算, settled已结算, cancelled已取消
-	SettlementID     *uint     `json:"settlement_id"`                    // 结算单ID
-	CreatedAt        time.Time `json:"created_at" gorm:"autoCreateTime"` // 创建时间
-	UpdatedAt        time.Time `json:"updated_at" gorm:"autoUpdateTime"` // 更新时间
+	ID               uint      `json:"id" gorm:"primaryKey"`               // 主键ID
+	SaleID           uint      `json:"sale_id" gorm:"index"`               // 销售记录ID
+	SalespersonID    uint      `json:"salesperson_id" gorm:"index"`        // 销售员ID（下级）
+	AgentID          uint      `json:"agent_id" gorm:"index"`              // 代理ID（上级）
+	AgentLevel       int       `json:"agent_level"`                        // 代理层级
+	OriginalAmount   float64   `json:"original_amount"`                    // 原始销售金额
+	CommissionRate   float64   `json:"commission_rate"`                    // 佣金比例
+	CommissionAmount float64   `json:"commission_amount"`                  // 佣金金额
+	RecognizedAmount float64   `json:"recognized_amount" gorm:"default:0"` // 已确认的佣金金额，随下级销售明细的佣金确认而确认，只有已确认的佣金计入上级的总佣金
+	Status           string    `json:"status" gorm:"default:pending"`      // 状态：pending待结算, settled已结算, cancelled已取消
+	SettlementID     *uint     `json:"settlement_id"`                      // 结算单ID
+	CreatedAt        time.Time `json:"created_at" gorm:"autoCreateTime"`   // 创建时间
+	UpdatedAt        time.Time `json:"updated_at" gorm:"autoUpdateTime"`   // 更新时间
 }
 
 // TableName 返回表名
@@ -29,20 +30,41 @@ func (SalespersonAgentCommission) TableName() string {
 // SalespersonAgentInvitation 销售员代理邀请记录
 // 记录销售员邀请其他销售员加入的记录
 type SalespersonAgentInvitation struct {
-	ID         uint       `json:"id" gorm:"primaryKey"`                   // 主键ID
-	InviterID  uint       `json:"inviter_id" gorm:"index"`                // 邀请人ID
-	InviteeID  *uint      `json:"invitee_id"`                             // 被邀请人ID，注册后才有
-	InviteCode string     `json:"invite_code" gorm:"size:50;uniqueIndex"` // 邀请码
-	Email      string     `json:"email" gorm:"size:100"`                  // 被邀请人邮箱
-	Phone      string     `json:"phone" gorm:"size:20"`                   // 被邀请人电话
-	Status     string     `json:"status" gorm:"default:pending"`          // 状态：pending待接受, accepted已接受, rejected已拒绝, expired已过期
-	AcceptedAt *time.Time `json:"accepted_at"`                            // 接受时间
-	ExpiredAt  time.Time  `json:"expired_at"`                             // 过期时间
-	CreatedAt  time.Time  `json:"created_at" gorm:"autoCreateTime"`       // 创建时间
-	UpdatedAt  time.Time  `json:"updated_at" gorm:"autoUpdateTime"`       // 更新时间
+	ID               uint       `json:"id" gorm:"primaryKey"`                           // 主键ID
+	InviterID        uint       `json:"inviter_id" gorm:"index"`                        // 邀请人ID
+	InviteeID        *uint      `json:"invitee_id"`                                     // 被邀请人ID，注册后才有
+	InviteCode       string     `json:"invite_code" gorm:"size:50;uniqueIndex"`         // 邀请码
+	Email            string     `json:"email" gorm:"size:100"`                          // 被邀请人邮箱
+	Phone            string     `json:"phone" gorm:"size:20"`                           // 被邀请人电话
+	Status           string     `json:"status" gorm:"default:pending"`                  // 状态：pending待接受, accepted已接受, rejected已拒绝, expired已过期, revoked已撤回
+	AcceptedAt       *time.Time `json:"accepted_at"`                                    // 接受时间
+	RevokedAt        *time.Time `json:"revoked_at"`                                     // 撤回时间
+	RejectedAt       *time.Time `json:"rejected_at"`                                    // 拒绝时间
+	DeliveryStatus   string     `json:"delivery_status" gorm:"size:20;default:pending"` // 发送状态：pending待发送, sent已发送, partial部分发送, failed发送失败
+	DeliveryError    string     `json:"delivery_error" gorm:"type:text"`                // 最近一次发送失败的原因
+	DeliveryAttempts int        `json:"delivery_attempts" gorm:"default:0"`             // 发送次数
+	LastSentAt       *time.Time `json:"last_sent_at"`                                   // 最近一次发送时间
+	ExpiredAt        time.Time  `json:"expired_at"`                                     // 过期时间
+	CreatedAt        time.Time  `json:"created_at" gorm:"autoCreateTime"`               // 创建时间
+	UpdatedAt        time.Time  `json:"updated_at" gorm:"autoUpdateTime"`               // 更新时间
 }
 
 // TableName 返回表名
 func (SalespersonAgentInvitation) TableName() string {
 	return "salesperson_agent_invitations"
 }
+
+// SalespersonAgentPath 代理层级闭包表
+// 记录每个销售员与其所有上级（包括自己）之间的关系，
+// 用于一次查询获取整个下级树或上级链，避免逐级递归查询
+type SalespersonAgentPath struct {
+	AncestorID   uint      `json:"ancestor_id" gorm:"primaryKey;autoIncrement:false"`         // 上级ID
+	DescendantID uint      `json:"descendant_id" gorm:"primaryKey;autoIncrement:false;index"` // 下级ID
+	Depth        int       `json:"depth" gorm:"not null;default:0"`                           // 层级距离，0表示自己
+	CreatedAt    time.Time `json:"created_at" gorm:"autoCreateTime"`                          // 创建时间
+}
+
+// TableName 返回表名
+func (SalespersonAgentPath) TableName() string {
+	return "salesperson_agent_paths"
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"time"
+)
+
+// SalespersonAPIKey 销售员API密钥
+// 供网店后端等服务端集成使用，以所属销售员的身份调用声明了对应权限范围的接口
+// 密钥格式为 gck_<前缀>_<密文>，数据库中只保存前缀和密文的摘要，完整密钥只在创建时返回一次
+type SalespersonAPIKey struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`              // 主键ID
+	SalespersonID uint       `json:"salesperson_id" gorm:"index"`       // 所属销售员ID
+	Name          string     `json:"name" gorm:"size:100"`              // 名称，用于区分不同的集成
+	Prefix        string     `json:"prefix" gorm:"size:20;uniqueIndex"` // 密钥前缀，用于查找密钥和在列表中识别
+	SecretHash    string     `json:"-" gorm:"size:64"`                  // 密文的SHA-256摘要
+	Scopes        string     `json:"scopes" gorm:"size:255"`            // 权限范围，逗号分隔
+	AllowedIPs    string     `json:"allowed_ips" gorm:"size:500"`       // 允许调用的IP或CIDR，逗号分隔，为空表示不限制
+	RateLimit     int        `json:"rate_limit" gorm:"default:0"`       // 每分钟最多请求次数，0表示不限制
+	ExpiredAt     *time.Time `json:"expired_at"`                        // 过期时间，为空表示永不过期
+	LastUsedAt    *time.Time `json:"last_used_at"`                      // 最近使用时间
+	LastUsedIP    string     `json:"last_used_ip" gorm:"size:50"`       // 最近使用的IP
+	RevokedAt     *time.Time `json:"revoked_at"`                        // 撤销时间
+	CreatedAt     time.Time  `json:"created_at" gorm:"autoCreateTime"`  // 创建时间
+	UpdatedAt     time.Time  `json:"updated_at" gorm:"autoUpdateTime"`  // 更新时间
+}
+
+// TableName 返回表名
+func (SalespersonAPIKey) TableName() string {
+	return "salesperson_api_keys"
+}
+
+// API密钥权限范围
+const (
+	APIKeyScopeKeysGenerate = "keys:generate" // 生成卡密
+	APIKeyScopeKeysRead     = "keys:read"     // 查询销售记录及其中的卡密
+	APIKeyScopeProductsRead = "products:read" // 查询可销售的产品
+)
+
+// APIKeyScopes 所有可用的API密钥权限范围
+var APIKeyScopes = []string{
+	APIKeyScopeKeysGenerate,
+	APIKeyScopeKeysRead,
+	APIKeyScopeProductsRead,
+}
@@ -4,19 +4,23 @@ import (
 	"time"
 )
 
-// SalespersonToken 销售员登录令牌模型
-// 该模型用于存储销售员的JWT认证令牌及相关会话信息
-// 支持多设备登录，每个设备会创建独立的令牌记录
-// 包含令牌本身、设备信息、IP地址和过期时间等安全相关字段
+// SalespersonToken 销售员登录会话模型
+// 该模型用于存储销售员的登录会话及相关设备信息
+// 支持多设备登录，每次登录会创建独立的会话记录，会话也是刷新令牌的令牌族
+// 访问令牌（JWT）中携带会话ID，撤销会话即可使该设备的访问令牌和刷新令牌全部失效
+// 数据库中不保存访问令牌本身，刷新令牌只保存摘要
 type SalespersonToken struct {
-	ID            uint      `json:"id" gorm:"primaryKey"`             // 主键ID
-	SalespersonID uint      `json:"salesperson_id" gorm:"index"`      // 关联的销售员ID，添加索引以提高查询性能
-	Token         string    `json:"token" gorm:"size:500;index"`      // JWT令牌字符串，添加索引以提高查询性能
-	UserAgent     string    `json:"user_agent" gorm:"size:255"`       // 用户代理信息，用于识别登录设备
-	IP            string    `json:"ip" gorm:"size:50"`                // 登录IP地址，用于安全审计
-	ExpiredAt     time.Time `json:"expired_at" gorm:"index"`          // 令牌过期时间，添加索引以提高查询性能
-	CreatedAt     time.Time `json:"created_at" gorm:"autoCreateTime"` // 记录创建时间，自动设置
-	UpdatedAt     time.Time `json:"updated_at" gorm:"autoUpdateTime"` // 记录更新时间，自动更新
+	ID            uint       `json:"id" gorm:"primaryKey"`                  // 主键ID
+	SalespersonID uint       `json:"salesperson_id" gorm:"index"`           // 关联的销售员ID，添加索引以提高查询性能
+	SessionID     string     `json:"session_id" gorm:"size:64;uniqueIndex"` // 会话ID，写入访问令牌的sid声明
+	UserAgent     string     `json:"user_agent" gorm:"size:255"`            // 用户代理信息，用于识别登录设备
+	IP            string     `json:"ip" gorm:"size:50"`                     // 最近使用的IP地址，用于安全审计
+	ExpiredAt     time.Time  `json:"expired_at" gorm:"index"`               // 会话过期时间，超过后刷新令牌也无法使用
+	LastUsedAt    *time.Time `json:"last_used_at"`                          // 最近一次刷新令牌的时间
+	RevokedAt     *time.Time `json:"revoked_at"`                            // 撤销时间，为空表示会话有效
+	RevokeReason  string     `json:"revoke_reason" gorm:"size:50"`          // 撤销原因：logout, password_changed, refresh_reuse等
+	CreatedAt     time.Time  `json:"created_at" gorm:"autoCreateTime"`      // 记录创建时间，自动设置
+	UpdatedAt     time.Time  `json:"updated_at" gorm:"autoUpdateTime"`      // 记录更新时间，自动更新
 }
 
 // TableName 返回表名
@@ -25,3 +29,71 @@ type SalespersonToken struct {
 func (SalespersonToken) TableName() string {
 	return "salesperson_tokens"
 }
+
+// SalespersonRefreshToken 销售员刷新令牌
+// 同一会话中的刷新令牌组成一个令牌族，每次刷新都会使用旧令牌换取新令牌
+// 已使用的旧令牌再次出现说明令牌可能被盗用，此时撤销整个会话
+type SalespersonRefreshToken struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`             // 主键ID
+	SessionID string     `json:"session_id" gorm:"size:64;index"`  // 所属会话ID
+	TokenHash string     `json:"-" gorm:"size:64;uniqueIndex"`     // 刷新令牌的SHA-256摘要
+	ExpiredAt time.Time  `json:"expired_at" gorm:"index"`          // 过期时间
+	UsedAt    *time.Time `json:"used_at"`                          // 使用（轮换）时间，为空表示未使用
+	CreatedAt time.Time  `json:"created_at" gorm:"autoCreateTime"` // 创建时间
+}
+
+// TableName 返回表名
+func (SalespersonRefreshToken) TableName() string {
+	return "salesperson_refresh_tokens"
+}
+
+// SalespersonPasswordReset 销售员密码重置令牌
+// 令牌通过邮件或短信发送给销售员，数据库中只保存令牌的摘要
+// 令牌有效期较短且只能使用一次
+type SalespersonPasswordReset struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`             // 主键ID
+	SalespersonID uint       `json:"salesperson_id" gorm:"index"`      // 关联的销售员ID
+	TokenHash     string     `json:"-" gorm:"size:64;uniqueIndex"`     // 令牌的SHA-256摘要
+	Channel       string     `json:"channel" gorm:"size:20"`           // 发送渠道：email, sms
+	IP            string     `json:"ip" gorm:"size:50"`                // 发起请求的IP地址，用于安全审计
+	ExpiredAt     time.Time  `json:"expired_at" gorm:"index"`          // 过期时间
+	UsedAt        *time.Time `json:"used_at"`                          // 使用时间，为空表示未使用
+	CreatedAt     time.Time  `json:"created_at" gorm:"autoCreateTime"` // 创建时间
+}
+
+// TableName 返回表名
+func (SalespersonPasswordReset) TableName() string {
+	return "salesperson_password_resets"
+}
+
+// SalespersonRecoveryCode 销售员两步验证恢复码
+// 丢失身份验证器时可以使用恢复码代替验证码登录，每个恢复码只能使用一次
+type SalespersonRecoveryCode struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`             // 主键ID
+	SalespersonID uint       `json:"salesperson_id" gorm:"index"`      // 关联的销售员ID
+	CodeHash      string     `json:"-" gorm:"size:64;index"`           // 恢复码的SHA-256摘要
+	UsedAt        *time.Time `json:"used_at"`                          // 使用时间，为空表示未使用
+	CreatedAt     time.Time  `json:"created_at" gorm:"autoCreateTime"` // 创建时间
+}
+
+// TableName 返回表名
+func (SalespersonRecoveryCode) TableName() string {
+	return "salesperson_recovery_codes"
+}
+
+// SalespersonLoginChallenge 两步验证登录挑战
+// 密码验证通过后签发的短期一次性令牌，客户端凭此令牌和验证码或恢复码完成登录，无需再次提交密码
+type SalespersonLoginChallenge struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`             // 主键ID
+	SalespersonID uint       `json:"salesperson_id" gorm:"index"`      // 关联的销售员ID
+	TokenHash     string     `json:"-" gorm:"size:64;uniqueIndex"`     // 挑战令牌的SHA-256摘要
+	IP            string     `json:"ip" gorm:"size:50"`                // 验证密码时的IP地址，用于安全审计
+	ExpiredAt     time.Time  `json:"expired_at" gorm:"index"`          // 过期时间
+	UsedAt        *time.Time `json:"used_at"`                          // 使用时间，为空表示未使用
+	CreatedAt     time.Time  `json:"created_at" gorm:"autoCreateTime"` // 创建时间
+}
+
+// TableName 返回表名
+func (SalespersonLoginChallenge) TableName() string {
+	return "salesperson_login_challenges"
+}
@@ -2,6 +2,8 @@ package models
 
 import (
 	"time"
+
+	"gorm.io/gorm"
 )
 
 // Package models 定义了应用程序的数据模型
@@ -9,17 +11,18 @@ import (
 // Software 软件模型
 // 用于存储软件的基本信息，包括名称、描述、版本、公告等
 type Software struct {
-	ID           uint      `json:"id" gorm:"primaryKey"`                          // 主键ID
-	Name         string    `json:"name" gorm:"size:100;not null"`                 // 软件名称，不能为空
-	Description  string    `json:"description" gorm:"type:text"`                  // 软件描述，详细说明软件的功能和特点
-	Version      string    `json:"version" gorm:"size:50"`                        // 软件版本号，如"1.0.0"
-	Announcement string    `json:"announcement" gorm:"type:text"`                 // 软件公告，用于向用户展示重要信息
-	Status       string    `json:"status" gorm:"size:20;default:active"`          // 软件状态：active活跃, inactive非活跃
-	IsActive     bool      `json:"is_active" gorm:"default:true"`                 // 是否启用，控制软件是否可用
-	CreatorID    uint      `json:"creator_id" gorm:"not null"`                    // 创建者ID，记录谁创建了这个软件
-	CreatedAt    time.Time `json:"created_at" gorm:"autoCreateTime"`              // 创建时间，记录软件的创建时间
-	UpdatedAt    time.Time `json:"updated_at" gorm:"autoUpdateTime"`              // 更新时间，记录软件的最后更新时间
-	KeyTypes     []KeyType `json:"key_types" gorm:"many2many:software_key_types"` // 关联的密钥类型，多对多关系
+	ID           uint           `json:"id" gorm:"primaryKey"`                          // 主键ID
+	Name         string         `json:"name" gorm:"size:100;not null"`                 // 软件名称，不能为空
+	Description  string         `json:"description" gorm:"type:text"`                  // 软件描述，详细说明软件的功能和特点
+	Version      string         `json:"version" gorm:"size:50"`                        // 软件版本号，如"1.0.0"
+	Announcement string         `json:"announcement" gorm:"type:text"`                 // 软件公告，用于向用户展示重要信息
+	Status       string         `json:"status" gorm:"size:20;default:active"`          // 软件状态：active活跃, inactive非活跃
+	IsActive     bool           `json:"is_active" gorm:"default:true"`                 // 是否启用，控制软件是否可用
+	CreatorID    uint           `json:"creator_id" gorm:"not null"`                    // 创建者ID，记录谁创建了这个软件
+	CreatedAt    time.Time      `json:"created_at" gorm:"autoCreateTime"`              // 创建时间，记录软件的创建时间
+	UpdatedAt    time.Time      `json:"updated_at" gorm:"autoUpdateTime"`              // 更新时间，记录软件的最后更新时间
+	DeletedAt    gorm.DeletedAt `json:"deleted_at" gorm:"index"`                       // 删除时间，软删除后可以恢复
+	KeyTypes     []KeyType      `json:"key_types" gorm:"many2many:software_key_types"` // 关联的密钥类型，多对多关系
 }
 
 // TableName 返回表名
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"time"
+)
+
+// 公告严重程度
+const (
+	AnnouncementSeverityInfo     = "info"     // 普通通知
+	AnnouncementSeverityWarning  = "warning"  // 警告
+	AnnouncementSeverityCritical = "critical" // 严重，客户端应醒目展示
+)
+
+// SoftwareAnnouncement 软件公告
+// 一个软件可以有多条公告，每条公告在生效时间内向符合条件的客户端展示
+// 卡密类型、版本范围和发布渠道都是可选的定向条件，为空表示不限制
+type SoftwareAnnouncement struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`                 // 主键ID
+	SoftwareID uint       `json:"software_id" gorm:"not null;index"`    // 软件ID
+	Title      string     `json:"title" gorm:"size:200;not null"`       // 标题
+	Content    string     `json:"content" gorm:"type:text"`             // 内容
+	Severity   string     `json:"severity" gorm:"size:20;default:info"` // 严重程度：info, warning, critical
+	Priority   int        `json:"priority" gorm:"default:0"`            // 优先级，数值越大越靠前
+	RequireAck bool       `json:"require_ack" gorm:"default:false"`     // 是否需要客户端确认
+	Status     string     `json:"status" gorm:"size:20;default:active"` // 状态：active启用, inactive停用
+	StartAt    *time.Time `json:"start_at"`                             // 开始时间，为空表示立即生效
+	EndAt      *time.Time `json:"end_at"`                               // 结束时间，为空表示长期有效
+	KeyTypeIDs string     `json:"key_type_ids" gorm:"size:500"`         // 定向的卡密类型ID，逗号分隔
+	MinVersion string     `json:"min_version" gorm:"size:50"`           // 定向的最低客户端版本（含）
+	MaxVersion string     `json:"max_version" gorm:"size:50"`           // 定向的最高客户端版本（含）
+	Channels   string     `json:"channels" gorm:"size:100"`             // 定向的发布渠道，逗号分隔
+	CreatedAt  time.Time  `json:"created_at" gorm:"autoCreateTime"`     // 创建时间
+	UpdatedAt  time.Time  `json:"updated_at" gorm:"autoUpdateTime"`     // 更新时间
+}
+
+// TableName 返回表名
+func (SoftwareAnnouncement) TableName() string {
+	return "software_announcements"
+}
+
+// IsValidAnnouncementSeverity 检查公告严重程度是否有效
+func IsValidAnnouncementSeverity(severity string) bool {
+	return severity == AnnouncementSeverityInfo ||
+		severity == AnnouncementSeverityWarning ||
+		severity == AnnouncementSeverityCritical
+}
+
+// SoftwareAnnouncementReceipt 公告阅读回执
+// 每个客户端对每条公告只有一条记录，用于统计阅读数和确认数
+type SoftwareAnnouncementReceipt struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`                                                   // 主键ID
+	AnnouncementID uint       `json:"announcement_id" gorm:"not null;uniqueIndex:idx_announcement_client"`    // 公告ID
+	ClientID       string     `json:"client_id" gorm:"size:100;not null;uniqueIndex:idx_announcement_client"` // 客户端标识，如设备ID
+	ReadAt         time.Time  `json:"read_at"`                                                                // 首次阅读时间
+	AckedAt        *time.Time `json:"acked_at"`                                                               // 确认时间
+}
+
+// TableName 返回表名
+func (SoftwareAnnouncementReceipt) TableName() string {
+	return "software_announcement_receipts"
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"time"
+)
+
+// 配置项值类型
+const (
+	ConfigValueString = "string" // 字符串
+	ConfigValueInt    = "int"    // 整数
+	ConfigValueFloat  = "float"  // 浮点数
+	ConfigValueBool   = "bool"   // 布尔值，常用作功能开关
+	ConfigValueJSON   = "json"   // 任意JSON
+)
+
+// 配置覆盖范围，卡密的覆盖优先于卡密类型的覆盖
+const (
+	ConfigScopeKeyType = "key_type" // 按卡密类型覆盖
+	ConfigScopeKey     = "key"      // 按单个卡密覆盖
+)
+
+// SoftwareConfigItem 软件远程配置项
+// 管理员为软件定义带类型的配置项和默认值，客户端激活或查询卡密时获得按卡密类型和卡密覆盖后的配置
+type SoftwareConfigItem struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`                                                               // 主键ID
+	SoftwareID   uint      `json:"software_id" gorm:"not null;uniqueIndex:idx_software_config_key"`                    // 软件ID
+	Key          string    `json:"key" gorm:"column:config_key;size:100;not null;uniqueIndex:idx_software_config_key"` // 配置项名称
+	ValueType    string    `json:"value_type" gorm:"size:20;not null"`                                                 // 值类型：string, int, float, bool, json
+	DefaultValue string    `json:"default_value" gorm:"type:text"`                                                     // 默认值，JSON编码
+	Description  string    `json:"description" gorm:"size:500"`                                                        // 说明
+	CreatedAt    time.Time `json:"created_at" gorm:"autoCreateTime"`                                                   // 创建时间
+	UpdatedAt    time.Time `json:"updated_at" gorm:"autoUpdateTime"`                                                   // 更新时间
+}
+
+// TableName 返回表名
+func (SoftwareConfigItem) TableName() string {
+	return "software_config_items"
+}
+
+// IsValidConfigValueType 检查配置项值类型是否有效
+func IsValidConfigValueType(valueType string) bool {
+	switch valueType {
+	case ConfigValueString, ConfigValueInt, ConfigValueFloat, ConfigValueBool, ConfigValueJSON:
+		return true
+	}
+	return false
+}
+
+// SoftwareConfigOverride 远程配置覆盖值
+// 按卡密类型或单个卡密覆盖配置项的默认值
+type SoftwareConfigOverride struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`                                                  // 主键ID
+	ConfigItemID uint      `json:"config_item_id" gorm:"not null;uniqueIndex:idx_config_override_target"` // 配置项ID
+	Scope        string    `json:"scope" gorm:"size:20;not null;uniqueIndex:idx_config_override_target"`  // 覆盖范围：key_type, key
+	TargetID     uint      `json:"target_id" gorm:"not null;uniqueIndex:idx_config_override_target"`      // 卡密类型ID或卡密ID
+	Value        string    `json:"value" gorm:"type:text"`                                                // 覆盖值，JSON编码
+	CreatedAt    time.Time `json:"created_at" gorm:"autoCreateTime"`                                      // 创建时间
+	UpdatedAt    time.Time `json:"updated_at" gorm:"autoUpdateTime"`                                      // 更新时间
+}
+
+// TableName 返回表名
+func (SoftwareConfigOverride) TableName() string {
+	return "software_config_overrides"
+}
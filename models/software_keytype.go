@@ -7,14 +7,19 @@ import (
 
 // SoftwareKeyType 软件与卡密类型的关联模型
 // 用于建立软件和卡密类型之间的多对多关系
+// 价格和有效期可以按软件覆盖，为空时使用卡密类型的价格和有效期
 type SoftwareKeyType struct {
-	ID         uint      `json:"id" gorm:"primaryKey"`              // 主键ID
-	SoftwareID uint      `json:"software_id" gorm:"not null;index"` // 软件ID，关联到Software表
-	KeyTypeID  uint      `json:"key_type_id" gorm:"not null;index"` // 卡密类型ID，关联到KeyType表
-	IsActive   bool      `json:"is_active" gorm:"default:true"`     // 是否启用，控制该关联是否有效
-	CreatorID  uint      `json:"creator_id" gorm:"not null"`        // 创建者ID，记录谁创建了这个关联
-	CreatedAt  time.Time `json:"created_at" gorm:"autoCreateTime"`  // 创建时间，记录关联的创建时间
-	UpdatedAt  time.Time `json:"updated_at" gorm:"autoUpdateTime"`  // 更新时间，记录关联的最后更新时间
+	ID             uint      `json:"id" gorm:"primaryKey"`              // 主键ID
+	SoftwareID     uint      `json:"software_id" gorm:"not null;index"` // 软件ID，关联到Software表
+	KeyTypeID      uint      `json:"key_type_id" gorm:"not null;index"` // 卡密类型ID，关联到KeyType表
+	IsActive       bool      `json:"is_active" gorm:"default:true"`     // 是否启用，控制该关联是否有效
+	Price          *float64  `json:"price"`                             // 该软件的价格，为空时使用卡密类型的价格
+	Hours          *int      `json:"hours"`                             // 该软件的有效期（小时），为空时使用卡密类型的有效期
+	DurationUnit   *string   `json:"duration_unit" gorm:"size:20"`      // 该软件的有效期单位，为空时按hours计算
+	DurationAmount *int      `json:"duration_amount"`                   // 该软件的有效期数量，永久时为0
+	CreatorID      uint      `json:"creator_id" gorm:"not null"`        // 创建者ID，记录谁创建了这个关联
+	CreatedAt      time.Time `json:"created_at" gorm:"autoCreateTime"`  // 创建时间，记录关联的创建时间
+	UpdatedAt      time.Time `json:"updated_at" gorm:"autoUpdateTime"`  // 更新时间，记录关联的最后更新时间
 }
 
 // TableName 返回表名
@@ -23,6 +28,49 @@ func (SoftwareKeyType) TableName() string {
 	return "software_key_types"
 }
 
+// ResolvePrice 返回该软件下卡密类型的实际价格，优先使用绑定上的价格
+func (b *SoftwareKeyType) ResolvePrice(keyType *KeyType) float64 {
+	if b != nil && b.Price != nil {
+		return *b.Price
+	}
+	return keyType.Price
+}
+
+// ResolveHours 返回该软件下卡密类型的实际有效期，优先使用绑定上的有效期
+func (b *SoftwareKeyType) ResolveHours(keyType *KeyType) int {
+	if b != nil && b.Hours != nil {
+		return *b.Hours
+	}
+	return keyType.Hours
+}
+
+// ResolveDuration 返回该软件下卡密类型的实际有效期，优先使用绑定上的有效期
+// 绑定上只设置了hours的历史数据按小时计算
+func (b *SoftwareKeyType) ResolveDuration(keyType *KeyType) KeyDuration {
+	if b != nil && b.DurationUnit != nil {
+		duration := KeyDuration{Unit: *b.DurationUnit}
+		if b.DurationAmount != nil {
+			duration.Amount = *b.DurationAmount
+		}
+		return duration
+	}
+	if b != nil && b.Hours != nil {
+		return KeyDuration{Unit: DurationUnitHour, Amount: *b.Hours}
+	}
+	return keyType.Duration()
+}
+
+// SetDurationOverride 设置绑定上的有效期覆盖，duration为nil时清除覆盖
+// hours同步为按小时计算的有效期，自然月、自然年和永久为0，与卡密类型保持一致
+func (b *SoftwareKeyType) SetDurationOverride(duration *KeyDuration) {
+	if duration == nil {
+		b.Hours, b.DurationUnit, b.DurationAmount = nil, nil, nil
+		return
+	}
+	unit, amount, hours := duration.Unit, duration.Amount, duration.Hours()
+	b.Hours, b.DurationUnit, b.DurationAmount = &hours, &unit, &amount
+}
+
 // SoftwareKeyTypeQuery 软件与卡密类型关联的查询参数
 // 用于接收前端传来的查询条件，进行关联关系的筛选查询
 type SoftwareKeyTypeQuery struct {
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+)
+
+// 发布渠道
+const (
+	ReleaseChannelStable = "stable" // 正式版
+	ReleaseChannelBeta   = "beta"   // 测试版，测试渠道的客户端同时接收正式版
+)
+
+// SoftwareRelease 软件发布版本
+// 记录软件每个版本的更新说明和下载信息，客户端检查更新和激活卡密时根据这些记录判断是否需要更新
+// 标记为最低支持版本的发布表示低于该版本的客户端必须更新后才能继续使用
+type SoftwareRelease struct {
+	ID                 uint       `json:"id" gorm:"primaryKey"`                                                     // 主键ID
+	SoftwareID         uint       `json:"software_id" gorm:"not null;uniqueIndex:idx_software_release_version"`     // 软件ID
+	Version            string     `json:"version" gorm:"size:50;not null;uniqueIndex:idx_software_release_version"` // 版本号，语义化版本格式，如"1.2.0"
+	Changelog          string     `json:"changelog" gorm:"type:text"`                                               // 更新说明
+	DownloadURL        string     `json:"download_url" gorm:"size:500"`                                             // 下载地址
+	Checksum           string     `json:"checksum" gorm:"size:150"`                                                 // 安装包校验值，如"sha256:..."
+	Channel            string     `json:"channel" gorm:"size:20;default:stable;index"`                              // 发布渠道：stable正式版, beta测试版
+	IsMinimumSupported bool       `json:"is_minimum_supported" gorm:"default:false"`                                // 是否为最低支持版本
+	PublishedAt        *time.Time `json:"published_at"`                                                             // 发布时间，为空表示草稿，草稿不会推送给客户端
+	CreatedAt          time.Time  `json:"created_at" gorm:"autoCreateTime"`                                         // 创建时间
+	UpdatedAt          time.Time  `json:"updated_at" gorm:"autoUpdateTime"`                                         // 更新时间
+}
+
+// TableName 返回表名
+func (SoftwareRelease) TableName() string {
+	return "software_releases"
+}
+
+// IsValidReleaseChannel 检查发布渠道是否有效
+func IsValidReleaseChannel(channel string) bool {
+	return channel == ReleaseChannelStable || channel == ReleaseChannelBeta
+}
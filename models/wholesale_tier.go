@@ -0,0 +1,61 @@
+package models
+
+import (
+	"time"
+)
+
+// WholesalePriceTier 销售员批发价格阶梯
+// 销售员一次生成的卡密数量达到MinQuantity时按UnitPrice结算，零售价与批发价的差额即为销售员的佣金
+// AgentLevel为空时适用于所有代理层级，否则只适用于指定层级的销售员，例如给顶级代理更低的批发价
+type WholesalePriceTier struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`                                 // 主键ID
+	SoftwareID  uint      `json:"software_id" gorm:"not null;index:idx_wholesale_tier"` // 软件ID
+	KeyTypeID   uint      `json:"key_type_id" gorm:"not null;index:idx_wholesale_tier"` // 卡密类型ID
+	Name        string    `json:"name" gorm:"size:100"`                                 // 阶梯名称，如"100张以上"
+	AgentLevel  *int      `json:"agent_level"`                                          // 适用的代理层级，为空表示适用于所有层级
+	MinQuantity int       `json:"min_quantity" gorm:"not null;default:1"`               // 单次生成的最少卡密数量
+	UnitPrice   float64   `json:"unit_price"`                                           // 批发单价
+	IsActive    bool      `json:"is_active" gorm:"default:true"`                        // 是否启用
+	CreatedAt   time.Time `json:"created_at" gorm:"autoCreateTime"`                     // 创建时间
+	UpdatedAt   time.Time `json:"updated_at" gorm:"autoUpdateTime"`                     // 更新时间
+}
+
+// TableName 返回表名
+func (WholesalePriceTier) TableName() string {
+	return "wholesale_price_tiers"
+}
+
+// SelectWholesaleTier 从候选阶梯中选出适用于指定代理层级和数量的阶梯
+// 在所有适用的阶梯（数量达到最少数量，且代理层级匹配或适用于所有层级）中使用批发单价最低的阶梯，
+// 使销售员总能得到对其有效的最优批发价；单价相同时指定了代理层级的阶梯优先，其次是最少数量更大的阶梯
+// 没有适用的阶梯时返回nil
+func SelectWholesaleTier(tiers []WholesalePriceTier, level, quantity int) *WholesalePriceTier {
+	var selected *WholesalePriceTier
+	for i := range tiers {
+		tier := &tiers[i]
+		if !tier.IsActive || quantity < tier.MinQuantity {
+			continue
+		}
+		if tier.AgentLevel != nil && *tier.AgentLevel != level {
+			continue
+		}
+		if selected == nil || tier.UnitPrice < selected.UnitPrice {
+			selected = tier
+			continue
+		}
+		if tier.UnitPrice > selected.UnitPrice {
+			continue
+		}
+		selectedSpecific, specific := selected.AgentLevel != nil, tier.AgentLevel != nil
+		if specific != selectedSpecific {
+			if specific {
+				selected = tier
+			}
+			continue
+		}
+		if tier.MinQuantity > selected.MinQuantity {
+			selected = tier
+		}
+	}
+	return selected
+}
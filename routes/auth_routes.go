@@ -16,6 +16,12 @@ func SetupAuthRoutes(app *fiber.App) {
 	// 这种分组方式有助于API的组织和版本管理
 	auth := app.Group("/api/auth")
 
+	// JWKS路由 - 发布验证令牌所需的公钥
+	// GET /.well-known/jwks.json
+	// 其他服务可以使用这些公钥独立验证本服务签发的令牌（仅包含RS256和EdDSA密钥）
+	// 不需要认证中间件，公钥本身是公开信息
+	app.Get("/.well-known/jwks.json", handlers.GetJWKS)
+
 	// 登录路由 - 处理销售员的登录请求
 	// POST /api/auth/login
 	// 请求体需包含用户名和密码
@@ -23,16 +29,74 @@ func SetupAuthRoutes(app *fiber.App) {
 	// 不需要认证中间件，因为用户尚未登录
 	auth.Post("/login", handlers.SalespersonLogin)
 
+	// 两步验证登录路由 - 启用两步验证的账号在密码验证通过后完成第二步
+	// POST /api/auth/login/2fa
+	// 请求体需包含登录时返回的challenge_token，以及totp_code或recovery_code
+	// 成功返回JWT令牌和过期时间，不需要重新提交密码
+	auth.Post("/login/2fa", handlers.VerifyLoginTwoFactor)
+
+	// 注册路由 - 通过上级代理码自助注册销售员
+	// POST /api/auth/register
+	// 请求体需包含代理码、用户名、密码和姓名
+	// 注册后账号处于待审核状态，上级或管理员审核通过后才能登录
+	// 不需要认证中间件，因为用户尚未注册
+	auth.Post("/register", handlers.RegisterSalesperson)
+
+	// 忘记密码路由 - 申请重置密码
+	// POST /api/auth/forgot-password
+	// 请求体需包含用户名，重置令牌通过邮件或短信发送
+	// 无论账号是否存在都返回相同结果，避免泄露账号信息
+	auth.Post("/forgot-password", handlers.ForgotPassword)
+
+	// 重置密码路由 - 使用重置令牌设置新密码
+	// POST /api/auth/reset-password
+	// 令牌只能使用一次，成功后撤销该账号的所有登录令牌
+	auth.Post("/reset-password", handlers.ResetPassword)
+
+	// 修改密码路由 - 已登录的销售员修改自己的密码
+	// POST /api/auth/change-password
+	// 需要提供原密码，成功后撤销其他设备的登录令牌
+	// 需要认证中间件确保用户已登录
+	auth.Post("/change-password", middleware.SalespersonAuthMiddleware(), handlers.ChangePassword)
+
+	// 两步验证路由 - 管理当前销售员的TOTP两步验证
+	// GET  /api/auth/2fa/status 查询启用状态和剩余恢复码数量
+	// POST /api/auth/2fa/setup 验证密码后生成密钥和配置地址
+	// POST /api/auth/2fa/confirm 提交验证码确认启用，返回恢复码
+	// POST /api/auth/2fa/disable 验证密码和验证码后关闭
+	// POST /api/auth/2fa/recovery-codes 重新生成恢复码
+	// 需要认证中间件确保用户已登录
+	twoFactor := auth.Group("/2fa", middleware.SalespersonAuthMiddleware())
+	twoFactor.Get("/status", handlers.GetTwoFactorStatus)
+	twoFactor.Post("/setup", handlers.SetupTwoFactor)
+	twoFactor.Post("/confirm", handlers.ConfirmTwoFactor)
+	twoFactor.Post("/disable", handlers.DisableTwoFactor)
+	twoFactor.Post("/recovery-codes", handlers.RegenerateRecoveryCodes)
+
+	// 两步验证管理路由 - 管理员功能
+	// POST /api/auth/2fa-requirement 按销售员ID或代理层级设置是否要求启用两步验证
+	// POST /api/auth/salesperson/:id/2fa/reset 销售员丢失身份验证器时重置两步验证
+	// 实际应用中应该使用管理员认证中间件
+	auth.Post("/2fa-requirement", handlers.SetTwoFactorRequirement)
+	auth.Post("/salesperson/:id/2fa/reset", handlers.ResetSalespersonTwoFactor)
+
+	// 登录锁定管理路由 - 管理员功能
+	// GET    /api/auth/login-lockouts 查看登录失败记录，支持locked、scope、username、ip过滤
+	// DELETE /api/auth/login-lockouts 按key、username或ip清除失败记录和锁定
+	// 实际应用中应该使用管理员认证中间件
+	auth.Get("/login-lockouts", handlers.GetLoginLockouts)
+	auth.Delete("/login-lockouts", handlers.ClearLoginLockouts)
+
 	// 登出路由 - 处理销售员的登出请求
 	// POST /api/auth/logout
 	// 使当前会话的令牌失效
 	// 需要认证中间件确保用户已登录
 	auth.Post("/logout", middleware.SalespersonAuthMiddleware(), handlers.SalespersonLogout)
 
-	// 刷新令牌路由 - 用于刷新JWT令牌，延长登录有效期
+	// 刷新令牌路由 - 使用刷新令牌换取新的访问令牌，延长登录有效期
 	// POST /api/auth/refresh
-	// 使用当前令牌获取新令牌，避免用户频繁登录
-	// 不需要认证中间件，因为令牌可能已过期，但仍可用于刷新
+	// 每个刷新令牌只能使用一次，使用后返回新的刷新令牌；已使用的令牌再次出现时撤销整个会话
+	// 不需要认证中间件，因为访问令牌可能已过期
 	auth.Post("/refresh", handlers.RefreshToken)
 
 	// 获取登录设备列表路由 - 查询当前销售员的所有登录设备
@@ -14,7 +14,13 @@ func RegisterKeyTypeRoutes(api fiber.Router) {
 	keyTypes.Get("/", handlers.GetAllKeyTypes)                   // 获取所有卡密类型
 	keyTypes.Get("/:id", handlers.GetKeyTypeByID)                // 获取单个卡密类型
 	keyTypes.Put("/:id", handlers.UpdateKeyType)                 // 更新卡密类型
-	keyTypes.Delete("/:id", handlers.DeleteKeyType)              // 删除卡密类型
+	keyTypes.Delete("/:id", handlers.DeleteKeyType)              // 删除卡密类型（软删除，cascade=true级联处理关联数据）
+	keyTypes.Post("/:id/restore", handlers.RestoreKeyType)       // 恢复已删除的卡密类型
 	keyTypes.Post("/:id/activate", handlers.ActivateKeyType)     // 激活卡密类型
 	keyTypes.Post("/:id/deactivate", handlers.DeactivateKeyType) // 停用卡密类型
+
+	// 卡密类型价格版本
+	keyTypes.Get("/:id/prices", handlers.GetKeyTypePrices)                // 获取价格历史和指定时间的有效价格
+	keyTypes.Post("/:id/prices", handlers.CreateKeyTypePrice)             // 调价、计划调价或设置促销价格
+	keyTypes.Delete("/:id/prices/:price_id", handlers.DeleteKeyTypePrice) // 取消计划调价或提前结束促销
 }
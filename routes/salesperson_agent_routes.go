@@ -18,6 +18,15 @@ func SetupSalespersonAgentRoutes(app *fiber.App) {
 	// 获取代理层级结构
 	agentGroup.Get("/hierarchy", handlers.GetAgentHierarchy)
 
+	// 获取整个下级树
+	agentGroup.Get("/tree", handlers.GetAgentTree)
+
+	// 获取上级链
+	agentGroup.Get("/upline", handlers.GetAgentUpline)
+
+	// 获取下级树的销售汇总
+	agentGroup.Get("/downline-sales", handlers.GetAgentDownlineSales)
+
 	// 获取代理佣金记录
 	agentGroup.Get("/commissions", handlers.GetAgentCommissions)
 
@@ -27,6 +36,34 @@ func SetupSalespersonAgentRoutes(app *fiber.App) {
 	// 接受代理邀请
 	agentGroup.Post("/invitation/accept", handlers.AcceptAgentInvitation)
 
+	// 拒绝代理邀请
+	agentGroup.Post("/invitation/reject", handlers.RejectAgentInvitation)
+
+	// 获取自己发出的邀请列表
+	agentGroup.Get("/invitations", handlers.GetAgentInvitations)
+
+	// 重新发送代理邀请
+	agentGroup.Post("/invitation/:id/resend", handlers.ResendAgentInvitation)
+
+	// 撤回代理邀请
+	agentGroup.Post("/invitation/:id/revoke", handlers.RevokeAgentInvitation)
+
+	// 查询和审核通过代理码注册的下级
+	agentGroup.Get("/registrations", handlers.GetPendingRegistrations)
+	agentGroup.Post("/registrations/:id/approve", handlers.ApproveRegistration)
+	agentGroup.Post("/registrations/:id/reject", handlers.RejectRegistration)
+
 	// 生成代理码（管理员操作）
 	app.Post("/api/admin/salesperson/:id/agent-code", handlers.GenerateAgentCode)
+
+	// 获取指定销售员的下级树（管理员操作）
+	app.Get("/api/admin/salesperson/:id/agent-tree", handlers.GetSalespersonAgentTree)
+
+	// 调整销售员的上级（管理员操作）
+	app.Post("/api/admin/salesperson/:id/reparent", handlers.ReparentSalesperson)
+
+	// 查询和审核自助注册（管理员操作）
+	app.Get("/api/admin/registrations", handlers.AdminGetPendingRegistrations)
+	app.Post("/api/admin/registrations/:id/approve", handlers.AdminApproveRegistration)
+	app.Post("/api/admin/registrations/:id/reject", handlers.AdminRejectRegistration)
 }
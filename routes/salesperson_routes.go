@@ -4,6 +4,7 @@ import (
 	// "go_creation/handlers"
 	"go_creation/handlers"
 	"go_creation/middleware"
+	"go_creation/models"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -14,34 +15,55 @@ func SetupSalespersonRoutes(app *fiber.App) {
 	salespersonGroup := app.Group("/api/salespersons")
 
 	//销售员基本管理
-	salespersonGroup.Post("/", handlers.CreateSalesperson)      // 创建销售员
-	salespersonGroup.Get("/", handlers.GetAllSalespersons)      // 获取所有销售员
-	salespersonGroup.Get("/:id", handlers.GetSalesperson)       // 获取单个销售员
-	salespersonGroup.Put("/:id", handlers.UpdateSalesperson)    // 更新销售员
-	salespersonGroup.Delete("/:id", handlers.DeleteSalesperson) // 删除销售员
+	salespersonGroup.Post("/", handlers.CreateSalesperson)             // 创建销售员
+	salespersonGroup.Get("/", handlers.GetAllSalespersons)             // 获取所有销售员
+	salespersonGroup.Get("/:id", handlers.GetSalesperson)              // 获取单个销售员
+	salespersonGroup.Put("/:id", handlers.UpdateSalesperson)           // 更新销售员
+	salespersonGroup.Delete("/:id", handlers.DeleteSalesperson)        // 删除销售员（软删除，cascade=true停用产品分配）
+	salespersonGroup.Post("/:id/restore", handlers.RestoreSalesperson) // 恢复已删除的销售员
 
 	// 销售员登录
-	app.Post("/api/salesperson/login", handlers.SalespersonLogin) // 销售员登录
+	app.Post("/api/salesperson/login", handlers.SalespersonLogin)         // 销售员登录
+	app.Post("/api/salesperson/login/2fa", handlers.VerifyLoginTwoFactor) // 两步验证登录的第二步
 
 	// 销售员产品管理（管理员访问）
 	salespersonGroup.Get("/:id/products", handlers.GetSalespersonProducts)     // 获取销售员可销售的产品
 	app.Post("/api/salesperson-products", handlers.AssignProductToSalesperson) // 为销售员分配产品
 
+	// 批发价格阶梯管理（管理员访问）
+	wholesaleTiers := app.Group("/api/wholesale-tiers")
+	wholesaleTiers.Get("/", handlers.GetWholesaleTiers)         // 获取批发价格阶梯
+	wholesaleTiers.Post("/", handlers.CreateWholesaleTier)      // 创建批发价格阶梯
+	wholesaleTiers.Put("/:id", handlers.UpdateWholesaleTier)    // 更新批发价格阶梯
+	wholesaleTiers.Delete("/:id", handlers.DeleteWholesaleTier) // 删除批发价格阶梯
+
+	// 优惠码管理（管理员访问）
+	coupons := app.Group("/api/coupons")
+	coupons.Get("/", handlers.GetCoupons)         // 获取优惠码列表
+	coupons.Post("/", handlers.CreateCoupon)      // 创建优惠码
+	coupons.Get("/:id", handlers.GetCoupon)       // 获取优惠码详情和使用记录
+	coupons.Put("/:id", handlers.UpdateCoupon)    // 更新优惠码
+	coupons.Delete("/:id", handlers.DeleteCoupon) // 删除未使用过的优惠码
+
 	// 销售员销售记录（管理员访问）
 	salespersonGroup.Get("/:id/sales", handlers.GetSalespersonSales)           // 获取销售员的销售记录
 	salespersonGroup.Get("/:id/commission", handlers.GetSalespersonCommission) // 获取销售员的佣金统计
+	app.Get("/api/admin/sales/:id", handlers.GetSaleDetail)                    // 获取销售记录详情（含卡密）
+	app.Post("/api/admin/sales/:id/cancel", handlers.CancelSale)               // 取消销售记录（退款）
+
+	// 同时支持API密钥访问的销售员接口 - 必须放在销售员专用API路由组前面，避免被只接受登录令牌的中间件拦截
+	app.Post("/api/salesperson/generate-keys", middleware.SalespersonAuthMiddleware(models.APIKeyScopeKeysGenerate), handlers.GenerateKeysForSalesperson) // 销售员生成卡密
+	app.Get("/api/salesperson/products", middleware.SalespersonAuthMiddleware(models.APIKeyScopeProductsRead), handlers.GetSalespersonOwnProducts)        // 获取销售员自己可销售的产品
+	app.Get("/api/salesperson/sales", middleware.SalespersonAuthMiddleware(models.APIKeyScopeKeysRead), handlers.GetSalespersonOwnSales)                  // 获取销售员自己的销售记录
+	app.Get("/api/salesperson/sales/:id", middleware.SalespersonAuthMiddleware(models.APIKeyScopeKeysRead), handlers.GetSalespersonOwnSaleDetail)         // 获取销售员自己的销售记录详情
 
 	// 销售员专用API（需要销售员身份验证）
 	salespersonAPI := app.Group("/api/salesperson", middleware.SalespersonAuthMiddleware())
 
-	// 销售员卡密生成
-	salespersonAPI.Post("/generate-keys", handlers.GenerateKeysForSalesperson) // 销售员生成卡密
-
-	// 销售员查询自己的产品
-	salespersonAPI.Get("/products", handlers.GetSalespersonOwnProducts) // 获取销售员自己可销售的产品
-
-	// 销售员查询自己的销售记录
-	salespersonAPI.Get("/sales", handlers.GetSalespersonOwnSales) // 获取销售员自己的销售记录
+	// 销售员API密钥管理（只能使用登录令牌操作）
+	salespersonAPI.Post("/api-keys", handlers.CreateAPIKey)       // 创建API密钥
+	salespersonAPI.Get("/api-keys", handlers.GetAPIKeys)          // 获取API密钥列表
+	salespersonAPI.Delete("/api-keys/:id", handlers.RevokeAPIKey) // 撤销API密钥
 
 	// 销售员查询自己的佣金
 	salespersonAPI.Get("/commission", handlers.GetSalespersonOwnCommission) // 获取销售员自己的佣金统计
@@ -14,10 +14,39 @@ func RegisterSoftwareRoutes(api fiber.Router) {
 	software.Get("/", handlers.GetAllSoftware)                   // 获取所有软件
 	software.Get("/:id", handlers.GetSoftwareByID)               // 获取单个软件
 	software.Put("/:id", handlers.UpdateSoftware)                // 更新软件
-	software.Delete("/:id", handlers.DeleteSoftware)             // 删除软件
+	software.Delete("/:id", handlers.DeleteSoftware)             // 删除软件（软删除，cascade=true级联处理关联数据）
+	software.Post("/:id/restore", handlers.RestoreSoftware)      // 恢复已删除的软件
 	software.Put("/:id/activate", handlers.ActivateSoftware)     // 激活软件
 	software.Put("/:id/deactivate", handlers.DeactivateSoftware) // 停用软件
 	software.Get("/:id/keytypes", handlers.GetSoftwareKeyTypes)  // 获取软件绑定的卡密类型
 	software.Post("/bind-keytype", handlers.BindKeyType)         // 绑定卡密类型
 	software.Post("/unbind-keytype", handlers.UnbindKeyType)     // 解绑卡密类型
+
+	// 软件下卡密类型的价格和有效期覆盖
+	software.Put("/:id/keytypes/:key_type_id/pricing", handlers.UpdateKeyTypeBindingPricing) // 设置或清除价格和有效期覆盖
+
+	// 软件发布版本管理
+	software.Get("/:id/releases", handlers.GetSoftwareReleases)                  // 获取软件的发布版本
+	software.Post("/:id/releases", handlers.CreateSoftwareRelease)               // 创建发布版本
+	software.Put("/:id/releases/:release_id", handlers.UpdateSoftwareRelease)    // 更新发布版本
+	software.Delete("/:id/releases/:release_id", handlers.DeleteSoftwareRelease) // 删除发布版本
+	software.Get("/:id/version-check", handlers.CheckSoftwareVersion)            // 客户端检查更新
+
+	// 软件公告管理
+	software.Get("/:id/announcements", handlers.GetSoftwareAnnouncements)                       // 获取软件的所有公告及阅读统计
+	software.Post("/:id/announcements", handlers.CreateSoftwareAnnouncement)                    // 创建公告
+	software.Put("/:id/announcements/:announcement_id", handlers.UpdateSoftwareAnnouncement)    // 更新公告
+	software.Delete("/:id/announcements/:announcement_id", handlers.DeleteSoftwareAnnouncement) // 删除公告
+	software.Get("/:id/announcements/active", handlers.GetActiveAnnouncements)                  // 客户端获取当前生效的公告
+	software.Post("/:id/announcements/:announcement_id/read", handlers.MarkAnnouncementRead)    // 客户端标记公告已读
+	software.Post("/:id/announcements/:announcement_id/ack", handlers.AckAnnouncement)          // 客户端确认公告
+
+	// 软件远程配置管理
+	software.Get("/:id/config", handlers.GetSoftwareConfig)                                  // 获取软件的配置项及覆盖值
+	software.Post("/:id/config", handlers.CreateSoftwareConfigItem)                          // 创建配置项
+	software.Get("/:id/config/preview", handlers.PreviewSoftwareConfig)                      // 预览卡密类型或卡密生效的配置
+	software.Put("/:id/config/:item_id", handlers.UpdateSoftwareConfigItem)                  // 更新配置项
+	software.Delete("/:id/config/:item_id", handlers.DeleteSoftwareConfigItem)               // 删除配置项
+	software.Put("/:id/config/:item_id/overrides", handlers.SetSoftwareConfigOverride)       // 设置覆盖值
+	software.Delete("/:id/config/:item_id/overrides", handlers.DeleteSoftwareConfigOverride) // 删除覆盖值
 }
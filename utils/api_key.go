@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiKeyPrefix API密钥的固定前缀，便于识别和在代码仓库中扫描泄露的密钥
+const apiKeyPrefix = "gck_"
+
+// GenerateAPIKey 生成API密钥
+// 返回完整密钥、用于查找的前缀和密文；完整密钥格式为 gck_<前缀>_<密文>
+func GenerateAPIKey() (key, prefix, secret string, err error) {
+	token, err := GenerateSecureToken()
+	if err != nil {
+		return "", "", "", err
+	}
+	prefix, secret = token[:12], token[12:]
+	return apiKeyPrefix + prefix + "_" + secret, prefix, secret, nil
+}
+
+// ParseAPIKey 从完整密钥中解析前缀和密文
+func ParseAPIKey(key string) (prefix, secret string, ok bool) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return "", "", false
+	}
+	prefix, secret, ok = strings.Cut(key[len(apiKeyPrefix):], "_")
+	if !ok || prefix == "" || secret == "" {
+		return "", "", false
+	}
+	return prefix, secret, true
+}
+
+// ParseIPAllowlist 解析逗号分隔的IP或CIDR列表，返回规范化后的列表
+func ParseIPAllowlist(list string) ([]string, error) {
+	entries := make([]string, 0)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("无效的CIDR: %s", entry)
+			}
+			entries = append(entries, ipNet.String())
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("无效的IP: %s", entry)
+		}
+		entries = append(entries, ip.String())
+	}
+	return entries, nil
+}
+
+// IPAllowed 判断IP是否在允许列表中，列表为空时不限制
+func IPAllowed(list, ip string) bool {
+	entries, err := ParseIPAllowlist(list)
+	if err != nil {
+		return false
+	}
+	if len(entries) == 0 {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			if _, ipNet, err := net.ParseCIDR(entry); err == nil && ipNet.Contains(addr) {
+				return true
+			}
+		} else if net.ParseIP(entry).Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyWindow 单个密钥当前分钟的请求计数
+type apiKeyWindow struct {
+	start time.Time
+	count int
+}
+
+// APIKeyRateLimiter API密钥请求频率限制器
+// 按自然分钟的固定窗口计数，计数保存在进程内，多实例部署时每个实例分别限制
+type APIKeyRateLimiter struct {
+	windows map[uint]*apiKeyWindow
+	mutex   sync.Mutex
+}
+
+// NewAPIKeyRateLimiter 创建API密钥请求频率限制器
+func NewAPIKeyRateLimiter() *APIKeyRateLimiter {
+	return &APIKeyRateLimiter{windows: make(map[uint]*apiKeyWindow)}
+}
+
+// Allow 记录一次请求并判断是否超过每分钟的限制，limit为0表示不限制
+// 返回是否允许以及距离窗口重置的时间
+func (l *APIKeyRateLimiter) Allow(keyID uint, limit int, now time.Time) (bool, time.Duration) {
+	if limit <= 0 {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	start := now.Truncate(time.Minute)
+	window, exists := l.windows[keyID]
+	if !exists || !window.start.Equal(start) {
+		// 进入新的窗口时顺便清理其他已过期的计数
+		for id, w := range l.windows {
+			if w.start.Before(start) {
+				delete(l.windows, id)
+			}
+		}
+		window = &apiKeyWindow{start: start}
+		l.windows[keyID] = window
+	}
+
+	if window.count >= limit {
+		return false, start.Add(time.Minute).Sub(now)
+	}
+	window.count++
+	return true, 0
+}
+
+// DefaultAPIKeyRateLimiter 默认的API密钥请求频率限制器实例
+var DefaultAPIKeyRateLimiter = NewAPIKeyRateLimiter()
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// 认证方式
+const (
+	AuthMethodJWT       = "jwt"        // Authorization头中的Bearer令牌
+	AuthMethodDevHeader = "dev_header" // 开发模式下的X-Salesperson-ID请求头
+	AuthMethodAPIKey    = "api_key"    // X-API-Key头中的API密钥
+)
+
+// AuthContext 认证中间件写入请求上下文的身份信息
+// 处理函数只能通过GetAuthContext获取当前销售员，不应再读取任何请求头
+type AuthContext struct {
+	SalespersonID uint     // 销售员ID
+	Username      string   // 用户名
+	Name          string   // 姓名
+	SessionID     string   // 登录会话ID，只有JWT认证时才有
+	Method        string   // 认证方式
+	APIKeyID      uint     // API密钥ID，只有API密钥认证时才有
+	Scopes        []string // API密钥的权限范围
+}
+
+// HasScope 判断是否拥有指定的权限范围
+// 交互式登录的销售员拥有自己的全部权限，API密钥只拥有创建时授予的权限范围
+func (a *AuthContext) HasScope(scope string) bool {
+	if a.Method != AuthMethodAPIKey {
+		return true
+	}
+	for _, s := range a.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// authContextKey 上下文键，使用未导出的类型避免与其他Locals冲突
+type authContextKey struct{}
+
+// SetAuthContext 保存认证信息，只应由认证中间件调用
+func SetAuthContext(c *fiber.Ctx, auth *AuthContext) {
+	c.Locals(authContextKey{}, auth)
+}
+
+// GetAuthContext 获取认证信息，请求未经过认证中间件时返回false
+func GetAuthContext(c *fiber.Ctx) (*AuthContext, bool) {
+	auth, ok := c.Locals(authContextKey{}).(*AuthContext)
+	return auth, ok && auth != nil
+}
+
+// DevHeaderAuthEnabled 是否允许通过X-Salesperson-ID请求头认证
+// 只有显式设置AUTH_DEV_HEADER=true且不是生产环境时才启用，仅用于本地开发和测试
+func DevHeaderAuthEnabled() bool {
+	if os.Getenv("ENV") == "production" {
+		return false
+	}
+	return strings.EqualFold(os.Getenv("AUTH_DEV_HEADER"), "true")
+}
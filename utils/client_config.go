@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// clientConfigTokenType 远程配置令牌头部的typ，防止配置令牌被当作登录令牌使用
+const clientConfigTokenType = "config+jwt"
+
+// ClientConfigClaims 签名的远程配置声明
+// 客户端使用/.well-known/jwks.json中的公钥验证签名，并校验software_id和code与自身一致
+type ClientConfigClaims struct {
+	SoftwareID uint                   `json:"software_id"` // 软件ID
+	KeyID      uint                   `json:"key_id"`      // 卡密ID
+	Code       string                 `json:"code"`        // 卡密码
+	KeyTypeID  uint                   `json:"key_type_id"` // 卡密类型ID
+	Config     map[string]interface{} `json:"config"`      // 解析后的配置
+	jwt.RegisteredClaims
+}
+
+// clientConfigTTL 配置令牌的有效期，通过CONFIG_TOKEN_TTL设置（如"24h"），默认24小时
+// 到期后客户端应重新查询卡密状态获取最新配置
+func clientConfigTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("CONFIG_TOKEN_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return 24 * time.Hour
+}
+
+// SignClientConfig 使用JWT密钥环中当前的非对称签名密钥签名远程配置
+// 令牌有效期不超过卡密的过期时间keyExpiredAt（为空表示不限制）
+// 客户端只持有JWKS中的公钥，只配置了HS256密钥时拒绝签发，避免把对称密钥分发给客户端
+func SignClientConfig(claims ClientConfigClaims, keyExpiredAt *time.Time) (string, error) {
+	ring, err := getKeyRing()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	key, err := ring.asymmetricSigningKey(now)
+	if err != nil {
+		return "", err
+	}
+
+	expiresAt := now.Add(clientConfigTTL())
+	if keyExpiredAt != nil && keyExpiredAt.Before(expiresAt) {
+		expiresAt = *keyExpiredAt
+	}
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	token.Header["typ"] = clientConfigTokenType
+	return token.SignedString(key.signKey)
+}
@@ -2,6 +2,8 @@ package utils
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	mathrand "math/rand"
 	"strconv"
 	"sync/atomic"
@@ -65,3 +67,20 @@ func GenerateSalespersonCode() string {
 	randomPart := GenerateRandomCode(4)
 	return "CODE" + strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatInt(counter, 36) + randomPart
 }
+
+// GenerateSecureToken 生成用于密码重置等场景的安全随机令牌
+// 与GenerateRandomCode不同，安全随机数生成失败时直接返回错误，不会回退到不安全的方法
+func GenerateSecureToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken 计算令牌的SHA-256摘要
+// 数据库中只保存令牌的摘要，即使数据泄露也无法直接使用
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
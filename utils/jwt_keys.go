@@ -0,0 +1,462 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// 支持的JWT签名算法
+const (
+	JWTAlgHS256 = "HS256" // HMAC-SHA256，对称密钥，只能由本服务验证
+	JWTAlgRS256 = "RS256" // RSA-SHA256，公钥通过JWKS发布
+	JWTAlgES256 = "ES256" // ECDSA P-256，公钥通过JWKS发布
+	JWTAlgEdDSA = "EdDSA" // Ed25519，公钥通过JWKS发布
+)
+
+// legacyKeyID 未携带kid的令牌使用的密钥ID，对应JWT_SECRET配置的密钥
+const legacyKeyID = "default"
+
+// defaultDevKeyFile 开发环境自动生成的签名密钥保存位置
+const defaultDevKeyFile = ".jwt_dev_key.pem"
+
+// JWTKeyConfig 签名密钥配置，来自JWT_KEYS_FILE指向的文件或JWT_KEYS环境变量（JSON数组）
+// 密钥材料可以直接写在配置中，也可以指向PEM文件；只配置公钥的密钥只用于验证
+type JWTKeyConfig struct {
+	KeyID          string     `json:"kid"`              // 密钥ID，写入令牌头部的kid
+	Algorithm      string     `json:"alg"`              // 签名算法：HS256, RS256, ES256, EdDSA
+	Secret         string     `json:"secret"`           // HS256密钥
+	PrivateKey     string     `json:"private_key"`      // PEM格式私钥
+	PrivateKeyFile string     `json:"private_key_file"` // PEM格式私钥文件
+	PublicKey      string     `json:"public_key"`       // PEM格式公钥
+	PublicKeyFile  string     `json:"public_key_file"`  // PEM格式公钥文件
+	NotBefore      *time.Time `json:"not_before"`       // 开始用于签名的时间，用于计划轮换，为空时立即生效
+	ExpiresAt      *time.Time `json:"expires_at"`       // 停止验证的时间，为空时不过期
+}
+
+// jwtKey 加载后的签名密钥
+type jwtKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{} // 签名使用的密钥，只有公钥时为nil
+	verifyKey interface{} // 验证使用的密钥
+	publicKey crypto.PublicKey
+	notBefore time.Time
+	expiresAt time.Time
+}
+
+// usable 判断密钥在指定时间是否可用于验证
+func (k *jwtKey) usable(now time.Time) bool {
+	return k.expiresAt.IsZero() || now.Before(k.expiresAt)
+}
+
+// jwtKeyRing 签名密钥环
+// 同一时间可以有多个有效密钥：最新生效的私钥用于签名，所有未过期的密钥都可用于验证
+type jwtKeyRing struct {
+	keys []*jwtKey // 按生效时间从新到旧排序
+}
+
+var (
+	keyRing     *jwtKeyRing
+	keyRingLock sync.RWMutex
+)
+
+// InitJWTKeys 加载JWT签名密钥
+// 应在环境变量加载之后调用，加载失败时返回错误
+func InitJWTKeys() error {
+	ring, err := loadJWTKeyRing()
+	if err != nil {
+		return err
+	}
+
+	keyRingLock.Lock()
+	keyRing = ring
+	keyRingLock.Unlock()
+
+	for _, k := range ring.keys {
+		log.Printf("已加载JWT密钥: kid=%s, alg=%s, 可签名=%t", k.id, k.method.Alg(), k.signKey != nil)
+	}
+	if _, err := ring.asymmetricSigningKey(time.Now()); err != nil {
+		log.Println("警告: 未配置可签名的非对称JWT密钥（RS256、ES256或EdDSA），将不会签发远程配置令牌")
+	}
+	return nil
+}
+
+// ReloadJWTKeys 重新加载JWT签名密钥
+// 用于在不重启服务的情况下轮换密钥，加载失败时保留原有密钥
+func ReloadJWTKeys() error {
+	ring, err := loadJWTKeyRing()
+	if err != nil {
+		return err
+	}
+
+	keyRingLock.Lock()
+	keyRing = ring
+	keyRingLock.Unlock()
+	return nil
+}
+
+// getKeyRing 返回当前的密钥环，尚未初始化时先加载
+func getKeyRing() (*jwtKeyRing, error) {
+	keyRingLock.RLock()
+	ring := keyRing
+	keyRingLock.RUnlock()
+	if ring != nil {
+		return ring, nil
+	}
+
+	if err := InitJWTKeys(); err != nil {
+		return nil, err
+	}
+	keyRingLock.RLock()
+	defer keyRingLock.RUnlock()
+	return keyRing, nil
+}
+
+// signingKey 返回当前用于签名的密钥：已生效且未过期的私钥中生效时间最晚的一个
+func (r *jwtKeyRing) signingKey(now time.Time) (*jwtKey, error) {
+	for _, k := range r.keys {
+		if k.signKey != nil && !now.Before(k.notBefore) && k.usable(now) {
+			return k, nil
+		}
+	}
+	return nil, errors.New("没有可用的JWT签名密钥")
+}
+
+// asymmetricSigningKey 返回当前可用的非对称签名密钥，规则与signingKey相同但跳过HS256密钥
+// 需要第三方通过JWKS验证的令牌（如远程配置）必须使用非对称密钥签名，HS256密钥公开后任何人都能伪造令牌
+func (r *jwtKeyRing) asymmetricSigningKey(now time.Time) (*jwtKey, error) {
+	for _, k := range r.keys {
+		if k.signKey != nil && k.publicKey != nil && !now.Before(k.notBefore) && k.usable(now) {
+			return k, nil
+		}
+	}
+	return nil, errors.New("没有可用的非对称JWT签名密钥")
+}
+
+// verificationKey 根据令牌头部的kid查找验证密钥，并确认签名算法与密钥一致
+func (r *jwtKeyRing) verificationKey(token *jwt.Token) (interface{}, error) {
+	// 同一密钥环还签名远程配置等其他令牌，只接受普通JWT
+	if typ, ok := token.Header["typ"].(string); ok && typ != "JWT" {
+		return nil, fmt.Errorf("不支持的令牌类型: %s", typ)
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = legacyKeyID
+	}
+
+	now := time.Now()
+	for _, k := range r.keys {
+		if k.id != kid {
+			continue
+		}
+		if !k.usable(now) {
+			return nil, errors.New("签名密钥已过期")
+		}
+		// 防止算法混淆攻击：令牌声明的算法必须与密钥的算法一致
+		if token.Method.Alg() != k.method.Alg() {
+			return nil, errors.New("无效的签名方法")
+		}
+		return k.verifyKey, nil
+	}
+	return nil, fmt.Errorf("未知的签名密钥: %s", kid)
+}
+
+// loadJWTKeyRing 根据环境变量加载密钥环，优先级：
+//   - JWT_KEYS_FILE: 密钥配置文件（JSON数组）
+//   - JWT_KEYS: 密钥配置（JSON数组）
+//   - JWT_SECRET: 单个HS256密钥，kid为default
+//   - 开发环境下自动生成Ed25519密钥并保存到JWT_DEV_KEY_FILE（默认.jwt_dev_key.pem），重启后继续使用
+func loadJWTKeyRing() (*jwtKeyRing, error) {
+	var configs []JWTKeyConfig
+
+	switch {
+	case os.Getenv("JWT_KEYS_FILE") != "":
+		data, err := os.ReadFile(os.Getenv("JWT_KEYS_FILE"))
+		if err != nil {
+			return nil, fmt.Errorf("读取JWT密钥配置文件失败: %w", err)
+		}
+		if err := json.Unmarshal(data, &configs); err != nil {
+			return nil, fmt.Errorf("解析JWT密钥配置文件失败: %w", err)
+		}
+	case os.Getenv("JWT_KEYS") != "":
+		if err := json.Unmarshal([]byte(os.Getenv("JWT_KEYS")), &configs); err != nil {
+			return nil, fmt.Errorf("解析JWT_KEYS失败: %w", err)
+		}
+	case os.Getenv("JWT_SECRET") != "":
+		secret := os.Getenv("JWT_SECRET")
+		if len(secret) < 16 {
+			log.Println("警告: JWT密钥长度不足，建议使用至少32字符的密钥")
+		}
+		configs = []JWTKeyConfig{{KeyID: legacyKeyID, Algorithm: JWTAlgHS256, Secret: secret}}
+	default:
+		if os.Getenv("ENV") == "production" {
+			return nil, errors.New("在生产环境中必须设置JWT_KEYS_FILE、JWT_KEYS或JWT_SECRET环境变量")
+		}
+		config, err := loadDevJWTKey()
+		if err != nil {
+			return nil, err
+		}
+		configs = []JWTKeyConfig{config}
+	}
+
+	if len(configs) == 0 {
+		return nil, errors.New("未配置JWT签名密钥")
+	}
+
+	ring := &jwtKeyRing{}
+	seen := make(map[string]bool)
+	for _, config := range configs {
+		if config.KeyID == "" {
+			return nil, errors.New("JWT密钥缺少kid")
+		}
+		if seen[config.KeyID] {
+			return nil, fmt.Errorf("JWT密钥kid重复: %s", config.KeyID)
+		}
+		seen[config.KeyID] = true
+
+		key, err := parseJWTKey(config)
+		if err != nil {
+			return nil, fmt.Errorf("加载JWT密钥%s失败: %w", config.KeyID, err)
+		}
+		ring.keys = append(ring.keys, key)
+	}
+
+	// 按生效时间从新到旧排序，生效时间相同时保持配置顺序
+	sort.SliceStable(ring.keys, func(i, j int) bool {
+		return ring.keys[i].notBefore.After(ring.keys[j].notBefore)
+	})
+
+	if _, err := ring.signingKey(time.Now()); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// parseJWTKey 解析单个密钥配置
+func parseJWTKey(config JWTKeyConfig) (*jwtKey, error) {
+	key := &jwtKey{id: config.KeyID}
+	if config.NotBefore != nil {
+		key.notBefore = *config.NotBefore
+	}
+	if config.ExpiresAt != nil {
+		key.expiresAt = *config.ExpiresAt
+	}
+
+	privatePEM, err := readPEM(config.PrivateKey, config.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	publicPEM, err := readPEM(config.PublicKey, config.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Algorithm {
+	case JWTAlgHS256:
+		if config.Secret == "" {
+			return nil, errors.New("HS256密钥不能为空")
+		}
+		key.method = jwt.SigningMethodHS256
+		key.signKey = []byte(config.Secret)
+		key.verifyKey = []byte(config.Secret)
+
+	case JWTAlgRS256:
+		key.method = jwt.SigningMethodRS256
+		var publicKey *rsa.PublicKey
+		if privatePEM != nil {
+			privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+			if err != nil {
+				return nil, fmt.Errorf("解析RSA私钥失败: %w", err)
+			}
+			key.signKey = privateKey
+			publicKey = &privateKey.PublicKey
+		} else if publicPEM != nil {
+			publicKey, err = jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+			if err != nil {
+				return nil, fmt.Errorf("解析RSA公钥失败: %w", err)
+			}
+		} else {
+			return nil, errors.New("RS256密钥需要配置私钥或公钥")
+		}
+		if publicKey.N.BitLen() < 2048 {
+			return nil, errors.New("RSA密钥长度不能少于2048位")
+		}
+		key.verifyKey = publicKey
+		key.publicKey = publicKey
+
+	case JWTAlgES256:
+		key.method = jwt.SigningMethodES256
+		var publicKey *ecdsa.PublicKey
+		if privatePEM != nil {
+			privateKey, err := jwt.ParseECPrivateKeyFromPEM(privatePEM)
+			if err != nil {
+				return nil, fmt.Errorf("解析ECDSA私钥失败: %w", err)
+			}
+			key.signKey = privateKey
+			publicKey = &privateKey.PublicKey
+		} else if publicPEM != nil {
+			publicKey, err = jwt.ParseECPublicKeyFromPEM(publicPEM)
+			if err != nil {
+				return nil, fmt.Errorf("解析ECDSA公钥失败: %w", err)
+			}
+		} else {
+			return nil, errors.New("ES256密钥需要配置私钥或公钥")
+		}
+		if publicKey.Curve != elliptic.P256() {
+			return nil, errors.New("ES256密钥必须使用P-256曲线")
+		}
+		key.verifyKey = publicKey
+		key.publicKey = publicKey
+
+	case JWTAlgEdDSA:
+		key.method = jwt.SigningMethodEdDSA
+		var publicKey ed25519.PublicKey
+		if privatePEM != nil {
+			privateKey, err := jwt.ParseEdPrivateKeyFromPEM(privatePEM)
+			if err != nil {
+				return nil, fmt.Errorf("解析Ed25519私钥失败: %w", err)
+			}
+			key.signKey = privateKey
+			publicKey = privateKey.(ed25519.PrivateKey).Public().(ed25519.PublicKey)
+		} else if publicPEM != nil {
+			pub, err := jwt.ParseEdPublicKeyFromPEM(publicPEM)
+			if err != nil {
+				return nil, fmt.Errorf("解析Ed25519公钥失败: %w", err)
+			}
+			publicKey = pub.(ed25519.PublicKey)
+		} else {
+			return nil, errors.New("EdDSA密钥需要配置私钥或公钥")
+		}
+		key.verifyKey = publicKey
+		key.publicKey = publicKey
+
+	default:
+		return nil, fmt.Errorf("不支持的签名算法: %s", config.Algorithm)
+	}
+
+	return key, nil
+}
+
+// readPEM 读取PEM内容，优先使用直接配置的内容，其次读取文件，都未配置时返回nil
+func readPEM(inline, path string) ([]byte, error) {
+	if inline != "" {
+		return []byte(inline), nil
+	}
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取密钥文件失败: %w", err)
+	}
+	return data, nil
+}
+
+// loadDevJWTKey 加载开发环境的签名密钥，密钥文件不存在时生成新的Ed25519密钥并保存
+// 密钥保存在本地文件中，重启服务不会使已签发的令牌失效
+func loadDevJWTKey() (JWTKeyConfig, error) {
+	path := os.Getenv("JWT_DEV_KEY_FILE")
+	if path == "" {
+		path = defaultDevKeyFile
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("警告: 未配置JWT签名密钥，将生成开发环境密钥并保存到%s（仅用于开发环境）", path)
+
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return JWTKeyConfig{}, fmt.Errorf("生成开发环境JWT密钥失败: %w", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			return JWTKeyConfig{}, fmt.Errorf("生成开发环境JWT密钥失败: %w", err)
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			return JWTKeyConfig{}, fmt.Errorf("保存开发环境JWT密钥失败: %w", err)
+		}
+	} else if err != nil {
+		return JWTKeyConfig{}, fmt.Errorf("读取开发环境JWT密钥失败: %w", err)
+	}
+
+	// 使用公钥摘要作为kid，更换密钥文件后kid随之变化
+	privateKey, err := jwt.ParseEdPrivateKeyFromPEM(data)
+	if err != nil {
+		return JWTKeyConfig{}, fmt.Errorf("解析开发环境JWT密钥失败: %w", err)
+	}
+	sum := sha256.Sum256(privateKey.(ed25519.PrivateKey).Public().(ed25519.PublicKey))
+
+	return JWTKeyConfig{
+		KeyID:      "dev-" + hex.EncodeToString(sum[:8]),
+		Algorithm:  JWTAlgEdDSA,
+		PrivateKey: string(data),
+	}, nil
+}
+
+// JWKS 返回用于验证令牌的公钥集合（RFC 7517）
+// 只包含非对称密钥，计划生效的密钥也会提前发布，方便其他服务在轮换前缓存
+func JWKS() (map[string]interface{}, error) {
+	ring, err := getKeyRing()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	keys := make([]map[string]interface{}, 0, len(ring.keys))
+	for _, k := range ring.keys {
+		if k.publicKey == nil || !k.usable(now) {
+			continue
+		}
+
+		jwk := map[string]interface{}{
+			"kid": k.id,
+			"alg": k.method.Alg(),
+			"use": "sig",
+		}
+		switch pub := k.publicKey.(type) {
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(pub)
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case *ecdsa.PublicKey:
+			// 坐标按RFC 7518固定为32字节
+			x := make([]byte, 32)
+			y := make([]byte, 32)
+			jwk["kty"] = "EC"
+			jwk["crv"] = "P-256"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(x))
+			jwk["y"] = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(y))
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+
+	return map[string]interface{}{"keys": keys}, nil
+}
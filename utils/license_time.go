@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	licenseLocation     *time.Location
+	licenseLocationOnce sync.Once
+)
+
+// LicenseLocation 返回计算卡密到期时间使用的时区，通过LICENSE_TIMEZONE设置（如"Asia/Shanghai"），默认为服务器本地时区
+// 按天、自然月和自然年计算的有效期以该时区的日历为准，导出卡密时的时间也使用该时区显示
+func LicenseLocation() *time.Location {
+	licenseLocationOnce.Do(func() {
+		licenseLocation = time.Local
+		if name := os.Getenv("LICENSE_TIMEZONE"); name != "" {
+			loc, err := time.LoadLocation(name)
+			if err != nil {
+				log.Printf("无效的LICENSE_TIMEZONE %q，使用服务器本地时区: %v", name, err)
+				return
+			}
+			licenseLocation = loc
+		}
+	})
+	return licenseLocation
+}
@@ -0,0 +1,327 @@
+package utils
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"go_creation/models"
+)
+
+// LoginAttemptStore 登录失败记录存储接口
+// 内存实现只在单个进程内有效；数据库和Redis实现可以在重启后保留锁定状态，并在多个实例间共享
+type LoginAttemptStore interface {
+	// Increment 增加失败次数并返回增加后的次数，记录在ttl内没有新的失败时过期
+	Increment(key string, now time.Time, ttl time.Duration) (int, error)
+	// Lock 锁定到指定时间
+	Lock(key string, until time.Time, ttl time.Duration) error
+	// Get 查询未过期的记录，不存在时返回nil
+	Get(key string, now time.Time) (*LoginAttemptInfo, error)
+	// Delete 删除记录
+	Delete(key string) error
+	// List 查询所有未过期的记录
+	List(now time.Time) ([]LoginAttemptInfo, error)
+}
+
+// sortAttempts 按最后失败时间从新到旧排序
+func sortAttempts(attempts []LoginAttemptInfo) {
+	sort.Slice(attempts, func(i, j int) bool {
+		return attempts[i].LastTry.After(attempts[j].LastTry)
+	})
+}
+
+// memoryAttempt 内存存储中的失败记录
+type memoryAttempt struct {
+	info      LoginAttemptInfo
+	expiresAt time.Time
+}
+
+// MemoryLoginAttemptStore 内存存储
+type MemoryLoginAttemptStore struct {
+	attempts map[string]*memoryAttempt // 登录尝试记录
+	mutex    sync.RWMutex              // 读写锁，保证并发安全
+}
+
+// NewMemoryLoginAttemptStore 创建内存存储，并按cleanInterval定期清理过期的记录
+func NewMemoryLoginAttemptStore(cleanInterval time.Duration) *MemoryLoginAttemptStore {
+	store := &MemoryLoginAttemptStore{
+		attempts: make(map[string]*memoryAttempt),
+	}
+
+	// 启动定期清理过期记录的协程
+	go func() {
+		ticker := time.NewTicker(cleanInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			store.cleanup(time.Now())
+		}
+	}()
+
+	return store
+}
+
+// cleanup 清理过期的尝试记录
+func (s *MemoryLoginAttemptStore) cleanup(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, attempt := range s.attempts {
+		if now.After(attempt.expiresAt) {
+			delete(s.attempts, key)
+		}
+	}
+}
+
+// Increment 增加失败次数
+func (s *MemoryLoginAttemptStore) Increment(key string, now time.Time, ttl time.Duration) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	attempt, exists := s.attempts[key]
+	if !exists || now.After(attempt.expiresAt) {
+		attempt = &memoryAttempt{info: LoginAttemptInfo{Key: key}}
+		s.attempts[key] = attempt
+	}
+
+	attempt.info.Count++
+	attempt.info.LastTry = now
+	if expiresAt := now.Add(ttl); expiresAt.After(attempt.expiresAt) {
+		attempt.expiresAt = expiresAt
+	}
+	return attempt.info.Count, nil
+}
+
+// Lock 锁定到指定时间
+func (s *MemoryLoginAttemptStore) Lock(key string, until time.Time, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	attempt, exists := s.attempts[key]
+	if !exists {
+		attempt = &memoryAttempt{info: LoginAttemptInfo{Key: key}}
+		s.attempts[key] = attempt
+	}
+	attempt.info.LockUntil = until
+	if until.After(attempt.expiresAt) {
+		attempt.expiresAt = until
+	}
+	return nil
+}
+
+// Get 查询未过期的记录
+func (s *MemoryLoginAttemptStore) Get(key string, now time.Time) (*LoginAttemptInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	attempt, exists := s.attempts[key]
+	if !exists || now.After(attempt.expiresAt) {
+		return nil, nil
+	}
+	info := attempt.info
+	return &info, nil
+}
+
+// Delete 删除记录
+func (s *MemoryLoginAttemptStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.attempts, key)
+	return nil
+}
+
+// List 查询所有未过期的记录
+func (s *MemoryLoginAttemptStore) List(now time.Time) ([]LoginAttemptInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	attempts := make([]LoginAttemptInfo, 0, len(s.attempts))
+	for _, attempt := range s.attempts {
+		if now.After(attempt.expiresAt) {
+			continue
+		}
+		attempts = append(attempts, attempt.info)
+	}
+	sortAttempts(attempts)
+	return attempts, nil
+}
+
+// DBLoginAttemptStore 数据库存储，记录保存在login_attempts表中
+type DBLoginAttemptStore struct {
+	DB *gorm.DB
+}
+
+// Increment 增加失败次数
+// 使用INSERT ... ON DUPLICATE KEY UPDATE保证并发时计数准确，记录过期后从1重新计数
+func (s *DBLoginAttemptStore) Increment(key string, now time.Time, ttl time.Duration) (int, error) {
+	expiresAt := now.Add(ttl)
+	record := models.LoginAttempt{Key: key, Count: 1, LastTry: now, ExpiresAt: expiresAt}
+
+	// MySQL按顺序执行赋值，count必须在expires_at之前更新
+	err := s.DB.Clauses(clause.OnConflict{
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "count"}, Value: gorm.Expr("IF(expires_at < ?, 1, count + 1)", now)},
+			{Column: clause.Column{Name: "lock_until"}, Value: gorm.Expr("IF(expires_at < ?, NULL, lock_until)", now)},
+			{Column: clause.Column{Name: "last_try"}, Value: now},
+			{Column: clause.Column{Name: "expires_at"}, Value: gorm.Expr("GREATEST(expires_at, ?)", expiresAt)},
+		},
+	}).Create(&record).Error
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.DB.Where("`key` = ?", key).First(&record).Error; err != nil {
+		return 0, err
+	}
+	return record.Count, nil
+}
+
+// Lock 锁定到指定时间
+func (s *DBLoginAttemptStore) Lock(key string, until time.Time, ttl time.Duration) error {
+	return s.DB.Model(&models.LoginAttempt{}).Where("`key` = ?", key).
+		Updates(map[string]interface{}{
+			"lock_until": until,
+			"expires_at": gorm.Expr("GREATEST(expires_at, ?)", until),
+		}).Error
+}
+
+// Get 查询未过期的记录
+func (s *DBLoginAttemptStore) Get(key string, now time.Time) (*LoginAttemptInfo, error) {
+	var record models.LoginAttempt
+	if err := s.DB.Where("`key` = ? AND expires_at > ?", key, now).First(&record).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	info := toLoginAttemptInfo(record)
+	return &info, nil
+}
+
+// toLoginAttemptInfo 把数据库记录转换为登录尝试信息
+func toLoginAttemptInfo(record models.LoginAttempt) LoginAttemptInfo {
+	info := LoginAttemptInfo{Key: record.Key, Count: record.Count, LastTry: record.LastTry}
+	if record.LockUntil != nil {
+		info.LockUntil = *record.LockUntil
+	}
+	return info
+}
+
+// Delete 删除记录
+func (s *DBLoginAttemptStore) Delete(key string) error {
+	return s.DB.Where("`key` = ?", key).Delete(&models.LoginAttempt{}).Error
+}
+
+// List 查询所有未过期的记录，同时顺便清理已过期的记录
+func (s *DBLoginAttemptStore) List(now time.Time) ([]LoginAttemptInfo, error) {
+	if err := s.DB.Where("expires_at <= ?", now).Delete(&models.LoginAttempt{}).Error; err != nil {
+		return nil, err
+	}
+
+	var records []models.LoginAttempt
+	if err := s.DB.Where("expires_at > ?", now).Order("last_try DESC").Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	attempts := make([]LoginAttemptInfo, 0, len(records))
+	for _, record := range records {
+		attempts = append(attempts, toLoginAttemptInfo(record))
+	}
+	return attempts, nil
+}
+
+// RedisLoginAttemptStore Redis存储
+// 每条记录保存为一个哈希（count、last_try、lock_until），过期由Redis的键过期机制处理
+type RedisLoginAttemptStore struct {
+	Client *redis.Client // Redis客户端
+	Prefix string        // 键前缀，避免与其他数据冲突
+}
+
+// Increment 增加失败次数
+func (s *RedisLoginAttemptStore) Increment(key string, now time.Time, ttl time.Duration) (int, error) {
+	ctx := context.Background()
+	var count *redis.IntCmd
+	_, err := s.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		count = pipe.HIncrBy(ctx, s.Prefix+key, "count", 1)
+		pipe.HSet(ctx, s.Prefix+key, "last_try", now.UnixMilli())
+		pipe.PExpire(ctx, s.Prefix+key, ttl)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(count.Val()), nil
+}
+
+// Lock 锁定到指定时间
+func (s *RedisLoginAttemptStore) Lock(key string, until time.Time, ttl time.Duration) error {
+	// 记录至少保留到锁定结束
+	if lock := time.Until(until); lock > ttl {
+		ttl = lock
+	}
+	ctx := context.Background()
+	_, err := s.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.Prefix+key, "lock_until", until.UnixMilli())
+		pipe.PExpire(ctx, s.Prefix+key, ttl)
+		return nil
+	})
+	return err
+}
+
+// Get 查询未过期的记录
+func (s *RedisLoginAttemptStore) Get(key string, now time.Time) (*LoginAttemptInfo, error) {
+	fields, err := s.Client.HGetAll(context.Background(), s.Prefix+key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	info := &LoginAttemptInfo{Key: key}
+	for name, value := range fields {
+		n, _ := strconv.ParseInt(value, 10, 64)
+		switch name {
+		case "count":
+			info.Count = int(n)
+		case "last_try":
+			info.LastTry = time.UnixMilli(n)
+		case "lock_until":
+			info.LockUntil = time.UnixMilli(n)
+		}
+	}
+	return info, nil
+}
+
+// Delete 删除记录
+func (s *RedisLoginAttemptStore) Delete(key string) error {
+	return s.Client.Del(context.Background(), s.Prefix+key).Err()
+}
+
+// List 使用SCAN遍历所有记录
+func (s *RedisLoginAttemptStore) List(now time.Time) ([]LoginAttemptInfo, error) {
+	ctx := context.Background()
+	attempts := make([]LoginAttemptInfo, 0)
+	iter := s.Client.Scan(ctx, 0, s.Prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		info, err := s.Get(strings.TrimPrefix(iter.Val(), s.Prefix), now)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			attempts = append(attempts, *info)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sortAttempts(attempts)
+	return attempts, nil
+}
@@ -1,148 +1,353 @@
 package utils
 
 import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// 登录限制维度
+const (
+	LoginScopeUsername   = "username"    // 按用户名限制，防止针对单个账号的暴力破解
+	LoginScopeIP         = "ip"          // 按IP限制，防止同一来源对多个账号撒网式尝试
+	LoginScopeUsernameIP = "username_ip" // 按用户名+IP限制，正常用户输错密码时只锁定该来源
 )
 
 // 登录尝试信息
 type LoginAttemptInfo struct {
+	Key       string    // 限制键
 	Count     int       // 尝试次数
 	LastTry   time.Time // 最后一次尝试时间
 	LockUntil time.Time // 锁定截止时间
 }
 
+// Locked 判断记录在指定时间是否处于锁定状态
+func (a *LoginAttemptInfo) Locked(now time.Time) bool {
+	return now.Before(a.LockUntil)
+}
+
+// LoginLimitRule 登录限制规则
+type LoginLimitRule struct {
+	Scope        string        // 限制维度
+	MaxAttempts  int           // 最大允许的登录失败次数
+	LockDuration time.Duration // 锁定时间
+}
+
 // LoginLimiter 登录限制器
 // 用于限制登录失败次数，防止暴力破解
+// 可以同时启用多条规则，任意一条规则达到上限即锁定；失败记录保存在可替换的存储中
 type LoginLimiter struct {
-	attempts      map[string]*LoginAttemptInfo // 登录尝试记录
-	mutex         sync.RWMutex                 // 读写锁，保证并发安全
-	maxAttempts   int                          // 最大允许的登录失败次数
-	lockDuration  time.Duration                // 锁定时间
-	cleanInterval time.Duration                // 清理间隔
+	store  LoginAttemptStore // 失败记录存储
+	rules  []LoginLimitRule  // 限制规则
+	window time.Duration     // 失败记录保留时间，超过该时间没有新的失败时重新计数
+	mutex  sync.RWMutex      // 读写锁，保证替换存储时并发安全
 }
 
 // NewLoginLimiter 创建新的登录限制器
 // 参数:
-//   - maxAttempts: 最大允许的登录失败次数
-//   - lockDuration: 锁定时间
-//   - cleanInterval: 清理间隔，定期清理过期的尝试记录
-func NewLoginLimiter(maxAttempts int, lockDuration, cleanInterval time.Duration) *LoginLimiter {
-	limiter := &LoginLimiter{
-		attempts:      make(map[string]*LoginAttemptInfo),
-		maxAttempts:   maxAttempts,
-		lockDuration:  lockDuration,
-		cleanInterval: cleanInterval,
+//   - store: 失败记录存储
+//   - window: 失败记录保留时间
+//   - rules: 限制规则
+func NewLoginLimiter(store LoginAttemptStore, window time.Duration, rules ...LoginLimitRule) *LoginLimiter {
+	return &LoginLimiter{
+		store:  store,
+		rules:  rules,
+		window: window,
 	}
+}
 
-	// 启动定期清理过期记录的协程
-	go limiter.cleanupRoutine()
+// SetStore 替换失败记录存储
+func (l *LoginLimiter) SetStore(store LoginAttemptStore) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.store = store
+}
 
-	return limiter
+// getStore 返回当前的失败记录存储
+func (l *LoginLimiter) getStore() LoginAttemptStore {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.store
 }
 
-// cleanupRoutine 定期清理过期的尝试记录
-func (l *LoginLimiter) cleanupRoutine() {
-	ticker := time.NewTicker(l.cleanInterval)
-	defer ticker.Stop()
+// LoginLimitKey 生成限制键
+func LoginLimitKey(scope, username, ip string) string {
+	switch scope {
+	case LoginScopeUsername:
+		return scope + ":" + username
+	case LoginScopeIP:
+		return scope + ":" + ip
+	default:
+		return scope + ":" + username + "|" + ip
+	}
+}
 
-	for range ticker.C {
-		l.cleanup()
+// ParseLoginLimitKey 从限制键中解析限制维度、用户名和IP
+func ParseLoginLimitKey(key string) (scope, username, ip string) {
+	scope, value, _ := strings.Cut(key, ":")
+	switch scope {
+	case LoginScopeUsername:
+		username = value
+	case LoginScopeIP:
+		ip = value
+	case LoginScopeUsernameIP:
+		if i := strings.LastIndex(value, "|"); i >= 0 {
+			username, ip = value[:i], value[i+1:]
+		}
 	}
+	return scope, username, ip
 }
 
-// cleanup 清理过期的尝试记录
-func (l *LoginLimiter) cleanup() {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
+// ruleKeys 返回本次登录适用的规则及对应的限制键
+// 缺少用户名或IP时跳过需要该信息的规则
+func (l *LoginLimiter) ruleKeys(username, ip string) ([]LoginLimitRule, []string) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
 
-	now := time.Now()
-	for username, attempt := range l.attempts {
-		// 如果锁定已过期且最后一次尝试时间超过24小时，删除记录
-		if now.After(attempt.LockUntil) && now.Sub(attempt.LastTry) > 24*time.Hour {
-			delete(l.attempts, username)
+	rules := make([]LoginLimitRule, 0, len(l.rules))
+	keys := make([]string, 0, len(l.rules))
+	for _, rule := range l.rules {
+		if (rule.Scope != LoginScopeIP && username == "") || (rule.Scope != LoginScopeUsername && ip == "") {
+			continue
 		}
+		rules = append(rules, rule)
+		keys = append(keys, LoginLimitKey(rule.Scope, username, ip))
 	}
+	return rules, keys
 }
 
 // RecordFailedLogin 记录登录失败
-// 更新登录尝试次数，并在达到最大尝试次数时锁定账号
+// 更新各条规则的失败次数，并在达到最大尝试次数时锁定
 // 返回是否被锁定及锁定剩余时间（分钟）
-func (l *LoginLimiter) RecordFailedLogin(username string) (bool, int) {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
+// 存储不可用时只记录日志，不影响登录
+func (l *LoginLimiter) RecordFailedLogin(username, ip string) (bool, int) {
+	store := l.getStore()
+	rules, keys := l.ruleKeys(username, ip)
 
 	now := time.Now()
+	locked, minutes := false, 0
+	for i, rule := range rules {
+		count, err := store.Increment(keys[i], now, l.window)
+		if err != nil {
+			log.Printf("记录登录失败次数失败: %v", err)
+			continue
+		}
 
-	attempt, exists := l.attempts[username]
-	if !exists {
-		attempt = &LoginAttemptInfo{
-			Count:   0,
-			LastTry: now,
+		// 如果达到最大尝试次数，锁定
+		if count >= rule.MaxAttempts {
+			if err := store.Lock(keys[i], now.Add(rule.LockDuration), l.window); err != nil {
+				log.Printf("锁定登录失败: %v", err)
+				continue
+			}
+			locked = true
+			if m := int(rule.LockDuration.Minutes()); m > minutes {
+				minutes = m
+			}
 		}
-		l.attempts[username] = attempt
 	}
 
-	attempt.Count++
-	attempt.LastTry = now
+	return locked, minutes
+}
+
+// IsLocked 检查是否被锁定
+// 返回是否被锁定及锁定剩余时间（分钟）
+func (l *LoginLimiter) IsLocked(username, ip string) (bool, int) {
+	store := l.getStore()
+	_, keys := l.ruleKeys(username, ip)
+
+	now := time.Now()
+	locked, minutes := false, 0
+	for _, key := range keys {
+		attempt, err := store.Get(key, now)
+		if err != nil {
+			log.Printf("查询登录失败记录失败: %v", err)
+			continue
+		}
 
-	// 如果达到最大尝试次数，锁定账号
-	if attempt.Count >= l.maxAttempts {
-		attempt.LockUntil = now.Add(l.lockDuration)
-		return true, int(l.lockDuration.Minutes())
+		// 如果锁定时间未过，返回锁定状态和剩余时间
+		if attempt != nil && attempt.Locked(now) {
+			locked = true
+			if m := int(attempt.LockUntil.Sub(now).Minutes()) + 1; m > minutes {
+				minutes = m
+			}
+		}
 	}
 
-	return false, 0
+	return locked, minutes
 }
 
-// IsLocked 检查账号是否被锁定
-// 返回是否被锁定及锁定剩余时间（分钟）
-func (l *LoginLimiter) IsLocked(username string) (bool, int) {
-	l.mutex.RLock()
-	defer l.mutex.RUnlock()
+// ResetAttempts 登录成功后重置失败次数
+// 只重置用户名和用户名+IP维度，IP维度的计数不因某个账号登录成功而清除
+func (l *LoginLimiter) ResetAttempts(username, ip string) {
+	store := l.getStore()
+	rules, keys := l.ruleKeys(username, ip)
+	for i, rule := range rules {
+		if rule.Scope == LoginScopeIP {
+			continue
+		}
+		if err := store.Delete(keys[i]); err != nil {
+			log.Printf("重置登录失败次数失败: %v", err)
+		}
+	}
+}
+
+// GetRemainingAttempts 获取剩余尝试次数，取各条规则中最小的值
+func (l *LoginLimiter) GetRemainingAttempts(username, ip string) int {
+	store := l.getStore()
+	rules, keys := l.ruleKeys(username, ip)
 
 	now := time.Now()
+	remaining := -1
+	for i, rule := range rules {
+		left := rule.MaxAttempts
+		attempt, err := store.Get(keys[i], now)
+		if err != nil {
+			log.Printf("查询登录失败记录失败: %v", err)
+		} else if attempt != nil {
+			left -= attempt.Count
+		}
+		if left < 0 {
+			left = 0
+		}
+		if remaining < 0 || left < remaining {
+			remaining = left
+		}
+	}
 
-	attempt, exists := l.attempts[username]
-	if !exists {
-		return false, 0
+	if remaining < 0 {
+		return 0
 	}
+	return remaining
+}
 
-	// 如果锁定时间未过，返回锁定状态和剩余时间
-	if now.Before(attempt.LockUntil) {
-		remainingMinutes := int(attempt.LockUntil.Sub(now).Minutes()) + 1
-		return true, remainingMinutes
+// ListAttempts 查询当前的失败记录，lockedOnly为true时只返回处于锁定状态的记录
+func (l *LoginLimiter) ListAttempts(lockedOnly bool) ([]LoginAttemptInfo, error) {
+	now := time.Now()
+	attempts, err := l.getStore().List(now)
+	if err != nil {
+		return nil, err
+	}
+	if !lockedOnly {
+		return attempts, nil
 	}
 
-	return false, 0
+	locked := make([]LoginAttemptInfo, 0, len(attempts))
+	for _, attempt := range attempts {
+		if attempt.Locked(now) {
+			locked = append(locked, attempt)
+		}
+	}
+	return locked, nil
 }
 
-// ResetAttempts 重置登录尝试次数
-func (l *LoginLimiter) ResetAttempts(username string) {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
+// ClearAttempts 清除失败记录和锁定
+// key不为空时只清除该记录；否则清除用户名或IP相关的所有记录，返回清除的数量
+func (l *LoginLimiter) ClearAttempts(key, username, ip string) (int, error) {
+	store := l.getStore()
+	if key != "" {
+		return 1, store.Delete(key)
+	}
+	if username == "" && ip == "" {
+		return 0, fmt.Errorf("必须指定key、username或ip")
+	}
 
-	delete(l.attempts, username)
+	attempts, err := store.List(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	cleared := 0
+	for _, attempt := range attempts {
+		_, u, i := ParseLoginLimitKey(attempt.Key)
+		if (username != "" && u != username) || (ip != "" && i != ip) {
+			continue
+		}
+		if u == "" && i == "" {
+			continue
+		}
+		if err := store.Delete(attempt.Key); err != nil {
+			return cleared, err
+		}
+		cleared++
+	}
+	return cleared, nil
 }
 
-// GetRemainingAttempts 获取剩余尝试次数
-func (l *LoginLimiter) GetRemainingAttempts(username string) int {
-	l.mutex.RLock()
-	defer l.mutex.RUnlock()
+// DefaultLoginLimiter 默认的登录限制器实例
+// 默认使用内存存储，按用户名+IP 5次、用户名 20次、IP 50次的失败上限锁定15分钟，失败记录保留24小时
+// 调用InitLoginLimiter后根据环境变量替换存储和规则
+var DefaultLoginLimiter = NewLoginLimiter(NewMemoryLoginAttemptStore(time.Hour), 24*time.Hour, defaultLoginLimitRules()...)
 
-	attempt, exists := l.attempts[username]
-	if !exists {
-		return l.maxAttempts
+// defaultLoginLimitRules 根据环境变量生成限制规则，上限为0的维度不启用：
+//   - LOGIN_LIMIT_USERNAME_IP: 用户名+IP维度的失败上限，默认5
+//   - LOGIN_LIMIT_USERNAME: 用户名维度的失败上限，默认20
+//   - LOGIN_LIMIT_IP: IP维度的失败上限，默认50
+//   - LOGIN_LOCK_MINUTES: 锁定时间（分钟），默认15
+func defaultLoginLimitRules() []LoginLimitRule {
+	envInt := func(name string, def int) int {
+		if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v >= 0 {
+			return v
+		}
+		return def
 	}
 
-	remaining := l.maxAttempts - attempt.Count
-	if remaining < 0 {
-		remaining = 0
+	lock := time.Duration(envInt("LOGIN_LOCK_MINUTES", 15)) * time.Minute
+	candidates := []LoginLimitRule{
+		{Scope: LoginScopeUsernameIP, MaxAttempts: envInt("LOGIN_LIMIT_USERNAME_IP", 5), LockDuration: lock},
+		{Scope: LoginScopeUsername, MaxAttempts: envInt("LOGIN_LIMIT_USERNAME", 20), LockDuration: lock},
+		{Scope: LoginScopeIP, MaxAttempts: envInt("LOGIN_LIMIT_IP", 50), LockDuration: lock},
 	}
 
-	return remaining
+	rules := make([]LoginLimitRule, 0, len(candidates))
+	for _, rule := range candidates {
+		if rule.MaxAttempts > 0 {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
 }
 
-// DefaultLoginLimiter 默认的登录限制器实例
-// 最大尝试次数为5次，锁定时间为15分钟，每小时清理一次过期记录
-var DefaultLoginLimiter = NewLoginLimiter(5, 15*time.Minute, 1*time.Hour)
+// InitLoginLimiter 根据环境变量配置默认的登录限制器
+// 应在环境变量加载和数据库初始化之后调用：
+//   - LOGIN_LIMITER_STORE: memory（默认）、database 或 redis
+//   - REDIS_ADDR / REDIS_PASSWORD / REDIS_DB: redis存储的连接参数，兼容Redis协议的服务均可使用
+func InitLoginLimiter(db *gorm.DB) error {
+	var store LoginAttemptStore
+	switch driver := os.Getenv("LOGIN_LIMITER_STORE"); driver {
+	case "", "memory":
+		store = DefaultLoginLimiter.getStore()
+	case "database":
+		store = &DBLoginAttemptStore{DB: db}
+	case "redis":
+		addr := os.Getenv("REDIS_ADDR")
+		if addr == "" {
+			addr = "localhost:6379"
+		}
+		redisDB, _ := strconv.Atoi(os.Getenv("REDIS_DB"))
+		store = &RedisLoginAttemptStore{
+			Client: redis.NewClient(&redis.Options{
+				Addr:         addr,
+				Password:     os.Getenv("REDIS_PASSWORD"),
+				DB:           redisDB,
+				DialTimeout:  5 * time.Second,
+				ReadTimeout:  5 * time.Second,
+				WriteTimeout: 5 * time.Second,
+			}),
+			Prefix: "login_limiter:",
+		}
+	default:
+		return fmt.Errorf("不支持的登录限制存储: %s", driver)
+	}
+
+	DefaultLoginLimiter.mutex.Lock()
+	DefaultLoginLimiter.store = store
+	DefaultLoginLimiter.rules = defaultLoginLimitRules()
+	DefaultLoginLimiter.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,323 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// 通知渠道
+const (
+	ChannelEmail = "email" // 邮件
+	ChannelSMS   = "sms"   // 短信
+)
+
+// NotifyMessage 待发送的通知
+type NotifyMessage struct {
+	Channel string // 通知渠道：email, sms
+	To      string // 收件人邮箱或手机号
+	Subject string // 标题，短信不使用
+	Body    string // 正文
+}
+
+// Notifier 通知发送接口
+// 不同的实现负责通过邮件、短信网关等方式把通知送达
+type Notifier interface {
+	Send(msg NotifyMessage) error
+}
+
+// SMTPNotifier 通过SMTP服务器发送邮件
+type SMTPNotifier struct {
+	Host     string        // SMTP服务器地址
+	Port     string        // SMTP服务器端口，465端口使用隐式TLS
+	Username string        // 登录用户名
+	Password string        // 登录密码
+	From     string        // 发件人地址
+	Timeout  time.Duration // 连接超时时间
+}
+
+// Send 发送邮件
+func (n *SMTPNotifier) Send(msg NotifyMessage) error {
+	addr := net.JoinHostPort(n.Host, n.Port)
+	dialer := &net.Dialer{Timeout: n.Timeout}
+
+	var conn net.Conn
+	var err error
+	if n.Port == "465" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: n.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("连接SMTP服务器失败: %w", err)
+	}
+	// 整个会话的读写也受超时限制
+	conn.SetDeadline(time.Now().Add(n.Timeout))
+
+	client, err := smtp.NewClient(conn, n.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("创建SMTP会话失败: %w", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: n.Host}); err != nil {
+			return fmt.Errorf("SMTP启用TLS失败: %w", err)
+		}
+	}
+	if n.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.Username, n.Password, n.Host)); err != nil {
+			return fmt.Errorf("SMTP认证失败: %w", err)
+		}
+	}
+
+	if err := client.Mail(n.From); err != nil {
+		return fmt.Errorf("设置发件人失败: %w", err)
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("设置收件人失败: %w", err)
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("发送邮件内容失败: %w", err)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("From: " + n.From + "\r\n")
+	buf.WriteString("To: " + msg.To + "\r\n")
+	buf.WriteString("Subject: " + mime.BEncoding.Encode("UTF-8", msg.Subject) + "\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		w.Close()
+		return fmt.Errorf("发送邮件内容失败: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("发送邮件内容失败: %w", err)
+	}
+
+	return client.Quit()
+}
+
+// SMSGatewayNotifier 通过HTTP短信网关发送短信
+// 以JSON格式POST {to, sender, content} 到网关地址，2xx状态码视为发送成功
+type SMSGatewayNotifier struct {
+	URL    string       // 网关地址
+	APIKey string       // 网关密钥，通过Authorization: Bearer头传递
+	Sender string       // 短信签名或发送方号码
+	Client *http.Client // HTTP客户端
+}
+
+// Send 发送短信
+func (n *SMSGatewayNotifier) Send(msg NotifyMessage) error {
+	payload, err := json.Marshal(map[string]string{
+		"to":      msg.To,
+		"sender":  n.Sender,
+		"content": msg.Body,
+	})
+	if err != nil {
+		return fmt.Errorf("构建短信请求失败: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("构建短信请求失败: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+n.APIKey)
+	}
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("请求短信网关失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("短信网关返回错误状态码: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// LogNotifier 开发和测试环境使用的通知实现
+// 不实际发送，只把通知写入日志或追加到指定文件
+type LogNotifier struct {
+	Path  string     // 输出文件路径，为空时写入日志
+	mutex sync.Mutex // 保证并发写文件安全
+}
+
+// Send 记录通知内容
+func (n *LogNotifier) Send(msg NotifyMessage) error {
+	entry := fmt.Sprintf("[%s] channel=%s to=%s subject=%q\n%s\n---\n",
+		time.Now().Format("2006-01-02 15:04:05"), msg.Channel, msg.To, msg.Subject, msg.Body)
+
+	if n.Path == "" {
+		log.Print("通知未实际发送: " + entry)
+		return nil
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	f, err := os.OpenFile(n.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("打开通知输出文件失败: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(entry); err != nil {
+		return fmt.Errorf("写入通知输出文件失败: %w", err)
+	}
+	return nil
+}
+
+var (
+	notifiers     = make(map[string]Notifier)
+	notifiersLock sync.RWMutex
+)
+
+// GetNotifier 返回指定渠道的通知实现
+// 首次调用时根据环境变量创建：
+//   - NOTIFIER_EMAIL_DRIVER: smtp 或 log（默认）
+//   - NOTIFIER_SMS_DRIVER: gateway 或 log（默认）
+//   - NOTIFIER_LOG_FILE: log实现的输出文件，为空时写入日志
+func GetNotifier(channel string) Notifier {
+	notifiersLock.RLock()
+	n, ok := notifiers[channel]
+	notifiersLock.RUnlock()
+	if ok {
+		return n
+	}
+
+	notifiersLock.Lock()
+	defer notifiersLock.Unlock()
+	if n, ok := notifiers[channel]; ok {
+		return n
+	}
+	n = newNotifierFromEnv(channel)
+	notifiers[channel] = n
+	return n
+}
+
+// SetNotifier 设置指定渠道的通知实现
+// 主要用于测试场景，允许注入模拟的通知实现
+func SetNotifier(channel string, n Notifier) {
+	notifiersLock.Lock()
+	defer notifiersLock.Unlock()
+	notifiers[channel] = n
+}
+
+// newNotifierFromEnv 根据环境变量创建通知实现
+func newNotifierFromEnv(channel string) Notifier {
+	switch {
+	case channel == ChannelEmail && os.Getenv("NOTIFIER_EMAIL_DRIVER") == "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return &SMTPNotifier{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("SMTP_FROM"),
+			Timeout:  15 * time.Second,
+		}
+	case channel == ChannelSMS && os.Getenv("NOTIFIER_SMS_DRIVER") == "gateway":
+		return &SMSGatewayNotifier{
+			URL:    os.Getenv("SMS_GATEWAY_URL"),
+			APIKey: os.Getenv("SMS_GATEWAY_API_KEY"),
+			Sender: os.Getenv("SMS_SENDER"),
+			Client: &http.Client{Timeout: 10 * time.Second},
+		}
+	default:
+		return &LogNotifier{Path: os.Getenv("NOTIFIER_LOG_FILE")}
+	}
+}
+
+// notifyTemplate 通知模板，标题和正文分别使用text/template渲染
+type notifyTemplate struct {
+	subject string
+	body    string
+}
+
+// notifyTemplates 内置的通知模板，键为"模板名.渠道"
+var notifyTemplates = map[string]notifyTemplate{
+	"agent_invitation." + ChannelEmail: {
+		subject: "{{.InviterName}} 邀请您成为代理",
+		body: `您好，
+
+{{.InviterName}} 邀请您成为其下级代理。
+
+邀请码：{{.InviteCode}}
+{{if .AcceptURL}}接受邀请：{{.AcceptURL}}
+{{end}}
+邀请将于 {{.ExpiredAt}} 过期，请及时处理。如非本人操作，请忽略此邮件。
+`,
+	},
+	"agent_invitation." + ChannelSMS: {
+		body: `{{.InviterName}}邀请您成为代理，邀请码{{.InviteCode}}，{{.ExpiredAt}}前有效。`,
+	},
+	"password_reset." + ChannelEmail: {
+		subject: "重置密码",
+		body: `{{.Name}}，您好：
+
+我们收到了重置您账号密码的请求。
+
+重置令牌：{{.Token}}
+{{if .ResetURL}}重置密码：{{.ResetURL}}
+{{end}}
+令牌{{.ExpiresMinutes}}分钟内有效且只能使用一次。如非本人操作，请忽略此邮件，您的密码不会被修改。
+`,
+	},
+	"password_reset." + ChannelSMS: {
+		body: `您的密码重置令牌为{{.Token}}，{{.ExpiresMinutes}}分钟内有效。如非本人操作请忽略。`,
+	},
+}
+
+// RenderNotification 使用内置模板渲染指定渠道的通知
+func RenderNotification(name, channel, to string, data interface{}) (NotifyMessage, error) {
+	tpl, ok := notifyTemplates[name+"."+channel]
+	if !ok {
+		return NotifyMessage{}, fmt.Errorf("通知模板不存在: %s.%s", name, channel)
+	}
+
+	render := func(text string) (string, error) {
+		t, err := template.New(name).Parse(text)
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+
+	subject, err := render(tpl.subject)
+	if err != nil {
+		return NotifyMessage{}, fmt.Errorf("渲染通知标题失败: %w", err)
+	}
+	body, err := render(tpl.body)
+	if err != nil {
+		return NotifyMessage{}, fmt.Errorf("渲染通知正文失败: %w", err)
+	}
+
+	return NotifyMessage{Channel: channel, To: to, Subject: subject, Body: body}, nil
+}
@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Semver 语义化版本号，格式为 主版本.次版本.修订号[-预发布标识][+构建信息]
+type Semver struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease []string // 预发布标识，按点分隔，如 beta.1
+	Build      string   // 构建信息，不参与比较
+}
+
+// ParseSemver 解析语义化版本号，允许带v前缀
+func ParseSemver(version string) (Semver, error) {
+	var v Semver
+	s := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if s == "" {
+		return v, fmt.Errorf("版本号不能为空")
+	}
+
+	if i := strings.Index(s, "+"); i >= 0 {
+		v.Build = s[i+1:]
+		s = s[:i]
+		if v.Build == "" {
+			return v, fmt.Errorf("无效的版本号: %s", version)
+		}
+	}
+	if i := strings.Index(s, "-"); i >= 0 {
+		pre := s[i+1:]
+		s = s[:i]
+		if pre == "" {
+			return v, fmt.Errorf("无效的版本号: %s", version)
+		}
+		v.Prerelease = strings.Split(pre, ".")
+		for _, id := range v.Prerelease {
+			if id == "" {
+				return v, fmt.Errorf("无效的版本号: %s", version)
+			}
+		}
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, fmt.Errorf("无效的版本号: %s，格式应为 主版本.次版本.修订号", version)
+	}
+	numbers := make([]int, 3)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || (len(part) > 1 && part[0] == '0') {
+			return v, fmt.Errorf("无效的版本号: %s", version)
+		}
+		numbers[i] = n
+	}
+	v.Major, v.Minor, v.Patch = numbers[0], numbers[1], numbers[2]
+	return v, nil
+}
+
+// String 返回规范化的版本号字符串（不带v前缀）
+func (v Semver) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Prerelease) > 0 {
+		s += "-" + strings.Join(v.Prerelease, ".")
+	}
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+	return s
+}
+
+// Compare 比较两个版本号，返回-1、0或1
+// 预发布版本低于对应的正式版本，构建信息不参与比较
+func (v Semver) Compare(other Semver) int {
+	for _, d := range []int{v.Major - other.Major, v.Minor - other.Minor, v.Patch - other.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+
+	switch {
+	case len(v.Prerelease) == 0 && len(other.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(other.Prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.Prerelease) && i < len(other.Prerelease); i++ {
+		if c := comparePrereleaseID(v.Prerelease[i], other.Prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(v.Prerelease) < len(other.Prerelease):
+		return -1
+	case len(v.Prerelease) > len(other.Prerelease):
+		return 1
+	}
+	return 0
+}
+
+// comparePrereleaseID 比较单个预发布标识，数字标识按数值比较且低于非数字标识
+func comparePrereleaseID(a, b string) int {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		switch {
+		case na < nb:
+			return -1
+		case na > nb:
+			return 1
+		}
+		return 0
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// CompareVersions 比较两个版本号字符串，任一版本号无效时返回错误
+func CompareVersions(a, b string) (int, error) {
+	va, err := ParseSemver(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := ParseSemver(b)
+	if err != nil {
+		return 0, err
+	}
+	return va.Compare(vb), nil
+}